@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxAdminRequestBytes limits the size of admin API request bodies.
+const maxAdminRequestBytes = 1 << 20
+
+// adminAPI serves authenticated cluster operations over HTTP, so
+// automation can do what operators do with the CLI from any node.
+// Status changes go through the same compare-and-set path as the
+// CLI and the reconcilers, and spec changes are compare-and-set on
+// the spec's UUID.
+type adminAPI struct {
+	store StateStore
+	token string
+
+	// source is recorded as the SourceNode of status writes.
+	source string
+}
+
+func newAdminAPI(store StateStore, nodeName string, token string) *adminAPI {
+	return &adminAPI{store: store, token: token, source: nodeName + " admin API"}
+}
+
+// readAdminToken reads the bearer token the admin API requires.
+func readAdminToken(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token: %w", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %s is empty", path)
+	}
+	return token, nil
+}
+
+func (a *adminAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/cluster", a.authenticated(a.getCluster))
+	mux.HandleFunc("POST /admin/switchover", a.authenticated(a.switchover))
+	mux.HandleFunc("POST /admin/pause", a.authenticated(a.setPaused(true)))
+	mux.HandleFunc("POST /admin/resume", a.authenticated(a.setPaused(false)))
+	mux.HandleFunc("POST /admin/nodes/{node}/restart", a.authenticated(a.requestNodeAction(NodeActionRestart)))
+	mux.HandleFunc("POST /admin/nodes/{node}/reinitialize", a.authenticated(a.requestNodeAction(NodeActionReinitialize)))
+	mux.HandleFunc("GET /admin/spec", a.authenticated(a.getSpec))
+	mux.HandleFunc("PUT /admin/spec", a.authenticated(a.setSpec))
+}
+
+func (a *adminAPI) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAdminRequestBytes)
+		handler(w, r)
+	}
+}
+
+// adminConflictError means the request doesn't make sense in the
+// current cluster state, like switching over during an upgrade.
+type adminConflictError struct {
+	err error
+}
+
+func (e adminConflictError) Error() string { return e.err.Error() }
+func (e adminConflictError) Unwrap() error { return e.err }
+
+func rejectAdminRequest(format string, args ...any) error {
+	return adminConflictError{err: fmt.Errorf(format, args...)}
+}
+
+// modifyStatus applies update with modifyClusterStatus and writes the
+// resulting status, or the error, as the response.
+func (a *adminAPI) modifyStatus(w http.ResponseWriter, update func(state ClusterState, status *ClusterStatus) error) {
+	status, err := modifyClusterStatus(a.store, a.source, update)
+	var conflict adminConflictError
+	switch {
+	case errors.As(err, &conflict):
+		writeAdminError(w, http.StatusConflict, err)
+	case err != nil:
+		log.Printf("Admin API failed to write cluster status: %v", err)
+		writeAdminError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeAdminJSON(w, http.StatusOK, status)
+	}
+}
+
+func (a *adminAPI) getCluster(w http.ResponseWriter, r *http.Request) {
+	state, err := a.store.FetchClusterState(r.Context())
+	if err != nil {
+		writeAdminError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, state)
+}
+
+type switchoverRequest struct {
+	Target string `json:"target"`
+}
+
+func (a *adminAPI) switchover(w http.ResponseWriter, r *http.Request) {
+	var req switchoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if req.Target == "" {
+		writeAdminError(w, http.StatusBadRequest, errors.New("target must be specified"))
+		return
+	}
+
+	a.modifyStatus(w, func(state ClusterState, status *ClusterStatus) error {
+		if !slices.ContainsFunc(state.Nodes, func(n NodeStatus) bool { return n.Name == req.Target }) {
+			return rejectAdminRequest("Node %s is not in the cluster", req.Target)
+		}
+		if state.Spec.isDelayedReplica(req.Target) {
+			return rejectAdminRequest("Node %s is a delayed replica and can't be the primary", req.Target)
+		}
+		newStatus, err := startSwitchover(*status, state.Nodes, req.Target)
+		if err != nil {
+			return adminConflictError{err: err}
+		}
+		*status = newStatus
+		return nil
+	})
+}
+
+func (a *adminAPI) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.modifyStatus(w, func(state ClusterState, status *ClusterStatus) error {
+			if !paused && status.Upgrade.inProgress() {
+				return rejectAdminRequest("A major version upgrade is in progress (%s), it resumes the cluster when it finishes", status.Upgrade.Phase)
+			}
+			status.Paused = paused
+			return nil
+		})
+	}
+}
+
+func (a *adminAPI) requestNodeAction(action NodeActionKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		node := r.PathValue("node")
+		a.modifyStatus(w, func(state ClusterState, status *ClusterStatus) error {
+			if !slices.ContainsFunc(state.Nodes, func(n NodeStatus) bool { return n.Name == node }) {
+				return rejectAdminRequest("Node %s is not in the cluster", node)
+			}
+			if pending, ok := status.NodeActions[node]; ok {
+				return rejectAdminRequest("Node %s already has a pending %s", node, pending.Action)
+			}
+			if action == NodeActionReinitialize && (node == status.IntendedPrimary || node == status.PreviousPrimary) {
+				return rejectAdminRequest("Node %s is the primary, switch over before reinitializing it", node)
+			}
+			setNodeAction(status, node, &NodeAction{Action: action, RequestedAt: time.Now().Format(time.RFC3339)})
+			return nil
+		})
+	}
+}
+
+func (a *adminAPI) getSpec(w http.ResponseWriter, r *http.Request) {
+	state, err := a.store.FetchClusterState(r.Context())
+	if err != nil {
+		writeAdminError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, state.Spec)
+}
+
+// setSpec replaces the cluster spec, but only if its spec_uuid is
+// still the one in the spec the client read from GET /admin/spec, so
+// concurrent edits don't overwrite each other. It returns the new
+// spec.
+func (a *adminAPI) setSpec(w http.ResponseWriter, r *http.Request) {
+	var spec ClusterSpec
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid cluster spec: %w", err))
+		return
+	}
+	if err := spec.validate(); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid cluster spec: %w", err))
+		return
+	}
+
+	prevSpecUUID := spec.SpecUuid
+	spec.SpecUuid = uuid.New()
+	err := a.store.AtomicWriteClusterSpec(r.Context(), prevSpecUUID, spec)
+	if errors.Is(err, ErrClusterSpecConflict) {
+		writeAdminError(w, http.StatusConflict, fmt.Errorf("the spec changed since spec_uuid %s, fetch it again", prevSpecUUID))
+		return
+	}
+	if err != nil {
+		log.Printf("Admin API failed to write cluster spec: %v", err)
+		writeAdminError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	log.Printf("Cluster spec updated through the admin API")
+	writeAdminJSON(w, http.StatusOK, spec)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write admin API response: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// setNodeAction sets or, with a nil action, clears a node's pending
+// action. It copies the map so the status we started from isn't
+// modified.
+func setNodeAction(status *ClusterStatus, node string, action *NodeAction) {
+	actions := maps.Clone(status.NodeActions)
+	if action != nil {
+		if actions == nil {
+			actions = make(map[string]NodeAction)
+		}
+		actions[node] = *action
+	} else {
+		delete(actions, node)
+	}
+	if len(actions) == 0 {
+		actions = nil
+	}
+	status.NodeActions = actions
+}
+
+// performNodeAction carries out an action requested for this node,
+// then clears it. If clearing fails we do the action again next
+// cycle, so actions must be safe to repeat.
+func (p *PostgresNode) performNodeAction(ctx context.Context, store StateStore, nodeName string, status ClusterStatus, action NodeAction) error {
+	log.Printf("Performing %s requested at %s", action.Action, action.RequestedAt)
+
+	switch action.Action {
+	case NodeActionRestart:
+		if err := p.postgres.Restart(); err != nil {
+			return fmt.Errorf("failed to restart Postgres: %w", err)
+		}
+	case NodeActionReinitialize:
+		if status.IntendedPrimary == nodeName {
+			log.Printf("Not reinitializing the intended primary")
+			break
+		}
+		if err := p.moveDataDirAside(); err != nil {
+			return err
+		}
+		p.recordRejoin(RejoinActionReclone, "reinitialize requested through the admin API", nil)
+	default:
+		log.Printf("Ignoring unknown node action %q", action.Action)
+	}
+
+	return updateClusterStatus(store, nodeName, func(status *ClusterStatus) {
+		// Don't clear an action that was requested again
+		if current, ok := status.NodeActions[nodeName]; ok && current == action {
+			setNodeAction(status, nodeName, nil)
+		}
+	})
+}
+
+// moveDataDirAside stops Postgres and moves the data directory to
+// PGDATA.pgdaemon-old, so ConfigureAsReplica clones a fresh copy. It
+// does nothing if the data directory is already gone.
+func (p *PostgresNode) moveDataDirAside() error {
+	if _, err := os.Stat(p.dataDir); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := p.postgres.Stop(); err != nil {
+		return fmt.Errorf("failed to stop Postgres: %w", err)
+	}
+	oldDataDir := p.dataDir + ".pgdaemon-old"
+	if err := os.RemoveAll(oldDataDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", oldDataDir, err)
+	}
+	if err := os.Rename(p.dataDir, oldDataDir); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", p.dataDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAdminServer(t *testing.T) (*memStore, http.Handler) {
+	store := &memStore{state: ClusterState{
+		Status: ClusterStatus{
+			StatusUuid:      uuid.New(),
+			IntendedPrimary: "node1",
+			FailoverState:   FailoverStateStable,
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true},
+			{Name: "node2"},
+		},
+	}}
+	mux := http.NewServeMux()
+	newAdminAPI(store, "node1", "secret").register(mux)
+	return store, mux
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method string, target string, body string) (int, map[string]any) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var response map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response), rec.Body.String())
+	return rec.Code, response
+}
+
+func TestAdminAPI_RequiresToken(t *testing.T) {
+	_, handler := newTestAdminServer(t)
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/pause", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+	}
+}
+
+func TestAdminAPI_Switchover(t *testing.T) {
+	store, handler := newTestAdminServer(t)
+
+	code, body := adminRequest(t, handler, http.MethodPost, "/admin/switchover", `{"target": "node3"}`)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "Node node3 is not in the cluster", body["error"])
+
+	code, _ = adminRequest(t, handler, http.MethodPost, "/admin/switchover", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, body = adminRequest(t, handler, http.MethodPost, "/admin/switchover", `{"target": "node2"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "node2", body["intended_primary"])
+	assert.Equal(t, "node1 admin API", body["source_node"])
+	assert.Equal(t, "node2", store.state.Status.IntendedPrimary)
+	assert.Equal(t, FailoverStateDemotingOldPrimary, store.state.Status.FailoverState)
+
+	code, body = adminRequest(t, handler, http.MethodPost, "/admin/switchover", `{"target": "node1"}`)
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, body["error"], "already in progress")
+}
+
+func TestAdminAPI_PauseAndResume(t *testing.T) {
+	store, handler := newTestAdminServer(t)
+
+	code, body := adminRequest(t, handler, http.MethodPost, "/admin/pause", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["paused"])
+	assert.True(t, store.state.Status.Paused)
+
+	code, _ = adminRequest(t, handler, http.MethodPost, "/admin/resume", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, store.state.Status.Paused)
+
+	// Upgrades pause the cluster until they finish
+	store.state.Status.Paused = true
+	store.state.Status.Upgrade = &ClusterUpgradeStatus{Phase: UpgradePhaseUpgradingPrimary}
+	code, _ = adminRequest(t, handler, http.MethodPost, "/admin/resume", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.True(t, store.state.Status.Paused)
+}
+
+func TestAdminAPI_NodeActions(t *testing.T) {
+	store, handler := newTestAdminServer(t)
+	before := store.state.Status
+
+	code, _ := adminRequest(t, handler, http.MethodPost, "/admin/nodes/node2/reinitialize", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, NodeActionReinitialize, store.state.Status.NodeActions["node2"].Action)
+	assert.Nil(t, before.NodeActions)
+
+	code, body := adminRequest(t, handler, http.MethodPost, "/admin/nodes/node2/restart", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "Node node2 already has a pending reinitialize", body["error"])
+
+	code, _ = adminRequest(t, handler, http.MethodPost, "/admin/nodes/node1/reinitialize", "")
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, body = adminRequest(t, handler, http.MethodPost, "/admin/nodes/node1/restart", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["node_actions"], 2)
+
+	code, _ = adminRequest(t, handler, http.MethodPost, "/admin/nodes/node9/restart", "")
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestAdminAPI_Spec(t *testing.T) {
+	store, handler := newTestAdminServer(t)
+	require.NoError(t, store.SetClusterSpec(t.Context(), &ClusterSpec{Nodes: map[string]NodeSpec{"node2": {}}}))
+
+	code, body := adminRequest(t, handler, http.MethodGet, "/admin/spec", "")
+	assert.Equal(t, http.StatusOK, code)
+	specUUID := body["spec_uuid"].(string)
+	assert.Equal(t, store.state.Spec.SpecUuid.String(), specUUID)
+
+	update := `{"spec_uuid": "` + specUUID + `", "nodes": {"node2": {}}, "read_only": true}`
+	code, body = adminRequest(t, handler, http.MethodPut, "/admin/spec", update)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["read_only"])
+	assert.True(t, store.state.Spec.ReadOnly)
+	assert.NotEqual(t, specUUID, body["spec_uuid"])
+	assert.Equal(t, store.state.Spec.SpecUuid.String(), body["spec_uuid"])
+
+	// Writing again with the old UUID would overwrite the change
+	code, _ = adminRequest(t, handler, http.MethodPut, "/admin/spec", update)
+	assert.Equal(t, http.StatusConflict, code)
+
+	for _, invalid := range []string{
+		`{"no_such_field": 1}`,
+		`{"nodes": {"node2": {"apply_delay": "1h'"}}}`,
+		`{"nodes": {"node2": {}}, "auth": {"allowed_cidrs": ["10.0.0.0"]}}`,
+		`{"nodes": {"node2": {}}, "pgbouncer": {"pool_mode": "bogus"}}`,
+		`{"nodes": {"node2": {}}, "pgbouncer": {"databases": {"app = x": "host=db"}}}`,
+		`{"nodes": {"node2": {}}, "read_only": "` + strings.Repeat("x", maxAdminRequestBytes) + `"}`,
+	} {
+		code, _ = adminRequest(t, handler, http.MethodPut, "/admin/spec", invalid)
+		assert.Equal(t, http.StatusBadRequest, code, invalid[:min(len(invalid), 80)])
+	}
+	assert.True(t, store.state.Spec.ReadOnly)
+
+	// Nodes are optional, and a spec without spec_uuid can't have
+	// been read from the store
+	code, _ = adminRequest(t, handler, http.MethodPut, "/admin/spec", `{"read_only": false}`)
+	assert.Equal(t, http.StatusConflict, code)
+	update = `{"spec_uuid": "` + store.state.Spec.SpecUuid.String() + `", "read_only": false}`
+	code, _ = adminRequest(t, handler, http.MethodPut, "/admin/spec", update)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, store.state.Spec.Nodes)
+}
+
+func TestSetNodeAction(t *testing.T) {
+	status := ClusterStatus{}
+	action := NodeAction{Action: NodeActionRestart, RequestedAt: "2025-01-02T03:04:05Z"}
+	setNodeAction(&status, "node1", &action)
+	assert.Equal(t, map[string]NodeAction{"node1": action}, status.NodeActions)
+
+	// The original map is left alone
+	before := status
+	setNodeAction(&status, "node1", nil)
+	assert.Nil(t, status.NodeActions)
+	assert.Len(t, before.NodeActions, 1)
+}
+
+func TestReadAdminToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+
+	require.NoError(t, os.WriteFile(path, []byte("secret\n"), 0600))
+	token, err := readAdminToken(path)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", token)
+
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+	_, err = readAdminToken(path)
+	assert.ErrorContains(t, err, "is empty")
+}
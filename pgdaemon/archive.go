@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ArchiveTarget stores archived WAL segments and base backups outside
+// of the cluster. Keys are slash-separated paths like
+// "wal/000000010000000000000001".
+type ArchiveTarget interface {
+	Put(ctx context.Context, key string, body io.Reader) error
+	// Get writes the object to w. It returns ErrArchiveObjectNotFound
+	// if the object doesn't exist.
+	Get(ctx context.Context, key string, w io.Writer) error
+	// List returns the keys that start with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes an object. Deleting a missing object is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+}
+
+var ErrArchiveObjectNotFound = errors.New("archive object not found")
+
+// newArchiveTarget builds the archive target for -archive-url. It
+// returns nil if archiving isn't configured.
+func newArchiveTarget(ctx context.Context, conf config) (ArchiveTarget, error) {
+	if conf.archiveURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(conf.archiveURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -archive-url %s: %w", conf.archiveURL, err)
+	}
+
+	switch u.Scheme {
+	case "", "file":
+		return NewLocalArchive(u.Path), nil
+	case "s3":
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		client := newS3Client(cfg, conf.archiveS3Endpoint)
+		return NewS3Archive(client, u.Host, strings.TrimPrefix(u.Path, "/")), nil
+	default:
+		return nil, fmt.Errorf("unsupported -archive-url scheme %q, must be file or s3", u.Scheme)
+	}
+}
+
+func newS3Client(cfg aws.Config, endpoint string) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			// S3-compatible stores like MinIO generally want
+			// path-style addressing and don't support the newer
+			// default checksums.
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+	})
+}
+
+// LocalArchive stores objects as files under a directory, which can be
+// a local disk or an NFS mount.
+type LocalArchive struct {
+	root string
+}
+
+func NewLocalArchive(root string) *LocalArchive {
+	return &LocalArchive{root: root}
+}
+
+func (a *LocalArchive) path(key string) string {
+	return filepath.Join(a.root, filepath.FromSlash(key))
+}
+
+func (a *LocalArchive) Put(ctx context.Context, key string, body io.Reader) error {
+	path := a.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory for %s: %w", key, err)
+	}
+
+	// Write to a temporary file and rename it into place so readers
+	// never see a partial object, even if we crash.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %s into place: %w", key, err)
+	}
+	return nil
+}
+
+func (a *LocalArchive) Get(ctx context.Context, key string, w io.Writer) error {
+	f, err := os.Open(a.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrArchiveObjectNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return nil
+}
+
+func (a *LocalArchive) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(a.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(a.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", a.root, err)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (a *LocalArchive) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(a.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// S3Archive stores objects in an S3 bucket, or an S3-compatible store
+// like MinIO, under an optional key prefix.
+type S3Archive struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Archive(client *s3.Client, bucket string, prefix string) *S3Archive {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &S3Archive{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (a *S3Archive) Put(ctx context.Context, key string, body io.Reader) error {
+	// The upload manager handles bodies of unknown length, like base
+	// backups streamed from pg_basebackup, with multipart uploads.
+	uploader := manager.NewUploader(a.client)
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + key),
+		Body:   body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to S3: %w", key, err)
+	}
+	return nil
+}
+
+func (a *S3Archive) Get(ctx context.Context, key string, w io.Writer) error {
+	out, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + key),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return ErrArchiveObjectNotFound
+		}
+		return fmt.Errorf("failed to download %s from S3: %w", key, err)
+	}
+	defer out.Body.Close()
+
+	if _, err := io.Copy(w, out.Body); err != nil {
+		return fmt.Errorf("failed to download %s from S3: %w", key, err)
+	}
+	return nil
+}
+
+func (a *S3Archive) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(a.prefix + prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.ToString(obj.Key), a.prefix))
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (a *S3Archive) Delete(ctx context.Context, key string) error {
+	_, err := a.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %w", key, err)
+	}
+	return nil
+}
+
+func walArchiveKey(walFileName string) string {
+	return "wal/" + walFileName
+}
+
+// archiveWalPush implements archive_command. Postgres may retry
+// archiving a segment that we already archived (e.g. if we crashed
+// before reporting success), so that is fine as long as the contents
+// match. We never overwrite a segment with different contents, because
+// that usually means two clusters are archiving to the same place.
+func archiveWalPush(ctx context.Context, archive ArchiveTarget, walPath string, walFileName string) error {
+	content, err := os.ReadFile(walPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", walPath, err)
+	}
+
+	var existing bytes.Buffer
+	err = archive.Get(ctx, walArchiveKey(walFileName), &existing)
+	if err == nil {
+		if bytes.Equal(existing.Bytes(), content) {
+			log.Printf("WAL file %s is already archived", walFileName)
+			return nil
+		}
+		return fmt.Errorf("WAL file %s is already archived with different contents", walFileName)
+	}
+	if !errors.Is(err, ErrArchiveObjectNotFound) {
+		return err
+	}
+
+	if err := archive.Put(ctx, walArchiveKey(walFileName), bytes.NewReader(content)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// archiveWalFetch implements restore_command. Postgres asks for files
+// that were never archived (like the next segment, or timeline history
+// files) and expects a failure for those, so a missing file returns
+// ErrArchiveObjectNotFound.
+func archiveWalFetch(ctx context.Context, archive ArchiveTarget, walFileName string, destPath string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(destPath), ".pgdaemon-restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", walFileName, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := archive.Get(ctx, walArchiveKey(walFileName), tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", destPath, err)
+	}
+	if err := os.Rename(tmp.Name(), destPath); err != nil {
+		return fmt.Errorf("failed to rename %s into place: %w", destPath, err)
+	}
+	return nil
+}
+
+// archiveCommandLine builds the shell command that Postgres runs to
+// archive or restore WAL via pgdaemon. args are passed through as is
+// so they can contain Postgres placeholders like %p.
+func archiveCommandLine(executable string, conf config, command string, args ...string) string {
+	parts := []string{
+		archiveCommandArg(executable),
+		"-cluster-name", archiveCommandArg(conf.clusterName),
+		"-archive-url", archiveCommandArg(conf.archiveURL),
+	}
+	if conf.archiveS3Endpoint != "" {
+		parts = append(parts, "-archive-s3-endpoint", archiveCommandArg(conf.archiveS3Endpoint))
+	}
+	parts = append(parts, command)
+	parts = append(parts, args...)
+	return strings.Join(parts, " ")
+}
+
+// archiveCommandArg quotes s for the shell, and escapes % so Postgres
+// doesn't treat it as a placeholder.
+func archiveCommandArg(s string) string {
+	return shellQuote(strings.ReplaceAll(s, "%", "%%"))
+}
+
+var shellSafeRegexp = regexp.MustCompile(`^[A-Za-z0-9_@+=:,./-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafeRegexp.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// quotePostgresConfString quotes s as a string value in
+// postgresql.conf.
+func quotePostgresConfString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// renderArchiveConf renders the WAL archiving settings. It returns nil
+// if archiving is disabled. We set restore_command on every node so
+// replicas that fall too far behind the primary can catch up from the
+// archive.
+func renderArchiveConf(archiveCommand string, restoreCommand string) []byte {
+	if archiveCommand == "" {
+		return nil
+	}
+	return fmt.Appendf(nil, "archive_mode = on\narchive_command = %s\nrestore_command = %s\n",
+		quotePostgresConfString(archiveCommand), quotePostgresConfString(restoreCommand))
+}
+
+// ensureArchiveConf writes archive.conf and restarts Postgres if it
+// changed, since archive_mode can only be changed with a restart.
+func (p *PostgresNode) ensureArchiveConf() error {
+	changed, err := writeConfFile(p.dataDir+"/postgresql.conf.d/archive.conf", renderArchiveConf(p.archiveCommand, p.restoreCommand))
+	if err != nil {
+		return fmt.Errorf("failed to write archive.conf: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+
+	log.Printf("WAL archive settings changed, restarting Postgres")
+	if err := p.postgres.Restart(); err != nil {
+		return fmt.Errorf("failed to restart Postgres service: %w", err)
+	}
+	return nil
+}
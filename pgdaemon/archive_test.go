@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testArchiveTarget exercises the ArchiveTarget contract.
+func testArchiveTarget(t *testing.T, archive ArchiveTarget) {
+	ctx := context.Background()
+
+	require.NoError(t, archive.Put(ctx, "wal/000000010000000000000001", strings.NewReader("segment 1")))
+	require.NoError(t, archive.Put(ctx, "wal/000000010000000000000002", strings.NewReader("segment 2")))
+	require.NoError(t, archive.Put(ctx, "basebackups/b1/backup.json", strings.NewReader("{}")))
+
+	var buf bytes.Buffer
+	require.NoError(t, archive.Get(ctx, "wal/000000010000000000000002", &buf))
+	assert.Equal(t, "segment 2", buf.String())
+
+	err := archive.Get(ctx, "wal/000000010000000000000003", &buf)
+	assert.ErrorIs(t, err, ErrArchiveObjectNotFound)
+
+	keys, err := archive.List(ctx, "wal/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wal/000000010000000000000001", "wal/000000010000000000000002"}, keys)
+
+	require.NoError(t, archive.Delete(ctx, "wal/000000010000000000000001"))
+	require.NoError(t, archive.Delete(ctx, "wal/000000010000000000000001"))
+	keys, err = archive.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"basebackups/b1/backup.json", "wal/000000010000000000000002"}, keys)
+}
+
+func TestLocalArchive(t *testing.T) {
+	testArchiveTarget(t, NewLocalArchive(filepath.Join(t.TempDir(), "archive")))
+}
+
+func TestLocalArchive_ListMissingRoot(t *testing.T) {
+	archive := NewLocalArchive(filepath.Join(t.TempDir(), "missing"))
+	keys, err := archive.List(context.Background(), "wal/")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+// fakeS3Server is a minimal in-memory stand-in for an S3-compatible
+// store like MinIO, using path-style requests.
+type fakeS3Server struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		s.objects[bucket+"/"+key] = body
+	case r.Method == http.MethodGet && key == "":
+		type object struct {
+			Key  string
+			Size int
+		}
+		type listResult struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			IsTruncated bool
+			Contents    []object
+		}
+		result := listResult{Name: bucket, Prefix: r.URL.Query().Get("prefix")}
+		for name, body := range s.objects {
+			objKey := strings.TrimPrefix(name, bucket+"/")
+			if strings.HasPrefix(objKey, result.Prefix) {
+				result.Contents = append(result.Contents, object{Key: objKey, Size: len(body)})
+			}
+		}
+		slices.SortFunc(result.Contents, func(a, b object) int { return strings.Compare(a.Key, b.Key) })
+		result.KeyCount = len(result.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodGet:
+		body, ok := s.objects[bucket+"/"+key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>missing</Message></Error>")
+			return
+		}
+		_, _ = w.Write(body)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestS3Archive(t *testing.T) {
+	fake := &fakeS3Server{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := aws.Config{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	}
+	archive := NewS3Archive(newS3Client(cfg, server.URL), "backups", "my-cluster")
+	testArchiveTarget(t, archive)
+
+	// Keys are stored under the prefix
+	_, ok := fake.objects["backups/my-cluster/wal/000000010000000000000002"]
+	assert.True(t, ok)
+}
+
+func TestArchiveWalPushAndFetch(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	archive := NewLocalArchive(filepath.Join(dir, "archive"))
+
+	walPath := filepath.Join(dir, "000000010000000000000001")
+	require.NoError(t, os.WriteFile(walPath, []byte("segment 1"), 0644))
+
+	require.NoError(t, archiveWalPush(ctx, archive, walPath, "000000010000000000000001"))
+
+	// Retrying with the same contents is fine
+	require.NoError(t, archiveWalPush(ctx, archive, walPath, "000000010000000000000001"))
+
+	// Different contents are never overwritten
+	require.NoError(t, os.WriteFile(walPath, []byte("something else"), 0644))
+	err := archiveWalPush(ctx, archive, walPath, "000000010000000000000001")
+	assert.ErrorContains(t, err, "already archived with different contents")
+
+	destPath := filepath.Join(dir, "RECOVERYXLOG")
+	require.NoError(t, archiveWalFetch(ctx, archive, "000000010000000000000001", destPath))
+	content, err := os.ReadFile(destPath)
+	require.NoError(t, err)
+	assert.Equal(t, "segment 1", string(content))
+
+	err = archiveWalFetch(ctx, archive, "00000002.history", destPath)
+	assert.ErrorIs(t, err, ErrArchiveObjectNotFound)
+}
+
+func TestArchiveCommandLine(t *testing.T) {
+	conf := config{clusterName: "my-cluster", archiveURL: "/mnt/wal archive/50%"}
+	cmd := archiveCommandLine("/usr/bin/pgdaemon", conf, "archive-wal-push", `"%p"`, "%f")
+	assert.Equal(t, `/usr/bin/pgdaemon -cluster-name my-cluster -archive-url '/mnt/wal archive/50%%' archive-wal-push "%p" %f`, cmd)
+
+	conf = config{clusterName: "my-cluster", archiveURL: "s3://bucket/prefix", archiveS3Endpoint: "http://minio:9000"}
+	cmd = archiveCommandLine("/usr/bin/pgdaemon", conf, "archive-wal-fetch", "%f", `"%p"`)
+	assert.Equal(t, `/usr/bin/pgdaemon -cluster-name my-cluster -archive-url s3://bucket/prefix -archive-s3-endpoint http://minio:9000 archive-wal-fetch %f "%p"`, cmd)
+}
+
+func TestRenderArchiveConf(t *testing.T) {
+	assert.Nil(t, renderArchiveConf("", ""))
+
+	content := renderArchiveConf("pgdaemon archive-wal-push '%p'", "pgdaemon archive-wal-fetch %f %p")
+	assert.Equal(t, "archive_mode = on\narchive_command = 'pgdaemon archive-wal-push ''%p'''\nrestore_command = 'pgdaemon archive-wal-fetch %f %p'\n", string(content))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// replicationPasswordEnv is where we look for the replication password
+// if -replication-password-file isn't given.
+const replicationPasswordEnv = "PGDAEMON_REPLICATION_PASSWORD"
+
+// pgUserPasswordEnv is where we look for -pguser's password if
+// -pguser-password-file isn't given.
+const pgUserPasswordEnv = "PGDAEMON_PGUSER_PASSWORD"
+
+// scramIterations matches Postgres' default scram_iterations.
+const scramIterations = 4096
+
+// readReplicationPassword reads the replication role's password. It
+// returns "" if none is configured.
+func readReplicationPassword(conf config) (string, error) {
+	return readPassword("replication", conf.replicationPasswordFile, replicationPasswordEnv)
+}
+
+// readPgUserPassword reads -pguser's password. It returns "" if none
+// is configured.
+func readPgUserPassword(conf config) (string, error) {
+	return readPassword("-pguser", conf.pgUserPasswordFile, pgUserPasswordEnv)
+}
+
+func readPassword(role string, file string, env string) (string, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s password: %w", role, err)
+		}
+		password := strings.TrimRight(string(content), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("%s password file %s is empty", role, file)
+		}
+		return password, nil
+	}
+	return os.Getenv(env), nil
+}
+
+// pgpassFile is where we write the passfile. It is outside of PGDATA so
+// pg_basebackup doesn't complain that PGDATA isn't empty.
+func pgpassFile(conf config) string {
+	return conf.pgDataDir + ".pgdaemon-pgpass"
+}
+
+// pgpassEnv is the environment for Postgres tools that connect to the
+// local Postgres as -pguser.
+func pgpassEnv(conf config) []string {
+	return append(os.Environ(), "PGPASSFILE="+pgpassFile(conf))
+}
+
+// setUpConnSecurity reads the role passwords and writes the passfile
+// that pgdaemon, the tools it runs, and Postgres itself connect with.
+func setUpConnSecurity(conf config) (security connSecurity, replicationPassword string, pgUserPassword string, err error) {
+	security = connSecurity{rootCert: conf.tlsCA}
+	if replicationPassword, err = readReplicationPassword(conf); err != nil {
+		return security, "", "", err
+	}
+	if pgUserPassword, err = readPgUserPassword(conf); err != nil {
+		return security, "", "", err
+	}
+	if replicationPassword == "" {
+		if pgUserPassword != "" {
+			return security, "", "", fmt.Errorf("a -pguser password is only used with the auth spec, which also needs a replication password")
+		}
+		return security, "", "", nil
+	}
+
+	security.replicationUser = conf.replicationUser
+	security.passfile = pgpassFile(conf)
+	content := renderPgpass(conf.replicationUser, replicationPassword)
+	if pgUserPassword != "" {
+		content = append(content, renderPgpass(conf.postgresUser, pgUserPassword)...)
+	}
+	if err := os.WriteFile(security.passfile, content, 0600); err != nil {
+		return security, "", "", fmt.Errorf("failed to write password file: %w", err)
+	}
+	return security, replicationPassword, pgUserPassword, nil
+}
+
+// renderPgpass renders a libpq password file with one entry for user.
+func renderPgpass(user string, password string) []byte {
+	escape := strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+	return fmt.Appendf(nil, "*:*:*:%s:%s\n", escape.Replace(user), escape.Replace(password))
+}
+
+// renderHbaConf renders pg_hba.conf from the spec. Unix sockets use
+// peer auth. Everything else must use SCRAM, including pgdaemon's own
+// role and clients that PgBouncer forwards over loopback, and TLS if it
+// is enabled. pgdaemon's role may also make replication connections
+// over loopback, for local backups.
+func renderHbaConf(auth AuthSpec, pgdaemonUser string, replicationUser string, tls bool) ([]byte, error) {
+	hostType := "host"
+	if tls {
+		hostType = "hostssl"
+	}
+
+	var b strings.Builder
+	b.WriteString("# Managed by pgdaemon from the cluster spec. Local changes are overwritten.\n")
+	b.WriteString("# TYPE  DATABASE     USER    ADDRESS    METHOD\n")
+	b.WriteString("local   all all peer\n")
+	b.WriteString("local   replication all peer\n")
+	b.WriteString("host    all all 127.0.0.1/32 scram-sha-256\n")
+	b.WriteString("host    all all ::1/128 scram-sha-256\n")
+	fmt.Fprintf(&b, "host    replication %s 127.0.0.1/32 scram-sha-256\n", pgdaemonUser)
+	fmt.Fprintf(&b, "host    replication %s ::1/128 scram-sha-256\n", pgdaemonUser)
+	for _, cidr := range auth.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %w", cidr, err)
+		}
+		fmt.Fprintf(&b, "%s all all %s scram-sha-256\n", hostType, cidr)
+		fmt.Fprintf(&b, "%s replication %s %s scram-sha-256\n", hostType, replicationUser, cidr)
+	}
+	return []byte(b.String()), nil
+}
+
+// scramSHA256Verifier computes the SCRAM-SHA-256 verifier Postgres
+// stores in pg_authid, so the password itself never appears in SQL or
+// in the server log. Postgres also normalizes passwords with SASLprep,
+// which doesn't change ASCII passwords.
+func scramSHA256Verifier(password string, salt []byte, iterations int) (string, error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive SCRAM key: %w", err)
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(salted, "Server Key")
+
+	enc := base64.StdEncoding
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations, enc.EncodeToString(salt), enc.EncodeToString(storedKey[:]), enc.EncodeToString(serverKey)), nil
+}
+
+// newScramSHA256Verifier computes a verifier for password with a fresh
+// salt.
+func newScramSHA256Verifier(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return scramSHA256Verifier(password, salt, scramIterations)
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramVerifierMatches returns true if verifier was computed from
+// password.
+func scramVerifierMatches(verifier string, password string) bool {
+	// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+	rest, ok := strings.CutPrefix(verifier, "SCRAM-SHA-256$")
+	if !ok {
+		return false
+	}
+	params, _, ok := strings.Cut(rest, "$")
+	if !ok {
+		return false
+	}
+	iterationsStr, saltStr, ok := strings.Cut(params, ":")
+	if !ok {
+		return false
+	}
+	iterations, err := strconv.Atoi(iterationsStr)
+	if err != nil {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(saltStr)
+	if err != nil {
+		return false
+	}
+	expected, err := scramSHA256Verifier(password, salt, iterations)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(verifier)) == 1
+}
+
+// replicationRoleGrants let the replication role run pg_rewind and our
+// rejoin checks without being a superuser. See the pg_rewind docs.
+var replicationRoleGrants = []string{
+	"pg_catalog.pg_ls_dir(text, boolean, boolean)",
+	"pg_catalog.pg_stat_file(text, boolean)",
+	"pg_catalog.pg_read_binary_file(text)",
+	"pg_catalog.pg_read_binary_file(text, bigint, bigint, boolean)",
+	"pg_catalog.pg_read_file(text)",
+}
+
+// ensureReplicationRole creates the replication role on the primary,
+// or resets its password if it changed. Replicas get the role through
+// replication.
+func (p *PostgresNode) ensureReplicationRole(ctx context.Context) error {
+	if !p.security.authEnabled() || p.replicationRoleReady {
+		return nil
+	}
+
+	user := p.security.replicationUser
+	var verifier *string
+	err := p.pool.QueryRow(ctx, "SELECT rolpassword FROM pg_authid WHERE rolname = $1", user).Scan(&verifier)
+	exists := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to look up replication role: %w", err)
+	}
+
+	ident := pgx.Identifier{user}.Sanitize()
+	if !exists || verifier == nil || !scramVerifierMatches(*verifier, p.replicationPassword) {
+		newVerifier, err := newScramSHA256Verifier(p.replicationPassword)
+		if err != nil {
+			return err
+		}
+		verb := "ALTER"
+		if !exists {
+			verb = "CREATE"
+		}
+		stmt := fmt.Sprintf("%s ROLE %s WITH LOGIN REPLICATION PASSWORD '%s'", verb, ident, newVerifier)
+		if _, err := p.pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to %s replication role: %w", strings.ToLower(verb), err)
+		}
+		log.Printf("Set up replication role %s", user)
+	}
+
+	for _, function := range replicationRoleGrants {
+		if _, err := p.pool.Exec(ctx, fmt.Sprintf("GRANT EXECUTE ON FUNCTION %s TO %s", function, ident)); err != nil {
+			return fmt.Errorf("failed to grant %s to replication role: %w", function, err)
+		}
+	}
+
+	p.replicationRoleReady = true
+	return nil
+}
+
+// ensurePgUserPassword makes sure -pguser's role has the configured
+// password, and returns false if it doesn't yet. Only the primary can
+// set it; replicas get it through replication.
+func (p *PostgresNode) ensurePgUserPassword(ctx context.Context) (bool, error) {
+	if p.pgUserPasswordReady {
+		return true, nil
+	}
+
+	var verifier *string
+	if err := p.pool.QueryRow(ctx, "SELECT rolpassword FROM pg_authid WHERE rolname = $1", p.pgdaemonUser).Scan(&verifier); err != nil {
+		return false, fmt.Errorf("failed to look up role %s: %w", p.pgdaemonUser, err)
+	}
+	if verifier == nil || !scramVerifierMatches(*verifier, p.pgUserPassword) {
+		isPrimary, err := CheckIsPrimary(p.pool)
+		if err != nil {
+			return false, err
+		}
+		if !isPrimary {
+			return false, nil
+		}
+		newVerifier, err := newScramSHA256Verifier(p.pgUserPassword)
+		if err != nil {
+			return false, err
+		}
+		stmt := fmt.Sprintf("ALTER ROLE %s WITH PASSWORD '%s'", pgx.Identifier{p.pgdaemonUser}.Sanitize(), newVerifier)
+		if _, err := p.pool.Exec(ctx, stmt); err != nil {
+			return false, fmt.Errorf("failed to set password of role %s: %w", p.pgdaemonUser, err)
+		}
+		log.Printf("Set the password of role %s", p.pgdaemonUser)
+	}
+
+	p.pgUserPasswordReady = true
+	return true, nil
+}
+
+// ensureAuthConf writes pg_hba.conf from the spec and the TLS settings,
+// and reloads Postgres if they changed. Without an auth spec we leave
+// pg_hba.conf alone, which keeps the trust rules from initdb.
+func (p *PostgresNode) ensureAuthConf(ctx context.Context, auth *AuthSpec) error {
+	// Don't write files into an empty PGDATA we still have to clone
+	if _, err := os.Stat(p.dataDir + "/PG_VERSION"); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	changed := false
+	if auth != nil {
+		if !p.security.authEnabled() {
+			return fmt.Errorf("the auth spec needs a replication password from -replication-password-file or $%s", replicationPasswordEnv)
+		}
+		if p.pgUserPassword == "" {
+			return fmt.Errorf("the auth spec needs a password for -pguser from -pguser-password-file or $%s", pgUserPasswordEnv)
+		}
+		ready, err := p.ensurePgUserPassword(ctx)
+		if err != nil {
+			return err
+		}
+		if ready {
+			content, err := renderHbaConf(*auth, p.pgdaemonUser, p.security.replicationUser, p.tlsFiles.enabled())
+			if err != nil {
+				return err
+			}
+			hbaChanged, err := writeConfFile(p.dataDir+"/pg_hba.conf", content)
+			if err != nil {
+				return fmt.Errorf("failed to write pg_hba.conf: %w", err)
+			}
+			changed = changed || hbaChanged
+		} else {
+			// Requiring a password Postgres doesn't know yet
+			// would lock us out.
+			log.Printf("Waiting for the password of role %s to replicate before requiring it", p.pgdaemonUser)
+		}
+	}
+
+	certChanged, err := ensureServerCert(p.tlsFiles, p.certHosts, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to generate server certificate: %w", err)
+	}
+	if certChanged {
+		log.Printf("Generated server certificate %s", p.tlsFiles.certFile)
+		// PgBouncer serves the same certificate
+		p.pgBouncerNeedsReload = true
+	}
+	tlsChanged, err := writeConfFile(p.dataDir+"/postgresql.conf.d/tls.conf", renderTLSConf(p.tlsFiles))
+	if err != nil {
+		return fmt.Errorf("failed to write tls.conf: %w", err)
+	}
+	changed = changed || certChanged || tlsChanged
+
+	if changed {
+		log.Printf("Authentication settings changed, reloading Postgres")
+		if err := p.postgres.Reload(); err != nil {
+			return fmt.Errorf("failed to reload Postgres service: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadReplicationPassword(t *testing.T) {
+	t.Setenv(replicationPasswordEnv, "")
+	password, err := readReplicationPassword(config{})
+	require.NoError(t, err)
+	assert.Empty(t, password)
+
+	t.Setenv(replicationPasswordEnv, "from-env")
+	password, err = readReplicationPassword(config{})
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", password)
+
+	// The file wins over the environment
+	file := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0600))
+	password, err = readReplicationPassword(config{replicationPasswordFile: file})
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", password)
+
+	require.NoError(t, os.WriteFile(file, []byte("\n"), 0600))
+	_, err = readReplicationPassword(config{replicationPasswordFile: file})
+	assert.ErrorContains(t, err, "is empty")
+}
+
+func TestSetUpConnSecurity(t *testing.T) {
+	t.Setenv(replicationPasswordEnv, "")
+	t.Setenv(pgUserPasswordEnv, "")
+	conf := config{pgDataDir: filepath.Join(t.TempDir(), "data"), postgresUser: "postgres", replicationUser: "replicator", tlsCA: "/tls/ca.crt"}
+	security, _, _, err := setUpConnSecurity(conf)
+	require.NoError(t, err)
+	assert.Equal(t, connSecurity{rootCert: "/tls/ca.crt"}, security)
+
+	t.Setenv(pgUserPasswordEnv, "pguser-secret")
+	_, _, _, err = setUpConnSecurity(conf)
+	assert.ErrorContains(t, err, "needs a replication password")
+
+	t.Setenv(replicationPasswordEnv, "replication-secret")
+	security, replicationPassword, pgUserPassword, err := setUpConnSecurity(conf)
+	require.NoError(t, err)
+	assert.Equal(t, "replication-secret", replicationPassword)
+	assert.Equal(t, "pguser-secret", pgUserPassword)
+	assert.Equal(t, "replicator", security.replicationUser)
+	assert.Equal(t, pgpassFile(conf), security.passfile)
+	assert.Contains(t, security.localParams(), "passfile=")
+
+	content, err := os.ReadFile(security.passfile)
+	require.NoError(t, err)
+	assert.Equal(t, "*:*:*:replicator:replication-secret\n*:*:*:postgres:pguser-secret\n", string(content))
+	info, err := os.Stat(security.passfile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRenderPgpass(t *testing.T) {
+	assert.Equal(t, `*:*:*:replicator:pa\:ss\\word`+"\n", string(renderPgpass("replicator", `pa:ss\word`)))
+}
+
+func TestRenderHbaConf(t *testing.T) {
+	content, err := renderHbaConf(AuthSpec{AllowedCIDRs: []string{"10.0.0.0/16"}}, "postgres", "replicator", true)
+	require.NoError(t, err)
+	assert.Equal(t, `# Managed by pgdaemon from the cluster spec. Local changes are overwritten.
+# TYPE  DATABASE     USER    ADDRESS    METHOD
+local   all all peer
+local   replication all peer
+host    all all 127.0.0.1/32 scram-sha-256
+host    all all ::1/128 scram-sha-256
+host    replication postgres 127.0.0.1/32 scram-sha-256
+host    replication postgres ::1/128 scram-sha-256
+hostssl all all 10.0.0.0/16 scram-sha-256
+hostssl replication replicator 10.0.0.0/16 scram-sha-256
+`, string(content))
+
+	content, err = renderHbaConf(AuthSpec{AllowedCIDRs: []string{"10.0.0.0/16"}}, "postgres", "replicator", false)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "\nhost all all 10.0.0.0/16 scram-sha-256\n")
+
+	_, err = renderHbaConf(AuthSpec{AllowedCIDRs: []string{"0.0.0.0/0 trust"}}, "postgres", "replicator", true)
+	assert.ErrorContains(t, err, "invalid allowed CIDR")
+}
+
+func TestScramSHA256Verifier(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	verifier, err := scramSHA256Verifier("secret", salt, scramIterations)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^SCRAM-SHA-256\$4096:MDEyMzQ1Njc4OWFiY2RlZg==\$[A-Za-z0-9+/=]{44}:[A-Za-z0-9+/=]{44}$`), verifier)
+
+	assert.True(t, scramVerifierMatches(verifier, "secret"))
+	assert.False(t, scramVerifierMatches(verifier, "wrong"))
+	assert.False(t, scramVerifierMatches("md5abcdef", "secret"))
+	assert.False(t, scramVerifierMatches("SCRAM-SHA-256$garbage", "secret"))
+}
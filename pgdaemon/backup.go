@@ -0,0 +1,424 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BaseBackupInfo describes a base backup in the archive. It is stored
+// next to the backup as backup.json, which we upload last, so a backup
+// without it is incomplete.
+type BaseBackupInfo struct {
+	Name      string    `json:"name" dynamodbav:"name"`
+	Node      string    `json:"node" dynamodbav:"node"`
+	StartTime time.Time `json:"start_time" dynamodbav:"start_time"`
+	StopTime  time.Time `json:"stop_time" dynamodbav:"stop_time"`
+
+	// StartWalFile is the first WAL file needed to restore this
+	// backup. WAL files before the oldest backup's StartWalFile can
+	// be removed from the archive.
+	StartWalFile string `json:"start_wal_file,omitempty" dynamodbav:"start_wal_file,omitempty"`
+}
+
+const baseBackupsPrefix = "basebackups/"
+
+func baseBackupTarKey(name string) string {
+	return baseBackupsPrefix + name + "/base.tar.gz"
+}
+
+func baseBackupInfoKey(name string) string {
+	return baseBackupsPrefix + name + "/backup.json"
+}
+
+// takeBaseBackup runs pg_basebackup against the local Postgres and
+// uploads the result to the archive. The backup includes the WAL
+// needed to make it consistent, so it can be restored even without
+// the WAL archive.
+func takeBaseBackup(ctx context.Context, archive ArchiveTarget, conf config) (BaseBackupInfo, error) {
+	info := BaseBackupInfo{
+		Node:      conf.nodeName,
+		StartTime: time.Now().UTC(),
+	}
+	info.Name = info.StartTime.Format("20060102T150405Z")
+
+	conf, err := withPgBinaries(conf)
+	if err != nil {
+		return info, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "pgdaemon-basebackup-")
+	if err != nil {
+		return info, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	log.Printf("Taking base backup %s", info.Name)
+	cmd := exec.CommandContext(ctx, pgBinPath(conf.pgBinDir, "pg_basebackup"),
+		"--host", conf.postgresHost,
+		"--port", strconv.Itoa(conf.postgresPort),
+		"--username", conf.postgresUser,
+		"--pgdata", tmpDir,
+		"--format", "tar",
+		"--gzip",
+		"--wal-method", "fetch",
+		"--checkpoint", "fast",
+		"--no-password",
+	)
+	cmd.Env = pgpassEnv(conf)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return info, fmt.Errorf("failed to run pg_basebackup: %w", err)
+	}
+	info.StopTime = time.Now().UTC()
+
+	if err := checkBaseBackupTarballs(tmpDir); err != nil {
+		return info, err
+	}
+
+	tarPath := filepath.Join(tmpDir, "base.tar.gz")
+	info.StartWalFile, err = readStartWalFile(tarPath)
+	if err != nil {
+		return info, err
+	}
+
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return info, fmt.Errorf("failed to open base backup: %w", err)
+	}
+	defer f.Close()
+	if err := archive.Put(ctx, baseBackupTarKey(info.Name), f); err != nil {
+		return info, err
+	}
+
+	infoBytes, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return info, fmt.Errorf("failed to convert backup info to JSON: %w", err)
+	}
+	if err := archive.Put(ctx, baseBackupInfoKey(info.Name), bytes.NewReader(infoBytes)); err != nil {
+		return info, err
+	}
+
+	log.Printf("Base backup %s uploaded successfully", info.Name)
+	return info, nil
+}
+
+// checkBaseBackupTarballs makes sure pg_basebackup wrote only
+// base.tar.gz. It writes a <oid>.tar.gz per tablespace, which we
+// neither upload nor know how to restore, so a backup of a cluster
+// with tablespaces would silently be missing data.
+func checkBaseBackupTarballs(dir string) error {
+	tarballs, err := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	if err != nil {
+		return fmt.Errorf("failed to list base backup files: %w", err)
+	}
+	var tablespaces []string
+	for _, path := range tarballs {
+		if name := filepath.Base(path); name != "base.tar.gz" {
+			tablespaces = append(tablespaces, strings.TrimSuffix(name, ".tar.gz"))
+		}
+	}
+	if len(tablespaces) > 0 {
+		return fmt.Errorf("base backups don't support tablespaces, found tablespace OIDs %s", strings.Join(tablespaces, ", "))
+	}
+	return nil
+}
+
+// listBaseBackups returns the complete base backups in the archive,
+// oldest first.
+func listBaseBackups(ctx context.Context, archive ArchiveTarget) ([]BaseBackupInfo, error) {
+	keys, err := archive.List(ctx, baseBackupsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []BaseBackupInfo
+	for _, key := range keys {
+		if !strings.HasSuffix(key, "/backup.json") {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := archive.Get(ctx, key, &buf); err != nil {
+			return nil, err
+		}
+		var info BaseBackupInfo
+		if err := json.Unmarshal(buf.Bytes(), &info); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+		backups = append(backups, info)
+	}
+
+	slices.SortFunc(backups, func(a, b BaseBackupInfo) int {
+		return a.StopTime.Compare(b.StopTime)
+	})
+	return backups, nil
+}
+
+// selectBaseBackup picks the newest backup to restore from. With a
+// target time, the backup must have finished before the target,
+// because recovery can't stop before the backup is consistent.
+// backups must be sorted oldest first.
+func selectBaseBackup(backups []BaseBackupInfo, targetTime *time.Time) (BaseBackupInfo, error) {
+	for _, backup := range slices.Backward(backups) {
+		if targetTime == nil || backup.StopTime.Before(*targetTime) {
+			return backup, nil
+		}
+	}
+	if targetTime != nil {
+		return BaseBackupInfo{}, fmt.Errorf("no base backup finished before %s", targetTime.Format(time.RFC3339))
+	}
+	return BaseBackupInfo{}, fmt.Errorf("no base backups found")
+}
+
+// readStartWalFile finds the first WAL file the backup needs in the
+// backup_label inside a pg_basebackup tarball.
+func readStartWalFile(tarGzPath string) (string, error) {
+	f, err := os.Open(tarGzPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open base backup: %w", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress base backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("base backup has no backup_label")
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read base backup: %w", err)
+		}
+		if hdr.Name != "backup_label" {
+			continue
+		}
+		label, err := io.ReadAll(tr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read backup_label: %w", err)
+		}
+		return parseBackupLabelStartWalFile(string(label))
+	}
+}
+
+var backupLabelStartWalRegexp = regexp.MustCompile(`(?m)^START WAL LOCATION: \S+ \(file ([0-9A-F]{24})\)$`)
+
+func parseBackupLabelStartWalFile(label string) (string, error) {
+	match := backupLabelStartWalRegexp.FindStringSubmatch(label)
+	if match == nil {
+		return "", fmt.Errorf("no START WAL LOCATION in backup_label")
+	}
+	return match[1], nil
+}
+
+// applyBackupRetention deletes all but the newest retention base
+// backups, and the archived WAL that only the deleted backups needed.
+func applyBackupRetention(ctx context.Context, archive ArchiveTarget, retention int) error {
+	if retention < 1 {
+		return fmt.Errorf("backup retention must be at least 1, got %d", retention)
+	}
+	backups, err := listBaseBackups(ctx, archive)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= retention {
+		return nil
+	}
+
+	expired, kept := backups[:len(backups)-retention], backups[len(backups)-retention:]
+	for _, backup := range expired {
+		log.Printf("Deleting base backup %s", backup.Name)
+		// Delete backup.json first so a partially deleted backup
+		// looks incomplete rather than restorable.
+		if err := archive.Delete(ctx, baseBackupInfoKey(backup.Name)); err != nil {
+			return err
+		}
+		if err := archive.Delete(ctx, baseBackupTarKey(backup.Name)); err != nil {
+			return err
+		}
+	}
+
+	if len(kept) == 0 || kept[0].StartWalFile == "" {
+		return nil
+	}
+
+	walKeys, err := archive.List(ctx, "wal/")
+	if err != nil {
+		return err
+	}
+	expiredWal := expiredWalKeys(walKeys, kept[0].StartWalFile)
+	if len(expiredWal) > 0 {
+		log.Printf("Deleting %d archived WAL files before %s", len(expiredWal), kept[0].StartWalFile)
+	}
+	for _, key := range expiredWal {
+		if err := archive.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var walSegmentFileRegexp = regexp.MustCompile(`^[0-9A-F]{24}`)
+
+// expiredWalKeys returns the archived WAL segments from before
+// startWalFile. Like pg_archivecleanup, we compare segment numbers and
+// ignore the timeline. Timeline history files are always kept.
+func expiredWalKeys(keys []string, startWalFile string) []string {
+	var expired []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, "wal/")
+		if !walSegmentFileRegexp.MatchString(name) {
+			continue
+		}
+		if name[8:24] < startWalFile[8:24] {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+// backupRetryDelay is how long we wait after a failed backup before
+// trying again.
+const backupRetryDelay = 5 * time.Minute
+
+// backupSchedulerLoop takes a base backup every -backup-interval when
+// this node is the cluster's BackupNode.
+func backupSchedulerLoop(ctx context.Context, store StateStore, conf config, archive ArchiveTarget) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("returning ctx.Done() error in backup scheduler loop: %w", ctx.Err())
+		case <-ticker.C:
+			if err := runScheduledBackup(ctx, store, conf, archive); err != nil {
+				log.Printf("Scheduled backup failed: %v", err)
+			}
+		}
+	}
+}
+
+func runScheduledBackup(ctx context.Context, store StateStore, conf config, archive ArchiveTarget) error {
+	state, err := store.FetchClusterState(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch cluster state: %w", err)
+	}
+
+	var backup ClusterBackupStatus
+	if state.Status.Backup != nil {
+		backup = *state.Status.Backup
+	}
+
+	// We take backups synchronously, so if we are marked as taking
+	// one, pgdaemon must have restarted in the middle of it.
+	if backup.InProgressNode == conf.nodeName {
+		log.Printf("Found an interrupted backup started at %s", backup.InProgressSince)
+		return updateBackupStatus(store, conf.nodeName, func(b *ClusterBackupStatus) {
+			finishBackup(b, conf.nodeName, backup.InProgressSince, nil, fmt.Errorf("pgdaemon restarted during the backup"))
+		})
+	}
+
+	if state.Status.BackupNode != conf.nodeName || backup.InProgressNode != "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	if !backupDue(backup, conf.backupInterval, now) {
+		return nil
+	}
+
+	// Claim the backup. If someone else changed the status in the
+	// meantime we try again on the next tick.
+	startTime := now.Format(time.RFC3339)
+	newStatus := state.Status
+	claimed := backup
+	claimed.InProgressNode = conf.nodeName
+	claimed.InProgressSince = startTime
+	newStatus.Backup = &claimed
+	if _, _, err := WriteClusterStatusIfChanged(store, state.Status, newStatus, conf.nodeName); err != nil {
+		if errors.Is(err, ErrClusterStatusConflict) {
+			return nil
+		}
+		return fmt.Errorf("failed to claim backup: %w", err)
+	}
+
+	info, backupErr := takeBaseBackup(ctx, archive, conf)
+	if err := updateBackupStatus(store, conf.nodeName, func(b *ClusterBackupStatus) {
+		finishBackup(b, conf.nodeName, startTime, &info, backupErr)
+	}); err != nil {
+		return err
+	}
+	if backupErr != nil {
+		return backupErr
+	}
+
+	if err := applyBackupRetention(ctx, archive, conf.backupRetention); err != nil {
+		return fmt.Errorf("failed to apply backup retention: %w", err)
+	}
+	return nil
+}
+
+// backupDue decides whether it is time for the next scheduled backup.
+func backupDue(backup ClusterBackupStatus, interval time.Duration, now time.Time) bool {
+	if backup.LastFailure != nil {
+		failedAt, err := time.Parse(time.RFC3339, backup.LastFailure.StartTime)
+		if err == nil && now.Sub(failedAt) < backupRetryDelay {
+			return false
+		}
+	}
+	if backup.LastSuccess == nil {
+		return true
+	}
+	return now.Sub(backup.LastSuccess.StartTime) >= interval
+}
+
+// finishBackup records the outcome of a backup started by nodeName.
+func finishBackup(backup *ClusterBackupStatus, nodeName string, startTime string, info *BaseBackupInfo, err error) {
+	if backup.InProgressNode == nodeName {
+		backup.InProgressNode = ""
+		backup.InProgressSince = ""
+	}
+	if err != nil {
+		backup.LastFailure = &BackupFailure{
+			Node:      nodeName,
+			StartTime: startTime,
+			Error:     err.Error(),
+		}
+		return
+	}
+	backup.LastSuccess = info
+}
+
+// updateBackupStatus applies update to the cluster's backup status,
+// retrying if the reconcilers write the status at the same time.
+func updateBackupStatus(store StateStore, nodeName string, update func(backup *ClusterBackupStatus)) error {
+	err := updateClusterStatus(store, nodeName, func(status *ClusterStatus) {
+		var backup ClusterBackupStatus
+		if status.Backup != nil {
+			backup = *status.Backup
+		}
+		update(&backup)
+		status.Backup = &backup
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write backup status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListBaseBackups(t *testing.T) {
+	ctx := context.Background()
+	archive := NewLocalArchive(filepath.Join(t.TempDir(), "archive"))
+
+	newer := BaseBackupInfo{Name: "20250702T000000Z", Node: "node2", StopTime: time.Date(2025, 7, 2, 0, 5, 0, 0, time.UTC)}
+	older := BaseBackupInfo{Name: "20250701T000000Z", Node: "node3", StopTime: time.Date(2025, 7, 1, 0, 5, 0, 0, time.UTC)}
+	for _, info := range []BaseBackupInfo{newer, older} {
+		infoBytes, err := json.Marshal(info)
+		require.NoError(t, err)
+		require.NoError(t, archive.Put(ctx, baseBackupTarKey(info.Name), bytes.NewReader(nil)))
+		require.NoError(t, archive.Put(ctx, baseBackupInfoKey(info.Name), bytes.NewReader(infoBytes)))
+	}
+
+	// An incomplete backup without backup.json is ignored
+	require.NoError(t, archive.Put(ctx, baseBackupTarKey("20250703T000000Z"), bytes.NewReader(nil)))
+
+	backups, err := listBaseBackups(ctx, archive)
+	require.NoError(t, err)
+	assert.Equal(t, []BaseBackupInfo{older, newer}, backups)
+}
+
+func TestSelectBaseBackup(t *testing.T) {
+	backups := []BaseBackupInfo{
+		{Name: "b1", StopTime: time.Date(2025, 7, 1, 0, 5, 0, 0, time.UTC)},
+		{Name: "b2", StopTime: time.Date(2025, 7, 2, 0, 5, 0, 0, time.UTC)},
+	}
+
+	backup, err := selectBaseBackup(backups, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "b2", backup.Name)
+
+	target := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	backup, err = selectBaseBackup(backups, &target)
+	require.NoError(t, err)
+	assert.Equal(t, "b1", backup.Name)
+
+	tooEarly := time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+	_, err = selectBaseBackup(backups, &tooEarly)
+	assert.ErrorContains(t, err, "no base backup finished before 2025-07-01T00:00:00Z")
+
+	_, err = selectBaseBackup(nil, nil)
+	assert.ErrorContains(t, err, "no base backups found")
+}
+
+// memStore is an in-memory StateStore with the same compare-and-swap
+// semantics as the real backends.
+type memStore struct {
+	mu     sync.Mutex
+	state  ClusterState
+	events []ClusterEvent
+
+	// beforeWrite and beforeSpecWrite, if set, run before each
+	// AtomicWriteClusterStatus and AtomicWriteClusterSpec so tests can
+	// simulate concurrent writers.
+	beforeWrite     func(state *ClusterState)
+	beforeSpecWrite func(state *ClusterState)
+}
+
+func (s *memStore) SetClusterSpec(ctx context.Context, spec *ClusterSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spec.SpecUuid = uuid.New()
+	s.state.Spec = *spec
+	return nil
+}
+
+func (s *memStore) AtomicWriteClusterSpec(ctx context.Context, prevSpecUUID uuid.UUID, spec ClusterSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.beforeSpecWrite != nil {
+		s.beforeSpecWrite(&s.state)
+	}
+	if s.state.Spec.SpecUuid != prevSpecUUID {
+		return ErrClusterSpecConflict
+	}
+	s.state.Spec = spec
+	return nil
+}
+
+func (s *memStore) FetchClusterState(ctx context.Context) (ClusterState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.Nodes = slices.Clone(s.state.Nodes)
+	return state, nil
+}
+
+func (s *memStore) AtomicWriteClusterStatus(ctx context.Context, prevStatusUUID uuid.UUID, status ClusterStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.beforeWrite != nil {
+		s.beforeWrite(&s.state)
+	}
+	if s.state.Status.StatusUuid != prevStatusUUID {
+		return ErrClusterStatusConflict
+	}
+	s.state.Status = status
+	return nil
+}
+
+func (s *memStore) WriteCurrentNodeStatus(ctx context.Context, status *NodeStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, node := range s.state.Nodes {
+		if node.Name == status.Name {
+			s.state.Nodes[i] = *status
+			return nil
+		}
+	}
+	s.state.Nodes = append(s.state.Nodes, *status)
+	return nil
+}
+
+func (s *memStore) RecordClusterEvents(ctx context.Context, events []ClusterEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range events {
+		if !slices.ContainsFunc(s.events, func(e ClusterEvent) bool { return e.ID == event.ID }) {
+			s.events = append(s.events, event)
+		}
+	}
+	sortClusterEvents(s.events)
+	s.events = slices.Delete(s.events, 0, len(excessClusterEvents(s.events)))
+	return nil
+}
+
+func (s *memStore) FetchClusterEvents(ctx context.Context) ([]ClusterEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.events), nil
+}
+
+func TestParseBackupLabelStartWalFile(t *testing.T) {
+	label := `START WAL LOCATION: 0/5000028 (file 000000010000000000000005)
+CHECKPOINT LOCATION: 0/5000060
+BACKUP METHOD: streamed
+BACKUP FROM: standby
+START TIME: 2025-07-01 00:00:00 UTC
+`
+	walFile, err := parseBackupLabelStartWalFile(label)
+	require.NoError(t, err)
+	assert.Equal(t, "000000010000000000000005", walFile)
+
+	_, err = parseBackupLabelStartWalFile("garbage")
+	assert.Error(t, err)
+}
+
+func TestCheckBaseBackupTarballs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"base.tar.gz", "backup_manifest"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0o600))
+	}
+	require.NoError(t, checkBaseBackupTarballs(dir))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "16385.tar.gz"), nil, 0o600))
+	err := checkBaseBackupTarballs(dir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "16385")
+}
+
+func TestExpiredWalKeys(t *testing.T) {
+	keys := []string{
+		"wal/000000010000000000000003",
+		"wal/000000010000000000000004.partial",
+		"wal/00000002.history",
+		"wal/000000020000000000000004",
+		"wal/000000020000000000000005",
+		"wal/000000020000000000000006",
+	}
+	assert.Equal(t, []string{
+		"wal/000000010000000000000003",
+		"wal/000000010000000000000004.partial",
+		"wal/000000020000000000000004",
+	}, expiredWalKeys(keys, "000000020000000000000005"))
+}
+
+func TestApplyBackupRetention(t *testing.T) {
+	ctx := context.Background()
+	archive := NewLocalArchive(filepath.Join(t.TempDir(), "archive"))
+
+	for i, startWal := range []string{"000000010000000000000002", "000000010000000000000004", "000000010000000000000006"} {
+		info := BaseBackupInfo{
+			Name:         "b" + string(rune('1'+i)),
+			StopTime:     time.Date(2025, 7, 1+i, 0, 0, 0, 0, time.UTC),
+			StartWalFile: startWal,
+		}
+		infoBytes, err := json.Marshal(info)
+		require.NoError(t, err)
+		require.NoError(t, archive.Put(ctx, baseBackupTarKey(info.Name), bytes.NewReader(nil)))
+		require.NoError(t, archive.Put(ctx, baseBackupInfoKey(info.Name), bytes.NewReader(infoBytes)))
+	}
+	for _, walFile := range []string{"000000010000000000000002", "000000010000000000000003", "000000010000000000000004", "000000010000000000000005"} {
+		require.NoError(t, archive.Put(ctx, walArchiveKey(walFile), bytes.NewReader(nil)))
+	}
+
+	// Keeping no backups would delete them all
+	assert.Error(t, applyBackupRetention(ctx, archive, 0))
+
+	require.NoError(t, applyBackupRetention(ctx, archive, 2))
+
+	keys, err := archive.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"basebackups/b2/backup.json",
+		"basebackups/b2/base.tar.gz",
+		"basebackups/b3/backup.json",
+		"basebackups/b3/base.tar.gz",
+		"wal/000000010000000000000004",
+		"wal/000000010000000000000005",
+	}, keys)
+}
+
+func TestBackupDue(t *testing.T) {
+	now := time.Date(2025, 7, 2, 12, 0, 0, 0, time.UTC)
+	interval := 24 * time.Hour
+
+	assert.True(t, backupDue(ClusterBackupStatus{}, interval, now))
+
+	recent := ClusterBackupStatus{LastSuccess: &BaseBackupInfo{StartTime: now.Add(-time.Hour)}}
+	assert.False(t, backupDue(recent, interval, now))
+
+	old := ClusterBackupStatus{LastSuccess: &BaseBackupInfo{StartTime: now.Add(-25 * time.Hour)}}
+	assert.True(t, backupDue(old, interval, now))
+
+	// Wait a bit after a failure before trying again
+	old.LastFailure = &BackupFailure{StartTime: now.Add(-time.Minute).Format(time.RFC3339)}
+	assert.False(t, backupDue(old, interval, now))
+	old.LastFailure.StartTime = now.Add(-time.Hour).Format(time.RFC3339)
+	assert.True(t, backupDue(old, interval, now))
+}
+
+func TestUpdateBackupStatus_RetriesOnConflict(t *testing.T) {
+	store := &memStore{state: ClusterState{
+		Status: ClusterStatus{
+			StatusUuid:      uuid.New(),
+			IntendedPrimary: "node1",
+			Backup:          &ClusterBackupStatus{InProgressNode: "node2", InProgressSince: "2025-07-01T00:00:00Z"},
+		},
+	}}
+
+	// Another node writes the status right before our first write
+	conflicts := 1
+	store.beforeWrite = func(state *ClusterState) {
+		if conflicts > 0 {
+			conflicts--
+			state.Status.StatusUuid = uuid.New()
+		}
+	}
+
+	info := BaseBackupInfo{Name: "20250701T000000Z", Node: "node2"}
+	err := updateBackupStatus(store, "node2", func(b *ClusterBackupStatus) {
+		finishBackup(b, "node2", "2025-07-01T00:00:00Z", &info, nil)
+	})
+	require.NoError(t, err)
+
+	backup := store.state.Status.Backup
+	require.NotNil(t, backup)
+	assert.Empty(t, backup.InProgressNode)
+	assert.Equal(t, &info, backup.LastSuccess)
+	assert.Nil(t, backup.LastFailure)
+}
+
+func TestFinishBackup_RecordsFailure(t *testing.T) {
+	backup := ClusterBackupStatus{InProgressNode: "node2", InProgressSince: "2025-07-01T00:00:00Z"}
+	finishBackup(&backup, "node2", "2025-07-01T00:00:00Z", nil, errors.New("pg_basebackup failed"))
+
+	assert.Empty(t, backup.InProgressNode)
+	assert.Equal(t, &BackupFailure{Node: "node2", StartTime: "2025-07-01T00:00:00Z", Error: "pg_basebackup failed"}, backup.LastFailure)
+}
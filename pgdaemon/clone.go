@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+)
+
+// cloneSource is where a replica copies its data from when it has no
+// data directory or has to be re-cloned.
+type cloneSource struct {
+	method  CloneMethod
+	host    string
+	port    int
+	maxRate string
+
+	// fallbackReason explains why we clone from the primary even
+	// though the spec asks for something else.
+	fallbackReason string
+}
+
+// chooseCloneSource resolves the cluster's clone spec for nodeName. If
+// the spec can't be satisfied we fall back to cloning from the
+// primary, since a slow clone is better than no replica.
+func chooseCloneSource(spec ClusterSpec, status ClusterStatus, nodes []NodeStatus, nodeName string, port int, haveArchive bool) cloneSource {
+	source := cloneSource{method: CloneMethodPrimary, host: status.IntendedPrimary, port: port}
+	if spec.Clone == nil {
+		return source
+	}
+	source.maxRate = spec.Clone.MaxRate
+
+	switch spec.Clone.Method {
+	case CloneMethodReplica:
+		candidates := slices.DeleteFunc(healthyReplicas(spec, nodes, status), func(name string) bool {
+			return name == nodeName
+		})
+		if len(candidates) == 0 {
+			source.fallbackReason = "no healthy replica to clone from"
+			return source
+		}
+		source.method = CloneMethodReplica
+		source.host = candidates[0]
+		if slices.Contains(candidates, spec.Clone.SourceNode) {
+			source.host = spec.Clone.SourceNode
+		}
+	case CloneMethodBackup:
+		if !haveArchive {
+			source.fallbackReason = "cloning from a backup needs an -archive-url"
+			return source
+		}
+		source.method = CloneMethodBackup
+		source.host = ""
+	}
+	return source
+}
+
+// cloneDataDir creates the data directory from source.
+func (p *PostgresNode) cloneDataDir(ctx context.Context, source cloneSource, user string) error {
+	if source.fallbackReason != "" {
+		log.Printf("Cloning from primary %s instead: %s", source.host, source.fallbackReason)
+	}
+
+	if source.method == CloneMethodBackup {
+		return p.cloneFromBackup(ctx)
+	}
+	return p.cloneWithPgBasebackup(source.host, source.port, user, source.maxRate)
+}
+
+func (p *PostgresNode) cloneWithPgBasebackup(host string, port int, user string, maxRate string) error {
+	log.Printf("Initializing replica from %s database in %s", host, p.dataDir)
+
+	args := []string{"-d", p.security.peerConninfo(host, port, user), "-D", p.dataDir, "--progress"}
+	if maxRate != "" {
+		args = append(args, "--max-rate", maxRate)
+	}
+	cmd := exec.Command(p.pgBin("pg_basebackup"), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to initialize replica database: %w", err)
+	}
+
+	// N.B. pg_basebackup copies all .conf files as well
+	return nil
+}
+
+// cloneFromBackup restores the latest base backup from the archive.
+// Once Postgres starts as a standby it replays archived WAL with
+// restore_command, then streams from its upstream. It has no
+// walreceiver until then, which ensureWalReceiverConnected allows for.
+func (p *PostgresNode) cloneFromBackup(ctx context.Context) error {
+	backups, err := listBaseBackups(ctx, p.archive)
+	if err != nil {
+		return err
+	}
+	backup, err := selectBaseBackup(backups, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Initializing replica from base backup %s in %s", backup.Name, p.dataDir)
+
+	// Extract next to PGDATA and rename it into place, so a failed
+	// download doesn't leave a PGDATA that looks initialized.
+	tmpDir := p.dataDir + ".pgdaemon-clone"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+	}
+	if err := os.Mkdir(tmpDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpDir, err)
+	}
+	if err := downloadAndExtract(ctx, p.archive, baseBackupTarKey(backup.Name), tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	// PGDATA may exist but be empty, e.g. after a failed pg_basebackup.
+	if err := os.Remove(p.dataDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove empty %s: %w", p.dataDir, err)
+	}
+	if err := os.Rename(tmpDir, p.dataDir); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", tmpDir, err)
+	}
+	return nil
+}
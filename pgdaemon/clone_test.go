@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseCloneSource(t *testing.T) {
+	streaming := &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"}
+	status := ClusterStatus{
+		IntendedPrimary:  "node1",
+		IntendedReplicas: []string{"node2", "node3", "node4"},
+	}
+	nodes := []NodeStatus{
+		{Name: "node1", IsPrimary: true},
+		{Name: "node2", ReplicationStatus: streaming},
+		{Name: "node3", ReplicationStatus: streaming},
+		{Name: "node4"},
+	}
+
+	// Default is the primary
+	source := chooseCloneSource(ClusterSpec{}, status, nodes, "node4", 5432, false)
+	assert.Equal(t, cloneSource{method: CloneMethodPrimary, host: "node1", port: 5432}, source)
+
+	// A chosen healthy replica
+	spec := ClusterSpec{Clone: &CloneSpec{Method: CloneMethodReplica, SourceNode: "node3", MaxRate: "50M"}}
+	source = chooseCloneSource(spec, status, nodes, "node4", 5432, false)
+	assert.Equal(t, cloneSource{method: CloneMethodReplica, host: "node3", port: 5432, maxRate: "50M"}, source)
+
+	// Any healthy replica if the chosen one isn't healthy, but never
+	// ourselves
+	spec.Clone.SourceNode = "node4"
+	source = chooseCloneSource(spec, status, nodes, "node2", 5432, false)
+	assert.Equal(t, "node3", source.host)
+
+	// Fall back to the primary without a healthy replica
+	source = chooseCloneSource(spec, status, nodes[:2], "node2", 5432, false)
+	assert.Equal(t, CloneMethodPrimary, source.method)
+	assert.Equal(t, "node1", source.host)
+	assert.Equal(t, "no healthy replica to clone from", source.fallbackReason)
+
+	// Backups need an archive
+	spec = ClusterSpec{Clone: &CloneSpec{Method: CloneMethodBackup}}
+	source = chooseCloneSource(spec, status, nodes, "node4", 5432, true)
+	assert.Equal(t, CloneMethodBackup, source.method)
+	source = chooseCloneSource(spec, status, nodes, "node4", 5432, false)
+	assert.Equal(t, CloneMethodPrimary, source.method)
+	assert.NotEmpty(t, source.fallbackReason)
+}
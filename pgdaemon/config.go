@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 type config struct {
@@ -27,11 +28,53 @@ type config struct {
 	pgBouncerHost string
 	pgBouncerPort int
 
+	serviceManager  string
+	pgDataDir       string
+	pgBinDir        string
+	postgresUnit    string
+	pgBouncerUnit   string
+	postgresLogFile string
+	pgBouncerBin    string
+	pgBouncerConfig string
+
 	listenAddress string
 
+	// primaryStatusMaxAge is how recently we must have seen a cluster
+	// status naming us the intended primary for /primary to pass.
+	primaryStatusMaxAge time.Duration
+	primaryFailOpen     bool
+
+	healthProbeInterval time.Duration
+	healthProbeMaxAge   time.Duration
+
+	adminTokenFile string
+
 	wakeupPort int
 
+	archiveURL        string
+	archiveS3Endpoint string
+	backupInterval    time.Duration
+	backupRetention   int
+
+	replicationUser         string
+	replicationPasswordFile string
+	pgUserPasswordFile      string
+	tlsCert                 string
+	tlsKey                  string
+	tlsCA                   string
+	tlsCAKey                string
+
+	newPgBinDir     string
+	newPostgresUnit string
+
+	targetCluster   string
+	publication     string
+	logicalDatabase string
+
 	targetPrimary string
+	specFile      string
+	targetNode    string
+	targetTime    string
 }
 
 func parseFlags() config {
@@ -47,16 +90,70 @@ func parseFlags() config {
 	pbHost := flag.String("pgbouncer-host", "127.0.0.1", "PgBouncer host")
 	pbPort := flag.Int("pgbouncer-port", 6432, "PgBouncer port")
 	pgUser := flag.String("pguser", "postgres", "PostgreSQL user")
+	serviceManager := flag.String("service-manager", "systemd", "How to manage Postgres and PgBouncer (systemd or direct)")
+	pgDataDir := flag.String("pgdata", "/var/lib/postgres/data", "PostgreSQL data directory")
+	pgBinDir := flag.String("pg-bin-dir", "", "Directory containing PostgreSQL binaries (default: use $PATH)")
+	postgresUnit := flag.String("postgres-unit", "postgresql.service", "systemd unit for PostgreSQL (with -service-manager systemd)")
+	pgBouncerUnit := flag.String("pgbouncer-unit", "pgbouncer.service", "systemd unit for PgBouncer (with -service-manager systemd)")
+	postgresLogFile := flag.String("postgres-log-file", "", "PostgreSQL server log file (with -service-manager direct)")
+	pgBouncerBin := flag.String("pgbouncer-bin", "pgbouncer", "PgBouncer binary (with -service-manager direct)")
+	pgBouncerConfig := flag.String("pgbouncer-config", "/etc/pgbouncer/pgbouncer.ini", "PgBouncer config file")
 	listenAddress := flag.String("listen", "0.0.0.0:8080", "Address to listen on")
+	primaryStatusMaxAge := flag.Duration("primary-status-max-age", 10*time.Second, "How recently /primary must have seen a cluster status naming this node the intended primary")
+	primaryFailOpen := flag.Bool("primary-fail-open", false, "Pass /primary on a local primary even if the cluster status is older than -primary-status-max-age, e.g. because the state store is unreachable")
+	healthProbeInterval := flag.Duration("health-probe-interval", 1*time.Second, "How often to check Postgres through PgBouncer for the health check endpoints")
+	healthProbeMaxAge := flag.Duration("health-probe-max-age", 5*time.Second, "Fail health checks if the last probe is older than this")
+	adminTokenFile := flag.String("admin-token-file", "", "File with the bearer token for the /admin API (default: admin API disabled)")
 	wakeupPort := flag.Int("wakeup-port", 9090, "UDP port for wakeup packets (0 to disable)")
 	targetPrimary := flag.String("target-primary", "", "Target primary node for manual failover (optional)")
+	specFile := flag.String("spec-file", "", "JSON cluster spec file for set-spec (- for stdin)")
+	targetNode := flag.String("node", "", "Node to operate on for node commands like pause-replay")
+	targetTime := flag.String("target-time", "", "RFC 3339 time to replay up to (fast-forward-replay) or recover to (restore)")
+	archiveURL := flag.String("archive-url", "", "Where to archive WAL and base backups: a directory, file:///path, or s3://bucket/prefix (default: archiving disabled)")
+	archiveS3Endpoint := flag.String("archive-s3-endpoint", "", "Endpoint for an S3-compatible archive like MinIO")
+	backupInterval := flag.Duration("backup-interval", 0, "How often to take a base backup from a replica into -archive-url (0 to disable)")
+	backupRetention := flag.Int("backup-retention", 7, "Number of base backups to keep, along with the WAL they need")
+	replicationUser := flag.String("replication-user", "replicator", "Role that nodes use to replicate from each other when a replication password is set")
+	replicationPasswordFile := flag.String("replication-password-file", "", "File with the replication role's password (default: $"+replicationPasswordEnv+", or no password)")
+	pgUserPasswordFile := flag.String("pguser-password-file", "", "File with -pguser's password, which the auth spec requires (default: $"+pgUserPasswordEnv+", or no password)")
+	tlsCert := flag.String("tls-cert", "", "Postgres server certificate (default: generate one if -tls-ca-key is set)")
+	tlsKey := flag.String("tls-key", "", "Postgres server certificate key")
+	tlsCA := flag.String("tls-ca", "", "CA certificate that signs every node's server certificate, used for sslmode=verify-full (default: TLS disabled)")
+	tlsCAKey := flag.String("tls-ca-key", "", "CA key used to generate a server certificate if -tls-cert isn't given")
+	newPgBinDir := flag.String("new-bin-dir", "", "Directory containing the new PostgreSQL binaries for upgrade")
+	newPostgresUnit := flag.String("new-postgres-unit", "", "systemd unit for the new PostgreSQL version for upgrade (default: keep -postgres-unit)")
+	targetCluster := flag.String("target-cluster", "", "Cluster name of the target cluster for the logical-* commands")
+	publication := flag.String("publication", "pgdaemon_migration", "Name of the publication, subscription, and replication slot for the logical-* commands")
+	logicalDatabase := flag.String("database", "postgres", "Database to replicate with the logical-* commands")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: pgdaemon [command] [options]\n")
 		fmt.Fprintln(os.Stderr, "Commands:")
 		fmt.Fprintln(os.Stderr, "  daemon        Start the main daemon")
 		fmt.Fprintln(os.Stderr, "  show-cluster  Show current cluster state")
+		fmt.Fprintln(os.Stderr, "  set-spec      Replace the cluster spec with -spec-file")
 		fmt.Fprintln(os.Stderr, "  failover      Perform failover to -target-primary or any replica if unspecified")
+		fmt.Fprintln(os.Stderr, "  promote-cluster")
+		fmt.Fprintln(os.Stderr, "                Turn a standby cluster into a normal cluster")
+		fmt.Fprintln(os.Stderr, "  upgrade       Upgrade the cluster to the major version in -new-bin-dir")
+		fmt.Fprintln(os.Stderr, "  logical-setup Logically replicate -database into the primary of -target-cluster,")
+		fmt.Fprintln(os.Stderr, "                which must already have the schema")
+		fmt.Fprintln(os.Stderr, "  logical-status")
+		fmt.Fprintln(os.Stderr, "                Show the logical replication lag to -target-cluster")
+		fmt.Fprintln(os.Stderr, "  logical-cutover")
+		fmt.Fprintln(os.Stderr, "                Freeze writes, wait for -target-cluster to catch up, sync")
+		fmt.Fprintln(os.Stderr, "                sequences, and route this cluster's PgBouncers to it")
+		fmt.Fprintln(os.Stderr, "  pause-replay  Pause WAL replay on replica -node")
+		fmt.Fprintln(os.Stderr, "  resume-replay Resume WAL replay on replica -node, with its usual delay")
+		fmt.Fprintln(os.Stderr, "  fast-forward-replay")
+		fmt.Fprintln(os.Stderr, "                Replay delayed replica -node up to -target-time and pause")
+		fmt.Fprintln(os.Stderr, "  base-backup   Take a base backup of this node into -archive-url")
+		fmt.Fprintln(os.Stderr, "  restore       Restore a new primary into an empty -pgdata from -archive-url,")
+		fmt.Fprintln(os.Stderr, "                up to -target-time if given")
+		fmt.Fprintln(os.Stderr, "  archive-wal-push <path> <file>")
+		fmt.Fprintln(os.Stderr, "                Archive a WAL file (used in archive_command)")
+		fmt.Fprintln(os.Stderr, "  archive-wal-fetch <file> <path>")
+		fmt.Fprintln(os.Stderr, "                Fetch an archived WAL file (used in restore_command)")
 		fmt.Fprintln(os.Stderr, "Options:")
 		flag.PrintDefaults()
 	}
@@ -80,6 +177,11 @@ func parseFlags() config {
 		log.Fatal("Cluster name must be specified with -cluster-name")
 	}
 
+	if *backupRetention < 1 {
+		// Keeping zero backups would delete every backup we take
+		log.Fatalf("-backup-retention must be at least 1, got %d", *backupRetention)
+	}
+
 	return config{
 		command: command,
 
@@ -100,10 +202,50 @@ func parseFlags() config {
 		pgBouncerHost: *pbHost,
 		pgBouncerPort: *pbPort,
 
+		serviceManager:  *serviceManager,
+		pgDataDir:       *pgDataDir,
+		pgBinDir:        *pgBinDir,
+		postgresUnit:    *postgresUnit,
+		pgBouncerUnit:   *pgBouncerUnit,
+		postgresLogFile: *postgresLogFile,
+		pgBouncerBin:    *pgBouncerBin,
+		pgBouncerConfig: *pgBouncerConfig,
+
 		listenAddress: *listenAddress,
 
+		primaryStatusMaxAge: *primaryStatusMaxAge,
+		primaryFailOpen:     *primaryFailOpen,
+
+		healthProbeInterval: *healthProbeInterval,
+		healthProbeMaxAge:   *healthProbeMaxAge,
+
+		adminTokenFile: *adminTokenFile,
+
 		wakeupPort: *wakeupPort,
 
+		archiveURL:        *archiveURL,
+		archiveS3Endpoint: *archiveS3Endpoint,
+		backupInterval:    *backupInterval,
+		backupRetention:   *backupRetention,
+
+		replicationUser:         *replicationUser,
+		replicationPasswordFile: *replicationPasswordFile,
+		pgUserPasswordFile:      *pgUserPasswordFile,
+		tlsCert:                 *tlsCert,
+		tlsKey:                  *tlsKey,
+		tlsCA:                   *tlsCA,
+		tlsCAKey:                *tlsCAKey,
+
+		newPgBinDir:     *newPgBinDir,
+		newPostgresUnit: *newPostgresUnit,
+
+		targetCluster:   *targetCluster,
+		publication:     *publication,
+		logicalDatabase: *logicalDatabase,
+
 		targetPrimary: *targetPrimary,
+		specFile:      *specFile,
+		targetNode:    *targetNode,
+		targetTime:    *targetTime,
 	}
 }
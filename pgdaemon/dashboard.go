@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardUpdateInterval is how often the dashboard's event stream
+// sends a fresh state. The reconciler updates the cache about this
+// often anyway.
+const dashboardUpdateInterval = time.Second
+
+// dashboardState is what the dashboard renders: the cluster status and
+// nodes like show-cluster prints them, plus the cluster events from
+// the state store. The spec isn't included because it can hold connection
+// strings with passwords, and the dashboard isn't authenticated.
+type dashboardState struct {
+	ObservedBy string `json:"observed_by"`
+	Version    string `json:"version"`
+
+	ClusterStatus           *ClusterStatus `json:"cluster_status"`
+	ClusterStatusAgeSeconds *float64       `json:"cluster_status_age_seconds"`
+
+	Nodes  []dashboardNode `json:"nodes"`
+	Events []ClusterEvent  `json:"events"`
+}
+
+type dashboardNode struct {
+	NodeStatus
+
+	Role string `json:"role"`
+	// LagBytes is how far the node's WAL position is behind the
+	// intended primary's.
+	LagBytes             *int64  `json:"lag_bytes"`
+	LastChangeAgeSeconds float64 `json:"last_change_age_seconds"`
+	Alive                bool    `json:"alive"`
+}
+
+func newDashboardState(nodeName string, snapshot statusSnapshot, events []ClusterEvent) dashboardState {
+	state := dashboardState{
+		ObservedBy: nodeName,
+		Version:    buildVersion(),
+		Nodes:      []dashboardNode{},
+		Events:     events,
+	}
+	if state.Events == nil {
+		state.Events = []ClusterEvent{}
+	}
+	if snapshot.clusterAge < 0 {
+		return state
+	}
+
+	cluster := snapshot.cluster
+	state.ClusterStatus = &cluster.Status
+	state.ClusterStatusAgeSeconds = ageSeconds(snapshot.clusterAge)
+
+	var primaryPosition LSN
+	for _, node := range cluster.Nodes {
+		if node.Name == cluster.Status.IntendedPrimary {
+			primaryPosition = nodeWalPosition(node)
+		}
+	}
+
+	for _, node := range cluster.Nodes {
+		age := snapshot.peerAges[node.Name]
+		entry := dashboardNode{
+			NodeStatus:           node,
+			Role:                 nodeRole(node, cluster, node.Name),
+			LastChangeAgeSeconds: age.Seconds(),
+			Alive:                age <= peerLivenessTimeout,
+		}
+		if position := nodeWalPosition(node); node.Name != cluster.Status.IntendedPrimary && position > 0 && primaryPosition > 0 {
+			lag := int64(primaryPosition) - int64(position)
+			entry.LagBytes = &lag
+		}
+		state.Nodes = append(state.Nodes, entry)
+	}
+	slices.SortFunc(state.Nodes, func(a, b dashboardNode) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return state
+}
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// fetchDashboardEvents fetches the cluster events for the dashboard.
+// If the state store is unavailable the dashboard still shows what
+// the cache has, just without events.
+func fetchDashboardEvents(ctx context.Context, store StateStore) []ClusterEvent {
+	ctx, cancel := context.WithTimeout(ctx, dashboardUpdateInterval)
+	defer cancel()
+	events, err := store.FetchClusterEvents(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch cluster events for the dashboard: %v", err)
+		return nil
+	}
+	return events
+}
+
+func dashboardStateHandler(nodeName string, store StateStore, cache *StatusCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		events := fetchDashboardEvents(r.Context(), store)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(newDashboardState(nodeName, cache.Snapshot(time.Now()), events)); err != nil {
+			log.Printf("Failed to write dashboard state: %v", err)
+		}
+	}
+}
+
+// dashboardEventsHandler streams the dashboard state as server-sent
+// events until the client goes away or ctx is done, which lets the
+// server shut down without waiting for open dashboards.
+func dashboardEventsHandler(ctx context.Context, nodeName string, store StateStore, cache *StatusCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		ticker := time.NewTicker(dashboardUpdateInterval)
+		defer ticker.Stop()
+
+		for {
+			events := fetchDashboardEvents(r.Context(), store)
+			data, err := json.Marshal(newDashboardState(nodeName, cache.Snapshot(time.Now()), events))
+			if err != nil {
+				log.Printf("Failed to encode dashboard state: %v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
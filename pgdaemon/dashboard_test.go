@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDashboardState(t *testing.T) {
+	empty := newDashboardState("node1", statusSnapshot{nodeAge: -1, clusterAge: -1, cycleAge: -1}, nil)
+	assert.Equal(t, "node1", empty.ObservedBy)
+	assert.Nil(t, empty.ClusterStatus)
+	assert.Empty(t, empty.Nodes)
+	assert.NotNil(t, empty.Events)
+
+	primaryLsn, replayLsn := "0/3000000", "0/1000000"
+	state := newDashboardState("node1", statusSnapshot{
+		cluster: ClusterState{
+			Status: ClusterStatus{IntendedPrimary: "node1"},
+			Nodes: []NodeStatus{
+				{Name: "node2", ReplayLsn: &replayLsn},
+				{Name: "node1", IsPrimary: true, CurrentLsn: &primaryLsn},
+			},
+		},
+		clusterAge: time.Second,
+		peerAges:   map[string]time.Duration{"node1": time.Second, "node2": time.Minute},
+	}, []ClusterEvent{{Kind: ClusterEventPaused, Message: "Automatic failover paused"}})
+	require.NotNil(t, state.ClusterStatus)
+	assert.Equal(t, "node1", state.ClusterStatus.IntendedPrimary)
+	require.Len(t, state.Nodes, 2)
+
+	assert.Equal(t, "node1", state.Nodes[0].Name)
+	assert.Equal(t, "primary", state.Nodes[0].Role)
+	assert.Nil(t, state.Nodes[0].LagBytes)
+	assert.True(t, state.Nodes[0].Alive)
+
+	assert.Equal(t, "node2", state.Nodes[1].Name)
+	assert.Equal(t, "replica", state.Nodes[1].Role)
+	require.NotNil(t, state.Nodes[1].LagBytes)
+	assert.Equal(t, int64(0x2000000), *state.Nodes[1].LagBytes)
+	assert.False(t, state.Nodes[1].Alive)
+
+	assert.Len(t, state.Events, 1)
+}
+
+func TestDashboardHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	dashboardHandler(rec, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "dashboard/events")
+}
+
+func TestDashboardEventsHandler(t *testing.T) {
+	cache := NewStatusCache()
+	cache.SetCluster(ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1"},
+		Nodes:  []NodeStatus{{Name: "node1", IsPrimary: true}},
+	})
+	store := &memStore{}
+	require.NoError(t, store.RecordClusterEvents(context.Background(), []ClusterEvent{
+		{ID: "1", Time: "2024-01-01T00:00:00Z", Kind: ClusterEventPaused, Message: "Automatic failover paused"},
+	}))
+
+	// With ctx already done the handler sends one state and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rec := httptest.NewRecorder()
+	dashboardEventsHandler(ctx, "node1", store, cache)(rec, httptest.NewRequest(http.MethodGet, "/dashboard/events", nil))
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+
+	event, data, ok := strings.Cut(strings.TrimSpace(rec.Body.String()), "\n")
+	require.True(t, ok)
+	assert.Equal(t, "event: state", event)
+	data, ok = strings.CutPrefix(data, "data: ")
+	require.True(t, ok)
+
+	var state map[string]any
+	require.NoError(t, json.Unmarshal([]byte(data), &state))
+	assert.Equal(t, "node1", state["observed_by"])
+	nodes := state["nodes"].([]any)
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "primary", nodes[0].(map[string]any)["role"])
+	assert.Len(t, state["events"], 1)
+}
@@ -115,8 +115,7 @@ func (d *DynamoDBBackend) AtomicWriteClusterStatus(ctx context.Context, prevStat
 	if _, err := d.client.PutItem(ctx, &putItemInput); err != nil {
 		var conditionErr *types.ConditionalCheckFailedException
 		if errors.As(err, &conditionErr) {
-			log.Printf("Cluster status write condition failed, previous UUID may not match")
-			return nil
+			return ErrClusterStatusConflict
 		}
 		return fmt.Errorf("failed to write cluster status: %w", err)
 	}
@@ -145,6 +144,7 @@ func (d *DynamoDBBackend) WriteCurrentNodeStatus(ctx context.Context, status *No
 }
 
 func (d *DynamoDBBackend) SetClusterSpec(ctx context.Context, spec *ClusterSpec) error {
+	spec.SpecUuid = uuid.New()
 	value, err := attributevalue.MarshalMap(*spec)
 	if err != nil {
 		return fmt.Errorf("failed to marshal cluster spec: %w", err)
@@ -163,6 +163,43 @@ func (d *DynamoDBBackend) SetClusterSpec(ctx context.Context, spec *ClusterSpec)
 	return nil
 }
 
+func (d *DynamoDBBackend) AtomicWriteClusterSpec(ctx context.Context, prevSpecUUID uuid.UUID, spec ClusterSpec) error {
+	value, err := attributevalue.MarshalMap(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cluster spec: %w", err)
+	}
+	value["cluster_name"] = &types.AttributeValueMemberS{Value: d.clusterName}
+	value["key"] = &types.AttributeValueMemberS{Value: clusterSpecRangeKey}
+
+	putItemInput := dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item:      value,
+	}
+	if prevSpecUUID != uuid.Nil {
+		prevUuidAttr, err := attributevalue.Marshal(prevSpecUUID)
+		if err != nil {
+			return fmt.Errorf("failed to marshal previous spec UUID: %w", err)
+		}
+
+		putItemInput.ConditionExpression = aws.String("spec_uuid = :prev_uuid")
+		putItemInput.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":prev_uuid": prevUuidAttr,
+		}
+	} else {
+		putItemInput.ConditionExpression = aws.String("attribute_not_exists(spec_uuid)")
+	}
+
+	if _, err := d.client.PutItem(ctx, &putItemInput); err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return ErrClusterSpecConflict
+		}
+		return fmt.Errorf("failed to write cluster spec: %w", err)
+	}
+
+	return nil
+}
+
 func (d *DynamoDBBackend) FetchClusterState(ctx context.Context) (ClusterState, error) {
 	resp, err := d.client.Query(ctx, &dynamodb.QueryInput{
 		TableName:              aws.String(d.tableName),
@@ -217,3 +254,78 @@ func (d *DynamoDBBackend) FetchClusterState(ctx context.Context) (ClusterState,
 
 	return state, nil
 }
+
+// eventsPartition holds the cluster events, so that fetching the
+// cluster state doesn't read them too.
+func (d *DynamoDBBackend) eventsPartition() string {
+	return d.clusterName + "/events"
+}
+
+func (d *DynamoDBBackend) RecordClusterEvents(ctx context.Context, events []ClusterEvent) error {
+	for _, event := range events {
+		value, err := attributevalue.MarshalMap(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal cluster event: %w", err)
+		}
+		value["cluster_name"] = &types.AttributeValueMemberS{Value: d.eventsPartition()}
+		value["key"] = &types.AttributeValueMemberS{Value: event.ID}
+
+		// Keep the first copy if several nodes record the event
+		putItemInput := dynamodb.PutItemInput{
+			TableName:           aws.String(d.tableName),
+			Item:                value,
+			ConditionExpression: aws.String("attribute_not_exists(cluster_name)"),
+		}
+		if _, err := d.client.PutItem(ctx, &putItemInput); err != nil {
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				continue
+			}
+			return fmt.Errorf("failed to write cluster event to DynamoDB: %w", err)
+		}
+	}
+
+	stored, err := d.FetchClusterEvents(ctx)
+	if err != nil {
+		return err
+	}
+	for _, event := range excessClusterEvents(stored) {
+		_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.tableName),
+			Key: map[string]types.AttributeValue{
+				"cluster_name": &types.AttributeValueMemberS{Value: d.eventsPartition()},
+				"key":          &types.AttributeValueMemberS{Value: event.ID},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete old cluster event from DynamoDB: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDBBackend) FetchClusterEvents(ctx context.Context) ([]ClusterEvent, error) {
+	var events []ClusterEvent
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("cluster_name = :cluster_name"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":cluster_name": &types.AttributeValueMemberS{Value: d.eventsPartition()},
+		},
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query cluster events from DynamoDB: %w", err)
+		}
+		for _, item := range resp.Items {
+			var event ClusterEvent
+			if err := attributevalue.UnmarshalMap(item, &event); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal cluster event: %w", err)
+			}
+			events = append(events, event)
+		}
+	}
+	sortClusterEvents(events)
+	return events, nil
+}
@@ -33,6 +33,10 @@ func (etcd *EtcdBackend) clusterSpecPrefix() string {
 	return etcd.clusterPrefix() + "/spec"
 }
 
+func (etcd *EtcdBackend) clusterSpecUuidPrefix() string {
+	return etcd.clusterPrefix() + "/spec-uuid"
+}
+
 func (etcd *EtcdBackend) clusterStatusUuidPrefix() string {
 	return etcd.clusterPrefix() + "/status-uuid"
 }
@@ -49,6 +53,58 @@ func (etcd *EtcdBackend) nodeStatusPrefix(nodeName string) string {
 	return etcd.nodeStatusesPrefix() + "/" + nodeName
 }
 
+func (etcd *EtcdBackend) clusterEventsPrefix() string {
+	return etcd.clusterPrefix() + "/events"
+}
+
+func (etcd *EtcdBackend) RecordClusterEvents(ctx context.Context, events []ClusterEvent) error {
+	for _, event := range events {
+		eventBytes, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to marshal cluster event: %w", err)
+		}
+		// Keep the first copy if several nodes record the event
+		key := etcd.clusterEventsPrefix() + "/" + event.ID
+		_, err = etcd.client.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+		).Then(
+			clientv3.OpPut(key, string(eventBytes)),
+		).Commit()
+		if err != nil {
+			return fmt.Errorf("failed to write cluster event to etcd: %w", err)
+		}
+	}
+
+	stored, err := etcd.FetchClusterEvents(ctx)
+	if err != nil {
+		return err
+	}
+	for _, event := range excessClusterEvents(stored) {
+		if _, err := etcd.client.Delete(ctx, etcd.clusterEventsPrefix()+"/"+event.ID); err != nil {
+			return fmt.Errorf("failed to delete old cluster event from etcd: %w", err)
+		}
+	}
+	return nil
+}
+
+func (etcd *EtcdBackend) FetchClusterEvents(ctx context.Context) ([]ClusterEvent, error) {
+	resp, err := etcd.client.Get(ctx, etcd.clusterEventsPrefix()+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster events from etcd: %w", err)
+	}
+
+	events := make([]ClusterEvent, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var event ClusterEvent
+		if err := json.Unmarshal(kv.Value, &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal cluster event %s: %w", kv.Key, err)
+		}
+		events = append(events, event)
+	}
+	sortClusterEvents(events)
+	return events, nil
+}
+
 func (etcd *EtcdBackend) AtomicWriteClusterStatus(ctx context.Context, prevStatusUUID uuid.UUID, status ClusterStatus) error {
 	compare := clientv3.Compare(clientv3.CreateRevision(etcd.clusterStatusUuidPrefix()), "=", 0)
 	if prevStatusUUID != uuid.Nil {
@@ -61,7 +117,7 @@ func (etcd *EtcdBackend) AtomicWriteClusterStatus(ctx context.Context, prevStatu
 	}
 
 	txn := etcd.client.Txn(ctx)
-	_, err = txn.If(
+	resp, err := txn.If(
 		compare,
 	).Then(
 		clientv3.OpPut(etcd.clusterStatusUuidPrefix(), status.StatusUuid.String()),
@@ -70,6 +126,9 @@ func (etcd *EtcdBackend) AtomicWriteClusterStatus(ctx context.Context, prevStatu
 	if err != nil {
 		return fmt.Errorf("failed to commit cluster status transaction: %w", err)
 	}
+	if !resp.Succeeded {
+		return ErrClusterStatusConflict
+	}
 
 	return nil
 }
@@ -88,12 +147,17 @@ func (etcd *EtcdBackend) WriteCurrentNodeStatus(ctx context.Context, status *Nod
 }
 
 func (etcd *EtcdBackend) SetClusterSpec(ctx context.Context, spec *ClusterSpec) error {
+	spec.SpecUuid = uuid.New()
 	specBytes, err := json.Marshal(spec)
 	if err != nil {
 		return fmt.Errorf("failed to marshal cluster spec: %w", err)
 	}
 
-	if _, err := etcd.client.Put(ctx, etcd.clusterSpecPrefix(), string(specBytes)); err != nil {
+	_, err = etcd.client.Txn(ctx).Then(
+		clientv3.OpPut(etcd.clusterSpecUuidPrefix(), spec.SpecUuid.String()),
+		clientv3.OpPut(etcd.clusterSpecPrefix(), string(specBytes)),
+	).Commit()
+	if err != nil {
 		return fmt.Errorf("failed to write cluster spec to etcd: %w", err)
 	}
 
@@ -102,6 +166,35 @@ func (etcd *EtcdBackend) SetClusterSpec(ctx context.Context, spec *ClusterSpec)
 	return nil
 }
 
+func (etcd *EtcdBackend) AtomicWriteClusterSpec(ctx context.Context, prevSpecUUID uuid.UUID, spec ClusterSpec) error {
+	compare := clientv3.Compare(clientv3.CreateRevision(etcd.clusterSpecUuidPrefix()), "=", 0)
+	if prevSpecUUID != uuid.Nil {
+		compare = clientv3.Compare(clientv3.Value(etcd.clusterSpecUuidPrefix()), "=", prevSpecUUID.String())
+	}
+
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cluster spec: %w", err)
+	}
+
+	resp, err := etcd.client.Txn(ctx).If(
+		compare,
+	).Then(
+		clientv3.OpPut(etcd.clusterSpecUuidPrefix(), spec.SpecUuid.String()),
+		clientv3.OpPut(etcd.clusterSpecPrefix(), string(specBytes)),
+	).Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit cluster spec transaction: %w", err)
+	}
+	if !resp.Succeeded {
+		return ErrClusterSpecConflict
+	}
+
+	log.Printf("Cluster spec set: %s", string(specBytes))
+
+	return nil
+}
+
 func (etcd *EtcdBackend) FetchClusterState(ctx context.Context) (ClusterState, error) {
 	var state ClusterState
 
@@ -124,8 +217,10 @@ func (etcd *EtcdBackend) FetchClusterState(ctx context.Context) (ClusterState, e
 			if err := json.Unmarshal(kv.Value, &state.Status); err != nil {
 				return state, fmt.Errorf("failed to unmarshal cluster status: %w", err)
 			}
-		} else if string(kv.Key) == etcd.clusterStatusUuidPrefix() {
+		} else if string(kv.Key) == etcd.clusterSpecUuidPrefix() || string(kv.Key) == etcd.clusterStatusUuidPrefix() {
 			// Ignore status UUID key in cluster state. UUID is embedded in status.
+		} else if strings.HasPrefix(string(kv.Key), etcd.clusterEventsPrefix()+"/") {
+			// Events are fetched with FetchClusterEvents.
 		} else if strings.HasPrefix(string(kv.Key), etcd.nodeStatusesPrefix()) {
 			nodeName := strings.TrimPrefix(string(kv.Key), etcd.nodeStatusesPrefix()+"/")
 			var nodeStatus NodeStatus
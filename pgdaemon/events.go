@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// maxClusterEvents is how many events the state store keeps.
+const maxClusterEvents = 200
+
+// ClusterEvent is a notable change in the cluster, like a failover or
+// a node going down. Each daemon notices events by comparing the
+// cluster states it reconciles, and records them in the state store.
+type ClusterEvent struct {
+	// ID is derived from the status that the event is about, so
+	// daemons that notice the same change record it only once.
+	ID string `json:"id" dynamodbav:"id"`
+	// Time is when the first node to record the event noticed it.
+	// It orders events, but is otherwise purely for informational
+	// purposes.
+	Time    string           `json:"time" dynamodbav:"time"`
+	Kind    ClusterEventKind `json:"kind" dynamodbav:"kind"`
+	Node    string           `json:"node,omitempty" dynamodbav:"node,omitempty"`
+	Message string           `json:"message" dynamodbav:"message"`
+}
+
+type ClusterEventKind string
+
+const (
+	ClusterEventPrimaryChanged ClusterEventKind = "primary_changed"
+	ClusterEventFailoverState  ClusterEventKind = "failover_state"
+	ClusterEventHealthChanged  ClusterEventKind = "health_changed"
+	ClusterEventPaused         ClusterEventKind = "paused"
+	ClusterEventUpgrade        ClusterEventKind = "upgrade"
+	ClusterEventNodeJoined     ClusterEventKind = "node_joined"
+	ClusterEventNodeLeft       ClusterEventKind = "node_left"
+	ClusterEventNodeError      ClusterEventKind = "node_error"
+	ClusterEventNodeRecovered  ClusterEventKind = "node_recovered"
+	ClusterEventNodeRole       ClusterEventKind = "node_role"
+	ClusterEventNodeAction     ClusterEventKind = "node_action"
+)
+
+// diffClusterStates returns the events between two cluster states, in
+// a stable order. The events don't have a time yet.
+func diffClusterStates(old, new ClusterState) []ClusterEvent {
+	var events []ClusterEvent
+	// cause is the UUID of the status the event shows up in.
+	addFor := func(cause uuid.UUID, kind ClusterEventKind, node string, format string, args ...any) {
+		events = append(events, ClusterEvent{
+			ID:      clusterEventID(cause, kind, node),
+			Kind:    kind,
+			Node:    node,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	add := func(kind ClusterEventKind, node string, format string, args ...any) {
+		addFor(new.Status.StatusUuid, kind, node, format, args...)
+	}
+
+	oldStatus, newStatus := old.Status, new.Status
+	if oldStatus.IntendedPrimary != newStatus.IntendedPrimary {
+		add(ClusterEventPrimaryChanged, newStatus.IntendedPrimary, "Intended primary changed from %q to %q", oldStatus.IntendedPrimary, newStatus.IntendedPrimary)
+	}
+	if failoverStateOrStable(oldStatus.FailoverState) != failoverStateOrStable(newStatus.FailoverState) {
+		add(ClusterEventFailoverState, "", "Failover state changed from %s to %s", failoverStateOrStable(oldStatus.FailoverState), failoverStateOrStable(newStatus.FailoverState))
+	}
+	if oldStatus.Health != newStatus.Health {
+		message := fmt.Sprintf("Cluster is %s", newStatus.Health)
+		if len(newStatus.HealthReasons) > 0 {
+			message += ": " + newStatus.HealthReasons[0]
+		}
+		add(ClusterEventHealthChanged, "", "%s", message)
+	}
+	if oldStatus.Paused != newStatus.Paused {
+		if newStatus.Paused {
+			add(ClusterEventPaused, "", "Automatic failover paused")
+		} else {
+			add(ClusterEventPaused, "", "Automatic failover resumed")
+		}
+	}
+	if upgradePhase(oldStatus.Upgrade) != upgradePhase(newStatus.Upgrade) && newStatus.Upgrade != nil {
+		add(ClusterEventUpgrade, newStatus.Upgrade.Primary, "Major version upgrade is %s", newStatus.Upgrade.Phase)
+	}
+	for _, node := range slices.Sorted(maps.Keys(newStatus.NodeActions)) {
+		action := newStatus.NodeActions[node]
+		if oldStatus.NodeActions[node] != action {
+			add(ClusterEventNodeAction, node, "Requested %s of %s", action.Action, node)
+		}
+	}
+	for _, node := range slices.Sorted(maps.Keys(oldStatus.NodeActions)) {
+		if _, ok := newStatus.NodeActions[node]; !ok {
+			add(ClusterEventNodeAction, node, "Finished %s of %s", oldStatus.NodeActions[node].Action, node)
+		}
+	}
+
+	oldNodes := make(map[string]NodeStatus, len(old.Nodes))
+	for _, node := range old.Nodes {
+		oldNodes[node.Name] = node
+	}
+	newNames := make(map[string]bool, len(new.Nodes))
+	for _, node := range new.Nodes {
+		newNames[node.Name] = true
+		prev, ok := oldNodes[node.Name]
+		switch {
+		case !ok:
+			addFor(node.StatusUuid, ClusterEventNodeJoined, node.Name, "Node %s joined the cluster", node.Name)
+		case prev.Error == nil && node.Error != nil:
+			addFor(node.StatusUuid, ClusterEventNodeError, node.Name, "%s: %s", nodeErrorReason(node).message, *node.Error)
+		case prev.Error != nil && node.Error == nil:
+			addFor(node.StatusUuid, ClusterEventNodeRecovered, node.Name, "Node %s recovered", node.Name)
+		}
+		if ok && node.Error == nil && prev.IsPrimary != node.IsPrimary {
+			if node.IsPrimary {
+				addFor(node.StatusUuid, ClusterEventNodeRole, node.Name, "Node %s is now a primary", node.Name)
+			} else {
+				addFor(node.StatusUuid, ClusterEventNodeRole, node.Name, "Node %s is now a replica", node.Name)
+			}
+		}
+	}
+	for _, node := range old.Nodes {
+		if !newNames[node.Name] {
+			addFor(node.StatusUuid, ClusterEventNodeLeft, node.Name, "Node %s left the cluster", node.Name)
+		}
+	}
+
+	return events
+}
+
+// clusterEventID identifies the event of kind about node that shows
+// up in the cluster or node status with UUID cause. A daemon that
+// misses the status, e.g. because a reconciliation cycle took long,
+// notices the change in a later one, so it can still record the same
+// event twice.
+func clusterEventID(cause uuid.UUID, kind ClusterEventKind, node string) string {
+	id := cause.String() + "-" + string(kind)
+	if node != "" {
+		id += "-" + node
+	}
+	return id
+}
+
+// sortClusterEvents sorts events oldest first.
+func sortClusterEvents(events []ClusterEvent) {
+	slices.SortStableFunc(events, func(a, b ClusterEvent) int {
+		return cmp.Or(cmp.Compare(a.Time, b.Time), cmp.Compare(a.ID, b.ID))
+	})
+}
+
+// excessClusterEvents returns the oldest of events, which must be
+// sorted, beyond the maxClusterEvents that the state store keeps.
+func excessClusterEvents(events []ClusterEvent) []ClusterEvent {
+	return events[:max(len(events)-maxClusterEvents, 0)]
+}
+
+func failoverStateOrStable(state FailoverState) FailoverState {
+	if state == "" {
+		return FailoverStateStable
+	}
+	return state
+}
+
+func upgradePhase(upgrade *ClusterUpgradeStatus) UpgradePhase {
+	if upgrade == nil {
+		return ""
+	}
+	return upgrade.Phase
+}
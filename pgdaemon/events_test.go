@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffClusterStates_Failover(t *testing.T) {
+	connErr := "connection refused"
+	old := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1", Health: ClusterHealthHealthy},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true},
+			{Name: "node2"},
+		},
+	}
+	new := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node2",
+			Health:          ClusterHealthUnhealthy,
+			HealthReasons:   []string{"Node node1 cannot connect to Postgres"},
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", Error: &connErr, ErrorKind: NodeErrorConnection},
+			{Name: "node2", IsPrimary: true},
+		},
+	}
+
+	events := diffClusterStates(old, new)
+	kinds := make([]ClusterEventKind, len(events))
+	for i, event := range events {
+		kinds[i] = event.Kind
+	}
+	assert.Equal(t, []ClusterEventKind{
+		ClusterEventPrimaryChanged,
+		ClusterEventHealthChanged,
+		ClusterEventNodeError,
+		ClusterEventNodeRole,
+	}, kinds)
+	assert.Equal(t, `Intended primary changed from "node1" to "node2"`, events[0].Message)
+	assert.Equal(t, "Cluster is unhealthy: Node node1 cannot connect to Postgres", events[1].Message)
+	assert.Equal(t, "Node node1 cannot connect to Postgres: connection refused", events[2].Message)
+	assert.Equal(t, "node2", events[3].Node)
+}
+
+func TestDiffClusterStates_NodesAndActions(t *testing.T) {
+	old := ClusterState{
+		Status: ClusterStatus{NodeActions: map[string]NodeAction{
+			"node2": {Action: NodeActionRestart, RequestedAt: "2024-01-01T00:00:00Z"},
+		}},
+		Nodes: []NodeStatus{{Name: "node1"}, {Name: "node2"}},
+	}
+	new := ClusterState{
+		Status: ClusterStatus{
+			Paused: true,
+			NodeActions: map[string]NodeAction{
+				"node1": {Action: NodeActionReinitialize, RequestedAt: "2024-01-01T00:01:00Z"},
+			},
+		},
+		Nodes: []NodeStatus{{Name: "node1"}, {Name: "node3"}},
+	}
+
+	events := diffClusterStates(old, new)
+	messages := make([]string, len(events))
+	for i, event := range events {
+		messages[i] = event.Message
+	}
+	assert.Equal(t, []string{
+		"Automatic failover paused",
+		"Requested reinitialize of node1",
+		"Finished restart of node2",
+		"Node node3 joined the cluster",
+		"Node node2 left the cluster",
+	}, messages)
+
+	assert.Empty(t, diffClusterStates(new, new))
+}
+
+func TestStatusCache_Events(t *testing.T) {
+	cache := NewStatusCache()
+	state := ClusterState{Status: ClusterStatus{IntendedPrimary: "node1", StatusUuid: uuid.New()}}
+
+	// The first state we see is the baseline, not an event
+	assert.Empty(t, cache.SetCluster(state))
+
+	state.Status.Paused = true
+	state.Status.StatusUuid = uuid.New()
+	state.Nodes = []NodeStatus{{Name: "node2", StatusUuid: uuid.New()}}
+	events := cache.SetCluster(state)
+	require.Len(t, events, 2)
+	assert.Equal(t, clusterEventID(state.Status.StatusUuid, ClusterEventPaused, ""), events[0].ID)
+	assert.Equal(t, clusterEventID(state.Nodes[0].StatusUuid, ClusterEventNodeJoined, "node2"), events[1].ID)
+	assert.Less(t, events[0].Time, events[1].Time)
+
+	assert.Empty(t, cache.SetCluster(state))
+}
+
+func TestRecordClusterEvents(t *testing.T) {
+	store := &memStore{}
+	state := ClusterState{Status: ClusterStatus{IntendedPrimary: "node1", StatusUuid: uuid.New()}}
+
+	// Every daemon notices the same changes, but each is stored once
+	caches := []*StatusCache{NewStatusCache(), NewStatusCache()}
+	for _, cache := range caches {
+		cache.SetCluster(state)
+	}
+	for i := range maxClusterEvents + 10 {
+		state.Status.Paused = i%2 == 0
+		state.Status.StatusUuid = uuid.New()
+		for _, cache := range caches {
+			require.NoError(t, store.RecordClusterEvents(t.Context(), cache.SetCluster(state)))
+		}
+	}
+
+	events, err := store.FetchClusterEvents(t.Context())
+	require.NoError(t, err)
+	require.Len(t, events, maxClusterEvents)
+	assert.NotEmpty(t, events[0].Time)
+	assert.Equal(t, "Automatic failover resumed", events[len(events)-1].Message)
+	assert.Equal(t, clusterEventID(state.Status.StatusUuid, ClusterEventPaused, ""), events[len(events)-1].ID)
+}
@@ -2,16 +2,63 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func runHealthCheckServer(ctx context.Context, conf config, pgNode *PostgresNode) error {
+// livenessTimeout is how long the reconciler can go without finishing
+// a cycle before /liveness fails, and how old the cached node status
+// can be before the lag checks stop trusting it. Like Patroni's TTL,
+// this has to cover slow cycles like cloning a replica.
+const livenessTimeout = 30 * time.Second
+
+func runHealthCheckServer(ctx context.Context, conf config, store StateStore, prober *HealthProber, cache *StatusCache, metrics *Metrics) error {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/health", healthCheck(false, pgNode))
-	mux.HandleFunc("/primary", healthCheck(true, pgNode))
+	mux.HandleFunc("/health", healthCheckMethods(healthCheck(false, conf, prober, cache)))
+	mux.HandleFunc("/primary", healthCheckMethods(healthCheck(true, conf, prober, cache)))
+
+	// Patroni's endpoints, so load balancer configs and tooling
+	// written for Patroni work unchanged. /master is Patroni's old
+	// name for /primary.
+	mux.HandleFunc("/master", healthCheckMethods(healthCheck(true, conf, prober, cache)))
+	for path, role := range map[string]roleCheck{
+		"/leader":         roleCheckLeader,
+		"/replica":        roleCheckReplica,
+		"/read-only":      roleCheckReadOnly,
+		"/standby-leader": roleCheckStandbyLeader,
+		"/standby_leader": roleCheckStandbyLeader,
+		"/sync":           roleCheckSync,
+		"/synchronous":    roleCheckSync,
+		"/async":          roleCheckAsync,
+		"/asynchronous":   roleCheckAsync,
+		"/readiness":      roleCheckReadiness,
+	} {
+		mux.HandleFunc(path, healthCheckMethods(roleHealthCheck(role, conf, prober, cache)))
+	}
+	mux.HandleFunc("/liveness", healthCheckMethods(livenessCheck(cache)))
+
+	mux.HandleFunc("GET /metrics", metricsHandler(conf.nodeName, cache, metrics))
+	mux.HandleFunc("GET /status", statusHandler(conf.nodeName, cache))
+
+	mux.HandleFunc("GET /dashboard", dashboardHandler)
+	mux.HandleFunc("GET /dashboard/state", dashboardStateHandler(conf.nodeName, store, cache))
+	mux.HandleFunc("GET /dashboard/events", dashboardEventsHandler(ctx, conf.nodeName, store, cache))
+
+	if conf.adminTokenFile != "" {
+		token, err := readAdminToken(conf.adminTokenFile)
+		if err != nil {
+			return err
+		}
+		newAdminAPI(store, conf.nodeName, token).register(mux)
+	}
 
 	srv := &http.Server{
 		Addr:    conf.listenAddress,
@@ -29,21 +76,430 @@ func runHealthCheckServer(ctx context.Context, conf config, pgNode *PostgresNode
 	return srv.ListenAndServe()
 }
 
-func healthCheck(checkPrimary bool, pgNode *PostgresNode) func(w http.ResponseWriter, r *http.Request) {
+// healthCheckMethods accepts the methods load balancers use for health
+// checks: GET, HEAD, and OPTIONS (HAProxy's default).
+func healthCheckMethods(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			handler(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// probeResponse is the body of GET requests to /health and /primary.
+type probeResponse struct {
+	IsPrimary bool `json:"is_primary"`
+	// AgeSeconds is how old the background probe's result is.
+	AgeSeconds *float64 `json:"age_seconds"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func healthCheck(checkPrimary bool, conf config, prober *HealthProber, cache *StatusCache) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// N.B. Check health through pgbouncer to ensure that is working
-		isPrimary, err := CheckIsPrimary(pgNode.pgBouncerPool)
+		limits, err := parseReplicaLagLimits(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// N.B. The prober checks health through pgbouncer to ensure
+		// that is working
+		now := time.Now()
+		probe := prober.Result(now)
+		response := probeResponse{IsPrimary: probe.isPrimary}
+		if probe.age >= 0 {
+			response.AgeSeconds = ageSeconds(probe.age)
+		}
+
+		err = probe.healthy(conf.healthProbeMaxAge)
+		if err == nil && checkPrimary && !probe.isPrimary {
+			err = fmt.Errorf("not a primary")
+		}
+
+		// Postgres alone can't tell us if another node was promoted
+		// while we were cut off, so also require that the cluster
+		// agrees we are the primary.
+		if err == nil && checkPrimary {
+			snapshot := cache.Snapshot(now)
+			err = checkIntendedPrimary(snapshot, conf.nodeName, conf.primaryStatusMaxAge, conf.primaryFailOpen)
+		}
+
+		if err == nil && !probe.isPrimary && limits.set() {
+			snapshot := cache.Snapshot(now)
+			if snapshot.nodeAge < 0 || snapshot.nodeAge > livenessTimeout {
+				err = fmt.Errorf("node status is stale")
+			} else {
+				err = checkReplicaLag(limits, snapshot.node, snapshot.cluster, conf.nodeName, now)
+			}
+		}
 
 		status := http.StatusOK
 		if err != nil {
-			log.Printf("/health failed: %v", err)
 			status = http.StatusServiceUnavailable
+			response.Error = err.Error()
 		}
+		writeHealthResponse(w, r, status, response)
+	}
+}
 
-		if checkPrimary && !isPrimary {
-			status = http.StatusServiceUnavailable
+// checkIntendedPrimary returns an error unless the last cluster status
+// we fetched names us the intended primary and is at most maxAge old.
+// If failOpen is set, a stale or missing status is fine, but a status
+// naming another node never is.
+func checkIntendedPrimary(snapshot statusSnapshot, nodeName string, maxAge time.Duration, failOpen bool) error {
+	if snapshot.statusAge < 0 {
+		if failOpen {
+			return nil
+		}
+		return fmt.Errorf("haven't seen a cluster status yet")
+	}
+	if intended := snapshot.status.IntendedPrimary; intended != nodeName {
+		return fmt.Errorf("intended primary is %q, not this node", intended)
+	}
+	if snapshot.statusAge > maxAge && !failOpen {
+		return fmt.Errorf("last cluster status is %s old, more than %s", snapshot.statusAge.Round(time.Millisecond), maxAge)
+	}
+	return nil
+}
+
+type roleCheck string
+
+const (
+	// roleCheckLeader passes on the primary and on a standby leader.
+	roleCheckLeader roleCheck = "leader"
+	// roleCheckReplica passes on replicas, but not a standby leader.
+	roleCheckReplica roleCheck = "replica"
+	// roleCheckReadOnly passes on any node that can serve reads,
+	// including the primary.
+	roleCheckReadOnly      roleCheck = "read-only"
+	roleCheckStandbyLeader roleCheck = "standby-leader"
+	// roleCheckSync and roleCheckAsync pass on replicas that their
+	// upstream reports as synchronous or asynchronous.
+	roleCheckSync  roleCheck = "sync"
+	roleCheckAsync roleCheck = "async"
+	// roleCheckReadiness passes once Postgres is up and running.
+	roleCheckReadiness roleCheck = "readiness"
+)
+
+// acceptsLagLimits is true for the endpoints that route reads to
+// replicas, which take the ?lag= and ?max_replay_delay= parameters.
+func (c roleCheck) acceptsLagLimits() bool {
+	switch c {
+	case roleCheckReplica, roleCheckReadOnly, roleCheckSync, roleCheckAsync:
+		return true
+	default:
+		return false
+	}
+}
+
+// nodeRole is the role we report, using Patroni's names.
+func nodeRole(node NodeStatus, cluster ClusterState, nodeName string) string {
+	switch {
+	case node.IsPrimary:
+		return "primary"
+	case cluster.Status.IntendedPrimary == nodeName && cluster.Status.StandbyLeaderUpstream != "":
+		return "standby_leader"
+	default:
+		return "replica"
+	}
+}
+
+// replicaSyncState is how this node's upstream reports it in
+// pg_stat_replication, e.g. "sync", "quorum", or "async". It is empty
+// if the upstream doesn't list us.
+func replicaSyncState(cluster ClusterState, nodeName string) string {
+	upstream := cluster.Status.UpstreamFor(nodeName)
+	idx := slices.IndexFunc(cluster.Nodes, func(node NodeStatus) bool { return node.Name == upstream })
+	if idx < 0 {
+		return ""
+	}
+	for _, replica := range cluster.Nodes[idx].Replicas {
+		// client_hostname may be fully qualified
+		if replica.Hostname != nodeName && !strings.HasPrefix(replica.Hostname, nodeName+".") {
+			continue
+		}
+		if replica.SyncState != nil {
+			return *replica.SyncState
+		}
+	}
+	return ""
+}
+
+// evaluateRoleCheck decides a role endpoint from the cached status.
+// Postgres must be running and reachable through PgBouncer, since
+// that is where load balancers send clients.
+func evaluateRoleCheck(check roleCheck, node NodeStatus, cluster ClusterState, nodeName string) bool {
+	if node.Error != nil {
+		return false
+	}
+
+	role := nodeRole(node, cluster, nodeName)
+	switch check {
+	case roleCheckLeader:
+		// Like /primary, don't vouch for a primary that the cluster
+		// has moved on from.
+		isIntended := cluster.Status.IntendedPrimary == nodeName
+		return (role == "primary" && isIntended) || role == "standby_leader"
+	case roleCheckReplica:
+		return role == "replica"
+	case roleCheckReadOnly, roleCheckReadiness:
+		return true
+	case roleCheckStandbyLeader:
+		return role == "standby_leader"
+	case roleCheckSync, roleCheckAsync:
+		if role != "replica" {
+			return false
+		}
+		syncState := replicaSyncState(cluster, nodeName)
+		isSync := syncState == "sync" || syncState == "quorum"
+		return isSync == (check == roleCheckSync)
+	default:
+		return false
+	}
+}
+
+// healthResponse is the body of GET requests, with the same keys as
+// Patroni where they overlap.
+type healthResponse struct {
+	State         string `json:"state"`
+	Role          string `json:"role,omitempty"`
+	ServerVersion int    `json:"server_version,omitempty"`
+	Timeline      uint32 `json:"timeline,omitempty"`
+	SyncState     string `json:"sync_state,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// probedNode is the cached node status, with the prober's view of
+// whether Postgres is reachable and a primary. The prober runs on its
+// own schedule, so it is fresher than the reconciler's status.
+func probedNode(probe healthProbe, node NodeStatus) NodeStatus {
+	node.IsPrimary = probe.isPrimary
+	node.Error = nil
+	if probe.err != nil {
+		errStr := probe.err.Error()
+		node.Error = &errStr
+	}
+	return node
+}
+
+// newHealthResponse describes node, which must come from probedNode.
+// The state is unknown if the probe is older than maxAge.
+func newHealthResponse(probe healthProbe, maxAge time.Duration, node NodeStatus, cluster ClusterState, nodeName string) healthResponse {
+	if probe.age < 0 || probe.age > maxAge {
+		return healthResponse{State: "unknown"}
+	}
+	response := healthResponse{
+		State:         "running",
+		Role:          nodeRole(node, cluster, nodeName),
+		ServerVersion: node.ServerVersionNum,
+		Timeline:      node.TimelineID,
+	}
+	if node.Error != nil {
+		response.State = "stopped"
+		response.Error = *node.Error
+	}
+	if response.Role == "replica" {
+		response.SyncState = replicaSyncState(cluster, nodeName)
+	}
+	return response
+}
+
+// roleHealthCheck serves a Patroni role endpoint. Like /health, it
+// goes by the prober and -health-probe-max-age, so a slow
+// reconciliation cycle doesn't fail it. Lag limits need the cached node
+// status, which is updated less often.
+func roleHealthCheck(check roleCheck, conf config, prober *HealthProber, cache *StatusCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var limits replicaLagLimits
+		if check.acceptsLagLimits() {
+			var err error
+			if limits, err = parseReplicaLagLimits(r.URL.Query()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		now := time.Now()
+		probe := prober.Result(now)
+		snapshot := cache.Snapshot(now)
+		node := probedNode(probe, snapshot.node)
+		response := newHealthResponse(probe, conf.healthProbeMaxAge, node, snapshot.cluster, conf.nodeName)
+
+		status := http.StatusServiceUnavailable
+		if probe.healthy(conf.healthProbeMaxAge) == nil && evaluateRoleCheck(check, node, snapshot.cluster, conf.nodeName) {
+			status = http.StatusOK
+			var err error
+			if limits.set() && (snapshot.nodeAge < 0 || snapshot.nodeAge > livenessTimeout) {
+				err = fmt.Errorf("node status is stale")
+			} else {
+				err = checkReplicaLag(limits, node, snapshot.cluster, conf.nodeName, now)
+			}
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				response.Error = err.Error()
+			}
+		}
+		writeHealthResponse(w, r, status, response)
+	}
+}
+
+// livenessCheck passes as long as the reconciler keeps running cycles,
+// even if Postgres is down.
+func livenessCheck(cache *StatusCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot := cache.Snapshot(time.Now())
+		status := http.StatusServiceUnavailable
+		if snapshot.cycleAge >= 0 && snapshot.cycleAge <= livenessTimeout {
+			status = http.StatusOK
 		}
+		w.WriteHeader(status)
+	}
+}
 
+func writeHealthResponse(w http.ResponseWriter, r *http.Request, status int, body any) {
+	if r.Method != http.MethodGet {
 		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write health check response: %v", err)
+	}
+}
+
+// replicaLagLimits are the optional ?lag= and ?max_replay_delay= query
+// parameters. A nil limit isn't checked.
+type replicaLagLimits struct {
+	maxLagBytes    *int64
+	maxReplayDelay *time.Duration
+}
+
+func (l replicaLagLimits) set() bool {
+	return l.maxLagBytes != nil || l.maxReplayDelay != nil
+}
+
+func parseReplicaLagLimits(query url.Values) (replicaLagLimits, error) {
+	var limits replicaLagLimits
+	if lag := query.Get("lag"); lag != "" {
+		bytes, err := parseByteSize(lag)
+		if err != nil {
+			return limits, fmt.Errorf("invalid lag: %w", err)
+		}
+		limits.maxLagBytes = &bytes
+	}
+	if delay := query.Get("max_replay_delay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return limits, fmt.Errorf("invalid max_replay_delay: %w", err)
+		}
+		limits.maxReplayDelay = &d
+	}
+	return limits, nil
+}
+
+// byteSizeUnits are the units Postgres accepts for memory settings,
+// which are all powers of 1024.
+var byteSizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"kb": 1 << 10,
+	"mb": 1 << 20,
+	"gb": 1 << 30,
+	"tb": 1 << 40,
+}
+
+// parseByteSize parses sizes like "16MB" or "1048576".
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	split := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if split < 0 {
+		split = len(s)
+	}
+	value, err := strconv.ParseInt(s[:split], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit, ok := byteSizeUnits[strings.ToLower(strings.TrimSpace(s[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit", s)
+	}
+	return value * unit, nil
+}
+
+// checkReplicaLag returns an error if a replica is further behind the
+// primary than the limits allow. We compare the replica's receive and
+// replay positions against the primary's last published position, so
+// the lag we see is at most one reconcile cycle stale. Primaries and
+// standby leaders are never behind.
+func checkReplicaLag(limits replicaLagLimits, node NodeStatus, cluster ClusterState, nodeName string, now time.Time) error {
+	if !limits.set() || node.IsPrimary || cluster.Status.IntendedPrimary == nodeName {
+		return nil
+	}
+
+	idx := slices.IndexFunc(cluster.Nodes, func(n NodeStatus) bool { return n.Name == cluster.Status.IntendedPrimary })
+	if idx < 0 {
+		return fmt.Errorf("primary %q has no status", cluster.Status.IntendedPrimary)
+	}
+	primaryLsn := nodeWalPosition(cluster.Nodes[idx])
+	if primaryLsn == 0 {
+		return fmt.Errorf("primary %s WAL position is unknown", cluster.Status.IntendedPrimary)
+	}
+	if node.ReplayLsn == nil {
+		return fmt.Errorf("replay position is unknown")
+	}
+	replayLsn, err := ParseLSN(*node.ReplayLsn)
+	if err != nil {
+		return err
+	}
+
+	if limits.maxLagBytes != nil {
+		positions := map[string]*string{"receive": node.ReceiveLsn, "replay": node.ReplayLsn}
+		for _, name := range []string{"receive", "replay"} {
+			// The receive position is unset if we've only ever
+			// restored WAL from the archive.
+			if positions[name] == nil {
+				continue
+			}
+			lsn, err := ParseLSN(*positions[name])
+			if err != nil {
+				return err
+			}
+			if lsn < primaryLsn && int64(primaryLsn-lsn) > *limits.maxLagBytes {
+				return fmt.Errorf("%s is %d bytes behind the primary, more than %d", name, primaryLsn-lsn, *limits.maxLagBytes)
+			}
+		}
+	}
+
+	// The last replay time is a commit timestamp from the primary, so
+	// the delay is only meaningful if there is WAL left to replay, and
+	// is off by any clock skew between the nodes.
+	if limits.maxReplayDelay != nil && replayLsn < primaryLsn {
+		if node.LastReplayTime == nil {
+			return fmt.Errorf("last replay time is unknown")
+		}
+		replayedAt, err := parsePgTimestamp(*node.LastReplayTime)
+		if err != nil {
+			return err
+		}
+		if delay := now.Sub(replayedAt); delay > *limits.maxReplayDelay {
+			return fmt.Errorf("replay is %s behind the primary, more than %s", delay.Round(time.Millisecond), *limits.maxReplayDelay)
+		}
+	}
+	return nil
+}
+
+// parsePgTimestamp parses a timestamptz in Postgres' default ISO
+// output format, e.g. "2025-01-02 03:04:05.123456+00".
+func parsePgTimestamp(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07", "2006-01-02 15:04:05.999999999-07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
 	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
 }
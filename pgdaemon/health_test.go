@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateRoleCheck(t *testing.T) {
+	syncState := "sync"
+	asyncState := "async"
+	errMsg := "connection refused"
+
+	cluster := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1"},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				Replicas: []NodeReplicas{
+					{Hostname: "node2.example.com", SyncState: &syncState},
+					{Hostname: "node3", SyncState: &asyncState},
+				},
+			},
+		},
+	}
+	standby := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1", StandbyLeaderUpstream: "upstream"},
+	}
+
+	primary := NodeStatus{Name: "node1", IsPrimary: true}
+	syncReplica := NodeStatus{Name: "node2"}
+	asyncReplica := NodeStatus{Name: "node3"}
+	standbyLeader := NodeStatus{Name: "node1"}
+	down := NodeStatus{Name: "node2", Error: &errMsg}
+
+	tests := []struct {
+		name     string
+		check    roleCheck
+		node     NodeStatus
+		cluster  ClusterState
+		expected bool
+	}{
+		{"leader on primary", roleCheckLeader, primary, cluster, true},
+		{"leader on replica", roleCheckLeader, syncReplica, cluster, false},
+		{"leader on standby leader", roleCheckLeader, standbyLeader, standby, true},
+		{"leader on deposed primary", roleCheckLeader, NodeStatus{Name: "node3", IsPrimary: true}, cluster, false},
+		{"replica on primary", roleCheckReplica, primary, cluster, false},
+		{"replica on replica", roleCheckReplica, syncReplica, cluster, true},
+		{"replica on standby leader", roleCheckReplica, standbyLeader, standby, false},
+		{"replica on down node", roleCheckReplica, down, cluster, false},
+		{"read-only on primary", roleCheckReadOnly, primary, cluster, true},
+		{"read-only on replica", roleCheckReadOnly, asyncReplica, cluster, true},
+		{"read-only on down node", roleCheckReadOnly, down, cluster, false},
+		{"standby leader on standby leader", roleCheckStandbyLeader, standbyLeader, standby, true},
+		{"standby leader on primary", roleCheckStandbyLeader, primary, cluster, false},
+		{"sync on sync replica", roleCheckSync, syncReplica, cluster, true},
+		{"sync on async replica", roleCheckSync, asyncReplica, cluster, false},
+		{"sync on primary", roleCheckSync, primary, cluster, false},
+		{"async on sync replica", roleCheckAsync, syncReplica, cluster, false},
+		{"async on async replica", roleCheckAsync, asyncReplica, cluster, true},
+		{"async on unlisted replica", roleCheckAsync, NodeStatus{Name: "node4"}, cluster, true},
+		{"readiness on down node", roleCheckReadiness, down, cluster, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, evaluateRoleCheck(tt.check, tt.node, tt.cluster, tt.node.Name))
+		})
+	}
+}
+
+func TestRoleHealthCheck(t *testing.T) {
+	var probeErr error
+	prober := NewHealthProber(func() (bool, error) { return false, probeErr })
+	cache := NewStatusCache()
+	conf := config{nodeName: "node2", healthProbeMaxAge: time.Minute}
+	handler := healthCheckMethods(roleHealthCheck(roleCheckReplica, conf, prober, cache))
+
+	// Nothing probed yet, so we can't vouch for this node
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/replica", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// The node status says Postgres was down, but the newer probe
+	// says it is back
+	cache.SetCluster(ClusterState{Status: ClusterStatus{IntendedPrimary: "node1"}})
+	down := "connect to Postgres: connection refused"
+	cache.SetNode(NodeStatus{Name: "node2", ServerVersionNum: 170004, TimelineID: 3, Error: &down})
+	prober.Probe()
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/replica", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body healthResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, healthResponse{
+		State:         "running",
+		Role:          "replica",
+		ServerVersion: 170004,
+		Timeline:      3,
+	}, body)
+
+	for _, method := range []string{http.MethodHead, http.MethodOptions} {
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, "/replica", nil))
+		assert.Equal(t, http.StatusOK, rec.Code, method)
+		assert.Empty(t, rec.Body.String(), method)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/replica", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET, HEAD, OPTIONS", rec.Header().Get("Allow"))
+
+	probeErr = errors.New("connection refused")
+	prober.Probe()
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/replica", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "stopped", body.State)
+
+	// A probe older than -health-probe-max-age isn't trusted
+	probeErr = nil
+	prober.Probe()
+	conf.healthProbeMaxAge = time.Nanosecond
+	handler = healthCheckMethods(roleHealthCheck(roleCheckReplica, conf, prober, cache))
+	time.Sleep(time.Millisecond)
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/replica", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "unknown", body.State)
+}
+
+func TestLivenessCheck(t *testing.T) {
+	cache := NewStatusCache()
+	handler := livenessCheck(cache)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/liveness", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	cache.CycleDone(time.Second, nil)
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/liveness", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"1048576", 1048576},
+		{"512B", 512},
+		{"16kB", 16 * 1024},
+		{"16MB", 16 * 1024 * 1024},
+		{"1gb", 1024 * 1024 * 1024},
+		{"2 TB", 2 << 40},
+	}
+	for _, tt := range tests {
+		actual, err := parseByteSize(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, actual, tt.input)
+	}
+
+	for _, input := range []string{"", "MB", "16XB", "-1MB"} {
+		_, err := parseByteSize(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestCheckReplicaLag(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	primaryLsn := "0/3000000"
+	cluster := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1"},
+		Nodes:  []NodeStatus{{Name: "node1", IsPrimary: true, CurrentLsn: &primaryLsn}},
+	}
+	replica := func(receive, replay, replayedAt string) NodeStatus {
+		node := NodeStatus{Name: "node2", ReplayLsn: &replay}
+		if receive != "" {
+			node.ReceiveLsn = &receive
+		}
+		if replayedAt != "" {
+			node.LastReplayTime = &replayedAt
+		}
+		return node
+	}
+	lag := func(bytes int64) replicaLagLimits { return replicaLagLimits{maxLagBytes: &bytes} }
+	delay := func(d time.Duration) replicaLagLimits { return replicaLagLimits{maxReplayDelay: &d} }
+
+	tests := []struct {
+		name    string
+		limits  replicaLagLimits
+		node    NodeStatus
+		cluster ClusterState
+		healthy bool
+	}{
+		{"no limits", replicaLagLimits{}, replica("0/0", "0/0", ""), cluster, true},
+		{"primary", lag(0), NodeStatus{Name: "node1", IsPrimary: true}, cluster, true},
+		{"caught up", lag(0), replica("0/3000000", "0/3000000", ""), cluster, true},
+		{"within lag", lag(16 << 20), replica("0/3000000", "0/2000000", ""), cluster, true},
+		{"replay too far behind", lag(1 << 20), replica("0/3000000", "0/2000000", ""), cluster, false},
+		{"receive too far behind", lag(1 << 20), replica("0/1000000", "0/1000000", ""), cluster, false},
+		{"archive only", lag(16 << 20), replica("", "0/2000000", ""), cluster, true},
+		{"ahead of stale primary status", lag(0), replica("0/4000000", "0/4000000", ""), cluster, true},
+		{"unknown primary", lag(16 << 20), replica("0/3000000", "0/3000000", ""), ClusterState{Status: ClusterStatus{IntendedPrimary: "node1"}}, false},
+		{"caught up ignores delay", delay(time.Second), replica("0/3000000", "0/3000000", "2024-01-01 00:00:00+00"), cluster, true},
+		{"within delay", delay(5 * time.Second), replica("0/3000000", "0/2000000", "2025-01-02 03:04:02.5+00"), cluster, true},
+		{"delay too long", delay(5 * time.Second), replica("0/3000000", "0/2000000", "2025-01-02 05:03:55+02"), cluster, false},
+		{"unknown replay time", delay(5 * time.Second), replica("0/3000000", "0/2000000", ""), cluster, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReplicaLag(tt.limits, tt.node, tt.cluster, tt.node.Name, now)
+			if tt.healthy {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestRoleHealthCheck_LagLimits(t *testing.T) {
+	primaryLsn := "0/3000000"
+	replayLsn := "0/1000000"
+	cache := NewStatusCache()
+	cache.SetCluster(ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1"},
+		Nodes:  []NodeStatus{{Name: "node1", IsPrimary: true, CurrentLsn: &primaryLsn}},
+	})
+	cache.SetNode(NodeStatus{Name: "node2", ReceiveLsn: &primaryLsn, ReplayLsn: &replayLsn})
+	prober := NewHealthProber(func() (bool, error) { return false, nil })
+	prober.Probe()
+	handler := roleHealthCheck(roleCheckReplica, config{nodeName: "node2", healthProbeMaxAge: time.Minute}, prober, cache)
+
+	for target, expected := range map[string]int{
+		"/replica":                    http.StatusOK,
+		"/replica?lag=64MB":           http.StatusOK,
+		"/replica?lag=16MB":           http.StatusServiceUnavailable,
+		"/replica?lag=lots":           http.StatusBadRequest,
+		"/replica?max_replay_delay=5": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, expected, rec.Code, target)
+	}
+}
+
+func TestCheckIntendedPrimary(t *testing.T) {
+	observed := func(intended string, age time.Duration) statusSnapshot {
+		return statusSnapshot{
+			status:    ClusterStatus{IntendedPrimary: intended},
+			statusAge: age,
+		}
+	}
+	never := statusSnapshot{statusAge: -1}
+
+	tests := []struct {
+		name     string
+		snapshot statusSnapshot
+		failOpen bool
+		healthy  bool
+	}{
+		{"recent and intended", observed("node1", time.Second), false, true},
+		{"recent but another node", observed("node2", time.Second), false, false},
+		{"stale", observed("node1", time.Minute), false, false},
+		{"stale with fail open", observed("node1", time.Minute), true, true},
+		{"stale another node with fail open", observed("node2", time.Minute), true, false},
+		{"never observed", never, false, false},
+		{"never observed with fail open", never, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkIntendedPrimary(tt.snapshot, "node1", 10*time.Second, tt.failOpen)
+			if tt.healthy {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestHealthCheck_ServesCachedProbe(t *testing.T) {
+	isPrimary := true
+	prober := NewHealthProber(func() (bool, error) { return isPrimary, nil })
+	cache := NewStatusCache()
+	cache.SetCluster(ClusterState{Status: ClusterStatus{IntendedPrimary: "node1"}})
+	conf := config{nodeName: "node1", healthProbeMaxAge: time.Minute, primaryStatusMaxAge: time.Minute}
+
+	get := func(handler http.HandlerFunc, target string) (int, probeResponse) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var body probeResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body
+	}
+
+	// Nothing probed yet
+	code, body := get(healthCheck(false, conf, prober, cache), "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Nil(t, body.AgeSeconds)
+
+	prober.Probe()
+	code, body = get(healthCheck(false, conf, prober, cache), "/health")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, body.IsPrimary)
+	assert.NotNil(t, body.AgeSeconds)
+
+	code, _ = get(healthCheck(true, conf, prober, cache), "/primary")
+	assert.Equal(t, http.StatusOK, code)
+
+	isPrimary = false
+	prober.Probe()
+	code, body = get(healthCheck(true, conf, prober, cache), "/primary")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not a primary", body.Error)
+
+	conf.healthProbeMaxAge = 0
+	code, _ = get(healthCheck(false, conf, prober, cache), "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
 	"slices"
 	"time"
@@ -12,12 +15,27 @@ import (
 
 type StateStore interface {
 	SetClusterSpec(ctx context.Context, spec *ClusterSpec) error
+	AtomicWriteClusterSpec(ctx context.Context, prevSpecUUID uuid.UUID, spec ClusterSpec) error
 	FetchClusterState(ctx context.Context) (ClusterState, error)
 	AtomicWriteClusterStatus(ctx context.Context, prevStatusUUID uuid.UUID, status ClusterStatus) error
 
 	WriteCurrentNodeStatus(ctx context.Context, status *NodeStatus) error
+
+	// RecordClusterEvents stores events, unless an event with the
+	// same ID is already stored, and keeps the latest
+	// maxClusterEvents. FetchClusterEvents returns them oldest first.
+	RecordClusterEvents(ctx context.Context, events []ClusterEvent) error
+	FetchClusterEvents(ctx context.Context) ([]ClusterEvent, error)
 }
 
+// ErrClusterStatusConflict is returned by AtomicWriteClusterStatus when
+// the status was changed by someone else since we read it.
+var ErrClusterStatusConflict = errors.New("cluster status was changed concurrently")
+
+// ErrClusterSpecConflict is returned by AtomicWriteClusterSpec when the
+// spec was changed by someone else since we read it.
+var ErrClusterSpecConflict = errors.New("cluster spec was changed concurrently")
+
 // ClusterState holds the entire state of the cluster.
 type ClusterState struct {
 	Spec   ClusterSpec   `json:"spec"`
@@ -26,7 +44,183 @@ type ClusterState struct {
 }
 
 // ClusterSpec defines the desired state of the cluster.
-type ClusterSpec struct{}
+type ClusterSpec struct {
+	// SpecUuid changes on every write, so the admin API can replace
+	// the spec only if it hasn't changed since the client read it.
+	// SetClusterSpec writes the spec unconditionally and sets a new
+	// one.
+	SpecUuid uuid.UUID `json:"spec_uuid" dynamodbav:"spec_uuid"`
+
+	// Nodes holds per-node settings, keyed by node name. Nodes
+	// don't need an entry to join the cluster.
+	Nodes map[string]NodeSpec `json:"nodes,omitempty" dynamodbav:"nodes,omitempty"`
+
+	// StandbyCluster makes this a standby cluster that follows a
+	// primary outside of the cluster, e.g. for disaster recovery
+	// in another region or for migrations. The IntendedPrimary
+	// becomes a "standby leader" that streams from the external
+	// primary, and the other replicas stream from the standby
+	// leader. Remove this (see promote-cluster) to turn the standby
+	// cluster into a normal cluster.
+	StandbyCluster *StandbyClusterSpec `json:"standby_cluster,omitempty" dynamodbav:"standby_cluster,omitempty"`
+
+	// Clone controls where new and re-cloned replicas copy their
+	// data from. The default is to clone from the primary.
+	Clone *CloneSpec `json:"clone,omitempty" dynamodbav:"clone,omitempty"`
+
+	// PgBouncer makes pgdaemon manage pgbouncer.ini on every node. If
+	// it and Auth are nil, pgbouncer.ini is left alone.
+	PgBouncer *PgBouncerSpec `json:"pgbouncer,omitempty" dynamodbav:"pgbouncer,omitempty"`
+
+	// Auth makes pgdaemon manage pg_hba.conf, and PgBouncer's
+	// authentication. Without it, the trust rules from initdb are
+	// left alone.
+	Auth *AuthSpec `json:"auth,omitempty" dynamodbav:"auth,omitempty"`
+
+	// ReadOnly makes new transactions on the primary read-only. The
+	// logical-cutover command sets it to freeze writes before moving
+	// clients to another cluster, and it stays set afterwards so the
+	// old cluster doesn't diverge. Sessions can SET it back, so
+	// logical-cutover also revokes CONNECT on the database.
+	ReadOnly bool `json:"read_only,omitempty" dynamodbav:"read_only,omitempty"`
+}
+
+type AuthSpec struct {
+	// AllowedCIDRs are the networks clients and other nodes may
+	// connect from, e.g. "10.0.0.0/16". They must authenticate with
+	// scram-sha-256, and use TLS if the nodes have certificates.
+	// Replication connections must use the replication role.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty" dynamodbav:"allowed_cidrs,omitempty"`
+}
+
+type PgBouncerSpec struct {
+	// PoolMode is session, transaction, or statement. The default is
+	// transaction.
+	PoolMode string `json:"pool_mode,omitempty" dynamodbav:"pool_mode,omitempty"`
+
+	// Pool sizes map to the PgBouncer settings of the same name.
+	// Zero means PgBouncer's default.
+	DefaultPoolSize  int `json:"default_pool_size,omitempty" dynamodbav:"default_pool_size,omitempty"`
+	MinPoolSize      int `json:"min_pool_size,omitempty" dynamodbav:"min_pool_size,omitempty"`
+	ReservePoolSize  int `json:"reserve_pool_size,omitempty" dynamodbav:"reserve_pool_size,omitempty"`
+	MaxClientConn    int `json:"max_client_conn,omitempty" dynamodbav:"max_client_conn,omitempty"`
+	MaxDbConnections int `json:"max_db_connections,omitempty" dynamodbav:"max_db_connections,omitempty"`
+
+	// Databases maps database names, or "*", to PgBouncer connection
+	// strings like "host=127.0.0.1 port=5432 dbname=app". The default
+	// sends every database to the local Postgres.
+	Databases map[string]string `json:"databases,omitempty" dynamodbav:"databases,omitempty"`
+
+	// MaxWaitSeconds is how long a client can wait for a server
+	// connection before we consider the pool saturated. The default
+	// is defaultPgBouncerMaxWaitSeconds.
+	MaxWaitSeconds int `json:"max_wait_seconds,omitempty" dynamodbav:"max_wait_seconds,omitempty"`
+}
+
+// defaultPgBouncerMaxWaitSeconds is the default for
+// PgBouncerSpec.MaxWaitSeconds.
+const defaultPgBouncerMaxWaitSeconds = 1
+
+// pgBouncerMaxWaitSeconds returns the spec's saturation threshold,
+// which also applies when pgbouncer.ini isn't managed by pgdaemon.
+func (s ClusterSpec) pgBouncerMaxWaitSeconds() int {
+	if s.PgBouncer == nil || s.PgBouncer.MaxWaitSeconds <= 0 {
+		return defaultPgBouncerMaxWaitSeconds
+	}
+	return s.PgBouncer.MaxWaitSeconds
+}
+
+type CloneMethod string
+
+const (
+	// CloneMethodPrimary runs pg_basebackup against the primary.
+	CloneMethodPrimary CloneMethod = "primary"
+	// CloneMethodReplica runs pg_basebackup against a healthy
+	// replica, to keep the load off the primary.
+	CloneMethodReplica CloneMethod = "replica"
+	// CloneMethodBackup restores the latest base backup from the
+	// archive and catches up by replaying archived WAL before
+	// streaming.
+	CloneMethodBackup CloneMethod = "backup"
+)
+
+type CloneSpec struct {
+	Method CloneMethod `json:"method,omitempty" dynamodbav:"method,omitempty"`
+
+	// SourceNode is the replica to clone from with CloneMethodReplica.
+	// If it is empty or not healthy, we pick a healthy replica.
+	SourceNode string `json:"source_node,omitempty" dynamodbav:"source_node,omitempty"`
+
+	// MaxRate caps the pg_basebackup transfer rate, e.g. "50M". It
+	// is passed to pg_basebackup --max-rate.
+	MaxRate string `json:"max_rate,omitempty" dynamodbav:"max_rate,omitempty"`
+}
+
+type StandbyClusterSpec struct {
+	Host string `json:"host" dynamodbav:"host"`
+	Port int    `json:"port,omitempty" dynamodbav:"port,omitempty"`
+}
+
+// PortOrDefault returns the external primary's port, defaulting to the
+// standard Postgres port.
+func (s StandbyClusterSpec) PortOrDefault() int {
+	if s.Port == 0 {
+		return 5432
+	}
+	return s.Port
+}
+
+// NodeSpec defines the desired settings for a single node.
+type NodeSpec struct {
+	// ReplicateFrom names another replica that this node should
+	// stream WAL from instead of the primary (cascading
+	// replication). If that node can't serve as an upstream, e.g.
+	// it is down, this node streams from the primary instead.
+	ReplicateFrom string `json:"replicate_from,omitempty" dynamodbav:"replicate_from,omitempty"`
+
+	// ApplyDelay makes this a delayed replica that applies WAL this
+	// long (a Postgres interval like "1h") after the primary
+	// commits, using recovery_min_apply_delay. This lets us recover
+	// from operator errors like a bad DROP TABLE. Delayed replicas
+	// are never chosen as the primary.
+	ApplyDelay string `json:"apply_delay,omitempty" dynamodbav:"apply_delay,omitempty"`
+
+	// ReplayPaused pauses WAL replay on this replica.
+	ReplayPaused bool `json:"replay_paused,omitempty" dynamodbav:"replay_paused,omitempty"`
+
+	// ReplayTargetTime fast-forwards a delayed replica. It replays
+	// without delay up to this time and then pauses.
+	ReplayTargetTime string `json:"replay_target_time,omitempty" dynamodbav:"replay_target_time,omitempty"`
+}
+
+// validate checks the fields that end up in Postgres settings, so a
+// bad spec is rejected when it is set rather than on every node.
+func (s ClusterSpec) validate() error {
+	if s.Auth != nil {
+		for _, cidr := range s.Auth.AllowedCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid allowed CIDR %q: %w", cidr, err)
+			}
+		}
+	}
+	if s.PgBouncer != nil {
+		if err := s.PgBouncer.validate(); err != nil {
+			return err
+		}
+	}
+	for name, node := range s.Nodes {
+		if err := validateReplaySpec(node); err != nil {
+			return fmt.Errorf("node %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// isDelayedReplica returns true if nodeName is configured as a delayed
+// replica.
+func (s ClusterSpec) isDelayedReplica(nodeName string) bool {
+	return s.Nodes[nodeName].ApplyDelay != ""
+}
 
 type ClusterHealth string
 
@@ -55,12 +249,180 @@ type ClusterStatus struct {
 
 	Health        ClusterHealth `json:"health" dynamodbav:"health"`
 	HealthReasons []string      `json:"health_reasons,omitempty" dynamodbav:"health_reasons,omitempty"`
+	// HealthReasonKinds classifies each of HealthReasons, in the
+	// same order.
+	HealthReasonKinds []HealthReasonKind `json:"health_reason_kinds,omitempty" dynamodbav:"health_reason_kinds,omitempty"`
 
 	// IntendedPrimary is the node that the cluster has decided
 	// should be the primary, although this may differ from the
 	// current primary during failovers.
 	IntendedPrimary  string   `json:"intended_primary" dynamodbav:"intended_primary"`
 	IntendedReplicas []string `json:"intended_replicas" dynamodbav:"intended_replicas,omitempty"`
+
+	// ReplicationUpstreams maps replicas that should stream from
+	// another replica to that replica. Replicas that aren't in
+	// this map stream from IntendedPrimary.
+	ReplicationUpstreams map[string]string `json:"replication_upstreams,omitempty" dynamodbav:"replication_upstreams,omitempty"`
+
+	// StandbyLeaderUpstream is the external primary that the
+	// IntendedPrimary streams from when this is a standby cluster.
+	// It is empty for normal clusters.
+	StandbyLeaderUpstream string `json:"standby_leader_upstream,omitempty" dynamodbav:"standby_leader_upstream,omitempty"`
+
+	// BackupNode is the replica that should take scheduled base
+	// backups, so backups don't load the primary. It is empty if no
+	// replica is healthy enough.
+	BackupNode string `json:"backup_node,omitempty" dynamodbav:"backup_node,omitempty"`
+
+	Backup *ClusterBackupStatus `json:"backup,omitempty" dynamodbav:"backup,omitempty"`
+
+	// FailoverState tracks planned switchovers, where we demote the
+	// old primary cleanly before promoting the new one.
+	FailoverState FailoverState `json:"failover_state,omitempty" dynamodbav:"failover_state,omitempty"`
+
+	// PreviousPrimary is the primary being demoted in a switchover.
+	PreviousPrimary string `json:"previous_primary,omitempty" dynamodbav:"previous_primary,omitempty"`
+
+	// SwitchoverLsn is the shutdown checkpoint LSN of the demoted
+	// primary. The new primary only promotes once it has received
+	// WAL past it, so the switchover doesn't lose any commits and
+	// the old primary can follow the new one without pg_rewind.
+	SwitchoverLsn string `json:"switchover_lsn,omitempty" dynamodbav:"switchover_lsn,omitempty"`
+
+	// Paused stops automatic failover: IntendedPrimary stays put
+	// even if its node disappears. Upgrades pause the cluster while
+	// the primary is down for pg_upgrade.
+	Paused bool `json:"paused,omitempty" dynamodbav:"paused,omitempty"`
+
+	// Upgrade tracks the last major version upgrade started with the
+	// upgrade command. It is kept after the upgrade finishes so
+	// humans can see how it went.
+	Upgrade *ClusterUpgradeStatus `json:"upgrade,omitempty" dynamodbav:"upgrade,omitempty"`
+
+	// NodeActions are one-off actions requested through the admin
+	// API, keyed by node name. Each node clears its own action once
+	// it has carried it out.
+	NodeActions map[string]NodeAction `json:"node_actions,omitempty" dynamodbav:"node_actions,omitempty"`
+}
+
+// NodeAction is a one-off action for a single node.
+type NodeAction struct {
+	Action NodeActionKind `json:"action" dynamodbav:"action"`
+
+	// RequestedAt is when the action was requested. It is purely for
+	// informational purposes, and so a node doesn't clear an action
+	// that was requested again while it was busy.
+	RequestedAt string `json:"requested_at" dynamodbav:"requested_at"`
+}
+
+type NodeActionKind string
+
+const (
+	// NodeActionRestart restarts Postgres, e.g. to apply a setting
+	// that needs a restart.
+	NodeActionRestart NodeActionKind = "restart"
+	// NodeActionReinitialize moves a replica's data directory aside
+	// so it clones a fresh copy.
+	NodeActionReinitialize NodeActionKind = "reinitialize"
+)
+
+type FailoverState string
+
+const (
+	FailoverStateStable FailoverState = "stable"
+	// FailoverStateDemotingOldPrimary means PreviousPrimary is
+	// shutting down cleanly. IntendedPrimary keeps replicating from
+	// it in the meantime.
+	FailoverStateDemotingOldPrimary FailoverState = "demoting_old_primary"
+	// FailoverStatePromotingNewPrimary means IntendedPrimary should
+	// promote itself once it has received SwitchoverLsn.
+	FailoverStatePromotingNewPrimary FailoverState = "promoting_new_primary"
+)
+
+// ClusterUpgradeStatus tracks a major version upgrade. The primary
+// runs pg_upgrade, then the replicas re-clone from it with the new
+// binaries.
+type ClusterUpgradeStatus struct {
+	Phase UpgradePhase `json:"phase" dynamodbav:"phase"`
+
+	// Primary is the node that runs pg_upgrade.
+	Primary string `json:"primary" dynamodbav:"primary"`
+
+	// NewBinDir and NewPostgresUnit replace -pg-bin-dir and
+	// -postgres-unit on every node.
+	NewBinDir       string `json:"new_bin_dir" dynamodbav:"new_bin_dir"`
+	NewPostgresUnit string `json:"new_postgres_unit,omitempty" dynamodbav:"new_postgres_unit,omitempty"`
+
+	// TargetMajorVersion is the major version of the new binaries,
+	// known once pg_upgrade --check passes.
+	TargetMajorVersion int `json:"target_major_version,omitempty" dynamodbav:"target_major_version,omitempty"`
+
+	StartedAt string `json:"started_at" dynamodbav:"started_at"`
+	Error     string `json:"error,omitempty" dynamodbav:"error,omitempty"`
+}
+
+type UpgradePhase string
+
+const (
+	// UpgradePhaseChecking means the primary is running pg_upgrade
+	// --check against a new data directory.
+	UpgradePhaseChecking UpgradePhase = "checking"
+	// UpgradePhaseUpgradingPrimary means the primary is down for
+	// pg_upgrade --link.
+	UpgradePhaseUpgradingPrimary UpgradePhase = "upgrading_primary"
+	// UpgradePhaseUpgradingReplicas means the primary runs the new
+	// version and replicas on the old version should re-clone.
+	UpgradePhaseUpgradingReplicas UpgradePhase = "upgrading_replicas"
+	UpgradePhaseDone              UpgradePhase = "done"
+	// UpgradePhaseRolledBack means the primary's upgrade failed and
+	// it is running the old version again. Error says why.
+	UpgradePhaseRolledBack UpgradePhase = "rolled_back"
+	// UpgradePhaseFailed means we couldn't roll back either. The
+	// cluster stays paused until a human repairs the primary.
+	UpgradePhaseFailed UpgradePhase = "failed"
+)
+
+// inProgress returns true while an upgrade is running. It is safe to
+// call on a nil upgrade.
+func (u *ClusterUpgradeStatus) inProgress() bool {
+	if u == nil {
+		return false
+	}
+	switch u.Phase {
+	case UpgradePhaseChecking, UpgradePhaseUpgradingPrimary, UpgradePhaseUpgradingReplicas:
+		return true
+	default:
+		return false
+	}
+}
+
+// ClusterBackupStatus tracks scheduled base backups.
+type ClusterBackupStatus struct {
+	// InProgressNode is the node taking a base backup right now. A
+	// node claims this with a compare-and-swap write before it
+	// starts, so only one node takes a backup at a time.
+	InProgressNode  string `json:"in_progress_node,omitempty" dynamodbav:"in_progress_node,omitempty"`
+	InProgressSince string `json:"in_progress_since,omitempty" dynamodbav:"in_progress_since,omitempty"`
+
+	LastSuccess *BaseBackupInfo `json:"last_success,omitempty" dynamodbav:"last_success,omitempty"`
+	LastFailure *BackupFailure  `json:"last_failure,omitempty" dynamodbav:"last_failure,omitempty"`
+}
+
+type BackupFailure struct {
+	Node      string `json:"node" dynamodbav:"node"`
+	StartTime string `json:"start_time" dynamodbav:"start_time"`
+	Error     string `json:"error" dynamodbav:"error"`
+}
+
+// UpstreamFor returns the host that nodeName should stream WAL from.
+func (s ClusterStatus) UpstreamFor(nodeName string) string {
+	if nodeName == s.IntendedPrimary {
+		return s.StandbyLeaderUpstream
+	}
+	if upstream, ok := s.ReplicationUpstreams[nodeName]; ok {
+		return upstream
+	}
+	return s.IntendedPrimary
 }
 
 // NodeDesiredState defines the desired state for a node.
@@ -78,18 +440,154 @@ type NodeStatus struct {
 	NodeTime string `json:"node_time" dynamodbav:"node_time"`
 
 	Error             *string                `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	ErrorKind         NodeErrorKind          `json:"error_kind,omitempty" dynamodbav:"error_kind,omitempty"`
 	IsPrimary         bool                   `json:"is_primary" dynamodbav:"is_primary"`
 	Replicas          []NodeReplicas         `json:"replicas,omitempty" dynamodbav:"replicas,omitempty"`
 	ReplicationStatus *NodeReplicationStatus `json:"replication_status,omitempty" dynamodbav:"replication_status,omitempty"`
+
+	ServerVersion       string `json:"server_version,omitempty" dynamodbav:"server_version,omitempty"`
+	ServerVersionNum    int    `json:"server_version_num,omitempty" dynamodbav:"server_version_num,omitempty"`
+	PostmasterStartTime string `json:"postmaster_start_time,omitempty" dynamodbav:"postmaster_start_time,omitempty"`
+	PendingRestart      bool   `json:"pending_restart,omitempty" dynamodbav:"pending_restart,omitempty"`
+
+	TimelineID uint32 `json:"timeline_id,omitempty" dynamodbav:"timeline_id,omitempty"`
+
+	// CurrentLsn is the current WAL insert position, and is only
+	// set on primaries.
+	CurrentLsn *string `json:"current_lsn,omitempty" dynamodbav:"current_lsn,omitempty"`
+
+	// ReceiveLsn, FlushLsn, and ReplayLsn are only set on replicas.
+	// ReplayLagBytes is how far replay is behind what the replica
+	// has received.
+	ReceiveLsn     *string `json:"receive_lsn,omitempty" dynamodbav:"receive_lsn,omitempty"`
+	FlushLsn       *string `json:"flush_lsn,omitempty" dynamodbav:"flush_lsn,omitempty"`
+	ReplayLsn      *string `json:"replay_lsn,omitempty" dynamodbav:"replay_lsn,omitempty"`
+	ReplayLagBytes *int64  `json:"replay_lag_bytes,omitempty" dynamodbav:"replay_lag_bytes,omitempty"`
+	ReplayPaused   bool    `json:"replay_paused,omitempty" dynamodbav:"replay_paused,omitempty"`
+	LastReplayTime *string `json:"last_replay_time,omitempty" dynamodbav:"last_replay_time,omitempty"`
+
+	DataDirectoryBytes *int64 `json:"data_directory_bytes,omitempty" dynamodbav:"data_directory_bytes,omitempty"`
+	DiskFreeBytes      *int64 `json:"disk_free_bytes,omitempty" dynamodbav:"disk_free_bytes,omitempty"`
+
+	// LastRejoin is the outcome of the last time this node turned
+	// itself from a primary into a replica.
+	LastRejoin *NodeRejoinStatus `json:"last_rejoin,omitempty" dynamodbav:"last_rejoin,omitempty"`
+
+	// ShutdownCheckpointLsn is set once this node has been cleanly
+	// shut down after being demoted in a switchover.
+	ShutdownCheckpointLsn *string `json:"shutdown_checkpoint_lsn,omitempty" dynamodbav:"shutdown_checkpoint_lsn,omitempty"`
+
+	// PgBouncer holds PgBouncer's SHOW POOLS and SHOW STATS output.
+	// It is nil if the admin console can't be queried.
+	PgBouncer *NodePgBouncerStatus `json:"pgbouncer,omitempty" dynamodbav:"pgbouncer,omitempty"`
+
+	// Upgrade is this node's progress in the last major version
+	// upgrade it took part in.
+	Upgrade *NodeUpgradeStatus `json:"upgrade,omitempty" dynamodbav:"upgrade,omitempty"`
+
+	// ReadOnly is true once this node has applied the spec's
+	// ReadOnly and terminated the sessions that could still write.
+	ReadOnly bool `json:"read_only,omitempty" dynamodbav:"read_only,omitempty"`
+}
+
+type NodeUpgradeStatus struct {
+	Phase NodeUpgradePhase `json:"phase" dynamodbav:"phase"`
+	Error *string          `json:"error,omitempty" dynamodbav:"error,omitempty"`
+
+	// NodeTime is when the phase started, as reported by the node.
+	NodeTime string `json:"node_time" dynamodbav:"node_time"`
+}
+
+type NodeUpgradePhase string
+
+const (
+	NodeUpgradePhaseChecking   NodeUpgradePhase = "checking"
+	NodeUpgradePhaseUpgrading  NodeUpgradePhase = "upgrading"
+	NodeUpgradePhaseRecloning  NodeUpgradePhase = "recloning"
+	NodeUpgradePhaseDone       NodeUpgradePhase = "done"
+	NodeUpgradePhaseRolledBack NodeUpgradePhase = "rolled_back"
+	NodeUpgradePhaseFailed     NodeUpgradePhase = "failed"
+)
+
+type NodePgBouncerStatus struct {
+	// Paused is true while PgBouncer holds client queries, e.g.
+	// during a switchover away from this node.
+	Paused    bool                     `json:"paused,omitempty" dynamodbav:"paused,omitempty"`
+	Pools     []PgBouncerPoolStats     `json:"pools,omitempty" dynamodbav:"pools,omitempty"`
+	Databases []PgBouncerDatabaseStats `json:"databases,omitempty" dynamodbav:"databases,omitempty"`
+}
+
+// PgBouncerPoolStats is a row of SHOW POOLS.
+type PgBouncerPoolStats struct {
+	Database       string `json:"database" dynamodbav:"database"`
+	User           string `json:"user" dynamodbav:"user"`
+	ClientsActive  int64  `json:"cl_active" dynamodbav:"cl_active"`
+	ClientsWaiting int64  `json:"cl_waiting" dynamodbav:"cl_waiting"`
+	ServersActive  int64  `json:"sv_active" dynamodbav:"sv_active"`
+	ServersIdle    int64  `json:"sv_idle" dynamodbav:"sv_idle"`
+	// MaxWaitUs is how long the oldest waiting client has waited.
+	MaxWaitUs int64  `json:"maxwait_us" dynamodbav:"maxwait_us"`
+	PoolMode  string `json:"pool_mode,omitempty" dynamodbav:"pool_mode,omitempty"`
+}
+
+// PgBouncerDatabaseStats is a row of SHOW STATS.
+type PgBouncerDatabaseStats struct {
+	Database        string `json:"database" dynamodbav:"database"`
+	TotalXactCount  int64  `json:"total_xact_count" dynamodbav:"total_xact_count"`
+	TotalQueryCount int64  `json:"total_query_count" dynamodbav:"total_query_count"`
+	AvgXactTimeUs   int64  `json:"avg_xact_time_us" dynamodbav:"avg_xact_time_us"`
+	AvgQueryTimeUs  int64  `json:"avg_query_time_us" dynamodbav:"avg_query_time_us"`
+	AvgWaitTimeUs   int64  `json:"avg_wait_time_us" dynamodbav:"avg_wait_time_us"`
+}
+
+// NodeErrorKind classifies NodeStatus.Error.
+type NodeErrorKind string
+
+const (
+	// NodeErrorConnection means we couldn't connect to Postgres
+	// because the connection was refused, the host unreachable, or
+	// the dial or handshake timed out. Waiting too long for a busy
+	// pooled connection is NodeErrorQuery, since a busy node is not
+	// down.
+	NodeErrorConnection NodeErrorKind = "connection"
+	// NodeErrorAuthentication means Postgres rejected our
+	// credentials.
+	NodeErrorAuthentication NodeErrorKind = "authentication"
+	// NodeErrorStartingUp means Postgres is starting up, shutting
+	// down, or in crash recovery and isn't accepting connections.
+	NodeErrorStartingUp NodeErrorKind = "starting_up"
+	// NodeErrorQuery means we connected to Postgres but a query
+	// failed, e.g. it timed out under load.
+	NodeErrorQuery NodeErrorKind = "query"
+	// NodeErrorPgBouncer means Postgres is fine but we couldn't
+	// query it through PgBouncer.
+	NodeErrorPgBouncer NodeErrorKind = "pgbouncer"
+)
+
+// nodeIsDown returns true if the node's Postgres isn't usable at all,
+// as opposed to being up but having a failed query or a broken
+// PgBouncer. Errors without a kind are treated as down.
+func nodeIsDown(node NodeStatus) bool {
+	if node.Error == nil {
+		return false
+	}
+	switch node.ErrorKind {
+	case NodeErrorQuery, NodeErrorPgBouncer:
+		return false
+	default:
+		return true
+	}
 }
 
 type NodeReplicas struct {
-	Hostname  string  `json:"hostname" dynamodbav:"hostname"`
-	State     string  `json:"state" dynamodbav:"state"`
-	WriteLsn  *string `json:"write_lsn" dynamodbav:"write_lsn"`
-	WriteLag  *string `json:"write_lag" dynamodbav:"write_lag"`
-	SyncState *string `json:"sync_state" dynamodbav:"sync_state"`
-	ReplyTime *string `json:"reply_time" dynamodbav:"reply_time"`
+	Hostname       string  `json:"hostname" dynamodbav:"hostname"`
+	State          string  `json:"state" dynamodbav:"state"`
+	WriteLsn       *string `json:"write_lsn" dynamodbav:"write_lsn"`
+	WriteLag       *string `json:"write_lag" dynamodbav:"write_lag"`
+	ReplayLsn      *string `json:"replay_lsn,omitempty" dynamodbav:"replay_lsn,omitempty"`
+	ReplayLagBytes *int64  `json:"replay_lag_bytes,omitempty" dynamodbav:"replay_lag_bytes,omitempty"`
+	SyncState      *string `json:"sync_state" dynamodbav:"sync_state"`
+	ReplyTime      *string `json:"reply_time" dynamodbav:"reply_time"`
 }
 
 type NodeReplicationStatus struct {
@@ -98,6 +596,15 @@ type NodeReplicationStatus struct {
 	WrittenLsn  *string `json:"written_lsn" dynamodbav:"written_lsn"`
 }
 
+type NodeRejoinStatus struct {
+	Action RejoinAction `json:"action" dynamodbav:"action"`
+	Reason string       `json:"reason" dynamodbav:"reason"`
+	Error  *string      `json:"error,omitempty" dynamodbav:"error,omitempty"`
+
+	// NodeTime is when the rejoin happened, as reported by the node.
+	NodeTime string `json:"node_time" dynamodbav:"node_time"`
+}
+
 func WriteClusterStatusIfChanged(store StateStore, oldStatus ClusterStatus, newStatus ClusterStatus, nodeName string) (ClusterStatus, bool, error) {
 	changed := clusterStatusChanged(oldStatus, newStatus)
 	if changed {
@@ -111,6 +618,79 @@ func WriteClusterStatusIfChanged(store StateStore, oldStatus ClusterStatus, newS
 	return newStatus, changed, nil
 }
 
+// updateClusterStatus applies update to the latest cluster status,
+// retrying if the reconcilers write the status at the same time.
+func updateClusterStatus(store StateStore, nodeName string, update func(status *ClusterStatus)) error {
+	_, err := modifyClusterStatus(store, nodeName, func(_ ClusterState, status *ClusterStatus) error {
+		update(status)
+		return nil
+	})
+	return err
+}
+
+// modifyClusterStatus is like updateClusterStatus, but the update can
+// look at the whole cluster state and reject it with an error. It
+// returns the status that is in the store afterwards.
+func modifyClusterStatus(store StateStore, nodeName string, update func(state ClusterState, status *ClusterStatus) error) (ClusterStatus, error) {
+	const maxAttempts = 10
+	for range maxAttempts {
+		state, err := store.FetchClusterState(context.Background())
+		if err != nil {
+			return ClusterStatus{}, fmt.Errorf("failed to fetch cluster state: %w", err)
+		}
+
+		newStatus := state.Status
+		if err := update(state, &newStatus); err != nil {
+			return state.Status, err
+		}
+
+		newStatus, _, err = WriteClusterStatusIfChanged(store, state.Status, newStatus, nodeName)
+		if errors.Is(err, ErrClusterStatusConflict) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		return newStatus, err
+	}
+	return ClusterStatus{}, fmt.Errorf("failed to write cluster status after %d attempts: %w", maxAttempts, ErrClusterStatusConflict)
+}
+
+// updateClusterSpec applies update to the latest cluster spec,
+// retrying if someone else writes the spec at the same time.
+func updateClusterSpec(ctx context.Context, store StateStore, update func(spec *ClusterSpec)) error {
+	return modifyClusterSpec(ctx, store, func(spec *ClusterSpec) error {
+		update(spec)
+		return nil
+	})
+}
+
+// modifyClusterSpec is like updateClusterSpec, but the update can
+// reject the spec with an error, which leaves it unchanged.
+func modifyClusterSpec(ctx context.Context, store StateStore, update func(spec *ClusterSpec) error) error {
+	const maxAttempts = 10
+	for range maxAttempts {
+		state, err := store.FetchClusterState(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch cluster state: %w", err)
+		}
+
+		spec := state.Spec
+		if err := update(&spec); err != nil {
+			return err
+		}
+		spec.SpecUuid = uuid.New()
+		err = store.AtomicWriteClusterSpec(ctx, state.Spec.SpecUuid, spec)
+		if errors.Is(err, ErrClusterSpecConflict) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write cluster spec: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to write cluster spec after %d attempts: %w", maxAttempts, ErrClusterSpecConflict)
+}
+
 // clusterStatusChanged checks if any meaningful fields in the cluster
 // status changed (e.g. not the UUID or source node).
 func clusterStatusChanged(old, new ClusterStatus) bool {
@@ -144,29 +724,49 @@ func normalizeSlicesInStruct(v reflect.Value) {
 
 // ComputeNewClusterStatus processes the current cluster state and returns
 // the updated cluster status, or nil if no changes are needed.
-func ComputeNewClusterStatus(state ClusterState) ClusterStatus {
+// staleNodes are the nodes whose status hasn't changed recently by our
+// local clock, which means their pgdaemon has stopped. Their Postgres
+// may still be fine, so this doesn't count as the node being down.
+func ComputeNewClusterStatus(state ClusterState, staleNodes []string) ClusterStatus {
 	status := state.Status
 
-	// Handle role assignment
-	status.IntendedPrimary = selectIntendedPrimary(state.Nodes, status.IntendedPrimary)
+	// Handle role assignment. While paused we keep the primary even
+	// if its node is gone.
+	if !status.Paused || status.IntendedPrimary == "" {
+		status.IntendedPrimary = selectIntendedPrimary(state.Spec, state.Nodes, status.IntendedPrimary)
+	}
 	status.IntendedReplicas = buildIntendedReplicas(state.Nodes, status.IntendedPrimary)
+	status.ReplicationUpstreams = buildReplicationUpstreams(state.Spec, state.Nodes, status.IntendedPrimary, status.IntendedReplicas)
+	status.StandbyLeaderUpstream = ""
+	if state.Spec.StandbyCluster != nil {
+		status.StandbyLeaderUpstream = state.Spec.StandbyCluster.Host
+	}
+
+	status = advanceFailoverState(status, state.Nodes, staleNodes)
+	status = advanceUpgrade(status, state.Nodes, staleNodes)
+	status.BackupNode = selectBackupNode(state.Spec, state.Nodes, status)
+	status.Backup = clearAbandonedBackup(state.Nodes, staleNodes, status.Backup)
 
 	// Assess health
-	status.HealthReasons = computeClusterUnhealthyReasons(state.Nodes, status)
+	status.HealthReasons = nil
+	status.HealthReasonKinds = nil
+	for _, reason := range computeClusterUnhealthyReasons(state.Spec, state.Nodes, status) {
+		status.HealthReasons = append(status.HealthReasons, reason.message)
+		status.HealthReasonKinds = append(status.HealthReasonKinds, reason.kind)
+	}
 	status.Health = ClusterHealthHealthy
 	if len(status.HealthReasons) > 0 {
 		status.Health = ClusterHealthUnhealthy
 	}
 
-	// TODO: Handle failover state transitions
-
 	return status
 }
 
-// selectIntendedPrimary chooses which node should be the primary
-func selectIntendedPrimary(nodes []NodeStatus, currentPrimary string) string {
+// selectIntendedPrimary chooses which node should be the primary.
+// Delayed replicas are never chosen.
+func selectIntendedPrimary(spec ClusterSpec, nodes []NodeStatus, currentPrimary string) string {
 	// If we already have a primary and it's still in the cluster, keep it
-	if currentPrimary != "" {
+	if currentPrimary != "" && !spec.isDelayedReplica(currentPrimary) {
 		for _, node := range nodes {
 			if node.Name == currentPrimary {
 				return currentPrimary
@@ -174,22 +774,59 @@ func selectIntendedPrimary(nodes []NodeStatus, currentPrimary string) string {
 		}
 	}
 
-	// If we have no primary or current primary left, pick the best node
-	if len(nodes) > 0 {
-		// Pick first node with no error
-		for _, node := range nodes {
-			if node.Error == nil {
-				return node.Name
-			}
-		}
+	// If we have no primary or current primary left, pick the node
+	// that is furthest along whose Postgres isn't down. A failed
+	// query doesn't mean the node can't be a primary.
+	candidates := rankFailoverCandidates(spec, nodes)
+	if len(candidates) > 0 {
+		return candidates[0].Name
+	}
 
-		// Fallback to first node if no healthy nodes
-		return nodes[0].Name
+	// Fallback to first node if no healthy nodes
+	for _, node := range nodes {
+		if !spec.isDelayedReplica(node.Name) {
+			return node.Name
+		}
 	}
 
 	return ""
 }
 
+// rankFailoverCandidates returns the nodes that can become primary,
+// most up to date first. Nodes on a later timeline win, then nodes
+// with more WAL. Ties keep the original order.
+func rankFailoverCandidates(spec ClusterSpec, nodes []NodeStatus) []NodeStatus {
+	var candidates []NodeStatus
+	for _, node := range nodes {
+		if !nodeIsDown(node) && !spec.isDelayedReplica(node.Name) {
+			candidates = append(candidates, node)
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b NodeStatus) int {
+		if a.TimelineID != b.TimelineID {
+			return cmp.Compare(b.TimelineID, a.TimelineID)
+		}
+		return cmp.Compare(nodeWalPosition(b), nodeWalPosition(a))
+	})
+	return candidates
+}
+
+// nodeWalPosition is how far along a node's WAL is: the insert
+// position for primaries, and the durably received position for
+// replicas, since a promoted replica replays everything it received.
+func nodeWalPosition(node NodeStatus) LSN {
+	for _, lsn := range []*string{node.CurrentLsn, node.FlushLsn, node.ReplayLsn} {
+		if lsn == nil {
+			continue
+		}
+		if parsed, err := ParseLSN(*lsn); err == nil {
+			return parsed
+		}
+	}
+	return 0
+}
+
 // buildIntendedReplicas creates the replica list from all nodes except the primary
 func buildIntendedReplicas(nodes []NodeStatus, intendedPrimary string) []string {
 	var replicas []string
@@ -204,46 +841,365 @@ func buildIntendedReplicas(nodes []NodeStatus, intendedPrimary string) []string
 	return replicas
 }
 
+// startSwitchover makes target the intended primary. If the current
+// primary is healthy this is a planned switchover, and we demote it
+// cleanly before the target promotes. Otherwise the target promotes
+// right away.
+func startSwitchover(status ClusterStatus, nodes []NodeStatus, target string) (ClusterStatus, error) {
+	if status.FailoverState != "" && status.FailoverState != FailoverStateStable {
+		return status, fmt.Errorf("A switchover from %s to %s is already in progress (%s)", status.PreviousPrimary, status.IntendedPrimary, status.FailoverState)
+	}
+	if status.Upgrade.inProgress() {
+		return status, fmt.Errorf("A major version upgrade is in progress (%s)", status.Upgrade.Phase)
+	}
+	if status.IntendedPrimary == target {
+		return status, nil
+	}
+
+	idx := slices.IndexFunc(nodes, func(node NodeStatus) bool { return node.Name == status.IntendedPrimary })
+	if idx >= 0 && !nodeIsDown(nodes[idx]) && nodes[idx].IsPrimary {
+		status.FailoverState = FailoverStateDemotingOldPrimary
+		status.PreviousPrimary = status.IntendedPrimary
+		status.SwitchoverLsn = ""
+	}
+	status.IntendedPrimary = target
+	return status, nil
+}
+
+// advanceFailoverState moves a planned switchover along. Once the old
+// primary has published its shutdown checkpoint, or if it went down
+// before it could, the new primary may promote. The switchover is done
+// when the new primary reports that it is a primary. If the old
+// primary's pgdaemon stops before it publishes anything, we can't tell
+// whether its Postgres is still running, so we abort the switchover.
+func advanceFailoverState(status ClusterStatus, nodes []NodeStatus, staleNodes []string) ClusterStatus {
+	switch status.FailoverState {
+	case FailoverStateDemotingOldPrimary:
+		idx := slices.IndexFunc(nodes, func(node NodeStatus) bool { return node.Name == status.PreviousPrimary })
+		if idx >= 0 && nodes[idx].ShutdownCheckpointLsn != nil {
+			status.FailoverState = FailoverStatePromotingNewPrimary
+			status.SwitchoverLsn = *nodes[idx].ShutdownCheckpointLsn
+		} else if idx < 0 || nodeIsDown(nodes[idx]) {
+			// There is nothing to wait for
+			status.FailoverState = FailoverStatePromotingNewPrimary
+			status.SwitchoverLsn = ""
+		} else if slices.Contains(staleNodes, status.PreviousPrimary) {
+			status = revertSwitchover(status)
+		}
+	case FailoverStatePromotingNewPrimary:
+		idx := slices.IndexFunc(nodes, func(node NodeStatus) bool { return node.Name == status.IntendedPrimary })
+		if idx >= 0 && nodes[idx].IsPrimary && nodes[idx].Error == nil {
+			status.FailoverState = FailoverStateStable
+			status.PreviousPrimary = ""
+			status.SwitchoverLsn = ""
+		}
+	default:
+		status.FailoverState = FailoverStateStable
+	}
+	return status
+}
+
+// advanceUpgrade finishes an upgrade once every node runs the new
+// major version, and unpauses the cluster. The earlier phases are
+// driven by the primary itself. Nodes whose pgdaemon has stopped can't
+// upgrade, so we don't wait for them. They re-clone with the new
+// version when they come back. A replica that is re-cloning keeps
+// publishing its status from nodeStatusLoop, so it isn't stale, and
+// we wait for it.
+func advanceUpgrade(status ClusterStatus, nodes []NodeStatus, staleNodes []string) ClusterStatus {
+	if status.Upgrade == nil || status.Upgrade.Phase != UpgradePhaseUpgradingReplicas {
+		return status
+	}
+	for _, node := range nodes {
+		if node.Name != status.IntendedPrimary && !slices.Contains(status.IntendedReplicas, node.Name) {
+			continue
+		}
+		if slices.Contains(staleNodes, node.Name) {
+			continue
+		}
+		if nodeIsDown(node) || node.ServerVersionNum/10000 != status.Upgrade.TargetMajorVersion {
+			return status
+		}
+	}
+
+	upgrade := *status.Upgrade
+	upgrade.Phase = UpgradePhaseDone
+	status.Upgrade = &upgrade
+	status.Paused = false
+	return status
+}
+
+// selectBackupNode picks the replica that takes scheduled base
+// backups: a streaming replica that isn't delayed or paused. We stick
+// with the node that is taking a backup, or the current choice, so
+// the choice doesn't move around while nothing is wrong.
+func selectBackupNode(spec ClusterSpec, nodes []NodeStatus, status ClusterStatus) string {
+	candidates := healthyReplicas(spec, nodes, status)
+	if status.Backup != nil && slices.Contains(candidates, status.Backup.InProgressNode) {
+		return status.Backup.InProgressNode
+	}
+	if slices.Contains(candidates, status.BackupNode) {
+		return status.BackupNode
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0]
+}
+
+// healthyReplicas returns the replicas that are streaming and aren't
+// delayed or paused, which makes them good sources for base backups
+// and clones, sorted by name.
+func healthyReplicas(spec ClusterSpec, nodes []NodeStatus, status ClusterStatus) []string {
+	var replicas []string
+	for _, node := range nodes {
+		if !slices.Contains(status.IntendedReplicas, node.Name) || spec.isDelayedReplica(node.Name) {
+			continue
+		}
+		if node.Error != nil || node.ReplayPaused {
+			continue
+		}
+		if node.ReplicationStatus == nil || node.ReplicationStatus.Status != "streaming" {
+			continue
+		}
+		replicas = append(replicas, node.Name)
+	}
+	slices.Sort(replicas)
+	return replicas
+}
+
+// clearAbandonedBackup records a failure for an in-progress backup
+// whose daemon has stopped or left the cluster, so another node can
+// take over. The daemon runs the backup, so a node whose Postgres is
+// down still finishes it, and records the failure itself.
+func clearAbandonedBackup(nodes []NodeStatus, staleNodes []string, backup *ClusterBackupStatus) *ClusterBackupStatus {
+	if backup == nil || backup.InProgressNode == "" {
+		return backup
+	}
+
+	member := slices.ContainsFunc(nodes, func(node NodeStatus) bool { return node.Name == backup.InProgressNode })
+	if member && !slices.Contains(staleNodes, backup.InProgressNode) {
+		return backup
+	}
+
+	cleared := *backup
+	cleared.LastFailure = &BackupFailure{
+		Node:      backup.InProgressNode,
+		StartTime: backup.InProgressSince,
+		Error:     fmt.Sprintf("pgdaemon on %s stopped during the backup", backup.InProgressNode),
+	}
+	cleared.InProgressNode = ""
+	cleared.InProgressSince = ""
+	return &cleared
+}
+
+// maxHealthyReplayLagBytes is how far a replica's replay can fall
+// behind what it has received before we consider it unhealthy.
+const maxHealthyReplayLagBytes = 64 * 1024 * 1024
+
+// minHealthyDiskFreeBytes is how little free disk space a node can
+// have before we consider it unhealthy.
+const minHealthyDiskFreeBytes = 1024 * 1024 * 1024
+
+// buildReplicationUpstreams assigns an upstream to each replica that
+// asks for one in the spec. A replica can only be an upstream if it is
+// an intended replica, its Postgres isn't down, and its own upstream
+// chain leads back to the primary. This is recomputed on every cycle,
+// so cascaded replicas are re-parented to the primary when their
+// upstream fails or becomes the new primary.
+func buildReplicationUpstreams(spec ClusterSpec, nodes []NodeStatus, intendedPrimary string, intendedReplicas []string) map[string]string {
+	nodesByName := make(map[string]NodeStatus, len(nodes))
+	for _, node := range nodes {
+		nodesByName[node.Name] = node
+	}
+
+	// canServe returns true if name can be an upstream, following
+	// its own chain of upstreams to catch cycles.
+	var canServe func(name string, visited map[string]bool) bool
+	canServe = func(name string, visited map[string]bool) bool {
+		if name == intendedPrimary {
+			return true
+		}
+		if visited[name] || !slices.Contains(intendedReplicas, name) {
+			return false
+		}
+		node, ok := nodesByName[name]
+		if !ok || nodeIsDown(node) {
+			return false
+		}
+		visited[name] = true
+
+		next := spec.Nodes[name].ReplicateFrom
+		if next == "" {
+			return true
+		}
+		return canServe(next, visited)
+	}
+
+	upstreams := make(map[string]string)
+	for _, replica := range intendedReplicas {
+		requested := spec.Nodes[replica].ReplicateFrom
+		if requested == "" || requested == intendedPrimary {
+			continue
+		}
+		if canServe(requested, map[string]bool{replica: true}) {
+			upstreams[replica] = requested
+		}
+	}
+
+	if len(upstreams) == 0 {
+		return nil
+	}
+	return upstreams
+}
+
+// HealthReasonKind classifies a reason the cluster is unhealthy,
+// since the reasons themselves include node names and numbers.
+type HealthReasonKind string
+
+const (
+	HealthReasonOther                HealthReasonKind = "other"
+	HealthReasonNoNodes              HealthReasonKind = "no_nodes"
+	HealthReasonUpgradeFailed        HealthReasonKind = "upgrade_failed"
+	HealthReasonPostgresUnreachable  HealthReasonKind = "postgres_unreachable"
+	HealthReasonPostgresStarting     HealthReasonKind = "postgres_starting"
+	HealthReasonPgBouncerUnreachable HealthReasonKind = "pgbouncer_unreachable"
+	HealthReasonNodeError            HealthReasonKind = "node_error"
+	HealthReasonPgBouncerSaturated   HealthReasonKind = "pgbouncer_saturated"
+	HealthReasonLowDiskSpace         HealthReasonKind = "low_disk_space"
+	HealthReasonUnexpectedPrimary    HealthReasonKind = "unexpected_primary"
+	HealthReasonReplayLag            HealthReasonKind = "replay_lag"
+	HealthReasonUnexpectedReplica    HealthReasonKind = "unexpected_replica"
+	HealthReasonNotReplicating       HealthReasonKind = "not_replicating"
+	HealthReasonWrongUpstream        HealthReasonKind = "wrong_upstream"
+	HealthReasonReplicaCountMismatch HealthReasonKind = "replica_count_mismatch"
+)
+
+type healthReason struct {
+	kind    HealthReasonKind
+	message string
+}
+
 // computeClusterUnhealthyReasons assesses the overall health of the cluster
-func computeClusterUnhealthyReasons(nodes []NodeStatus, status ClusterStatus) []string {
+func computeClusterUnhealthyReasons(spec ClusterSpec, nodes []NodeStatus, status ClusterStatus) []healthReason {
 	if len(nodes) == 0 {
-		return []string{"No nodes in the cluster"}
+		return []healthReason{{HealthReasonNoNodes, "No nodes in the cluster"}}
 	}
 
-	var unhealthyReasons []string
+	var unhealthyReasons []healthReason
+
+	if status.Upgrade != nil && status.Upgrade.Phase == UpgradePhaseFailed {
+		reason := fmt.Sprintf("Major version upgrade of %s failed and needs manual repair: %s", status.Upgrade.Primary, status.Upgrade.Error)
+		unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonUpgradeFailed, reason})
+	}
 
 	for _, node := range nodes {
 		if node.Error != nil {
-			reason := fmt.Sprintf("Node %s has an error", node.Name)
-			unhealthyReasons = append(unhealthyReasons, reason)
-		} else if node.IsPrimary {
+			unhealthyReasons = append(unhealthyReasons, nodeErrorReason(node))
+
+			// If we got a node state, check it even though
+			// PgBouncer is broken.
+			if node.ErrorKind != NodeErrorPgBouncer {
+				continue
+			}
+		}
+
+		unhealthyReasons = append(unhealthyReasons, pgBouncerSaturationReasons(node, spec.pgBouncerMaxWaitSeconds())...)
+
+		if node.DiskFreeBytes != nil && *node.DiskFreeBytes < minHealthyDiskFreeBytes {
+			reason := fmt.Sprintf("Node %s has only %d bytes of free disk space", node.Name, *node.DiskFreeBytes)
+			unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonLowDiskSpace, reason})
+		}
+
+		if node.IsPrimary {
 			if node.Name != status.IntendedPrimary {
 				reason := fmt.Sprintf("Node %s is marked as primary but not intended primary", node.Name)
-				unhealthyReasons = append(unhealthyReasons, reason)
-			}
-			// Check replica statuses match
-			if len(node.Replicas) != len(status.IntendedReplicas) {
-				reason := fmt.Sprintf(
-					"Node %s has %d replica statuses but there are %d intended replicas",
-					node.Name,
-					len(node.Replicas),
-					len(status.IntendedReplicas),
-				)
-				unhealthyReasons = append(unhealthyReasons, reason)
+				unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonUnexpectedPrimary, reason})
+			} else if status.StandbyLeaderUpstream != "" {
+				reason := fmt.Sprintf("Node %s is a primary but should be a standby leader following %s", node.Name, status.StandbyLeaderUpstream)
+				unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonUnexpectedPrimary, reason})
 			}
 		} else {
-			// Node is replica
-			if !slices.Contains(status.IntendedReplicas, node.Name) {
+			// Node is replica. Delayed and paused replicas are
+			// expected to lag.
+			expectsLag := spec.isDelayedReplica(node.Name) || spec.Nodes[node.Name].ReplayPaused
+			if node.ReplayLagBytes != nil && *node.ReplayLagBytes > maxHealthyReplayLagBytes && !expectsLag {
+				reason := fmt.Sprintf("Node %s replay is %d bytes behind what it received", node.Name, *node.ReplayLagBytes)
+				unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonReplayLag, reason})
+			}
+			isStandbyLeader := node.Name == status.IntendedPrimary && status.StandbyLeaderUpstream != ""
+			if !slices.Contains(status.IntendedReplicas, node.Name) && !isStandbyLeader {
 				reason := fmt.Sprintf("Node %s is not in the intended replicas list", node.Name)
-				unhealthyReasons = append(unhealthyReasons, reason)
+				unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonUnexpectedReplica, reason})
 			}
-			// Should be replicating to primary
+			// Should be replicating from its upstream
 			if node.ReplicationStatus == nil {
 				reason := fmt.Sprintf("Node %s has no replication status", node.Name)
-				unhealthyReasons = append(unhealthyReasons, reason)
+				unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonNotReplicating, reason})
+			} else if upstream := status.UpstreamFor(node.Name); node.ReplicationStatus.PrimaryHost != upstream {
+				reason := fmt.Sprintf("Node %s is replicating from %s but its intended upstream is %s", node.Name, node.ReplicationStatus.PrimaryHost, upstream)
+				unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonWrongUpstream, reason})
+			}
+		}
+
+		// Check replica statuses match the replicas that should
+		// be streaming from this node
+		downstreams := 0
+		for _, replica := range status.IntendedReplicas {
+			if status.UpstreamFor(replica) == node.Name {
+				downstreams++
 			}
 		}
+		if (node.IsPrimary || downstreams > 0) && len(node.Replicas) != downstreams {
+			reason := fmt.Sprintf(
+				"Node %s has %d replica statuses but there are %d intended replicas",
+				node.Name,
+				len(node.Replicas),
+				downstreams,
+			)
+			unhealthyReasons = append(unhealthyReasons, healthReason{HealthReasonReplicaCountMismatch, reason})
+		}
 	}
 
 	return unhealthyReasons
 }
+
+// pgBouncerSaturationReasons reports PgBouncer pools where clients
+// have waited more than maxWaitSeconds for a server connection.
+func pgBouncerSaturationReasons(node NodeStatus, maxWaitSeconds int) []healthReason {
+	if node.PgBouncer == nil {
+		return nil
+	}
+	var reasons []healthReason
+	for _, pool := range node.PgBouncer.Pools {
+		if pool.ClientsWaiting > 0 && pool.MaxWaitUs >= int64(maxWaitSeconds)*1_000_000 {
+			reason := fmt.Sprintf(
+				"Node %s PgBouncer pool %s/%s is saturated: %d clients waiting up to %s",
+				node.Name,
+				pool.Database,
+				pool.User,
+				pool.ClientsWaiting,
+				time.Duration(pool.MaxWaitUs)*time.Microsecond,
+			)
+			reasons = append(reasons, healthReason{HealthReasonPgBouncerSaturated, reason})
+		}
+	}
+	return reasons
+}
+
+func nodeErrorReason(node NodeStatus) healthReason {
+	switch node.ErrorKind {
+	case NodeErrorConnection:
+		return healthReason{HealthReasonPostgresUnreachable, fmt.Sprintf("Node %s cannot connect to Postgres", node.Name)}
+	case NodeErrorAuthentication:
+		return healthReason{HealthReasonPostgresUnreachable, fmt.Sprintf("Node %s failed to authenticate to Postgres", node.Name)}
+	case NodeErrorStartingUp:
+		return healthReason{HealthReasonPostgresStarting, fmt.Sprintf("Node %s Postgres is starting up or in recovery", node.Name)}
+	case NodeErrorQuery:
+		return healthReason{HealthReasonPostgresUnreachable, fmt.Sprintf("Node %s failed to query Postgres", node.Name)}
+	case NodeErrorPgBouncer:
+		return healthReason{HealthReasonPgBouncerUnreachable, fmt.Sprintf("Node %s cannot query Postgres through PgBouncer", node.Name)}
+	default:
+		return healthReason{HealthReasonNodeError, fmt.Sprintf("Node %s has an error", node.Name)}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestComputeNewClusterStatus_EmptyCluster(t *testing.T) {
@@ -12,7 +15,7 @@ func TestComputeNewClusterStatus_EmptyCluster(t *testing.T) {
 		Nodes:  []NodeStatus{},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
 	assert.Contains(t, result.HealthReasons, "No nodes in the cluster")
@@ -32,7 +35,7 @@ func TestComputeNewClusterStatus_SingleHealthyNode(t *testing.T) {
 		},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	assert.Equal(t, ClusterHealthHealthy, result.Health)
 	assert.Empty(t, result.HealthReasons)
@@ -76,7 +79,7 @@ func TestComputeNewClusterStatus_PrimaryWithReplicas(t *testing.T) {
 		},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	assert.Equal(t, ClusterHealthHealthy, result.Health)
 	assert.Empty(t, result.HealthReasons)
@@ -97,7 +100,7 @@ func TestComputeNewClusterStatus_NodeWithError(t *testing.T) {
 		},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
 	assert.Contains(t, result.HealthReasons, "Node node1 has an error")
@@ -123,7 +126,7 @@ func TestComputeNewClusterStatus_WrongPrimary(t *testing.T) {
 		},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
 	assert.Contains(t, result.HealthReasons, "Node node1 is marked as primary but not intended primary")
@@ -152,7 +155,7 @@ func TestComputeNewClusterStatus_ReplicaMissingReplicationStatus(t *testing.T) {
 		},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
 	assert.Contains(t, result.HealthReasons, "Node node2 has no replication status")
@@ -178,9 +181,659 @@ func TestComputeNewClusterStatus_PrimaryFailoverToHealthyNode(t *testing.T) {
 		},
 	}
 
-	result := ComputeNewClusterStatus(state)
+	result := ComputeNewClusterStatus(state, nil)
 
 	// Current logic keeps existing primary even with error, only changes if node leaves cluster
 	assert.Equal(t, "node1", result.IntendedPrimary)
 	assert.ElementsMatch(t, []string{"node2"}, result.IntendedReplicas)
 }
+
+func TestComputeNewClusterStatus_ErrorKindsInHealthReasons(t *testing.T) {
+	connErr := "connection refused"
+	queryErr := "query timed out"
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				Error:     &queryErr,
+				ErrorKind: NodeErrorQuery,
+			},
+			{
+				Name:      "node2",
+				Error:     &connErr,
+				ErrorKind: NodeErrorConnection,
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
+	assert.ElementsMatch(t, []string{
+		"Node node1 failed to query Postgres",
+		"Node node2 cannot connect to Postgres",
+	}, result.HealthReasons)
+}
+
+func TestComputeNewClusterStatus_PgBouncerErrorStillChecksRole(t *testing.T) {
+	pgBouncerErr := "pgbouncer is down"
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				Replicas:  []NodeReplicas{{Hostname: "node2"}},
+			},
+			{
+				Name:      "node2",
+				Error:     &pgBouncerErr,
+				ErrorKind: NodeErrorPgBouncer,
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.ElementsMatch(t, []string{
+		"Node node2 cannot query Postgres through PgBouncer",
+		"Node node2 has no replication status",
+	}, result.HealthReasons)
+}
+
+func TestComputeNewClusterStatus_QueryErrorNodeCanBecomePrimary(t *testing.T) {
+	connErr := "connection refused"
+	queryErr := "query timed out"
+	state := ClusterState{
+		Status: ClusterStatus{},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				Error:     &connErr,
+				ErrorKind: NodeErrorConnection,
+			},
+			{
+				Name:      "node2",
+				Error:     &queryErr,
+				ErrorKind: NodeErrorQuery,
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, "node2", result.IntendedPrimary)
+	assert.ElementsMatch(t, []string{"node1"}, result.IntendedReplicas)
+}
+
+func TestComputeNewClusterStatus_NewPrimaryIsMostUpToDate(t *testing.T) {
+	behind := "0/3000000"
+	ahead := "0/5000000"
+	state := ClusterState{
+		Status: ClusterStatus{},
+		Nodes: []NodeStatus{
+			{Name: "node1", TimelineID: 2, FlushLsn: &behind},
+			{Name: "node2", TimelineID: 2, FlushLsn: &ahead},
+			{Name: "node3", TimelineID: 1, FlushLsn: &ahead},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, "node2", result.IntendedPrimary)
+	assert.ElementsMatch(t, []string{"node1", "node3"}, result.IntendedReplicas)
+}
+
+func TestComputeNewClusterStatus_LagAndDiskSpace(t *testing.T) {
+	lag := int64(maxHealthyReplayLagBytes + 1)
+	diskFree := int64(1024)
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:          "node1",
+				IsPrimary:     true,
+				Replicas:      []NodeReplicas{{Hostname: "node2"}},
+				DiskFreeBytes: &diskFree,
+			},
+			{
+				Name:              "node2",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"},
+				ReplayLagBytes:    &lag,
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.ElementsMatch(t, []string{
+		"Node node1 has only 1024 bytes of free disk space",
+		"Node node2 replay is 67108865 bytes behind what it received",
+	}, result.HealthReasons)
+}
+
+func TestComputeNewClusterStatus_CascadingReplica(t *testing.T) {
+	state := ClusterState{
+		Spec: ClusterSpec{
+			Nodes: map[string]NodeSpec{
+				"node3": {ReplicateFrom: "node2"},
+			},
+		},
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				Replicas:  []NodeReplicas{{Hostname: "node2"}},
+			},
+			{
+				Name:              "node2",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"},
+				Replicas:          []NodeReplicas{{Hostname: "node3"}},
+			},
+			{
+				Name:              "node3",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node2", Status: "streaming"},
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, ClusterHealthHealthy, result.Health)
+	assert.Empty(t, result.HealthReasons)
+	assert.Equal(t, map[string]string{"node3": "node2"}, result.ReplicationUpstreams)
+	assert.Equal(t, "node2", result.UpstreamFor("node3"))
+	assert.Equal(t, "node1", result.UpstreamFor("node2"))
+}
+
+func TestComputeNewClusterStatus_CascadingReplicaWrongUpstream(t *testing.T) {
+	state := ClusterState{
+		Spec: ClusterSpec{
+			Nodes: map[string]NodeSpec{
+				"node3": {ReplicateFrom: "node2"},
+			},
+		},
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				Replicas:  []NodeReplicas{{Hostname: "node2"}, {Hostname: "node3"}},
+			},
+			{
+				Name:              "node2",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"},
+			},
+			{
+				Name:              "node3",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"},
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.ElementsMatch(t, []string{
+		"Node node3 is replicating from node1 but its intended upstream is node2",
+		"Node node2 has 0 replica statuses but there are 1 intended replicas",
+		"Node node1 has 2 replica statuses but there are 1 intended replicas",
+	}, result.HealthReasons)
+}
+
+func TestComputeNewClusterStatus_StandbyCluster(t *testing.T) {
+	state := ClusterState{
+		Spec: ClusterSpec{
+			StandbyCluster: &StandbyClusterSpec{Host: "external-primary"},
+		},
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:              "node1",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "external-primary", Status: "streaming"},
+				Replicas:          []NodeReplicas{{Hostname: "node2"}},
+			},
+			{
+				Name:              "node2",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"},
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, ClusterHealthHealthy, result.Health)
+	assert.Empty(t, result.HealthReasons)
+	assert.Equal(t, "node1", result.IntendedPrimary)
+	assert.Equal(t, "external-primary", result.StandbyLeaderUpstream)
+	assert.Equal(t, "external-primary", result.UpstreamFor("node1"))
+	assert.Equal(t, "node1", result.UpstreamFor("node2"))
+}
+
+func TestComputeNewClusterStatus_StandbyLeaderIsPrimary(t *testing.T) {
+	state := ClusterState{
+		Spec: ClusterSpec{
+			StandbyCluster: &StandbyClusterSpec{Host: "external-primary"},
+		},
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				Replicas:  []NodeReplicas{{Hostname: "node2"}},
+			},
+			{
+				Name:              "node2",
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"},
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, []string{
+		"Node node1 is a primary but should be a standby leader following external-primary",
+	}, result.HealthReasons)
+}
+
+func TestBuildReplicationUpstreams_ReparentsWhenUpstreamUnavailable(t *testing.T) {
+	connErr := "connection refused"
+	spec := ClusterSpec{
+		Nodes: map[string]NodeSpec{
+			"node2": {ReplicateFrom: "node4"},
+			"node3": {ReplicateFrom: "node2"},
+			"node4": {ReplicateFrom: "node3"},
+			"node5": {ReplicateFrom: "node6"},
+		},
+	}
+	nodes := []NodeStatus{
+		{Name: "node1"},
+		{Name: "node2"},
+		{Name: "node3"},
+		{Name: "node4"},
+		{Name: "node5"},
+		{Name: "node6", Error: &connErr, ErrorKind: NodeErrorConnection},
+	}
+	replicas := []string{"node2", "node3", "node4", "node5", "node6"}
+
+	// node2 -> node4 -> node3 -> node2 is a cycle and node6 is down,
+	// so everything streams from the primary.
+	assert.Nil(t, buildReplicationUpstreams(spec, nodes, "node1", replicas))
+
+	// After failover to node2, node3 can cascade from it because it
+	// is now the primary, and node4 can cascade from node3.
+	upstreams := buildReplicationUpstreams(spec, nodes, "node2", []string{"node1", "node3", "node4", "node5", "node6"})
+	assert.Equal(t, map[string]string{"node4": "node3"}, upstreams)
+}
+
+func TestComputeNewClusterStatus_DelayedReplicaNeverPrimary(t *testing.T) {
+	ahead := "0/9000000"
+	behind := "0/3000000"
+	lag := int64(maxHealthyReplayLagBytes * 10)
+	state := ClusterState{
+		Spec: ClusterSpec{
+			Nodes: map[string]NodeSpec{
+				"node1": {ApplyDelay: "1h"},
+			},
+		},
+		Status: ClusterStatus{},
+		Nodes: []NodeStatus{
+			{
+				Name:              "node1",
+				FlushLsn:          &ahead,
+				ReplayLagBytes:    &lag,
+				ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node2", Status: "streaming"},
+			},
+			{Name: "node2", FlushLsn: &behind},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+
+	assert.Equal(t, "node2", result.IntendedPrimary)
+	assert.Equal(t, []string{"node1"}, result.IntendedReplicas)
+	for _, reason := range result.HealthReasons {
+		assert.NotContains(t, reason, "bytes behind")
+	}
+
+	// Even an existing primary is replaced if it becomes delayed
+	state.Status.IntendedPrimary = "node1"
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, "node2", result.IntendedPrimary)
+}
+
+func TestComputeNewClusterStatus_BackupNode(t *testing.T) {
+	streaming := &NodeReplicationStatus{PrimaryHost: "node1", Status: "streaming"}
+	connErr := "connection refused"
+	state := ClusterState{
+		Spec: ClusterSpec{
+			Nodes: map[string]NodeSpec{
+				"node2": {ApplyDelay: "1h"},
+			},
+		},
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true},
+			{Name: "node2", ReplicationStatus: streaming},
+			{Name: "node3", Error: &connErr, ErrorKind: NodeErrorConnection},
+			{Name: "node5", ReplicationStatus: streaming},
+			{Name: "node4", ReplicationStatus: streaming},
+		},
+	}
+
+	// Not the primary, delayed replicas, or down replicas
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, "node4", result.BackupNode)
+
+	// Stick with the node that is taking a backup
+	state.Status.Backup = &ClusterBackupStatus{InProgressNode: "node5"}
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, "node5", result.BackupNode)
+
+	// No healthy replicas means no backups, rather than loading the
+	// primary
+	state.Status.Backup = nil
+	state.Nodes = state.Nodes[:3]
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Empty(t, result.BackupNode)
+}
+
+func TestComputeNewClusterStatus_ClearsAbandonedBackup(t *testing.T) {
+	connErr := "connection refused"
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+			Backup: &ClusterBackupStatus{
+				InProgressNode:  "node2",
+				InProgressSince: "2025-07-01T00:00:00Z",
+			},
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true},
+			{Name: "node2", Error: &connErr, ErrorKind: NodeErrorConnection},
+		},
+	}
+
+	// Postgres being down doesn't stop the daemon from finishing
+	// the backup, or from recording its failure
+	result := ComputeNewClusterStatus(state, nil)
+	require.NotNil(t, result.Backup)
+	assert.Equal(t, "node2", result.Backup.InProgressNode)
+
+	result = ComputeNewClusterStatus(state, []string{"node2"})
+
+	require.NotNil(t, result.Backup)
+	assert.Empty(t, result.Backup.InProgressNode)
+	assert.Equal(t, &BackupFailure{
+		Node:      "node2",
+		StartTime: "2025-07-01T00:00:00Z",
+		Error:     "pgdaemon on node2 stopped during the backup",
+	}, result.Backup.LastFailure)
+
+	// A node that left the cluster doesn't finish its backup either
+	state.Nodes = state.Nodes[:1]
+	result = ComputeNewClusterStatus(state, nil)
+	require.NotNil(t, result.Backup)
+	assert.Empty(t, result.Backup.InProgressNode)
+
+	// The stored status isn't modified in place
+	assert.Equal(t, "node2", state.Status.Backup.InProgressNode)
+}
+
+func TestStartSwitchover(t *testing.T) {
+	nodes := []NodeStatus{
+		{Name: "node1", IsPrimary: true},
+		{Name: "node2"},
+	}
+	status := ClusterStatus{IntendedPrimary: "node1", FailoverState: FailoverStateStable}
+
+	result, err := startSwitchover(status, nodes, "node2")
+	require.NoError(t, err)
+	assert.Equal(t, "node2", result.IntendedPrimary)
+	assert.Equal(t, "node1", result.PreviousPrimary)
+	assert.Equal(t, FailoverStateDemotingOldPrimary, result.FailoverState)
+
+	// Only one switchover at a time
+	_, err = startSwitchover(result, nodes, "node1")
+	assert.ErrorContains(t, err, "already in progress")
+
+	// A primary that is down can't be demoted, so just fail over
+	connErr := "connection refused"
+	nodes[0].Error = &connErr
+	nodes[0].ErrorKind = NodeErrorConnection
+	result, err = startSwitchover(status, nodes, "node2")
+	require.NoError(t, err)
+	assert.Equal(t, "node2", result.IntendedPrimary)
+	assert.Equal(t, FailoverStateStable, result.FailoverState)
+	assert.Empty(t, result.PreviousPrimary)
+
+	// No switchovers in the middle of an upgrade
+	status.Upgrade = &ClusterUpgradeStatus{Phase: UpgradePhaseUpgradingPrimary}
+	_, err = startSwitchover(status, nodes, "node2")
+	assert.ErrorContains(t, err, "upgrade is in progress")
+}
+
+func TestComputeNewClusterStatus_SwitchoverStates(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node2",
+			PreviousPrimary: "node1",
+			FailoverState:   FailoverStateDemotingOldPrimary,
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true},
+			{Name: "node2"},
+		},
+	}
+
+	// Keep waiting while the old primary shuts down
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, FailoverStateDemotingOldPrimary, result.FailoverState)
+	assert.Equal(t, "node2", result.IntendedPrimary)
+
+	// The old primary published its shutdown checkpoint
+	connErr := "connection refused"
+	shutdownLsn := "0/5000028"
+	state.Nodes[0] = NodeStatus{Name: "node1", Error: &connErr, ErrorKind: NodeErrorConnection, ShutdownCheckpointLsn: &shutdownLsn}
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, FailoverStatePromotingNewPrimary, result.FailoverState)
+	assert.Equal(t, "0/5000028", result.SwitchoverLsn)
+
+	// The new primary promoted
+	state.Status = result
+	state.Nodes[1].IsPrimary = true
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, FailoverStateStable, result.FailoverState)
+	assert.Empty(t, result.PreviousPrimary)
+	assert.Empty(t, result.SwitchoverLsn)
+}
+
+func TestComputeNewClusterStatus_SwitchoverOldPrimaryDied(t *testing.T) {
+	connErr := "connection refused"
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node2",
+			PreviousPrimary: "node1",
+			FailoverState:   FailoverStateDemotingOldPrimary,
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", Error: &connErr, ErrorKind: NodeErrorConnection},
+			{Name: "node2"},
+		},
+	}
+
+	// Don't wait for a shutdown checkpoint that will never come
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, FailoverStatePromotingNewPrimary, result.FailoverState)
+	assert.Empty(t, result.SwitchoverLsn)
+}
+
+func TestComputeNewClusterStatus_SwitchoverOldPrimaryDaemonStopped(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node2",
+			PreviousPrimary: "node1",
+			FailoverState:   FailoverStateDemotingOldPrimary,
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true},
+			{Name: "node2"},
+		},
+	}
+
+	// Its last status looks healthy, but we can't tell if Postgres
+	// is still running, so give up on the switchover.
+	result := ComputeNewClusterStatus(state, []string{"node1"})
+	assert.Equal(t, FailoverStateStable, result.FailoverState)
+	assert.Equal(t, "node1", result.IntendedPrimary)
+	assert.Empty(t, result.PreviousPrimary)
+
+	_, err := startSwitchover(result, state.Nodes, "node2")
+	assert.NoError(t, err)
+}
+
+func TestComputeNewClusterStatus_PgBouncerSaturation(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1"},
+		Nodes: []NodeStatus{
+			{
+				Name:      "node1",
+				IsPrimary: true,
+				PgBouncer: &NodePgBouncerStatus{Pools: []PgBouncerPoolStats{
+					{Database: "app", User: "postgres", ClientsWaiting: 5, MaxWaitUs: 2_500_000},
+					{Database: "reports", User: "postgres", ClientsWaiting: 1, MaxWaitUs: 100},
+				}},
+			},
+		},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
+	assert.Equal(t, []string{"Node node1 PgBouncer pool app/postgres is saturated: 5 clients waiting up to 2.5s"}, result.HealthReasons)
+
+	// The threshold comes from the spec
+	state.Spec.PgBouncer = &PgBouncerSpec{MaxWaitSeconds: 5}
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, ClusterHealthHealthy, result.Health)
+}
+
+func TestComputeNewClusterStatus_PausedKeepsPrimary(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1", Paused: true},
+		Nodes:  []NodeStatus{{Name: "node2"}},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, "node1", result.IntendedPrimary)
+
+	state.Status.Paused = false
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, "node2", result.IntendedPrimary)
+}
+
+func TestComputeNewClusterStatus_UpgradeFinishes(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+			Paused:          true,
+			Upgrade:         &ClusterUpgradeStatus{Phase: UpgradePhaseUpgradingReplicas, Primary: "node1", TargetMajorVersion: 17},
+		},
+		Nodes: []NodeStatus{
+			{Name: "node1", IsPrimary: true, ServerVersionNum: 170002},
+			{Name: "node2", ServerVersionNum: 160004},
+		},
+	}
+
+	// node2 hasn't re-cloned yet
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, UpgradePhaseUpgradingReplicas, result.Upgrade.Phase)
+	assert.True(t, result.Paused)
+
+	state.Nodes[1].ServerVersionNum = 170002
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, UpgradePhaseDone, result.Upgrade.Phase)
+	assert.False(t, result.Paused)
+	// The input status is unchanged
+	assert.Equal(t, UpgradePhaseUpgradingReplicas, state.Status.Upgrade.Phase)
+
+	// Wait for a node that is re-cloning, which reports Postgres as
+	// down while pg_basebackup runs
+	errStr := "connect to Postgres: connection refused"
+	state.Nodes[1] = NodeStatus{Name: "node2", Error: &errStr, ErrorKind: NodeErrorConnection, Upgrade: &NodeUpgradeStatus{Phase: NodeUpgradePhaseRecloning}}
+	result = ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, UpgradePhaseUpgradingReplicas, result.Upgrade.Phase)
+	assert.True(t, result.Paused)
+
+	// Don't wait for a node whose pgdaemon stopped
+	state.Nodes[1] = NodeStatus{Name: "node2", ServerVersionNum: 160004}
+	result = ComputeNewClusterStatus(state, []string{"node2"})
+	assert.Equal(t, UpgradePhaseDone, result.Upgrade.Phase)
+	assert.False(t, result.Paused)
+}
+
+func TestComputeNewClusterStatus_FailedUpgradeIsUnhealthy(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{
+			IntendedPrimary: "node1",
+			Paused:          true,
+			Upgrade:         &ClusterUpgradeStatus{Phase: UpgradePhaseFailed, Primary: "node1", Error: "pg_upgrade failed"},
+		},
+		Nodes: []NodeStatus{{Name: "node1", IsPrimary: true}},
+	}
+
+	result := ComputeNewClusterStatus(state, nil)
+	assert.Equal(t, ClusterHealthUnhealthy, result.Health)
+	assert.Contains(t, result.HealthReasons, "Major version upgrade of node1 failed and needs manual repair: pg_upgrade failed")
+}
+
+func TestModifyClusterSpec(t *testing.T) {
+	store := &memStore{}
+	require.NoError(t, store.SetClusterSpec(t.Context(), &ClusterSpec{Nodes: map[string]NodeSpec{"node1": {}}}))
+
+	// Someone else freezes writes while we change a node, and we
+	// don't undo that
+	writes := 0
+	store.beforeSpecWrite = func(state *ClusterState) {
+		writes++
+		if writes == 1 {
+			state.Spec.ReadOnly = true
+			state.Spec.SpecUuid = uuid.New()
+		}
+	}
+	err := modifyClusterSpec(t.Context(), store, func(spec *ClusterSpec) error {
+		spec.Nodes = map[string]NodeSpec{"node1": {ApplyDelay: "1h"}}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, writes)
+	assert.True(t, store.state.Spec.ReadOnly)
+	assert.Equal(t, "1h", store.state.Spec.Nodes["node1"].ApplyDelay)
+
+	// A rejected update leaves the spec alone
+	specUUID := store.state.Spec.SpecUuid
+	err = modifyClusterSpec(t.Context(), store, func(spec *ClusterSpec) error {
+		spec.ReadOnly = false
+		return errors.New("no")
+	})
+	assert.EqualError(t, err, "no")
+	assert.Equal(t, specUUID, store.state.Spec.SpecUuid)
+	assert.True(t, store.state.Spec.ReadOnly)
+}
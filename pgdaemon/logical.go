@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// logicalCutoverTimeout is how long logical-cutover waits for the
+// source primary to freeze writes, and then for the subscription to
+// catch up, before it gives up and unfreezes writes.
+const logicalCutoverTimeout = 60 * time.Second
+
+// readOnlyConfContent freezes writes for ClusterSpec.ReadOnly.
+const readOnlyConfContent = "default_transaction_read_only = on\n"
+
+// ensureReadOnly applies ClusterSpec.ReadOnly on the primary. Sessions
+// that started before the reload, or that SET the default back, could
+// still write, so we terminate them once the setting has been applied.
+func (p *PostgresNode) ensureReadOnly(ctx context.Context, readOnly bool) error {
+	var content []byte
+	if readOnly {
+		content = []byte(readOnlyConfContent)
+	}
+	changed, err := writeConfFile(p.dataDir+"/postgresql.conf.d/read_only.conf", content)
+	if err != nil {
+		return fmt.Errorf("failed to write read_only.conf: %w", err)
+	}
+	if changed {
+		log.Printf("Setting default_transaction_read_only = %t", readOnly)
+		if err := p.postgres.Reload(); err != nil {
+			return fmt.Errorf("failed to reload Postgres service: %w", err)
+		}
+	}
+
+	if !readOnly {
+		p.statusMu.Lock()
+		p.readOnly = false
+		p.statusMu.Unlock()
+		return nil
+	}
+	if p.readOnly {
+		return nil
+	}
+
+	var setting string
+	if err := p.pool.QueryRow(ctx, "SELECT current_setting('default_transaction_read_only')").Scan(&setting); err != nil {
+		return fmt.Errorf("failed to check default_transaction_read_only: %w", err)
+	}
+	if setting != "on" {
+		// Postgres hasn't processed the reload yet
+		return nil
+	}
+	terminated, err := p.terminateClientBackends(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Writes are frozen, terminated %d client backends", terminated)
+	p.statusMu.Lock()
+	p.readOnly = true
+	p.statusMu.Unlock()
+	return nil
+}
+
+// logicalGroup is a logical replication group: a publication on this
+// cluster's primary, replicated into the primary of a target cluster
+// managed under another cluster name. Once the target has caught up,
+// clients can be moved over to it, e.g. to rebuild bloated tables or
+// to split a shard.
+type logicalGroup struct {
+	// name is the name of the publication, the subscription, and the
+	// replication slot.
+	name string
+
+	sourcePrimary    string
+	sourcePort       int
+	targetPrimary    string
+	targetPort       int
+	sourceConnString string
+	targetConnString string
+
+	// database is the database we replicate. replicationUser is the
+	// role the subscription connects as if the target has a
+	// replication password.
+	database        string
+	replicationUser string
+}
+
+// LogicalReplicationStatus is the output of logical-status.
+type LogicalReplicationStatus struct {
+	Name          string `json:"name"`
+	SourcePrimary string `json:"source_primary"`
+	TargetPrimary string `json:"target_primary"`
+
+	// SlotActive is true while the subscription is streaming from
+	// the slot on the source primary.
+	SlotActive        bool    `json:"slot_active"`
+	SourceLsn         string  `json:"source_lsn"`
+	ConfirmedFlushLsn *string `json:"confirmed_flush_lsn,omitempty"`
+	// LagBytes is how much WAL the target hasn't confirmed yet.
+	LagBytes *int64 `json:"lag_bytes,omitempty"`
+
+	// TablesSyncing is the number of tables still doing their
+	// initial copy.
+	TablesSyncing      int     `json:"tables_syncing"`
+	LastMsgReceiptTime *string `json:"last_msg_receipt_time,omitempty"`
+}
+
+// clusterPrimary returns the cluster's primary if it is up and not in
+// the middle of a switchover.
+func clusterPrimary(state ClusterState) (string, error) {
+	primary := state.Status.IntendedPrimary
+	if state.Status.FailoverState != "" && state.Status.FailoverState != FailoverStateStable {
+		return "", fmt.Errorf("a switchover to %s is in progress", primary)
+	}
+	idx := slices.IndexFunc(state.Nodes, func(node NodeStatus) bool { return node.Name == primary })
+	if primary == "" || idx < 0 || nodeIsDown(state.Nodes[idx]) || !state.Nodes[idx].IsPrimary {
+		return "", fmt.Errorf("primary %q is not up", primary)
+	}
+	return primary, nil
+}
+
+// logicalConnString is how the CLI connects to a primary, as -pguser.
+func logicalConnString(conf config, host string) string {
+	return fmt.Sprintf("host=%s port=%d user=%s dbname=%s %s",
+		conninfoValue(host), conf.postgresPort, conninfoValue(conf.postgresUser), conninfoValue(conf.logicalDatabase),
+		connSecurity{rootCert: conf.tlsCA}.sslParams())
+}
+
+func newLogicalGroup(ctx context.Context, conf config, source StateStore, target StateStore) (*logicalGroup, error) {
+	sourceState, err := source.FetchClusterState(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch cluster state: %w", err)
+	}
+	sourcePrimary, err := clusterPrimary(sourceState)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %w", conf.clusterName, err)
+	}
+	targetState, err := target.FetchClusterState(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch state of cluster %s: %w", conf.targetCluster, err)
+	}
+	targetPrimary, err := clusterPrimary(targetState)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %w", conf.targetCluster, err)
+	}
+
+	return &logicalGroup{
+		name:             conf.publication,
+		sourcePrimary:    sourcePrimary,
+		sourcePort:       conf.postgresPort,
+		targetPrimary:    targetPrimary,
+		targetPort:       conf.postgresPort,
+		sourceConnString: logicalConnString(conf, sourcePrimary),
+		targetConnString: logicalConnString(conf, targetPrimary),
+		database:         conf.logicalDatabase,
+		replicationUser:  conf.replicationUser,
+	}, nil
+}
+
+// subscriptionSettings are the target primary's settings that decide
+// how it connects to the source primary.
+type subscriptionSettings struct {
+	dataDir     string
+	hasPassfile bool
+	ssl         bool
+	caFile      string
+}
+
+// subscriptionConnString is the CONNECTION of the subscription. The
+// target primary makes this connection, not the CLI, so it uses the
+// passfile and CA that pgdaemon set up on the target rather than the
+// CLI's own. Without a passfile the target has no replication
+// password and we fall back to -pguser, which only works with trust
+// auth.
+func (g *logicalGroup) subscriptionConnString(settings subscriptionSettings, fallbackUser string) string {
+	parts := []string{"host=" + conninfoValue(g.sourcePrimary), fmt.Sprintf("port=%d", g.sourcePort)}
+	if settings.hasPassfile {
+		parts = append(parts, "user="+conninfoValue(g.replicationUser), "passfile="+conninfoValue(settings.dataDir+".pgdaemon-pgpass"))
+	} else {
+		parts = append(parts, "user="+conninfoValue(fallbackUser))
+	}
+	parts = append(parts, "dbname="+conninfoValue(g.database))
+
+	var security connSecurity
+	if settings.ssl && settings.caFile != "" {
+		security.rootCert = settings.caFile
+		if !filepath.IsAbs(security.rootCert) {
+			security.rootCert = filepath.Join(settings.dataDir, security.rootCert)
+		}
+	}
+	parts = append(parts, security.sslParams())
+	return strings.Join(parts, " ")
+}
+
+// fetchSubscriptionSettings reads the settings for
+// subscriptionConnString from the target primary.
+func fetchSubscriptionSettings(ctx context.Context, target *pgx.Conn) (subscriptionSettings, error) {
+	var settings subscriptionSettings
+	err := target.QueryRow(ctx, `
+		SELECT current_setting('data_directory'),
+			(pg_stat_file(current_setting('data_directory') || '.pgdaemon-pgpass', true)).size IS NOT NULL,
+			current_setting('ssl') = 'on',
+			current_setting('ssl_ca_file')`,
+	).Scan(&settings.dataDir, &settings.hasPassfile, &settings.ssl, &settings.caFile)
+	if err != nil {
+		return settings, fmt.Errorf("failed to query target settings: %w", err)
+	}
+	return settings, nil
+}
+
+// Setup creates the publication on the source primary and the
+// subscription on the target primary. The subscription copies the
+// existing rows and then streams changes. The target must already have
+// the schema, e.g. from pg_dump --schema-only. Setup is idempotent.
+func (g *logicalGroup) Setup(ctx context.Context) error {
+	ident := pgx.Identifier{g.name}.Sanitize()
+
+	source, err := pgx.Connect(ctx, g.sourceConnString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to source primary %s: %w", g.sourcePrimary, err)
+	}
+	defer source.Close(context.Background())
+
+	target, err := pgx.Connect(ctx, g.targetConnString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target primary %s: %w", g.targetPrimary, err)
+	}
+	defer target.Close(context.Background())
+
+	settings, err := fetchSubscriptionSettings(ctx, target)
+	if err != nil {
+		return err
+	}
+	fallbackUser := target.Config().User
+
+	var exists bool
+	if err := source.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", g.name).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up publication: %w", err)
+	}
+	if !exists {
+		if _, err := source.Exec(ctx, fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", ident)); err != nil {
+			return fmt.Errorf("failed to create publication: %w", err)
+		}
+		log.Printf("Created publication %s on %s", g.name, g.sourcePrimary)
+	}
+	if settings.hasPassfile {
+		// The initial copy reads every table as the replication
+		// role. It can already read everything through physical
+		// replication, so this doesn't give it more access.
+		if _, err := source.Exec(ctx, fmt.Sprintf("GRANT pg_read_all_data TO %s", pgx.Identifier{g.replicationUser}.Sanitize())); err != nil {
+			return fmt.Errorf("failed to let the replication role read the published tables: %w", err)
+		}
+	}
+
+	if err := target.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_subscription
+			WHERE subname = $1 AND subdbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+		)`, g.name).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up subscription: %w", err)
+	}
+	if !exists {
+		// CREATE SUBSCRIPTION also creates the replication slot on
+		// the source primary.
+		stmt := fmt.Sprintf("CREATE SUBSCRIPTION %s CONNECTION %s PUBLICATION %s", ident, quotePostgresConfString(g.subscriptionConnString(settings, fallbackUser)), ident)
+		if _, err := target.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create subscription: %w", err)
+		}
+		log.Printf("Created subscription %s on %s", g.name, g.targetPrimary)
+	}
+	return nil
+}
+
+// Status measures how far the subscription is behind the source.
+func (g *logicalGroup) Status(ctx context.Context) (LogicalReplicationStatus, error) {
+	status := LogicalReplicationStatus{
+		Name:          g.name,
+		SourcePrimary: g.sourcePrimary,
+		TargetPrimary: g.targetPrimary,
+	}
+
+	source, err := pgx.Connect(ctx, g.sourceConnString)
+	if err != nil {
+		return status, fmt.Errorf("failed to connect to source primary %s: %w", g.sourcePrimary, err)
+	}
+	defer source.Close(context.Background())
+
+	err = source.QueryRow(ctx, `
+		SELECT pg_current_wal_lsn()::text, active, confirmed_flush_lsn::text
+		FROM pg_replication_slots
+		WHERE slot_name = $1`, g.name,
+	).Scan(&status.SourceLsn, &status.SlotActive, &status.ConfirmedFlushLsn)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return status, fmt.Errorf("replication slot %s doesn't exist on %s, run logical-setup first", g.name, g.sourcePrimary)
+	}
+	if err != nil {
+		return status, fmt.Errorf("failed to query replication slot: %w", err)
+	}
+	status.LagBytes = logicalLagBytes(status.SourceLsn, status.ConfirmedFlushLsn)
+
+	target, err := pgx.Connect(ctx, g.targetConnString)
+	if err != nil {
+		return status, fmt.Errorf("failed to connect to target primary %s: %w", g.targetPrimary, err)
+	}
+	defer target.Close(context.Background())
+
+	if err := target.QueryRow(ctx, `
+		SELECT count(*)
+		FROM pg_subscription_rel r
+		JOIN pg_subscription s ON s.oid = r.srsubid
+		WHERE s.subname = $1 AND r.srsubstate <> 'r'`, g.name,
+	).Scan(&status.TablesSyncing); err != nil {
+		return status, fmt.Errorf("failed to query subscription tables: %w", err)
+	}
+	err = target.QueryRow(ctx, `
+		SELECT last_msg_receipt_time::text
+		FROM pg_stat_subscription
+		WHERE subname = $1 AND relid IS NULL`, g.name,
+	).Scan(&status.LastMsgReceiptTime)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return status, fmt.Errorf("failed to query subscription stats: %w", err)
+	}
+	return status, nil
+}
+
+// logicalLagBytes is how far confirmedLsn is behind currentLsn, or nil
+// if either is unknown.
+func logicalLagBytes(currentLsn string, confirmedLsn *string) *int64 {
+	if confirmedLsn == nil {
+		return nil
+	}
+	current, err := ParseLSN(currentLsn)
+	if err != nil {
+		return nil
+	}
+	confirmed, err := ParseLSN(*confirmedLsn)
+	if err != nil {
+		return nil
+	}
+	lag := int64(0)
+	if current > confirmed {
+		lag = int64(current - confirmed)
+	}
+	return &lag
+}
+
+// Cutover moves clients from this cluster to the target: freeze writes
+// on the source, wait until the target has everything, copy sequence
+// values (logical replication doesn't replicate them), drop the
+// subscription so the target is independent, and route this cluster's
+// PgBouncers to the target primary. If the target doesn't catch up in
+// time we unfreeze writes and give up.
+//
+// ClusterSpec.ReadOnly alone doesn't freeze writes, since clients can
+// SET default_transaction_read_only back, so we also lock clients out
+// of the database until the subscription is dropped. It stays locked
+// after a successful cutover so nothing can diverge from the target.
+func (g *logicalGroup) Cutover(ctx context.Context, source StateStore) error {
+	status, err := g.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.SlotActive {
+		return fmt.Errorf("subscription %s isn't streaming from %s", g.name, g.sourcePrimary)
+	}
+	if status.TablesSyncing > 0 {
+		return fmt.Errorf("%d tables are still doing their initial copy", status.TablesSyncing)
+	}
+
+	log.Printf("Freezing writes on %s", g.sourcePrimary)
+	if err := updateClusterSpec(ctx, source, func(spec *ClusterSpec) { spec.ReadOnly = true }); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(logicalCutoverTimeout)
+	if err := g.cutoverFrozen(ctx, source, deadline); err != nil {
+		log.Printf("Cutover failed, unfreezing writes on %s", g.sourcePrimary)
+		if unfreezeErr := updateClusterSpec(ctx, source, func(spec *ClusterSpec) { spec.ReadOnly = false }); unfreezeErr != nil {
+			log.Printf("Failed to unfreeze writes: %v", unfreezeErr)
+		}
+		return err
+	}
+
+	// The route names the target primary, so it doesn't follow a
+	// failover in the target cluster. Clients should move to the
+	// target cluster's own PgBouncers afterwards.
+	if err := updateClusterSpec(ctx, source, func(spec *ClusterSpec) {
+		*spec = routeToCluster(*spec, g.targetPrimary, g.targetPort)
+	}); err != nil {
+		return err
+	}
+	log.Printf("Cut over to %s, writes on this cluster stay frozen", g.targetPrimary)
+	return nil
+}
+
+// cutoverFrozen waits for the source primary to freeze writes, locks
+// clients out of the database, waits for the target to confirm
+// everything written before the lock, copies the sequence values, and
+// drops the subscription. If anything fails before the subscription is
+// dropped, clients get their access back.
+func (g *logicalGroup) cutoverFrozen(ctx context.Context, source StateStore, deadline time.Time) error {
+	for {
+		state, err := source.FetchClusterState(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to fetch cluster state: %w", err)
+		}
+		idx := slices.IndexFunc(state.Nodes, func(node NodeStatus) bool { return node.Name == g.sourcePrimary })
+		if idx >= 0 && state.Nodes[idx].ReadOnly {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't freeze writes within %s", g.sourcePrimary, logicalCutoverTimeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// The freeze terminated every client session, so connect now
+	sourceConn, err := pgx.Connect(ctx, g.sourceConnString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to source primary %s: %w", g.sourcePrimary, err)
+	}
+	defer sourceConn.Close(context.Background())
+
+	revoked, err := g.lockDatabase(ctx, sourceConn)
+	if err != nil {
+		return err
+	}
+	dropped := false
+	defer func() {
+		if !dropped {
+			g.unlockDatabase(sourceConn, revoked)
+		}
+	}()
+
+	if err := g.waitForSubscription(ctx, sourceConn, deadline); err != nil {
+		return err
+	}
+	if err := g.syncSequences(ctx, sourceConn); err != nil {
+		return err
+	}
+	// Check again right before dropping the subscription, in case
+	// anything was written since it caught up.
+	if err := g.waitForSubscription(ctx, sourceConn, deadline); err != nil {
+		return err
+	}
+
+	target, err := pgx.Connect(ctx, g.targetConnString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target primary %s: %w", g.targetPrimary, err)
+	}
+	defer target.Close(context.Background())
+	if _, err := target.Exec(ctx, fmt.Sprintf("DROP SUBSCRIPTION %s", pgx.Identifier{g.name}.Sanitize())); err != nil {
+		return fmt.Errorf("failed to drop subscription: %w", err)
+	}
+	dropped = true
+	return nil
+}
+
+// lockDatabase revokes CONNECT on the database from every role but the
+// one the subscription might reconnect as, and terminates the sessions
+// connected to it. Superusers can still connect. It returns the roles
+// it revoked CONNECT from, where "PUBLIC" means everyone.
+func (g *logicalGroup) lockDatabase(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT coalesce(r.rolname, 'PUBLIC')
+		FROM pg_database d
+		CROSS JOIN LATERAL aclexplode(coalesce(d.datacl, acldefault('d', d.datdba))) a
+		LEFT JOIN pg_roles r ON r.oid = a.grantee
+		WHERE d.datname = $1 AND a.privilege_type = 'CONNECT' AND coalesce(r.rolname, '') <> $2`,
+		g.database, g.replicationUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database privileges: %w", err)
+	}
+	grantees, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database privileges: %w", err)
+	}
+
+	db := pgx.Identifier{g.database}.Sanitize()
+	var revoked []string
+	for _, grantee := range grantees {
+		if _, err := conn.Exec(ctx, fmt.Sprintf("REVOKE CONNECT ON DATABASE %s FROM %s", db, granteeIdent(grantee))); err != nil {
+			g.unlockDatabase(conn, revoked)
+			return nil, fmt.Errorf("failed to revoke CONNECT from %s: %w", grantee, err)
+		}
+		revoked = append(revoked, grantee)
+	}
+
+	var terminated int
+	if err := conn.QueryRow(ctx, `
+		SELECT count(*) FILTER (WHERE pg_terminate_backend(pid))
+		FROM pg_stat_activity
+		WHERE datname = $1 AND backend_type = 'client backend' AND pid <> pg_backend_pid()`, g.database,
+	).Scan(&terminated); err != nil {
+		g.unlockDatabase(conn, revoked)
+		return nil, fmt.Errorf("failed to terminate sessions: %w", err)
+	}
+	log.Printf("Locked clients out of database %s on %s, terminated %d sessions", g.database, g.sourcePrimary, terminated)
+	return revoked, nil
+}
+
+// unlockDatabase grants CONNECT back to the roles lockDatabase revoked
+// it from.
+func (g *logicalGroup) unlockDatabase(conn *pgx.Conn, revoked []string) {
+	db := pgx.Identifier{g.database}.Sanitize()
+	for _, grantee := range revoked {
+		if _, err := conn.Exec(context.Background(), fmt.Sprintf("GRANT CONNECT ON DATABASE %s TO %s", db, granteeIdent(grantee))); err != nil {
+			log.Printf("Failed to grant CONNECT on %s back to %s: %v", g.database, grantee, err)
+		}
+	}
+}
+
+// granteeIdent is a role name for GRANT and REVOKE.
+func granteeIdent(grantee string) string {
+	if grantee == "PUBLIC" {
+		return grantee
+	}
+	return pgx.Identifier{grantee}.Sanitize()
+}
+
+// waitForSubscription waits until the subscription has confirmed
+// everything written on the source so far.
+func (g *logicalGroup) waitForSubscription(ctx context.Context, sourceConn *pgx.Conn, deadline time.Time) error {
+	var currentLsnStr string
+	if err := sourceConn.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text").Scan(&currentLsnStr); err != nil {
+		return fmt.Errorf("failed to query WAL position: %w", err)
+	}
+	currentLsn, err := ParseLSN(currentLsnStr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var confirmedStr *string
+		if err := sourceConn.QueryRow(ctx, "SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1", g.name).Scan(&confirmedStr); err != nil {
+			return fmt.Errorf("failed to query replication slot: %w", err)
+		}
+		if confirmedStr != nil {
+			confirmed, err := ParseLSN(*confirmedStr)
+			if err != nil {
+				return err
+			}
+			if confirmed >= currentLsn {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("subscription %s didn't catch up to %s within %s", g.name, currentLsn, logicalCutoverTimeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	log.Printf("Subscription %s caught up to %s", g.name, currentLsn)
+	return nil
+}
+
+// syncSequences sets every sequence on the target to its value on the
+// source.
+func (g *logicalGroup) syncSequences(ctx context.Context, sourceConn *pgx.Conn) error {
+	rows, err := sourceConn.Query(ctx, "SELECT schemaname, sequencename, last_value FROM pg_sequences WHERE last_value IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("failed to query sequences: %w", err)
+	}
+	type sequence struct {
+		schema    string
+		name      string
+		lastValue int64
+	}
+	sequences, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (sequence, error) {
+		var s sequence
+		err := row.Scan(&s.schema, &s.name, &s.lastValue)
+		return s, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query sequences: %w", err)
+	}
+
+	target, err := pgx.Connect(ctx, g.targetConnString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to target primary %s: %w", g.targetPrimary, err)
+	}
+	defer target.Close(context.Background())
+
+	for _, s := range sequences {
+		if _, err := target.Exec(ctx, "SELECT setval(format('%I.%I', $1::text, $2::text)::regclass, $3)", s.schema, s.name, s.lastValue); err != nil {
+			return fmt.Errorf("failed to set sequence %s.%s: %w", s.schema, s.name, err)
+		}
+	}
+	log.Printf("Synced %d sequences to %s", len(sequences), g.targetPrimary)
+	return nil
+}
+
+// routeToCluster points every PgBouncer database at host:port, keeping
+// the rest of each connection string.
+func routeToCluster(spec ClusterSpec, host string, port int) ClusterSpec {
+	var pgBouncer PgBouncerSpec
+	if spec.PgBouncer != nil {
+		pgBouncer = *spec.PgBouncer
+	}
+
+	databases := make(map[string]string)
+	if len(pgBouncer.Databases) == 0 {
+		databases["*"] = fmt.Sprintf("host=%s port=%d", host, port)
+	}
+	for name, connString := range pgBouncer.Databases {
+		databases[name] = retargetConnString(connString, host, port)
+	}
+	pgBouncer.Databases = databases
+	spec.PgBouncer = &pgBouncer
+	return spec
+}
+
+// retargetConnString replaces host and port in a PgBouncer connection
+// string.
+func retargetConnString(connString string, host string, port int) string {
+	parts := []string{"host=" + host, fmt.Sprintf("port=%d", port)}
+	for _, field := range strings.Fields(connString) {
+		if strings.HasPrefix(field, "host=") || strings.HasPrefix(field, "port=") {
+			continue
+		}
+		parts = append(parts, field)
+	}
+	return strings.Join(parts, " ")
+}
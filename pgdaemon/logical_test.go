@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterPrimary(t *testing.T) {
+	state := ClusterState{
+		Status: ClusterStatus{IntendedPrimary: "node1", FailoverState: FailoverStateStable},
+		Nodes:  []NodeStatus{{Name: "node1", IsPrimary: true}, {Name: "node2"}},
+	}
+	primary, err := clusterPrimary(state)
+	require.NoError(t, err)
+	assert.Equal(t, "node1", primary)
+
+	state.Status.FailoverState = FailoverStateDemotingOldPrimary
+	_, err = clusterPrimary(state)
+	assert.ErrorContains(t, err, "switchover")
+
+	state.Status.FailoverState = FailoverStateStable
+	state.Nodes[0].IsPrimary = false
+	_, err = clusterPrimary(state)
+	assert.ErrorContains(t, err, "not up")
+}
+
+func TestLogicalConnString(t *testing.T) {
+	conf := config{postgresPort: 5432, postgresUser: "postgres", logicalDatabase: "app"}
+	assert.Equal(t, "host=node1 port=5432 user=postgres dbname=app sslmode=disable", logicalConnString(conf, "node1"))
+
+	conf.tlsCA = "/etc/pgdaemon/ca.crt"
+	assert.Equal(t, "host=node1 port=5432 user=postgres dbname=app sslmode=verify-full sslrootcert=/etc/pgdaemon/ca.crt", logicalConnString(conf, "node1"))
+}
+
+func TestSubscriptionConnString(t *testing.T) {
+	g := logicalGroup{sourcePrimary: "node1", sourcePort: 5432, database: "app", replicationUser: "replicator"}
+
+	// Without a replication password the target connects as -pguser
+	settings := subscriptionSettings{dataDir: "/var/lib/postgres/data"}
+	assert.Equal(t, "host=node1 port=5432 user=postgres dbname=app sslmode=disable", g.subscriptionConnString(settings, "postgres"))
+
+	// The passfile and CA are the target's, not the CLI's
+	settings = subscriptionSettings{dataDir: "/srv/pg", hasPassfile: true, ssl: true, caFile: "/etc/pgdaemon/ca.crt"}
+	assert.Equal(t, "host=node1 port=5432 user=replicator passfile=/srv/pg.pgdaemon-pgpass dbname=app sslmode=verify-full sslrootcert=/etc/pgdaemon/ca.crt", g.subscriptionConnString(settings, "postgres"))
+
+	// ssl_ca_file is relative to the data directory
+	settings.caFile = "ca.crt"
+	assert.Contains(t, g.subscriptionConnString(settings, "postgres"), "sslrootcert=/srv/pg/ca.crt")
+}
+
+func TestGranteeIdent(t *testing.T) {
+	assert.Equal(t, "PUBLIC", granteeIdent("PUBLIC"))
+	assert.Equal(t, `"app_user"`, granteeIdent("app_user"))
+	assert.Equal(t, `"public"`, granteeIdent("public"))
+}
+
+func TestLogicalLagBytes(t *testing.T) {
+	confirmed := "0/3000000"
+	lag := logicalLagBytes("0/3000100", &confirmed)
+	require.NotNil(t, lag)
+	assert.Equal(t, int64(0x100), *lag)
+
+	// The slot can be ahead of what we read a moment earlier
+	lag = logicalLagBytes("0/2FFFFFF", &confirmed)
+	require.NotNil(t, lag)
+	assert.Equal(t, int64(0), *lag)
+
+	assert.Nil(t, logicalLagBytes("0/3000100", nil))
+}
+
+func TestRouteToCluster(t *testing.T) {
+	spec := routeToCluster(ClusterSpec{}, "target1", 5432)
+	require.NotNil(t, spec.PgBouncer)
+	assert.Equal(t, map[string]string{"*": "host=target1 port=5432"}, spec.PgBouncer.Databases)
+
+	spec = ClusterSpec{PgBouncer: &PgBouncerSpec{
+		PoolMode: "session",
+		Databases: map[string]string{
+			"app":     "host=127.0.0.1 port=5432 dbname=app",
+			"reports": "dbname=app pool_size=5",
+		},
+	}}
+	routed := routeToCluster(spec, "target1", 5433)
+	assert.Equal(t, "session", routed.PgBouncer.PoolMode)
+	assert.Equal(t, map[string]string{
+		"app":     "host=target1 port=5433 dbname=app",
+		"reports": "host=target1 port=5433 dbname=app pool_size=5",
+	}, routed.PgBouncer.Databases)
+	// The original spec is unchanged
+	assert.Equal(t, "host=127.0.0.1 port=5432 dbname=app", spec.PgBouncer.Databases["app"])
+}
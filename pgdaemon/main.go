@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"time"
@@ -25,8 +28,63 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var store StateStore
+	// These commands only need the local node and the archive, not
+	// the store. Postgres runs archive-wal-push and archive-wal-fetch
+	// for every WAL file, so they should start quickly.
+	switch conf.command {
+	case "archive-wal-push", "archive-wal-fetch", "base-backup", "restore":
+		runArchiveCommand(ctx, conf)
+		return
+	}
+
+	store, closeStore, err := newStateStore(ctx, conf, conf.clusterName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStore()
+
+	switch conf.command {
+	case "show-cluster":
+		showCluster(ctx, store)
+	case "set-spec":
+		setSpec(ctx, store, conf.specFile)
+	case "failover":
+		failover(ctx, store, conf.targetPrimary)
+	case "promote-cluster":
+		promoteCluster(ctx, store)
+	case "upgrade":
+		upgrade(ctx, store, conf.newPgBinDir, conf.newPostgresUnit)
+	case "logical-setup", "logical-status", "logical-cutover":
+		runLogicalCommand(ctx, conf, store)
+	case "pause-replay":
+		updateNodeSpec(ctx, store, conf.targetNode, func(spec *NodeSpec) {
+			spec.ReplayPaused = true
+		})
+	case "resume-replay":
+		updateNodeSpec(ctx, store, conf.targetNode, func(spec *NodeSpec) {
+			spec.ReplayPaused = false
+			spec.ReplayTargetTime = ""
+		})
+	case "fast-forward-replay":
+		if _, err := time.Parse(time.RFC3339, conf.targetTime); err != nil {
+			log.Fatalf("Invalid -target-time %q, must be RFC 3339: %v", conf.targetTime, err)
+		}
+		updateNodeSpec(ctx, store, conf.targetNode, func(spec *NodeSpec) {
+			spec.ReplayPaused = false
+			spec.ReplayTargetTime = conf.targetTime
+		})
+	case "daemon":
+		daemon(ctx, store, conf)
+	default:
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", conf.command)
+		os.Exit(1)
+	}
+}
 
+// newStateStore connects to the -store-backend for clusterName. The
+// logical replication commands use it to reach a second cluster.
+func newStateStore(ctx context.Context, conf config, clusterName string) (StateStore, func(), error) {
 	switch conf.storeBackend {
 	case "etcd":
 		log.Printf("Setting up etcd backend")
@@ -35,16 +93,14 @@ func main() {
 			DialTimeout: 2 * time.Second,
 		})
 		if err != nil {
-			log.Fatal(fmt.Errorf("failed to connect to etcd: %w", err))
+			return nil, nil, fmt.Errorf("failed to connect to etcd: %w", err)
 		}
-		defer cli.Close()
-
-		store = NewEtcdBackend(cli, conf.clusterName, conf.nodeName)
+		return NewEtcdBackend(cli, clusterName, conf.nodeName), func() { cli.Close() }, nil
 	case "dynamodb":
 		log.Printf("Setting up DynamoDB backend")
 		cfg, err := awsconfig.LoadDefaultConfig(ctx)
 		if err != nil {
-			log.Fatalf("failed to load AWS configuration, %v", err)
+			return nil, nil, fmt.Errorf("failed to load AWS configuration, %w", err)
 		}
 
 		dynamoClient := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
@@ -53,32 +109,85 @@ func main() {
 			}
 		})
 
-		dynamoStore, err := NewDynamoDBBackend(dynamoClient, conf.dynamoDBTableName, conf.clusterName, conf.nodeName)
+		dynamoStore, err := NewDynamoDBBackend(dynamoClient, conf.dynamoDBTableName, clusterName, conf.nodeName)
 		if err != nil {
-			log.Fatalf("Failed to create DynamoDB backend: %v", err)
+			return nil, nil, fmt.Errorf("Failed to create DynamoDB backend: %w", err)
 		}
 
 		if err := dynamoStore.InitTable(ctx); err != nil {
-			log.Fatalf("Failed to initialize DynamoDB table: %v", err)
+			return nil, nil, fmt.Errorf("Failed to initialize DynamoDB table: %w", err)
+		}
+		return dynamoStore, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown -store-backend %s", conf.storeBackend)
+	}
+}
+
+func runArchiveCommand(ctx context.Context, conf config) {
+	archive, err := newArchiveTarget(ctx, conf)
+	if err != nil {
+		log.Fatalf("Failed to set up archive: %v", err)
+	}
+	if archive == nil {
+		log.Fatal("Archive must be specified with -archive-url")
+	}
+
+	switch conf.command {
+	case "archive-wal-push":
+		if flag.NArg() != 3 {
+			log.Fatal("Usage: pgdaemon [options] archive-wal-push <path> <file>")
 		}
+		err = archiveWalPush(ctx, archive, flag.Arg(1), flag.Arg(2))
+	case "archive-wal-fetch":
+		if flag.NArg() != 3 {
+			log.Fatal("Usage: pgdaemon [options] archive-wal-fetch <file> <path>")
+		}
+		err = archiveWalFetch(ctx, archive, flag.Arg(1), flag.Arg(2))
+	case "base-backup":
+		_, err = takeBaseBackup(ctx, archive, conf)
+	case "restore":
+		err = restoreFromArchive(ctx, conf, archive, conf.targetTime)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", conf.command, err)
+	}
+}
 
-		store = dynamoStore
+// runLogicalCommand runs the logical replication commands between this
+// cluster and -target-cluster.
+func runLogicalCommand(ctx context.Context, conf config, store StateStore) {
+	if conf.targetCluster == "" || conf.targetCluster == conf.clusterName {
+		log.Fatal("Target cluster must be specified with -target-cluster and differ from -cluster-name")
+	}
+	targetStore, closeTargetStore, err := newStateStore(ctx, conf, conf.targetCluster)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeTargetStore()
 
-	default:
-		log.Fatalf("Unknown -store-backend %s", conf.storeBackend)
+	group, err := newLogicalGroup(ctx, conf, store, targetStore)
+	if err != nil {
+		log.Fatalf("%s failed: %v", conf.command, err)
 	}
 
 	switch conf.command {
-	case "show-cluster":
-		showCluster(ctx, store)
-	case "failover":
-		failover(ctx, store, conf.targetPrimary)
-	case "daemon":
-		daemon(ctx, store, conf)
-	default:
-		flag.Usage()
-		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", conf.command)
-		os.Exit(1)
+	case "logical-setup":
+		err = group.Setup(ctx)
+	case "logical-status":
+		var status LogicalReplicationStatus
+		status, err = group.Status(ctx)
+		if err == nil {
+			jsonBytes, jsonErr := json.MarshalIndent(status, "", "  ")
+			if jsonErr != nil {
+				log.Fatalf("Failed to convert status to JSON: %v", jsonErr)
+			}
+			fmt.Println(string(jsonBytes))
+		}
+	case "logical-cutover":
+		err = group.Cutover(ctx, store)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", conf.command, err)
 	}
 }
 
@@ -95,6 +204,86 @@ func showCluster(ctx context.Context, store StateStore) {
 	fmt.Println(string(jsonBytes))
 }
 
+func setSpec(ctx context.Context, store StateStore, specFile string) {
+	if specFile == "" {
+		log.Fatal("Spec file must be specified with -spec-file")
+	}
+
+	var specBytes []byte
+	var err error
+	if specFile == "-" {
+		specBytes, err = io.ReadAll(os.Stdin)
+	} else {
+		specBytes, err = os.ReadFile(specFile)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read spec file: %v", err)
+	}
+
+	var spec ClusterSpec
+	if err := json.Unmarshal(specBytes, &spec); err != nil {
+		log.Fatalf("Failed to parse cluster spec: %v", err)
+	}
+	if err := spec.validate(); err != nil {
+		log.Fatalf("Invalid cluster spec: %v", err)
+	}
+
+	if err := store.SetClusterSpec(ctx, &spec); err != nil {
+		log.Fatalf("Failed to set cluster spec: %v", err)
+	}
+	log.Printf("Cluster spec updated")
+}
+
+// promoteCluster turns a standby cluster into a normal cluster. The
+// standby leader promotes itself on its next reconciliation cycle.
+func promoteCluster(ctx context.Context, store StateStore) {
+	errNotStandby := errors.New("not a standby cluster")
+	var standbyCluster *StandbyClusterSpec
+	err := modifyClusterSpec(ctx, store, func(spec *ClusterSpec) error {
+		if spec.StandbyCluster == nil {
+			return errNotStandby
+		}
+		standbyCluster = spec.StandbyCluster
+		spec.StandbyCluster = nil
+		return nil
+	})
+	if errors.Is(err, errNotStandby) {
+		log.Printf("Cluster is not a standby cluster, nothing to do")
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to set cluster spec: %v", err)
+	}
+	log.Printf("Promoting standby cluster, it will stop following %s", standbyCluster.Host)
+}
+
+// updateNodeSpec applies update to a single node's spec and writes
+// the cluster spec back to the store.
+func updateNodeSpec(ctx context.Context, store StateStore, nodeName string, update func(spec *NodeSpec)) {
+	if nodeName == "" {
+		log.Fatal("Node must be specified with -node")
+	}
+
+	var nodeSpec NodeSpec
+	err := modifyClusterSpec(ctx, store, func(spec *ClusterSpec) error {
+		nodeSpec = spec.Nodes[nodeName]
+		update(&nodeSpec)
+		if err := validateReplaySpec(nodeSpec); err != nil {
+			return fmt.Errorf("invalid spec for node %s: %w", nodeName, err)
+		}
+		spec.Nodes = maps.Clone(spec.Nodes)
+		if spec.Nodes == nil {
+			spec.Nodes = make(map[string]NodeSpec)
+		}
+		spec.Nodes[nodeName] = nodeSpec
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to set cluster spec: %v", err)
+	}
+	log.Printf("Updated spec for node %s: %+v", nodeName, nodeSpec)
+}
+
 func failover(ctx context.Context, store StateStore, targetPrimary string) {
 	if targetPrimary == "" {
 		log.Fatal("Target primary node must be specified for failover")
@@ -105,8 +294,14 @@ func failover(ctx context.Context, store StateStore, targetPrimary string) {
 		log.Fatalf("Failed to fetch cluster state: %v", err)
 	}
 
-	newStatus := state.Status
-	newStatus.IntendedPrimary = targetPrimary
+	if state.Spec.isDelayedReplica(targetPrimary) {
+		log.Fatalf("Node %s is a delayed replica and can't be the primary", targetPrimary)
+	}
+
+	newStatus, err := startSwitchover(state.Status, state.Nodes, targetPrimary)
+	if err != nil {
+		log.Fatal(err)
+	}
 	nodeName := "pgdaemon CLI"
 
 	_, changed, err := WriteClusterStatusIfChanged(store, state.Status, newStatus, nodeName)
@@ -114,24 +309,57 @@ func failover(ctx context.Context, store StateStore, targetPrimary string) {
 		log.Fatalf("Failed to write cluster status: %v", err)
 	}
 
-	if changed {
+	if changed && newStatus.FailoverState == FailoverStateDemotingOldPrimary {
+		log.Printf("Initiated switchover from %s to %s", newStatus.PreviousPrimary, targetPrimary)
+	} else if changed {
 		log.Printf("Initiated failover to %s", targetPrimary)
 	} else {
 		log.Printf("No changes made, current primary is already %s", targetPrimary)
 	}
 }
 
+// upgrade starts a major version upgrade. The primary picks it up on
+// its next reconciliation cycle.
+func upgrade(ctx context.Context, store StateStore, newBinDir string, newPostgresUnit string) {
+	state, err := store.FetchClusterState(ctx)
+	if err != nil {
+		log.Fatalf("Failed to fetch cluster state: %v", err)
+	}
+
+	newStatus, err := startUpgrade(state.Spec, state.Status, state.Nodes, newBinDir, newPostgresUnit, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, _, err := WriteClusterStatusIfChanged(store, state.Status, newStatus, "pgdaemon CLI"); err != nil {
+		log.Fatalf("Failed to write cluster status: %v", err)
+	}
+	log.Printf("Started upgrade of %s to the binaries in %s, follow it with show-cluster", newStatus.Upgrade.Primary, newBinDir)
+}
+
 func daemon(ctx context.Context, store StateStore, conf config) {
-	pgNode, err := NewPostgresNode(conf.postgresHost, conf.postgresPort, conf.postgresUser, conf.pgBouncerHost, conf.pgBouncerPort)
+	archive, err := newArchiveTarget(ctx, conf)
+	if err != nil {
+		log.Fatalf("Failed to set up archive: %v", err)
+	}
+	if conf.backupInterval > 0 && archive == nil {
+		log.Fatal("Scheduled backups with -backup-interval need an -archive-url")
+	}
+
+	pgNode, err := NewPostgresNode(conf, archive)
 	if err != nil {
 		log.Fatalf("Failed to create Postgres node: %v", err)
 	}
 
 	g, ctx := errgroup.WithContext(ctx)
 
+	cache := NewStatusCache()
+	metrics := NewMetrics()
+	store = newInstrumentedStore(store, metrics)
+
 	var wakeupManager *WakeupManager
 	if conf.wakeupPort > 0 {
-		wakeupManager = NewWakeupManager(conf.wakeupPort, conf.clusterName, conf.nodeName)
+		wakeupManager = NewWakeupManager(conf.wakeupPort, conf.clusterName, conf.nodeName, metrics)
 		if err := wakeupManager.StartListener(ctx); err != nil {
 			log.Printf("Failed to start wakeup listener: %v", err)
 			wakeupManager = nil // Disable wakeup functionality
@@ -139,13 +367,32 @@ func daemon(ctx context.Context, store StateStore, conf config) {
 	}
 
 	g.Go(func() error {
-		return nodeReconcilerLoop(ctx, store, conf, pgNode, wakeupManager)
+		return nodeReconcilerLoop(ctx, store, conf, pgNode, wakeupManager, cache, metrics)
+	})
+
+	g.Go(func() error {
+		return nodeStatusLoop(ctx, store, conf.nodeName, pgNode, cache, nodeStatusHeartbeatInterval)
 	})
 
+	prober := NewHealthProber(func() (bool, error) { return CheckIsPrimary(pgNode.pgBouncerPool) })
 	g.Go(func() error {
-		return runHealthCheckServer(ctx, conf, pgNode)
+		return prober.Run(ctx, conf.healthProbeInterval)
 	})
 
+	g.Go(func() error {
+		return cache.WatchClusterStatus(ctx, store, clusterStatusWatchInterval)
+	})
+
+	g.Go(func() error {
+		return runHealthCheckServer(ctx, conf, store, prober, cache, metrics)
+	})
+
+	if conf.backupInterval > 0 {
+		g.Go(func() error {
+			return backupSchedulerLoop(ctx, store, conf, archive)
+		})
+	}
+
 	if err := g.Wait(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Fatal error: %v", err)
 	}
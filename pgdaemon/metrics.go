@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Metrics holds the counters and histograms we export on /metrics in
+// the Prometheus text format. Gauges like the node's role are computed
+// from the StatusCache when scraped. A nil *Metrics records nothing.
+type Metrics struct {
+	mu sync.Mutex
+
+	cycleDuration *histogram
+	cycleErrors   uint64
+
+	storeDuration map[string]*histogram
+	storeErrors   map[string]uint64
+	casConflicts  uint64
+
+	wakeupsSent     uint64
+	wakeupsReceived uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		cycleDuration: newHistogram(cycleDurationBuckets),
+		storeDuration: make(map[string]*histogram),
+		storeErrors:   make(map[string]uint64),
+	}
+}
+
+// Cycles usually take milliseconds, but cloning or rewinding a replica
+// can take minutes.
+var cycleDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var storeDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// ObserveCycle records a reconciliation cycle.
+func (m *Metrics) ObserveCycle(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cycleDuration.observe(duration.Seconds())
+	if err != nil {
+		m.cycleErrors++
+	}
+}
+
+// ObserveStoreOp records a call to the state store. CAS conflicts
+// are counted separately from errors since they are expected.
+func (m *Metrics) ObserveStoreOp(operation string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.storeDuration[operation]
+	if !ok {
+		h = newHistogram(storeDurationBuckets)
+		m.storeDuration[operation] = h
+	}
+	h.observe(duration.Seconds())
+	switch {
+	case errors.Is(err, ErrClusterStatusConflict), errors.Is(err, ErrClusterSpecConflict):
+		m.casConflicts++
+	case err != nil:
+		m.storeErrors[operation]++
+	}
+}
+
+func (m *Metrics) WakeupSent() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wakeupsSent++
+}
+
+func (m *Metrics) WakeupReceived() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.wakeupsReceived++
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// instrumentedStore records the latency and outcome of every state
+// store call.
+type instrumentedStore struct {
+	store   StateStore
+	metrics *Metrics
+}
+
+func newInstrumentedStore(store StateStore, metrics *Metrics) StateStore {
+	return &instrumentedStore{store: store, metrics: metrics}
+}
+
+func (s *instrumentedStore) SetClusterSpec(ctx context.Context, spec *ClusterSpec) error {
+	start := time.Now()
+	err := s.store.SetClusterSpec(ctx, spec)
+	s.metrics.ObserveStoreOp("set_cluster_spec", time.Since(start), err)
+	return err
+}
+
+func (s *instrumentedStore) AtomicWriteClusterSpec(ctx context.Context, prevSpecUUID uuid.UUID, spec ClusterSpec) error {
+	start := time.Now()
+	err := s.store.AtomicWriteClusterSpec(ctx, prevSpecUUID, spec)
+	s.metrics.ObserveStoreOp("atomic_write_cluster_spec", time.Since(start), err)
+	return err
+}
+
+func (s *instrumentedStore) FetchClusterState(ctx context.Context) (ClusterState, error) {
+	start := time.Now()
+	state, err := s.store.FetchClusterState(ctx)
+	s.metrics.ObserveStoreOp("fetch_cluster_state", time.Since(start), err)
+	return state, err
+}
+
+func (s *instrumentedStore) AtomicWriteClusterStatus(ctx context.Context, prevStatusUUID uuid.UUID, status ClusterStatus) error {
+	start := time.Now()
+	err := s.store.AtomicWriteClusterStatus(ctx, prevStatusUUID, status)
+	s.metrics.ObserveStoreOp("atomic_write_cluster_status", time.Since(start), err)
+	return err
+}
+
+func (s *instrumentedStore) WriteCurrentNodeStatus(ctx context.Context, status *NodeStatus) error {
+	start := time.Now()
+	err := s.store.WriteCurrentNodeStatus(ctx, status)
+	s.metrics.ObserveStoreOp("write_node_status", time.Since(start), err)
+	return err
+}
+
+func (s *instrumentedStore) RecordClusterEvents(ctx context.Context, events []ClusterEvent) error {
+	start := time.Now()
+	err := s.store.RecordClusterEvents(ctx, events)
+	s.metrics.ObserveStoreOp("record_cluster_events", time.Since(start), err)
+	return err
+}
+
+func (s *instrumentedStore) FetchClusterEvents(ctx context.Context) ([]ClusterEvent, error) {
+	start := time.Now()
+	events, err := s.store.FetchClusterEvents(ctx)
+	s.metrics.ObserveStoreOp("fetch_cluster_events", time.Since(start), err)
+	return events, err
+}
+
+func metricsHandler(nodeName string, cache *StatusCache, metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, nodeName, cache.Snapshot(time.Now()), metrics)
+	}
+}
+
+func writeMetrics(w io.Writer, nodeName string, snapshot statusSnapshot, metrics *Metrics) {
+	p := &promWriter{w: w}
+
+	if snapshot.nodeAge >= 0 {
+		node := snapshot.node
+		p.header("pgdaemon_node_status_age_seconds", "gauge", "Seconds since this node last gathered its status.")
+		p.sample("pgdaemon_node_status_age_seconds", nil, snapshot.nodeAge.Seconds())
+
+		role := nodeRole(node, snapshot.cluster, nodeName)
+		p.header("pgdaemon_role", "gauge", "The role of this node, 1 for the current role.")
+		for _, r := range []string{"primary", "replica", "standby_leader"} {
+			p.sample("pgdaemon_role", []string{"role", r}, boolFloat(node.Error == nil && r == role))
+		}
+
+		// A PgBouncer error means we could query Postgres directly.
+		postgresUp := node.Error == nil || node.ErrorKind == NodeErrorPgBouncer
+		p.header("pgdaemon_postgres_up", "gauge", "Whether Postgres is reachable.")
+		p.sample("pgdaemon_postgres_up", nil, boolFloat(postgresUp))
+		p.header("pgdaemon_pgbouncer_up", "gauge", "Whether Postgres is reachable through PgBouncer.")
+		p.sample("pgdaemon_pgbouncer_up", nil, boolFloat(node.Error == nil))
+
+		if node.ReplayLagBytes != nil {
+			p.header("pgdaemon_replay_lag_bytes", "gauge", "How far this replica's replay is behind what it received.")
+			p.sample("pgdaemon_replay_lag_bytes", nil, float64(*node.ReplayLagBytes))
+		}
+
+		p.header("pgdaemon_replica_lag_bytes", "gauge", "How far each replica streaming from this node is behind it, from pg_stat_replication.")
+		for _, replica := range node.Replicas {
+			if replica.ReplayLagBytes != nil {
+				p.sample("pgdaemon_replica_lag_bytes", []string{"replica", replica.Hostname}, float64(*replica.ReplayLagBytes))
+			}
+		}
+	}
+
+	if snapshot.clusterAge >= 0 {
+		status := snapshot.cluster.Status
+		p.header("pgdaemon_cluster_healthy", "gauge", "Whether the cluster status is healthy.")
+		p.sample("pgdaemon_cluster_healthy", nil, boolFloat(status.Health == ClusterHealthHealthy))
+
+		counts := make(map[string]int)
+		for i := range status.HealthReasons {
+			// Statuses written by older daemons have no kinds.
+			kind := HealthReasonOther
+			if i < len(status.HealthReasonKinds) {
+				kind = status.HealthReasonKinds[i]
+			}
+			counts[string(kind)]++
+		}
+		p.header("pgdaemon_cluster_health_reasons", "gauge", "Number of reasons the cluster is unhealthy, by kind.")
+		for _, kind := range slices.Sorted(maps.Keys(counts)) {
+			p.sample("pgdaemon_cluster_health_reasons", []string{"kind", kind}, float64(counts[kind]))
+		}
+	}
+
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	p.header("pgdaemon_reconcile_cycle_duration_seconds", "histogram", "Duration of reconciliation cycles.")
+	p.histogram("pgdaemon_reconcile_cycle_duration_seconds", nil, metrics.cycleDuration)
+	p.header("pgdaemon_reconcile_errors_total", "counter", "Reconciliation cycles that failed.")
+	p.sample("pgdaemon_reconcile_errors_total", nil, float64(metrics.cycleErrors))
+
+	p.header("pgdaemon_cas_conflicts_total", "counter", "Cluster status writes that lost a compare-and-set race.")
+	p.sample("pgdaemon_cas_conflicts_total", nil, float64(metrics.casConflicts))
+
+	p.header("pgdaemon_wakeups_sent_total", "counter", "Wakeup packets sent to peers.")
+	p.sample("pgdaemon_wakeups_sent_total", nil, float64(metrics.wakeupsSent))
+	p.header("pgdaemon_wakeups_received_total", "counter", "Wakeup packets received from peers.")
+	p.sample("pgdaemon_wakeups_received_total", nil, float64(metrics.wakeupsReceived))
+
+	operations := slices.Sorted(maps.Keys(metrics.storeDuration))
+	p.header("pgdaemon_state_store_duration_seconds", "histogram", "Latency of state store operations.")
+	for _, op := range operations {
+		p.histogram("pgdaemon_state_store_duration_seconds", []string{"operation", op}, metrics.storeDuration[op])
+	}
+	p.header("pgdaemon_state_store_errors_total", "counter", "State store operations that failed, not counting CAS conflicts.")
+	for _, op := range operations {
+		p.sample("pgdaemon_state_store_errors_total", []string{"operation", op}, float64(metrics.storeErrors[op]))
+	}
+}
+
+// promWriter writes the Prometheus text exposition format. Labels are
+// name/value pairs.
+type promWriter struct {
+	w io.Writer
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name string, labels []string, value float64) {
+	fmt.Fprintf(p.w, "%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (p *promWriter) histogram(name string, labels []string, h *histogram) {
+	for i, bound := range h.buckets {
+		le := append(slices.Clone(labels), "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		p.sample(name+"_bucket", le, float64(h.counts[i]))
+	}
+	p.sample(name+"_bucket", append(slices.Clone(labels), "le", "+Inf"), float64(h.count))
+	p.sample(name+"_sum", labels, h.sum)
+	p.sample(name+"_count", labels, float64(h.count))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
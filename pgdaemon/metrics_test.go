@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentedStore_CountsConflicts(t *testing.T) {
+	metrics := NewMetrics()
+	store := newInstrumentedStore(&memStore{state: ClusterState{
+		Status: ClusterStatus{StatusUuid: uuid.New()},
+	}}, metrics)
+
+	_, err := store.FetchClusterState(context.Background())
+	require.NoError(t, err)
+	err = store.AtomicWriteClusterStatus(context.Background(), uuid.New(), ClusterStatus{})
+	require.ErrorIs(t, err, ErrClusterStatusConflict)
+
+	assert.Equal(t, uint64(1), metrics.casConflicts)
+	assert.Empty(t, metrics.storeErrors)
+	assert.Equal(t, uint64(1), metrics.storeDuration["fetch_cluster_state"].count)
+	assert.Equal(t, uint64(1), metrics.storeDuration["atomic_write_cluster_status"].count)
+}
+
+func TestHealthReasonKind(t *testing.T) {
+	errMsg := "boom"
+	diskFree := int64(1)
+	lag := int64(1 << 30)
+	spec := ClusterSpec{}
+	status := ClusterStatus{
+		IntendedPrimary:  "node1",
+		IntendedReplicas: []string{"node2"},
+		Upgrade:          &ClusterUpgradeStatus{Phase: UpgradePhaseFailed, Primary: "node1", Error: "pg_upgrade failed"},
+	}
+	nodes := []NodeStatus{
+		{Name: "node1", IsPrimary: true, DiskFreeBytes: &diskFree},
+		{Name: "node2", ReplayLagBytes: &lag},
+		{Name: "node3", IsPrimary: true},
+		{Name: "node4", Error: &errMsg, ErrorKind: NodeErrorConnection},
+		{Name: "node5", Error: &errMsg, ErrorKind: NodeErrorPgBouncer, ReplicationStatus: &NodeReplicationStatus{PrimaryHost: "node3"}},
+	}
+
+	reasons := computeClusterUnhealthyReasons(spec, nodes, status)
+	require.NotEmpty(t, reasons)
+	for _, reason := range reasons {
+		assert.NotEmpty(t, reason.kind, reason.message)
+		assert.NotEqual(t, HealthReasonOther, reason.kind, reason.message)
+	}
+	assert.Equal(t, HealthReasonNoNodes, computeClusterUnhealthyReasons(spec, nil, status)[0].kind)
+
+	result := ComputeNewClusterStatus(ClusterState{Nodes: nodes, Status: status}, nil)
+	assert.Len(t, result.HealthReasonKinds, len(result.HealthReasons))
+}
+
+func TestWriteMetrics(t *testing.T) {
+	lag := int64(1024)
+	metrics := NewMetrics()
+	metrics.ObserveCycle(20*time.Millisecond, nil)
+	metrics.ObserveCycle(2*time.Second, errors.New("failed"))
+	metrics.ObserveStoreOp("fetch_cluster_state", 3*time.Millisecond, nil)
+	metrics.WakeupSent()
+
+	snapshot := statusSnapshot{
+		node: NodeStatus{
+			Name:      "node1",
+			IsPrimary: true,
+			Replicas:  []NodeReplicas{{Hostname: `node"2`, ReplayLagBytes: &lag}},
+		},
+		nodeAge: time.Second,
+		cluster: ClusterState{Status: ClusterStatus{
+			IntendedPrimary: "node1",
+			Health:          ClusterHealthUnhealthy,
+			HealthReasons: []string{
+				"Node node2 has no replication status",
+				"Node node3 has no replication status",
+				"Written by an older daemon",
+			},
+			HealthReasonKinds: []HealthReasonKind{HealthReasonNotReplicating, HealthReasonNotReplicating},
+		}},
+		clusterAge: time.Second,
+		cycleAge:   -1,
+	}
+
+	var b strings.Builder
+	writeMetrics(&b, "node1", snapshot, metrics)
+	lines := strings.Split(b.String(), "\n")
+
+	for _, expected := range []string{
+		`pgdaemon_role{role="primary"} 1`,
+		`pgdaemon_role{role="replica"} 0`,
+		`pgdaemon_postgres_up 1`,
+		`pgdaemon_pgbouncer_up 1`,
+		`pgdaemon_replica_lag_bytes{replica="node\"2"} 1024`,
+		`pgdaemon_cluster_healthy 0`,
+		`pgdaemon_cluster_health_reasons{kind="not_replicating"} 2`,
+		`pgdaemon_cluster_health_reasons{kind="other"} 1`,
+		`# TYPE pgdaemon_reconcile_cycle_duration_seconds histogram`,
+		`pgdaemon_reconcile_cycle_duration_seconds_bucket{le="0.05"} 1`,
+		`pgdaemon_reconcile_cycle_duration_seconds_bucket{le="+Inf"} 2`,
+		`pgdaemon_reconcile_cycle_duration_seconds_count 2`,
+		`pgdaemon_reconcile_errors_total 1`,
+		`pgdaemon_cas_conflicts_total 0`,
+		`pgdaemon_wakeups_sent_total 1`,
+		`pgdaemon_wakeups_received_total 0`,
+		`pgdaemon_state_store_duration_seconds_count{operation="fetch_cluster_state"} 1`,
+		`pgdaemon_state_store_errors_total{operation="fetch_cluster_state"} 0`,
+	} {
+		assert.Contains(t, lines, expected)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"slices"
@@ -12,10 +13,21 @@ import (
 
 // nodeReconcilerLoop runs the node reconciler, which fetches the spec
 // and status of the current node and performs tasks to reconcile them.
-func nodeReconcilerLoop(ctx context.Context, store StateStore, conf config, pgNode *PostgresNode, wakeupManager *WakeupManager) error {
+func nodeReconcilerLoop(ctx context.Context, store StateStore, conf config, pgNode *PostgresNode, wakeupManager *WakeupManager, cache *StatusCache, metrics *Metrics) error {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
+	runCycle := func() {
+		start := time.Now()
+		err := performReconciliationCycle(ctx, store, conf, pgNode, wakeupManager, cache)
+		duration := time.Since(start)
+		cache.CycleDone(duration, err)
+		metrics.ObserveCycle(duration, err)
+		if err != nil {
+			log.Printf("Failed to perform reconciliation cycle: %v", err)
+		}
+	}
+
 	var wakeupChan <-chan struct{}
 	if wakeupManager != nil {
 		wakeupChan = wakeupManager.WakeupChannel()
@@ -26,52 +38,109 @@ func nodeReconcilerLoop(ctx context.Context, store StateStore, conf config, pgNo
 		case <-ctx.Done():
 			return fmt.Errorf("returning ctx.Done() error in node reconciler loop: %w", ctx.Err())
 		case <-ticker.C:
-			if err := performReconciliationCycle(ctx, store, conf, pgNode, wakeupManager); err != nil {
-				log.Printf("Failed to perform reconciliation cycle: %v", err)
-			}
+			runCycle()
 		case <-wakeupChan:
 			log.Printf("Wakeup received, performing immediate reconciliation")
-			if err := performReconciliationCycle(ctx, store, conf, pgNode, wakeupManager); err != nil {
-				log.Printf("Failed to perform reconciliation cycle: %v", err)
-			}
+			runCycle()
 		}
 	}
 }
 
 // performReconciliationCycle performs one full reconciliation cycle
-func performReconciliationCycle(ctx context.Context, store StateStore, conf config, pgNode *PostgresNode, wakeupManager *WakeupManager) error {
-	if err := storeNodeStatus(ctx, store, conf.nodeName, pgNode); err != nil {
+func performReconciliationCycle(ctx context.Context, store StateStore, conf config, pgNode *PostgresNode, wakeupManager *WakeupManager, cache *StatusCache) error {
+	if err := storeNodeStatus(ctx, store, conf.nodeName, pgNode, cache); err != nil {
 		log.Printf("Failed to store node status: %v", err)
 	}
 
-	if err := performNodeTasks(ctx, store, conf, pgNode, wakeupManager); err != nil {
+	if err := performNodeTasks(ctx, store, conf, pgNode, wakeupManager, cache); err != nil {
 		return fmt.Errorf("Failed to perform node tasks: %w", err)
 	}
 
 	return nil
 }
 
-func storeNodeStatus(ctx context.Context, store StateStore, nodeName string, pgNode *PostgresNode) error {
+// nodeStatusHeartbeatInterval is how often nodeStatusLoop checks that
+// the node status was published. It is well within
+// peerLivenessTimeout.
+const nodeStatusHeartbeatInterval = 2 * time.Second
+
+// nodeStatusLoop publishes the node status whenever the reconciler
+// hasn't for interval. Peers take a node whose status stops changing
+// for gone, so the status has to keep changing while the reconciler is
+// busy with a long task, like demoting the primary in a switchover or
+// cloning a replica.
+func nodeStatusLoop(ctx context.Context, store StateStore, nodeName string, pgNode *PostgresNode, cache *StatusCache, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("returning ctx.Done() error in node status loop: %w", ctx.Err())
+		case <-ticker.C:
+		}
+
+		if age := cache.Snapshot(time.Now()).nodeAge; age >= 0 && age < interval {
+			continue
+		}
+		if err := storeNodeStatus(ctx, store, nodeName, pgNode, cache); err != nil {
+			log.Printf("Failed to store node status: %v", err)
+		}
+	}
+}
+
+func storeNodeStatus(ctx context.Context, store StateStore, nodeName string, pgNode *PostgresNode, cache *StatusCache) error {
+	pgNode.publishMu.Lock()
+	defer pgNode.publishMu.Unlock()
+
 	var status NodeStatus
 	status.Name = nodeName
 	status.StatusUuid = uuid.New()
 
+	pgNode.statusMu.Lock()
+	status.LastRejoin = pgNode.lastRejoin
+	status.ShutdownCheckpointLsn = pgNode.shutdownCheckpointLsn
+	status.Upgrade = pgNode.upgradeProgress
+	status.ReadOnly = pgNode.readOnly
+	pgNode.statusMu.Unlock()
+
 	pgState, err := pgNode.FetchState()
 	if err != nil {
 		log.Printf("Failed to fetch Postgres node state: %v", err)
 		errStr := err.Error()
 		status.Error = &errStr
+		status.ErrorKind = NodeErrorQuery
+		var stateErr *NodeStateError
+		if errors.As(err, &stateErr) {
+			status.ErrorKind = stateErr.Kind
+		}
 	} else {
 		status.NodeTime = pgState.NodeTime
 		status.IsPrimary = pgState.IsPrimary
+		status.ServerVersion = pgState.ServerVersion
+		status.ServerVersionNum = pgState.ServerVersionNum
+		status.PostmasterStartTime = pgState.PostmasterStartTime
+		status.PendingRestart = pgState.PendingRestart
+		status.TimelineID = pgState.TimelineID
+		status.CurrentLsn = pgState.CurrentLsn
+		status.ReceiveLsn = pgState.ReceiveLsn
+		status.FlushLsn = pgState.FlushLsn
+		status.ReplayLsn = pgState.ReplayLsn
+		status.ReplayLagBytes = pgState.ReplayLagBytes
+		status.ReplayPaused = pgState.ReplayPaused
+		status.LastReplayTime = pgState.LastReplayTime
+		status.DataDirectoryBytes = pgState.DataDirectoryBytes
+		status.DiskFreeBytes = pgState.DiskFreeBytes
 		for _, replica := range pgState.PgStatReplicas {
 			status.Replicas = append(status.Replicas, NodeReplicas{
-				Hostname:  replica.ClientHostname,
-				State:     replica.State,
-				WriteLsn:  replica.WriteLsn,
-				WriteLag:  replica.WriteLag,
-				SyncState: replica.SyncState,
-				ReplyTime: replica.ReplyTime,
+				Hostname:       replica.ClientHostname,
+				State:          replica.State,
+				WriteLsn:       replica.WriteLsn,
+				WriteLag:       replica.WriteLag,
+				ReplayLsn:      replica.ReplayLsn,
+				ReplayLagBytes: replica.ReplayLagBytes,
+				SyncState:      replica.SyncState,
+				ReplyTime:      replica.ReplyTime,
 			})
 		}
 		if pgState.PgStatWalReceiver != nil {
@@ -81,8 +150,24 @@ func storeNodeStatus(ctx context.Context, store StateStore, nodeName string, pgN
 				WrittenLsn:  pgState.PgStatWalReceiver.WrittenLsn,
 			}
 		}
+
+		// Postgres is fine, but make sure clients can reach it
+		// through PgBouncer too.
+		if _, err := CheckIsPrimary(pgNode.pgBouncerPool); err != nil {
+			log.Printf("Failed to query Postgres through PgBouncer: %v", err)
+			errStr := fmt.Sprintf("query through PgBouncer: %v", err)
+			status.Error = &errStr
+			status.ErrorKind = NodeErrorPgBouncer
+		}
 	}
 
+	status.PgBouncer, err = pgNode.FetchPgBouncerStatus(ctx)
+	if err != nil {
+		log.Printf("Failed to fetch PgBouncer stats: %v", err)
+	}
+
+	cache.SetNode(status)
+
 	wCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	err = store.WriteCurrentNodeStatus(wCtx, &status)
 	cancel()
@@ -93,14 +178,21 @@ func storeNodeStatus(ctx context.Context, store StateStore, nodeName string, pgN
 	return nil
 }
 
-func performNodeTasks(ctx context.Context, store StateStore, conf config, pgNode *PostgresNode, wakeupManager *WakeupManager) error {
+func performNodeTasks(ctx context.Context, store StateStore, conf config, pgNode *PostgresNode, wakeupManager *WakeupManager, cache *StatusCache) error {
 	state, err := store.FetchClusterState(ctx)
 	if err != nil {
 		return fmt.Errorf("Failed to fetch node spec: %w", err)
 	}
 
-	newStatus := ComputeNewClusterStatus(state)
+	newStatus := ComputeNewClusterStatus(state, cache.StaleNodes(state.Nodes))
 	newStatus, statusChanged, err := WriteClusterStatusIfChanged(store, state.Status, newStatus, conf.nodeName)
+	if errors.Is(err, ErrClusterStatusConflict) {
+		// Another node or the CLI changed the status since we read
+		// it. Don't act on a status that was never written; the
+		// next cycle will see the new one.
+		log.Printf("Cluster status changed concurrently, retrying next cycle")
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to write cluster status: %w", err)
 	}
@@ -114,21 +206,127 @@ func performNodeTasks(ctx context.Context, store StateStore, conf config, pgNode
 	}
 
 	state.Status = newStatus
+	if events := cache.SetCluster(state); len(events) > 0 {
+		// Events are informational, so failing to record them
+		// doesn't hold up the cycle.
+		eCtx, cancel := context.WithTimeout(ctx, 1*time.Second)
+		err := store.RecordClusterEvents(eCtx, events)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to record cluster events: %v", err)
+		}
+	}
+
+	if state.Status.FailoverState == FailoverStateDemotingOldPrimary && state.Status.PreviousPrimary == conf.nodeName {
+		// Planned switchover: stop client traffic and shut down
+		// cleanly so the new primary can take over without losing
+		// writes. Fast shutdown terminates clients anyway, so a
+		// failed freeze doesn't block the switchover.
+		if err := pgNode.FreezeWrites(ctx); err != nil {
+			log.Printf("Failed to freeze writes, demoting anyway: %v", err)
+		}
+		if err := pgNode.Demote(ctx); err != nil {
+			return fmt.Errorf("Failed to demote primary: %w", err)
+		}
+		return nil
+	}
 
-	if state.Status.IntendedPrimary == conf.nodeName {
+	if action, ok := state.Status.NodeActions[conf.nodeName]; ok {
+		if err := pgNode.performNodeAction(ctx, store, conf.nodeName, state.Status, action); err != nil {
+			return fmt.Errorf("Failed to perform %s: %w", action.Action, err)
+		}
+		return nil
+	}
+
+	if err := pgNode.ensureAuthConf(ctx, state.Spec.Auth); err != nil {
+		return fmt.Errorf("Failed to configure authentication: %w", err)
+	}
+
+	if state.Status.IntendedPrimary == conf.nodeName && state.Spec.StandbyCluster != nil {
+		// Standby leader: stream from the external primary, which is
+		// also where we clone and rewind from.
+		standby := state.Spec.StandbyCluster
+		nodeSpec := state.Spec.Nodes[conf.nodeName]
+		clone := cloneSource{method: CloneMethodPrimary, host: standby.Host, port: standby.PortOrDefault()}
+		if state.Spec.Clone != nil {
+			clone.maxRate = state.Spec.Clone.MaxRate
+		}
+		if err := pgNode.ConfigureAsReplica(ctx, standby.Host, standby.Host, standby.PortOrDefault(), conf.postgresUser, nodeSpec, clone, true); err != nil {
+			return fmt.Errorf("Failed to configure as standby leader: %w", err)
+		}
+	} else if state.Status.IntendedPrimary == conf.nodeName {
+		if upgrade := state.Status.Upgrade; upgrade.inProgress() && upgrade.Primary == conf.nodeName && upgrade.Phase != UpgradePhaseUpgradingReplicas {
+			return pgNode.upgradeAsPrimary(ctx, store, conf, *upgrade)
+		}
+		action, err := pgNode.readyToPromote(ctx, state.Status)
+		if err != nil {
+			return fmt.Errorf("Failed to check switchover progress: %w", err)
+		}
+		switch action {
+		case promotionActionWait:
+			return nil
+		case promotionActionAbort:
+			if err := abortSwitchover(store, conf.nodeName); err != nil {
+				return fmt.Errorf("Failed to abort switchover: %w", err)
+			}
+			return nil
+		}
 		if err := pgNode.ConfigureAsPrimary(ctx); err != nil {
 			return fmt.Errorf("Failed to configure as primary: %w", err)
 		}
+		if err := pgNode.ensureReplicationRole(ctx); err != nil {
+			return fmt.Errorf("Failed to set up replication role: %w", err)
+		}
+		if err := pgNode.ensureReadOnly(ctx, state.Spec.ReadOnly); err != nil {
+			return fmt.Errorf("Failed to apply read-only setting: %w", err)
+		}
 	} else if slices.Contains(state.Status.IntendedReplicas, conf.nodeName) {
-		if err := pgNode.ConfigureAsReplica(ctx, state.Status.IntendedPrimary, conf.postgresPort, conf.postgresUser); err != nil {
+		upstream := state.Status.UpstreamFor(conf.nodeName)
+		nodeSpec := state.Spec.Nodes[conf.nodeName]
+		clone := chooseCloneSource(state.Spec, state.Status, state.Nodes, conf.nodeName, conf.postgresPort, pgNode.archive != nil)
+		if upgrade := state.Status.Upgrade; upgrade != nil && (upgrade.Phase == UpgradePhaseUpgradingReplicas || upgrade.Phase == UpgradePhaseDone) {
+			// Nodes that were gone while the upgrade finished
+			// catch up once they are back.
+			if err := pgNode.prepareReplicaUpgrade(*upgrade); err != nil {
+				return fmt.Errorf("Failed to upgrade replica: %w", err)
+			}
+			// Backups and other replicas may still be on the old
+			// version, but the primary isn't.
+			if upgrade.Phase == UpgradePhaseUpgradingReplicas || pgNode.upgradeProgress.recloning() {
+				clone = cloneSource{method: CloneMethodPrimary, host: state.Status.IntendedPrimary, port: conf.postgresPort, maxRate: clone.maxRate}
+			}
+		}
+		if err := pgNode.ConfigureAsReplica(ctx, state.Status.IntendedPrimary, upstream, conf.postgresPort, conf.postgresUser, nodeSpec, clone, state.Spec.StandbyCluster != nil); err != nil {
 			return fmt.Errorf("Failed to configure as replica: %w", err)
 		}
 	} else {
 		return fmt.Errorf("Node %s is not a primary or replica in the cluster spec", conf.nodeName)
 	}
 
-	if err := ensurePgBouncerRunning(); err != nil {
-		return fmt.Errorf("Failed to ensure PgBouncer is running: %w", err)
+	pgNode.statusMu.Lock()
+	paused, hasClients := pgNode.pgBouncerPaused, pgNode.pgBouncerHasClients
+	pgNode.statusMu.Unlock()
+	redirect := nextPgBouncerRedirect(pgNode.pgBouncerRedirect, paused, hasClients, state.Status, conf.nodeName)
+	if redirect != pgNode.pgBouncerRedirect {
+		if redirect == "" {
+			log.Printf("Pointing PgBouncer back at the local Postgres")
+		} else {
+			log.Printf("Pointing PgBouncer at the new primary %s", redirect)
+		}
+		pgNode.pgBouncerRedirect = redirect
+	}
+	if err := pgNode.ensurePgBouncer(state.Spec.PgBouncer, state.Spec.Auth, conf); err != nil {
+		return fmt.Errorf("Failed to configure PgBouncer: %w", err)
+	}
+
+	// Traffic frozen for a switchover away from this node flows
+	// again once the new primary has been promoted. PgBouncer has
+	// been pointed at the new primary above, so the clients it held
+	// resume there.
+	if !pgBouncerShouldBePaused(state.Status, conf.nodeName) {
+		if err := pgNode.ResumeWrites(ctx); err != nil {
+			return fmt.Errorf("Failed to resume PgBouncer: %w", err)
+		}
 	}
 
 	return nil
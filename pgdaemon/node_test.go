@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeStatusLoop(t *testing.T) {
+	// Nothing listens on this port, like while Postgres and PgBouncer
+	// are down for a long task
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	pool, err := connectPostgresPool("127.0.0.1", port, "postgres", "sslmode=disable")
+	require.NoError(t, err)
+	defer pool.Close()
+	lsn := "0/5000028"
+	pgNode := &PostgresNode{
+		pool:                  pool,
+		pgBouncerPool:         pool,
+		pgBouncerAdmin:        NewPgBouncerAdmin("127.0.0.1", port, "postgres", connSecurity{}),
+		dataDir:               t.TempDir(),
+		shutdownCheckpointLsn: &lsn,
+	}
+	store := &memStore{}
+	cache := NewStatusCache()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- nodeStatusLoop(ctx, store, "node1", pgNode, cache, 20*time.Millisecond) }()
+
+	// The status keeps changing, so peers see the node as alive
+	nodeStatusUuid := func() uuid.UUID {
+		state, err := store.FetchClusterState(ctx)
+		require.NoError(t, err)
+		if len(state.Nodes) == 0 {
+			return uuid.Nil
+		}
+		return state.Nodes[0].StatusUuid
+	}
+	require.Eventually(t, func() bool { return nodeStatusUuid() != uuid.Nil }, 5*time.Second, 10*time.Millisecond)
+	first := nodeStatusUuid()
+	assert.Eventually(t, func() bool { return nodeStatusUuid() != first }, 5*time.Second, 10*time.Millisecond)
+
+	state, err := store.FetchClusterState(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, NodeErrorConnection, state.Nodes[0].ErrorKind)
+	assert.Equal(t, &lsn, state.Nodes[0].ShutdownCheckpointLsn)
+
+	cancel()
+	assert.Error(t, <-done)
+}
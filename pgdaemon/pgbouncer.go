@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// pgBouncerPauseTimeout is how long we let in-flight transactions
+// finish after PAUSE before we terminate them.
+const pgBouncerPauseTimeout = 5 * time.Second
+
+// PgBouncerAdmin runs commands on the PgBouncer admin console, which is
+// the special "pgbouncer" database. Our Postgres user must be in
+// admin_users.
+type PgBouncerAdmin struct {
+	connString string
+}
+
+func NewPgBouncerAdmin(host string, port int, user string, security connSecurity) *PgBouncerAdmin {
+	// The admin console only supports the simple query protocol
+	return &PgBouncerAdmin{
+		connString: fmt.Sprintf("host=%s port=%d user=%s dbname=pgbouncer %s default_query_exec_mode=simple_protocol", host, port, user, security.localParams()),
+	}
+}
+
+// Command runs a single admin console command like PAUSE or RESUME.
+func (a *PgBouncerAdmin) Command(ctx context.Context, command string) error {
+	conn, err := pgx.Connect(ctx, a.connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PgBouncer admin console: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, command); err != nil {
+		return fmt.Errorf("PgBouncer %s: %w", command, err)
+	}
+	return nil
+}
+
+// Show runs a SHOW command like "SHOW POOLS" and returns its rows
+// keyed by column name.
+func (a *PgBouncerAdmin) Show(ctx context.Context, command string) ([]map[string]any, error) {
+	conn, err := pgx.Connect(ctx, a.connString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PgBouncer admin console: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	rows, err := conn.Query(ctx, command)
+	if err != nil {
+		return nil, fmt.Errorf("PgBouncer %s: %w", command, err)
+	}
+	defer rows.Close()
+
+	var result []map[string]any
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, fmt.Errorf("PgBouncer %s: %w", command, err)
+		}
+		row := make(map[string]any, len(values))
+		for i, field := range rows.FieldDescriptions() {
+			row[field.Name] = values[i]
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("PgBouncer %s: %w", command, err)
+	}
+	return result, nil
+}
+
+// pgBouncerInt reads an integer column from a SHOW row. Columns vary
+// between PgBouncer versions, so missing columns are zero.
+func pgBouncerInt(row map[string]any, column string) int64 {
+	switch v := row[column].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case pgtype.Numeric:
+		// PgBouncer reports unsigned 64-bit counters as numeric
+		n, err := v.Int64Value()
+		if err != nil || !n.Valid {
+			return 0
+		}
+		return n.Int64
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	default:
+		return 0
+	}
+}
+
+func pgBouncerString(row map[string]any, column string) string {
+	s, _ := row[column].(string)
+	return s
+}
+
+// parsePgBouncerPools converts SHOW POOLS rows, skipping the admin
+// console's own pool.
+func parsePgBouncerPools(rows []map[string]any) []PgBouncerPoolStats {
+	var pools []PgBouncerPoolStats
+	for _, row := range rows {
+		if pgBouncerString(row, "database") == "pgbouncer" {
+			continue
+		}
+		pools = append(pools, PgBouncerPoolStats{
+			Database:       pgBouncerString(row, "database"),
+			User:           pgBouncerString(row, "user"),
+			ClientsActive:  pgBouncerInt(row, "cl_active"),
+			ClientsWaiting: pgBouncerInt(row, "cl_waiting"),
+			ServersActive:  pgBouncerInt(row, "sv_active"),
+			ServersIdle:    pgBouncerInt(row, "sv_idle"),
+			MaxWaitUs:      pgBouncerInt(row, "maxwait")*1_000_000 + pgBouncerInt(row, "maxwait_us"),
+			PoolMode:       pgBouncerString(row, "pool_mode"),
+		})
+	}
+	return pools
+}
+
+// parsePgBouncerStats converts SHOW STATS rows, skipping the admin
+// console.
+func parsePgBouncerStats(rows []map[string]any) []PgBouncerDatabaseStats {
+	var stats []PgBouncerDatabaseStats
+	for _, row := range rows {
+		if pgBouncerString(row, "database") == "pgbouncer" {
+			continue
+		}
+		stats = append(stats, PgBouncerDatabaseStats{
+			Database:        pgBouncerString(row, "database"),
+			TotalXactCount:  pgBouncerInt(row, "total_xact_count"),
+			TotalQueryCount: pgBouncerInt(row, "total_query_count"),
+			AvgXactTimeUs:   pgBouncerInt(row, "avg_xact_time"),
+			AvgQueryTimeUs:  pgBouncerInt(row, "avg_query_time"),
+			AvgWaitTimeUs:   pgBouncerInt(row, "avg_wait_time"),
+		})
+	}
+	return stats
+}
+
+// FetchPgBouncerStatus collects pool stats from the admin console.
+func (p *PostgresNode) FetchPgBouncerStatus(ctx context.Context) (*NodePgBouncerStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	pools, err := p.pgBouncerAdmin.Show(ctx, "SHOW POOLS")
+	if err != nil {
+		return nil, err
+	}
+	stats, err := p.pgBouncerAdmin.Show(ctx, "SHOW STATS")
+	if err != nil {
+		return nil, err
+	}
+	state, err := p.pgBouncerAdmin.Show(ctx, "SHOW STATE")
+	if err != nil {
+		return nil, err
+	}
+	status := &NodePgBouncerStatus{
+		Paused:    parsePgBouncerPaused(state),
+		Pools:     parsePgBouncerPools(pools),
+		Databases: parsePgBouncerStats(stats),
+	}
+	// A previous pgdaemon may have died while PgBouncer was paused,
+	// so we go by what PgBouncer says.
+	p.statusMu.Lock()
+	p.pgBouncerPaused = status.Paused
+	p.pgBouncerHasClients = pgBouncerHasClients(status.Pools, p.pgdaemonUser)
+	p.statusMu.Unlock()
+	return status, nil
+}
+
+// pgBouncerHasClients returns true if any pool has clients other than
+// pgdaemon's own connections.
+func pgBouncerHasClients(pools []PgBouncerPoolStats, pgdaemonUser string) bool {
+	for _, pool := range pools {
+		if pool.User != pgdaemonUser && pool.ClientsActive+pool.ClientsWaiting > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePgBouncerPaused returns true if SHOW STATE says PgBouncer is
+// paused.
+func parsePgBouncerPaused(rows []map[string]any) bool {
+	for _, row := range rows {
+		if pgBouncerString(row, "key") == "paused" {
+			return pgBouncerString(row, "value") == "yes"
+		}
+	}
+	return false
+}
+
+// renderPgBouncerIni renders pgbouncer.ini from the spec. The settings
+// that aren't in the spec match what the lab scripts used to write.
+// With an auth spec, PgBouncer authenticates clients using
+// pgbouncerHbaFile (see renderPgBouncerHbaConf) and looks up their
+// SCRAM secrets in Postgres with auth_query, which it runs as -pguser
+// with the password from pgBouncerUserlistFile. With TLS, PgBouncer
+// offers clients the node's server certificate and verifies Postgres'
+// like pgdaemon does. If redirect is set, the default databases point
+// at that node's Postgres instead of ours. Databases from the spec are
+// left alone.
+func renderPgBouncerIni(spec PgBouncerSpec, auth *AuthSpec, tls serverTLSFiles, conf config, redirect string) ([]byte, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	poolMode := spec.PoolMode
+	if poolMode == "" {
+		poolMode = "transaction"
+	}
+
+	databases := spec.Databases
+	if len(databases) == 0 {
+		host := conf.postgresHost
+		if redirect != "" {
+			host = redirect
+		}
+		databases = map[string]string{"*": fmt.Sprintf("host=%s port=%d", host, conf.postgresPort)}
+	}
+
+	var b strings.Builder
+	b.WriteString("; Managed by pgdaemon from the cluster spec. Local changes are overwritten.\n")
+	b.WriteString("[databases]\n")
+	for _, name := range slices.Sorted(maps.Keys(databases)) {
+		fmt.Fprintf(&b, "%s = %s\n", name, databases[name])
+	}
+
+	b.WriteString("\n[pgbouncer]\n")
+	b.WriteString("listen_addr = 0.0.0.0\n")
+	fmt.Fprintf(&b, "listen_port = %d\n", conf.pgBouncerPort)
+	if auth == nil {
+		b.WriteString("auth_type = trust\n")
+		b.WriteString("auth_file = /etc/pgbouncer/userlist.txt\n")
+	} else {
+		b.WriteString("auth_type = hba\n")
+		fmt.Fprintf(&b, "auth_hba_file = %s\n", pgBouncerHbaFile(conf))
+		fmt.Fprintf(&b, "auth_file = %s\n", pgBouncerUserlistFile(conf))
+		fmt.Fprintf(&b, "auth_user = %s\n", conf.postgresUser)
+		b.WriteString("auth_query = SELECT usename, passwd FROM pg_catalog.pg_shadow WHERE usename = $1\n")
+	}
+	if tls.enabled() {
+		b.WriteString("client_tls_sslmode = prefer\n")
+		fmt.Fprintf(&b, "client_tls_cert_file = %s\n", tls.certFile)
+		fmt.Fprintf(&b, "client_tls_key_file = %s\n", tls.keyFile)
+		fmt.Fprintf(&b, "client_tls_ca_file = %s\n", tls.caFile)
+		b.WriteString("server_tls_sslmode = verify-full\n")
+		fmt.Fprintf(&b, "server_tls_ca_file = %s\n", tls.caFile)
+	}
+	fmt.Fprintf(&b, "admin_users = %s\n", conf.postgresUser)
+	b.WriteString("server_reset_query = DISCARD ALL\n")
+	fmt.Fprintf(&b, "pool_mode = %s\n", poolMode)
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"default_pool_size", spec.DefaultPoolSize},
+		{"min_pool_size", spec.MinPoolSize},
+		{"reserve_pool_size", spec.ReservePoolSize},
+		{"max_client_conn", spec.MaxClientConn},
+		{"max_db_connections", spec.MaxDbConnections},
+	} {
+		if setting.value > 0 {
+			fmt.Fprintf(&b, "%s = %d\n", setting.name, setting.value)
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+// pgBouncerHbaFile is where we write PgBouncer's auth_hba_file, next
+// to pgbouncer.ini.
+func pgBouncerHbaFile(conf config) string {
+	return filepath.Join(filepath.Dir(conf.pgBouncerConfig), "pgbouncer_hba.conf")
+}
+
+// validate checks the settings that would make renderPgBouncerIni
+// fail, or write something other than what they say.
+func (s PgBouncerSpec) validate() error {
+	if s.PoolMode != "" && !slices.Contains([]string{"session", "transaction", "statement"}, s.PoolMode) {
+		return fmt.Errorf("invalid PgBouncer pool_mode %q", s.PoolMode)
+	}
+	for name, conninfo := range s.Databases {
+		if name == "" || strings.ContainsAny(name, "=\n") || strings.Contains(conninfo, "\n") {
+			return fmt.Errorf("invalid PgBouncer database %q", name)
+		}
+	}
+	return nil
+}
+
+// pgBouncerUserlistFile is where we write PgBouncer's auth_file with
+// -pguser's password, next to pgbouncer.ini.
+func pgBouncerUserlistFile(conf config) string {
+	return filepath.Join(filepath.Dir(conf.pgBouncerConfig), "pgdaemon_userlist.txt")
+}
+
+// renderPgBouncerUserlist renders an auth_file with one user. PgBouncer
+// needs the password itself, not a SCRAM verifier, to log in to
+// Postgres as that user.
+func renderPgBouncerUserlist(user string, password string) []byte {
+	quote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, `""`) + `"` }
+	return fmt.Appendf(nil, "%s %s\n", quote(user), quote(password))
+}
+
+// renderPgBouncerHbaConf renders PgBouncer's auth_hba_file. Like
+// pg_hba.conf, everyone must use SCRAM, including pgdaemon's own role,
+// so PgBouncer can't be used to get around the rules in pg_hba.conf,
+// and TLS if it is enabled.
+func renderPgBouncerHbaConf(auth AuthSpec, tls bool) ([]byte, error) {
+	hostType := "host   "
+	if tls {
+		hostType = "hostssl"
+	}
+
+	var b strings.Builder
+	b.WriteString("# Managed by pgdaemon from the cluster spec. Local changes are overwritten.\n")
+	b.WriteString("# TYPE  DATABASE     USER    ADDRESS    METHOD\n")
+	b.WriteString("host    all all 127.0.0.1/32 scram-sha-256\n")
+	b.WriteString("host    all all ::1/128 scram-sha-256\n")
+	for _, cidr := range auth.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid allowed CIDR %q: %w", cidr, err)
+		}
+		fmt.Fprintf(&b, "%s all all %s scram-sha-256\n", hostType, cidr)
+	}
+	return []byte(b.String()), nil
+}
+
+// ensurePgBouncer writes pgbouncer.ini if the spec manages it, makes
+// sure PgBouncer is running, and reloads it after config changes. An
+// auth spec always manages pgbouncer.ini, since PgBouncer would
+// otherwise let anyone in with trust auth, and so do TLS, since our own
+// connections to PgBouncer require it, and a redirect to the new
+// primary, since the default databases have to change. We reload
+// through the service rather than the admin console, which we can't
+// connect to until PgBouncer has loaded the TLS settings.
+func (p *PostgresNode) ensurePgBouncer(spec *PgBouncerSpec, auth *AuthSpec, conf config) error {
+	if spec == nil && (auth != nil || p.tlsFiles.enabled() || p.pgBouncerRedirect != "") {
+		spec = &PgBouncerSpec{}
+	}
+	if auth != nil {
+		changed, err := writeSecretFile(pgBouncerUserlistFile(conf), renderPgBouncerUserlist(conf.postgresUser, p.pgUserPassword))
+		if err != nil {
+			return fmt.Errorf("failed to write PgBouncer auth file: %w", err)
+		}
+		content, err := renderPgBouncerHbaConf(*auth, p.tlsFiles.enabled())
+		if err != nil {
+			return err
+		}
+		hbaChanged, err := writeConfFile(pgBouncerHbaFile(conf), content)
+		if err != nil {
+			return fmt.Errorf("failed to write PgBouncer HBA file: %w", err)
+		}
+		if changed || hbaChanged {
+			log.Printf("Updated %s and %s", pgBouncerUserlistFile(conf), pgBouncerHbaFile(conf))
+			p.pgBouncerNeedsReload = true
+		}
+	}
+	if spec != nil {
+		content, err := renderPgBouncerIni(*spec, auth, p.tlsFiles, conf, p.pgBouncerRedirect)
+		if err != nil {
+			return err
+		}
+		changed, err := writeConfFile(conf.pgBouncerConfig, content)
+		if err != nil {
+			return fmt.Errorf("failed to write pgbouncer.ini: %w", err)
+		}
+		if changed {
+			log.Printf("Updated %s", conf.pgBouncerConfig)
+			p.pgBouncerNeedsReload = true
+		}
+	}
+
+	if err := p.pgBouncer.EnsureRunning(); err != nil {
+		return fmt.Errorf("Failed to ensure PgBouncer is running: %w", err)
+	}
+
+	if p.pgBouncerNeedsReload {
+		if err := p.pgBouncer.Reload(); err != nil {
+			return fmt.Errorf("failed to reload PgBouncer: %w", err)
+		}
+		log.Printf("Reloaded PgBouncer config")
+		p.pgBouncerNeedsReload = false
+	}
+	return nil
+}
+
+// isPgBouncerAlreadyPaused and isPgBouncerNotPaused recognize the
+// errors PgBouncer returns when PAUSE or RESUME has nothing to do.
+func isPgBouncerAlreadyPaused(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already suspended/paused")
+}
+
+func isPgBouncerNotPaused(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not paused/suspended")
+}
+
+// FreezeWrites stops client traffic to this primary during a
+// switchover. PAUSE makes PgBouncer wait for in-flight transactions
+// and then hold new queries. If transactions don't finish in time, or
+// clients are connected to Postgres directly, we terminate their
+// backends.
+func (p *PostgresNode) FreezeWrites(ctx context.Context) error {
+	if p.shutdownCheckpointLsn != nil {
+		// Postgres is already shut down
+		return nil
+	}
+
+	log.Printf("Freezing writes: pausing PgBouncer")
+	pauseCtx, cancel := context.WithTimeout(ctx, 2*pgBouncerPauseTimeout)
+	defer cancel()
+	pauseErr := make(chan error, 1)
+	go func() {
+		pauseErr <- p.pgBouncerAdmin.Command(pauseCtx, "PAUSE")
+	}()
+
+	paused := false
+	select {
+	case err := <-pauseErr:
+		if err != nil && !isPgBouncerAlreadyPaused(err) {
+			return err
+		}
+		paused = true
+	case <-time.After(pgBouncerPauseTimeout):
+		log.Printf("In-flight transactions did not finish within %s", pgBouncerPauseTimeout)
+	}
+	// From here on PgBouncer holds new queries, so it has to be
+	// resumed eventually even if the PAUSE fails.
+	p.statusMu.Lock()
+	p.pgBouncerPaused = true
+	p.statusMu.Unlock()
+
+	terminated, err := p.terminateClientBackends(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Freezing writes: terminated %d client backends", terminated)
+
+	if !paused {
+		if err := <-pauseErr; err != nil && !isPgBouncerAlreadyPaused(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminateClientBackends terminates every client session except our
+// own and returns how many there were.
+func (p *PostgresNode) terminateClientBackends(ctx context.Context) (int64, error) {
+	tag, err := p.pool.Exec(ctx, `
+		SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity
+		WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to terminate client backends: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// pgBouncerShouldBePaused is true while a switchover away from
+// nodeName is in progress, from demoting it until the new primary has
+// been promoted. Only the old primary's PgBouncer is ever paused.
+func pgBouncerShouldBePaused(status ClusterStatus, nodeName string) bool {
+	return status.FailoverState != "" && status.FailoverState != FailoverStateStable && status.PreviousPrimary == nodeName
+}
+
+// nextPgBouncerRedirect decides which node PgBouncer's default
+// databases should point at, other than the local Postgres. Clients
+// that PgBouncer held during a switchover away from this node were
+// using the primary, so rather than resuming them onto what is now a
+// read-only replica, we send them to the new primary. We keep doing
+// that until they have disconnected, since they would end up on the
+// replica as soon as we pointed PgBouncer back at it.
+func nextPgBouncerRedirect(current string, paused bool, hasClients bool, status ClusterStatus, nodeName string) string {
+	switch {
+	case status.IntendedPrimary == nodeName || status.IntendedPrimary == "":
+		return ""
+	case paused, current != "" && hasClients:
+		// Follow the primary if it has moved again.
+		return status.IntendedPrimary
+	default:
+		return ""
+	}
+}
+
+// ResumeWrites resumes PgBouncer if it is paused. If RESUME fails,
+// the next status fetch checks again whether PgBouncer is paused.
+func (p *PostgresNode) ResumeWrites(ctx context.Context) error {
+	p.statusMu.Lock()
+	paused := p.pgBouncerPaused
+	p.statusMu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	if err := p.pgBouncerAdmin.Command(ctx, "RESUME"); err != nil && !isPgBouncerNotPaused(err) {
+		return err
+	}
+	log.Printf("Resumed PgBouncer")
+	p.statusMu.Lock()
+	p.pgBouncerPaused = false
+	p.statusMu.Unlock()
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPgBouncerAdmin(t *testing.T) {
+	admin := NewPgBouncerAdmin("localhost", 6432, "postgres", connSecurity{})
+	assert.Equal(t, "host=localhost port=6432 user=postgres dbname=pgbouncer sslmode=disable default_query_exec_mode=simple_protocol", admin.connString)
+
+	admin = NewPgBouncerAdmin("localhost", 6432, "postgres", connSecurity{rootCert: "/etc/pgdaemon/ca.crt"})
+	assert.Equal(t, "host=localhost port=6432 user=postgres dbname=pgbouncer sslmode=verify-full sslrootcert=/etc/pgdaemon/ca.crt default_query_exec_mode=simple_protocol", admin.connString)
+}
+
+func TestPgBouncerPauseErrors(t *testing.T) {
+	assert.True(t, isPgBouncerAlreadyPaused(errors.New("PgBouncer PAUSE: ERROR: already suspended/paused (SQLSTATE 08P01)")))
+	assert.False(t, isPgBouncerAlreadyPaused(errors.New("connection refused")))
+	assert.False(t, isPgBouncerAlreadyPaused(nil))
+
+	assert.True(t, isPgBouncerNotPaused(errors.New("PgBouncer RESUME: ERROR: pooler is not paused/suspended (SQLSTATE 08P01)")))
+	assert.False(t, isPgBouncerNotPaused(errors.New("connection refused")))
+}
+
+func TestParsePgBouncerPaused(t *testing.T) {
+	state := []map[string]any{
+		{"key": "active", "value": "yes"},
+		{"key": "paused", "value": "no"},
+		{"key": "suspended", "value": "no"},
+	}
+	assert.False(t, parsePgBouncerPaused(state))
+	state[1]["value"] = "yes"
+	assert.True(t, parsePgBouncerPaused(state))
+	assert.False(t, parsePgBouncerPaused(nil))
+}
+
+func TestPgBouncerShouldBePaused(t *testing.T) {
+	status := ClusterStatus{IntendedPrimary: "node2", PreviousPrimary: "node1", FailoverState: FailoverStateDemotingOldPrimary}
+	assert.True(t, pgBouncerShouldBePaused(status, "node1"))
+	assert.False(t, pgBouncerShouldBePaused(status, "node2"))
+
+	// Still paused while the new primary is promoted
+	status.FailoverState = FailoverStatePromotingNewPrimary
+	assert.True(t, pgBouncerShouldBePaused(status, "node1"))
+
+	status.FailoverState = FailoverStateStable
+	status.PreviousPrimary = ""
+	assert.False(t, pgBouncerShouldBePaused(status, "node1"))
+}
+
+func TestNextPgBouncerRedirect(t *testing.T) {
+	status := ClusterStatus{IntendedPrimary: "node2", PreviousPrimary: "node1", FailoverState: FailoverStatePromotingNewPrimary}
+
+	// Paused for the switchover, so the held clients go to node2
+	assert.Equal(t, "node2", nextPgBouncerRedirect("", true, true, status, "node1"))
+	// The new primary's PgBouncer uses its own Postgres
+	assert.Equal(t, "", nextPgBouncerRedirect("", false, true, status, "node2"))
+
+	// Once resumed, we stay on node2 while those clients are around
+	status.FailoverState = FailoverStateStable
+	status.PreviousPrimary = ""
+	assert.Equal(t, "node2", nextPgBouncerRedirect("node2", false, true, status, "node1"))
+	assert.Equal(t, "", nextPgBouncerRedirect("node2", false, false, status, "node1"))
+	// Replicas that were never paused use their own Postgres
+	assert.Equal(t, "", nextPgBouncerRedirect("", false, true, status, "node3"))
+
+	// Follow the primary if it moves again, and stop once it's us
+	status.IntendedPrimary = "node3"
+	assert.Equal(t, "node3", nextPgBouncerRedirect("node2", false, true, status, "node1"))
+	status.IntendedPrimary = "node1"
+	assert.Equal(t, "", nextPgBouncerRedirect("node3", false, true, status, "node1"))
+}
+
+func TestPgBouncerResumesOntoNewPrimary(t *testing.T) {
+	conf := config{postgresHost: "127.0.0.1", postgresPort: 5432, pgBouncerPort: 6432, postgresUser: "postgres"}
+	status := ClusterStatus{IntendedPrimary: "node2", IntendedReplicas: []string{"node1"}, FailoverState: FailoverStateStable}
+
+	// node1's PgBouncer is still paused from the switchover, and
+	// isn't supposed to be anymore.
+	require.False(t, pgBouncerShouldBePaused(status, "node1"))
+	redirect := nextPgBouncerRedirect("", true, true, status, "node1")
+	content, err := renderPgBouncerIni(PgBouncerSpec{}, nil, serverTLSFiles{}, conf, redirect)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "[databases]\n* = host=node2 port=5432\n")
+
+	// Spec databases are routed by the operator
+	content, err = renderPgBouncerIni(PgBouncerSpec{Databases: map[string]string{"app": "host=10.0.0.5"}}, nil, serverTLSFiles{}, conf, redirect)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "[databases]\napp = host=10.0.0.5\n")
+}
+
+func TestPgBouncerHasClients(t *testing.T) {
+	pools := []PgBouncerPoolStats{
+		{Database: "postgres", User: "postgres", ClientsActive: 2},
+		{Database: "app", User: "app"},
+	}
+	assert.False(t, pgBouncerHasClients(pools, "postgres"))
+	pools[1].ClientsWaiting = 1
+	assert.True(t, pgBouncerHasClients(pools, "postgres"))
+}
+
+func TestParsePgBouncerPools(t *testing.T) {
+	var maxWaitNumeric pgtype.Numeric
+	require.NoError(t, maxWaitNumeric.Scan("2"))
+
+	rows := []map[string]any{
+		{"database": "pgbouncer", "user": "pgbouncer", "cl_active": int64(1)},
+		{
+			"database":   "app",
+			"user":       "postgres",
+			"cl_active":  int64(20),
+			"cl_waiting": int64(5),
+			"sv_active":  int64(20),
+			"sv_idle":    int64(0),
+			"maxwait":    maxWaitNumeric,
+			"maxwait_us": int64(500000),
+			"pool_mode":  "transaction",
+		},
+	}
+	assert.Equal(t, []PgBouncerPoolStats{{
+		Database:       "app",
+		User:           "postgres",
+		ClientsActive:  20,
+		ClientsWaiting: 5,
+		ServersActive:  20,
+		MaxWaitUs:      2_500_000,
+		PoolMode:       "transaction",
+	}}, parsePgBouncerPools(rows))
+}
+
+func TestParsePgBouncerStats(t *testing.T) {
+	rows := []map[string]any{
+		{"database": "app", "total_xact_count": int64(100), "total_query_count": "250", "avg_xact_time": int64(1200), "avg_query_time": int64(400), "avg_wait_time": int64(10)},
+	}
+	assert.Equal(t, []PgBouncerDatabaseStats{{
+		Database:        "app",
+		TotalXactCount:  100,
+		TotalQueryCount: 250,
+		AvgXactTimeUs:   1200,
+		AvgQueryTimeUs:  400,
+		AvgWaitTimeUs:   10,
+	}}, parsePgBouncerStats(rows))
+}
+
+func TestRenderPgBouncerIni(t *testing.T) {
+	conf := config{postgresHost: "127.0.0.1", postgresPort: 5432, pgBouncerPort: 6432, postgresUser: "postgres"}
+
+	content, err := renderPgBouncerIni(PgBouncerSpec{}, nil, serverTLSFiles{}, conf, "")
+	require.NoError(t, err)
+	assert.Equal(t, `; Managed by pgdaemon from the cluster spec. Local changes are overwritten.
+[databases]
+* = host=127.0.0.1 port=5432
+
+[pgbouncer]
+listen_addr = 0.0.0.0
+listen_port = 6432
+auth_type = trust
+auth_file = /etc/pgbouncer/userlist.txt
+admin_users = postgres
+server_reset_query = DISCARD ALL
+pool_mode = transaction
+`, string(content))
+
+	content, err = renderPgBouncerIni(PgBouncerSpec{
+		PoolMode:        "session",
+		DefaultPoolSize: 40,
+		MaxClientConn:   1000,
+		Databases: map[string]string{
+			"reports": "host=127.0.0.1 port=5432 dbname=app pool_size=5",
+			"app":     "host=127.0.0.1 port=5432",
+		},
+	}, nil, serverTLSFiles{}, conf, "")
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "[databases]\napp = host=127.0.0.1 port=5432\nreports = host=127.0.0.1 port=5432 dbname=app pool_size=5\n")
+	assert.Contains(t, string(content), "pool_mode = session\ndefault_pool_size = 40\nmax_client_conn = 1000\n")
+
+	_, err = renderPgBouncerIni(PgBouncerSpec{PoolMode: "bogus"}, nil, serverTLSFiles{}, conf, "")
+	assert.ErrorContains(t, err, "invalid PgBouncer pool_mode")
+
+	conf.pgBouncerConfig = "/etc/pgbouncer/pgbouncer.ini"
+	content, err = renderPgBouncerIni(PgBouncerSpec{}, &AuthSpec{}, serverTLSFiles{}, conf, "")
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `auth_type = hba
+auth_hba_file = /etc/pgbouncer/pgbouncer_hba.conf
+auth_file = /etc/pgbouncer/pgdaemon_userlist.txt
+auth_user = postgres
+auth_query = SELECT usename, passwd FROM pg_catalog.pg_shadow WHERE usename = $1
+`)
+	assert.NotContains(t, string(content), "trust")
+	assert.NotContains(t, string(content), "tls")
+
+	tls := serverTLSFiles{certFile: "/tls/server.crt", keyFile: "/tls/server.key", caFile: "/tls/ca.crt"}
+	content, err = renderPgBouncerIni(PgBouncerSpec{}, nil, tls, conf, "")
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `client_tls_sslmode = prefer
+client_tls_cert_file = /tls/server.crt
+client_tls_key_file = /tls/server.key
+client_tls_ca_file = /tls/ca.crt
+server_tls_sslmode = verify-full
+server_tls_ca_file = /tls/ca.crt
+`)
+}
+
+func TestValidatePgBouncerSpec(t *testing.T) {
+	assert.NoError(t, ClusterSpec{PgBouncer: &PgBouncerSpec{}}.validate())
+	assert.NoError(t, ClusterSpec{PgBouncer: &PgBouncerSpec{PoolMode: "session", Databases: map[string]string{"*": "host=127.0.0.1"}}}.validate())
+
+	assert.ErrorContains(t, ClusterSpec{PgBouncer: &PgBouncerSpec{PoolMode: "bogus"}}.validate(), "pool_mode")
+	assert.ErrorContains(t, ClusterSpec{PgBouncer: &PgBouncerSpec{Databases: map[string]string{"app = x": "host=db"}}}.validate(), "invalid PgBouncer database")
+	assert.ErrorContains(t, ClusterSpec{PgBouncer: &PgBouncerSpec{Databases: map[string]string{"app": "host=db\n[pgbouncer]"}}}.validate(), "invalid PgBouncer database")
+}
+
+func TestRenderPgBouncerUserlist(t *testing.T) {
+	assert.Equal(t, `"postgres" "pa""ss"`+"\n", string(renderPgBouncerUserlist("postgres", `pa"ss`)))
+}
+
+func TestRenderPgBouncerHbaConf(t *testing.T) {
+	content, err := renderPgBouncerHbaConf(AuthSpec{AllowedCIDRs: []string{"10.0.0.0/16"}}, false)
+	require.NoError(t, err)
+	assert.Equal(t, `# Managed by pgdaemon from the cluster spec. Local changes are overwritten.
+# TYPE  DATABASE     USER    ADDRESS    METHOD
+host    all all 127.0.0.1/32 scram-sha-256
+host    all all ::1/128 scram-sha-256
+host    all all 10.0.0.0/16 scram-sha-256
+`, string(content))
+
+	content, err = renderPgBouncerHbaConf(AuthSpec{AllowedCIDRs: []string{"10.0.0.0/16"}}, true)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "hostssl all all 10.0.0.0/16 scram-sha-256\n")
+
+	_, err = renderPgBouncerHbaConf(AuthSpec{AllowedCIDRs: []string{"bogus"}}, false)
+	assert.ErrorContains(t, err, "invalid allowed CIDR")
+}
@@ -4,38 +4,194 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type PostgresNode struct {
 	pool          *pgxpool.Pool
 	pgBouncerPool *pgxpool.Pool
+
+	// dataDir is PGDATA and binDir is the directory holding the
+	// Postgres binaries (empty to use $PATH).
+	dataDir string
+	binDir  string
+
+	postgres       Service
+	pgBouncer      Service
+	pgBouncerAdmin *PgBouncerAdmin
+
+	// postgresServiceFor builds the Postgres service for other
+	// binaries, so an upgrade can switch to the new version.
+	postgresServiceFor func(bins pgBinaries) (Service, error)
+
+	// statusMu guards the fields that storeNodeStatus reads or sets,
+	// since nodeStatusLoop runs it while the reconciler's tasks change
+	// them: pgBouncerPaused, pgBouncerHasClients, lastRejoin,
+	// readOnly, upgradeProgress, and shutdownCheckpointLsn. publishMu
+	// makes sure only one storeNodeStatus runs at a time.
+	statusMu  sync.Mutex
+	publishMu sync.Mutex
+
+	// pgBouncerPaused is whether PgBouncer is paused, as of
+	// FreezeWrites or the SHOW STATE of the last status fetch.
+	pgBouncerPaused bool
+	// pgBouncerNeedsReload is true when we changed pgbouncer.ini but
+	// haven't RELOADed PgBouncer yet.
+	pgBouncerNeedsReload bool
+	// pgBouncerRedirect is the primary that PgBouncer's default
+	// databases point at instead of the local Postgres, after a
+	// switchover away from this node (see nextPgBouncerRedirect).
+	// A restarted pgdaemon forgets it.
+	pgBouncerRedirect string
+	// pgBouncerHasClients is whether PgBouncer had clients other
+	// than pgdaemon, as of the last status fetch.
+	pgBouncerHasClients bool
+
+	// lastRejoin is the outcome of the last time we turned this
+	// node from a primary into a replica.
+	lastRejoin *NodeRejoinStatus
+
+	// dataDirSize is cached because it is expensive to compute. It is
+	// computed in the background, and dataDirSizeMu protects it.
+	dataDirSizeMu      sync.Mutex
+	dataDirSize        *int64
+	dataDirSizeAt      time.Time
+	dataDirSizeRunning bool
+
+	// walReceiverMismatchSince is when we first noticed that the
+	// walreceiver wasn't streaming from the intended primary, or
+	// zero if it is. walReceiverRestarts counts the restarts since it
+	// last streamed, for backoff. walReceiverReplayLsn is the replay
+	// LSN we saw last cycle without a walreceiver, to tell if we are
+	// replaying from the archive.
+	walReceiverMismatchSince time.Time
+	walReceiverRestarts      int
+	walReceiverReplayLsn     LSN
+
+	// readOnly is true once ensureReadOnly has frozen writes.
+	readOnly bool
+
+	// upgradeProgress is this node's part in the last major version
+	// upgrade.
+	upgradeProgress *NodeUpgradeStatus
+
+	// shutdownCheckpointLsn is set once Demote has cleanly shut down
+	// this node for a switchover, until it is configured again.
+	shutdownCheckpointLsn *string
+	// promotionWaitSince is when we started waiting to receive the
+	// old primary's shutdown checkpoint in a switchover.
+	promotionWaitSince time.Time
+
+	// pgdaemonUser is -pguser, the role pgdaemon connects as locally.
+	pgdaemonUser string
+
+	// security is how we connect to other nodes. tlsFiles,
+	// certHosts, and replicationPassword configure this node's side.
+	security             connSecurity
+	tlsFiles             serverTLSFiles
+	certHosts            []string
+	replicationPassword  string
+	replicationRoleReady bool
+	// pgUserPassword is pgdaemonUser's password, which the auth spec
+	// requires over loopback.
+	pgUserPassword      string
+	pgUserPasswordReady bool
+
+	// archive is -archive-url, or nil if archiving is disabled.
+	// archiveCommand and restoreCommand archive WAL to it and fetch
+	// WAL from it.
+	archive        ArchiveTarget
+	archiveCommand string
+	restoreCommand string
 }
 
-func NewPostgresNode(host string, port int, user string, pgBouncerHost string, pgBouncerPort int) (*PostgresNode, error) {
+func NewPostgresNode(conf config, archive ArchiveTarget) (*PostgresNode, error) {
+	host, port, user := conf.postgresHost, conf.postgresPort, conf.postgresUser
 	if host == "" || port <= 0 || user == "" {
 		return nil, fmt.Errorf("invalid Postgres connection parameters: host=%s, port=%d, user=%s", host, port, user)
 	}
+	if conf.pgDataDir == "" {
+		return nil, fmt.Errorf("PGDATA directory must be specified")
+	}
+
+	// An upgrade may have switched this node to newer binaries
+	baseConf := conf
+	conf, err := withPgBinaries(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	postgres, pgBouncer, err := newServices(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsFiles, err := newServerTLSFiles(conf)
+	if err != nil {
+		return nil, err
+	}
+	security, replicationPassword, pgUserPassword, err := setUpConnSecurity(conf)
+	if err != nil {
+		return nil, err
+	}
 
-	pool, err := connectPostgresPool(host, port, user)
+	pool, err := connectPostgresPool(host, port, user, security.localParams())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
 	}
 
-	pgBouncerPool, err := connectPostgresPool(pgBouncerHost, pgBouncerPort, user)
+	// With TLS, PgBouncer uses this node's server certificate (see
+	// renderPgBouncerIni), so we verify it like Postgres'.
+	pgBouncerPool, err := connectPostgresPool(conf.pgBouncerHost, conf.pgBouncerPort, user, security.localParams())
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
 	}
 
+	var archiveCommand, restoreCommand string
+	if conf.archiveURL != "" {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find pgdaemon executable: %w", err)
+		}
+		archiveCommand = archiveCommandLine(executable, conf, "archive-wal-push", `"%p"`, "%f")
+		restoreCommand = archiveCommandLine(executable, conf, "archive-wal-fetch", "%f", `"%p"`)
+	}
+
 	log.Printf("Connected to Postgres at %s:%d as user %s", host, port, user)
 	return &PostgresNode{
-		pool:          pool,
-		pgBouncerPool: pgBouncerPool,
+		pool:                pool,
+		pgBouncerPool:       pgBouncerPool,
+		dataDir:             conf.pgDataDir,
+		binDir:              conf.pgBinDir,
+		postgres:            postgres,
+		pgBouncer:           pgBouncer,
+		pgBouncerAdmin:      NewPgBouncerAdmin(conf.pgBouncerHost, conf.pgBouncerPort, user, security),
+		pgdaemonUser:        user,
+		security:            security,
+		tlsFiles:            tlsFiles,
+		certHosts:           certHostnames(conf),
+		replicationPassword: replicationPassword,
+		pgUserPassword:      pgUserPassword,
+		archive:             archive,
+		archiveCommand:      archiveCommand,
+		restoreCommand:      restoreCommand,
+		postgresServiceFor: func(bins pgBinaries) (Service, error) {
+			postgres, _, err := newServices(applyPgBinaries(baseConf, bins))
+			return postgres, err
+		},
 	}, nil
 }
 
@@ -43,14 +199,20 @@ const maxPoolSize = 3
 const poolIdleTime = 10 * time.Second
 const localQueryTimeout = 200 * time.Millisecond
 
-func connectPostgresPool(host string, port int, user string) (*pgxpool.Pool, error) {
+// poolConnectTimeout bounds dialing and the handshake of new pooled
+// connections. Acquire gives up after its own timeout, but without
+// this a hung Postgres would keep the attempts going and fill the pool.
+const poolConnectTimeout = 5 * time.Second
+
+func connectPostgresPool(host string, port int, user string, sslParams string) (*pgxpool.Pool, error) {
 	// N.B. default_query_exec_mode=exec because the default uses
 	// statement caching, which doesn't work with pgbouncer.
-	connStr := fmt.Sprintf("host=%s port=%d user=%s sslmode=disable default_query_exec_mode=exec pool_max_conns=%d pool_max_conn_idle_time=%s", host, port, user, maxPoolSize, poolIdleTime)
+	connStr := fmt.Sprintf("host=%s port=%d user=%s %s default_query_exec_mode=exec pool_max_conns=%d pool_max_conn_idle_time=%s", host, port, user, sslParams, maxPoolSize, poolIdleTime)
 	config, err := pgxpool.ParseConfig(connStr)
 	if err != nil {
 		return nil, fmt.Errorf("pgx parse config error: %w", err)
 	}
+	config.ConnConfig.ConnectTimeout = poolConnectTimeout
 
 	pool, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
@@ -60,8 +222,30 @@ func connectPostgresPool(host string, port int, user string) (*pgxpool.Pool, err
 }
 
 type PostgresNodeState struct {
-	NodeTime          string
-	IsPrimary         bool
+	NodeTime            string
+	IsPrimary           bool
+	ServerVersion       string
+	ServerVersionNum    int
+	PostmasterStartTime string
+	PendingRestart      bool
+
+	TimelineID uint32
+
+	// CurrentLsn is only set on primaries
+	CurrentLsn *string
+
+	// These are only set on replicas. ReplayLagBytes is how far
+	// replay is behind what we have received.
+	ReceiveLsn     *string
+	FlushLsn       *string
+	ReplayLsn      *string
+	ReplayLagBytes *int64
+	ReplayPaused   bool
+	LastReplayTime *string
+
+	DataDirectoryBytes *int64
+	DiskFreeBytes      *int64
+
 	PgStatReplicas    []PostgresPgStatReplica
 	PgStatWalReceiver *PgStatWalReceiver
 }
@@ -80,6 +264,7 @@ type PostgresPgStatReplica struct {
 	ReplayLag      *string
 	SyncState      *string
 	ReplyTime      *string
+	ReplayLagBytes *int64
 }
 
 type PgStatWalReceiver struct {
@@ -91,57 +276,279 @@ type PgStatWalReceiver struct {
 	FlushedLsn      *string
 }
 
+// NodeStateError is returned by FetchState and says what kind of
+// failure happened, so we can tell "Postgres is down" apart from "a
+// query failed".
+type NodeStateError struct {
+	Kind NodeErrorKind
+	Err  error
+}
+
+func (e *NodeStateError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *NodeStateError) Unwrap() error {
+	return e.Err
+}
+
+// SQLSTATE codes we use to classify errors. See
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	sqlStateInvalidAuthorizationSpecification = "28000"
+	sqlStateInvalidPassword                   = "28P01"
+	sqlStateAdminShutdown                     = "57P01"
+	sqlStateCrashShutdown                     = "57P02"
+	sqlStateCannotConnectNow                  = "57P03"
+)
+
+// classifyConnectError classifies an error we got while trying to get
+// a connection to Postgres. A refused, unreachable, or timed out dial
+// or handshake means Postgres is down. When every pooled connection
+// was busy, though, timing out only means we were waiting for one of
+// them, so Postgres is busy rather than down and we count it as a
+// query error.
+func classifyConnectError(err error, poolBusy bool) NodeErrorKind {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case sqlStateInvalidPassword, sqlStateInvalidAuthorizationSpecification:
+			return NodeErrorAuthentication
+		case sqlStateCannotConnectNow:
+			// "the database system is starting up", "is in
+			// recovery mode", "is shutting down", etc.
+			return NodeErrorStartingUp
+		}
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.ENOENT} {
+		// ENOENT is a missing Unix socket
+		if errors.Is(err, errno) {
+			return NodeErrorConnection
+		}
+	}
+	var netErr net.Error
+	timedOut := errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) || (errors.As(err, &netErr) && netErr.Timeout())
+	if timedOut && !poolBusy {
+		return NodeErrorConnection
+	}
+	return NodeErrorQuery
+}
+
+// classifyQueryError classifies an error we got while running a query
+// on a connection we already established.
+func classifyQueryError(err error) NodeErrorKind {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case sqlStateAdminShutdown, sqlStateCrashShutdown, sqlStateCannotConnectNow:
+			return NodeErrorStartingUp
+		}
+	}
+	return NodeErrorQuery
+}
+
 func (p *PostgresNode) FetchState() (*PostgresNodeState, error) {
+	dataDirBytes, diskFreeBytes := p.diskUsage()
+
 	ctx, cancel := context.WithTimeout(context.Background(), localQueryTimeout)
 	defer cancel()
 
+	// Acquire a connection explicitly so we can tell connection
+	// failures apart from query failures.
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		// Acquire returns the same context error whether it was
+		// waiting for a busy connection or for a new one to be
+		// dialed, so look at what the pool was doing.
+		stat := p.pool.Stat()
+		poolBusy := stat.AcquiredConns() >= stat.MaxConns()
+		return nil, &NodeStateError{Kind: classifyConnectError(err, poolBusy), Err: fmt.Errorf("connect to Postgres: %w", err)}
+	}
+	defer conn.Release()
+
+	queryErr := func(format string, err error) error {
+		return &NodeStateError{Kind: classifyQueryError(err), Err: fmt.Errorf(format, err)}
+	}
+
 	var state PostgresNodeState
-	if err := p.pool.QueryRow(ctx, "SELECT now(), NOT pg_is_in_recovery()").Scan(&state.NodeTime, &state.IsPrimary); err != nil {
-		return nil, fmt.Errorf("check pg_is_in_recovery: %w", err)
+	if err := conn.QueryRow(ctx, `
+		SELECT now(), NOT pg_is_in_recovery(),
+		       current_setting('server_version'),
+		       current_setting('server_version_num')::int,
+		       pg_postmaster_start_time()::text,
+		       EXISTS (SELECT 1 FROM pg_settings WHERE pending_restart)`,
+	).Scan(
+		&state.NodeTime, &state.IsPrimary,
+		&state.ServerVersion, &state.ServerVersionNum,
+		&state.PostmasterStartTime, &state.PendingRestart,
+	); err != nil {
+		return nil, queryErr("check pg_is_in_recovery: %w", err)
 	}
 
+	state.DataDirectoryBytes, state.DiskFreeBytes = dataDirBytes, diskFreeBytes
+
 	if state.IsPrimary {
-		rows, err := p.pool.Query(ctx, `
-			SELECT client_hostname, client_addr, client_port, state, sent_lsn,
-			       write_lsn, flush_lsn, replay_lsn, write_lag, flush_lag,
-			       replay_lag, sync_state, reply_time
-			FROM pg_stat_replication`)
-		if err != nil {
-			return nil, fmt.Errorf("query pg_stat_replication: %w", err)
+		var walFile string
+		if err := conn.QueryRow(ctx, "SELECT pg_current_wal_lsn()::text, pg_walfile_name(pg_current_wal_lsn())").Scan(&state.CurrentLsn, &walFile); err != nil {
+			return nil, queryErr("query current WAL position: %w", err)
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var r PostgresPgStatReplica
-			if err := rows.Scan(
-				&r.ClientHostname, &r.ClientAddr, &r.ClientPort, &r.State,
-				&r.SentLsn, &r.WriteLsn, &r.FlushLsn, &r.ReplayLsn,
-				&r.WriteLag, &r.FlushLag, &r.ReplayLag,
-				&r.SyncState, &r.ReplyTime,
-			); err != nil {
-				return nil, fmt.Errorf("scan pg_stat_replication row: %w", err)
-			}
-			state.PgStatReplicas = append(state.PgStatReplicas, r)
+		if state.TimelineID, err = timelineFromWalFileName(walFile); err != nil {
+			return nil, queryErr("parse timeline: %w", err)
 		}
+	}
 
+	// N.B. Replicas have pg_stat_replication rows too if other
+	// replicas cascade from them.
+	if err := fetchPgStatReplication(ctx, conn, &state); err != nil {
+		return nil, queryErr("%w", err)
+	}
+
+	if state.IsPrimary {
 		return &state, nil
 	}
 
+	if err := conn.QueryRow(ctx, `
+		SELECT coalesce(
+		           (SELECT received_tli FROM pg_stat_wal_receiver),
+		           (SELECT timeline_id FROM pg_control_checkpoint())
+		       ),
+		       (SELECT written_lsn::text FROM pg_stat_wal_receiver),
+		       pg_last_wal_receive_lsn()::text,
+		       pg_last_wal_replay_lsn()::text,
+		       pg_wal_lsn_diff(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn())::bigint,
+		       pg_is_wal_replay_paused(),
+		       pg_last_xact_replay_timestamp()::text`,
+	).Scan(
+		&state.TimelineID, &state.ReceiveLsn, &state.FlushLsn,
+		&state.ReplayLsn, &state.ReplayLagBytes,
+		&state.ReplayPaused, &state.LastReplayTime,
+	); err != nil {
+		return nil, queryErr("query replica WAL positions: %w", err)
+	}
+
+	// N.B. pg_stat_wal_receiver has no rows if the walreceiver isn't
+	// running. That isn't a query failure, the replica just has no
+	// replication status.
 	var receiver PgStatWalReceiver
-	if err := p.pool.QueryRow(ctx, `
+	err = conn.QueryRow(ctx, `
 		SELECT sender_host, sender_port, status,
 		       receive_start_lsn, written_lsn, flushed_lsn
 		FROM pg_stat_wal_receiver`,
 	).Scan(
 		&receiver.SenderHost, &receiver.SenderPort, &receiver.Status,
 		&receiver.ReceiveStartLsn, &receiver.WrittenLsn, &receiver.FlushedLsn,
-	); err != nil {
-		return nil, fmt.Errorf("query pg_stat_wal_receiver: %w", err)
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, queryErr("query pg_stat_wal_receiver: %w", err)
 	}
 	state.PgStatWalReceiver = &receiver
 	return &state, nil
 }
 
+func fetchPgStatReplication(ctx context.Context, conn *pgxpool.Conn, state *PostgresNodeState) error {
+	// pg_current_wal_lsn() errors during recovery, so cascading
+	// replicas measure lag against what they have received.
+	rows, err := conn.Query(ctx, `
+		SELECT client_hostname, client_addr, client_port, state, sent_lsn,
+		       write_lsn, flush_lsn, replay_lsn, write_lag, flush_lag,
+		       replay_lag, sync_state, reply_time,
+		       pg_wal_lsn_diff(
+		           CASE WHEN pg_is_in_recovery() THEN pg_last_wal_receive_lsn() ELSE pg_current_wal_lsn() END,
+		           replay_lsn
+		       )::bigint
+		FROM pg_stat_replication`)
+	if err != nil {
+		return fmt.Errorf("query pg_stat_replication: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r PostgresPgStatReplica
+		if err := rows.Scan(
+			&r.ClientHostname, &r.ClientAddr, &r.ClientPort, &r.State,
+			&r.SentLsn, &r.WriteLsn, &r.FlushLsn, &r.ReplayLsn,
+			&r.WriteLag, &r.FlushLag, &r.ReplayLag,
+			&r.SyncState, &r.ReplyTime, &r.ReplayLagBytes,
+		); err != nil {
+			return fmt.Errorf("scan pg_stat_replication row: %w", err)
+		}
+		state.PgStatReplicas = append(state.PgStatReplicas, r)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query pg_stat_replication: %w", err)
+	}
+	return nil
+}
+
+// timelineFromWalFileName extracts the timeline from a WAL segment file
+// name, which starts with the timeline as 8 hex digits.
+func timelineFromWalFileName(walFile string) (uint32, error) {
+	if len(walFile) < 8 {
+		return 0, fmt.Errorf("invalid WAL file name %q", walFile)
+	}
+	tli, err := strconv.ParseUint(walFile[:8], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse timeline from WAL file %s: %w", walFile, err)
+	}
+	return uint32(tli), nil
+}
+
+// dataDirSizeInterval is how often we recompute the size of the data
+// directory. Walking a large data directory is too expensive to do on
+// every reconciliation cycle.
+const dataDirSizeInterval = 1 * time.Minute
+
+// diskUsage returns the size of the data directory and the free space
+// on its filesystem. Either is nil if we couldn't compute it. The size
+// is refreshed in the background, so this returns the last size we
+// computed.
+func (p *PostgresNode) diskUsage() (dataDirBytes *int64, diskFreeBytes *int64) {
+	p.dataDirSizeMu.Lock()
+	if !p.dataDirSizeRunning && (p.dataDirSizeAt.IsZero() || time.Since(p.dataDirSizeAt) > dataDirSizeInterval) {
+		p.dataDirSizeRunning = true
+		go p.refreshDataDirSize()
+	}
+	dataDirBytes = p.dataDirSize
+	p.dataDirSizeMu.Unlock()
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(p.dataDir, &stat); err == nil {
+		free := int64(stat.Bavail) * int64(stat.Bsize)
+		diskFreeBytes = &free
+	}
+
+	return dataDirBytes, diskFreeBytes
+}
+
+// refreshDataDirSize walks the data directory to compute its size.
+func (p *PostgresNode) refreshDataDirSize() {
+	var size int64
+	err := filepath.WalkDir(p.dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files come and go (e.g. WAL segments) while we
+			// walk.
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	p.dataDirSizeMu.Lock()
+	defer p.dataDirSizeMu.Unlock()
+	if err != nil {
+		log.Printf("Failed to compute size of %s: %v", p.dataDir, err)
+	} else {
+		p.dataDirSize = &size
+	}
+	p.dataDirSizeAt = time.Now()
+	p.dataDirSizeRunning = false
+}
+
 func CheckIsPrimary(pool *pgxpool.Pool) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), localQueryTimeout)
 	defer cancel()
@@ -154,70 +561,80 @@ func CheckIsPrimary(pool *pgxpool.Pool) (bool, error) {
 	return isPrimary, nil
 }
 
-const pgDataDir = "/var/lib/postgres/data"
-const pgVersionFile = pgDataDir + "/PG_VERSION"
-
-func (p *PostgresNode) ConfigureAsReplica(ctx context.Context, primaryHost string, primaryPort int, user string) error {
-	if _, err := os.Stat(pgVersionFile); errors.Is(err, os.ErrNotExist) {
-		log.Printf("Initializing replica for primary %s database in %s", primaryHost, pgDataDir)
-
-		cmd := exec.Command("pg_basebackup", "-h", primaryHost, "-p", fmt.Sprintf("%d", primaryPort), "-U", user, "-D", pgDataDir, "--progress")
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// pgBin returns the path to the named Postgres binary.
+func (p *PostgresNode) pgBin(name string) string {
+	return pgBinPath(p.binDir, name)
+}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to initialize replica database: %w", err)
+// ConfigureAsReplica makes this node a replica that streams WAL from
+// upstreamHost, which is the primary unless we are cascading from
+// another replica. clone says where to copy a new data directory
+// from: the primary, a replica, or a base backup. We always rewind
+// from primaryHost. With standbyCluster set, primaryHost is the
+// standby leader or the external primary, and may be in recovery
+// itself.
+func (p *PostgresNode) ConfigureAsReplica(ctx context.Context, primaryHost string, upstreamHost string, primaryPort int, user string, nodeSpec NodeSpec, clone cloneSource, standbyCluster bool) error {
+	if _, err := os.Stat(p.dataDir + "/PG_VERSION"); errors.Is(err, os.ErrNotExist) {
+		if err := p.cloneDataDir(ctx, clone, user); err != nil {
+			return err
 		}
-
-		// N.B. pg_basebackup copies all .conf files as well
 	}
 
 	// Ensure standby.signal exists
-	standbySignalPath := pgDataDir + "/standby.signal"
+	standbySignalPath := p.dataDir + "/standby.signal"
 	if _, err := os.Stat(standbySignalPath); errors.Is(err, os.ErrNotExist) {
-		log.Printf("Creating standby.signal in %s", pgDataDir)
+		log.Printf("Creating standby.signal in %s", p.dataDir)
 		if err := os.WriteFile(standbySignalPath, []byte{}, 0644); err != nil {
 			return fmt.Errorf("failed to create standby.signal: %w", err)
 		}
 	}
 
 	// Check conninfo to see if we need to change it
-	conninfoPath := pgDataDir + "/postgresql.conf.d/primary_conninfo.conf"
-	currentConninfo, err := os.ReadFile(conninfoPath)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("failed to read primary_conninfo.conf: %w", err)
+	conninfoPath := p.dataDir + "/postgresql.conf.d/primary_conninfo.conf"
+	expectedConninfo := fmt.Appendf(nil, "primary_conninfo = %s", quotePostgresConfString(p.security.peerConninfo(upstreamHost, primaryPort, user)))
+	conninfoChanged, err := writeConfFile(conninfoPath, expectedConninfo)
+	if err != nil {
+		return fmt.Errorf("failed to write primary_conninfo.conf: %w", err)
+	}
+	if conninfoChanged {
+		log.Printf("Changed primary connection info to %s", expectedConninfo)
 	}
 
-	expectedConninfo := fmt.Appendf(nil, "primary_conninfo = 'host=%s port=%d user=%s'", primaryHost, primaryPort, user)
-	if string(currentConninfo) != string(expectedConninfo) {
-		log.Printf("Primary connection info is %s, changing to %s", currentConninfo, expectedConninfo)
+	// Writes were blocked if we were demoted in a switchover
+	demoteConfChanged, err := writeConfFile(p.dataDir+"/postgresql.conf.d/demote.conf", nil)
+	if err != nil {
+		return fmt.Errorf("failed to remove demote.conf: %w", err)
+	}
 
-		if err := os.WriteFile(conninfoPath, expectedConninfo, 0644); err != nil {
-			return fmt.Errorf("failed to write primary_conninfo.conf: %w", err)
-		}
+	if err := p.ensureArchiveConf(); err != nil {
+		return err
+	}
+
+	replayNeedsReload, replayNeedsRestart, err := p.writeReplayConfFiles(nodeSpec)
+	if err != nil {
+		return fmt.Errorf("failed to write delayed replica settings: %w", err)
+	}
 
-		// Call systemctl reload postgresql.service if running
-		if err := systemctlCommandIfRunning("reload", postgresSystemdUnit); err != nil {
+	if replayNeedsRestart {
+		log.Printf("Recovery target changed, restarting Postgres")
+		if err := p.postgres.Restart(); err != nil {
+			return fmt.Errorf("failed to restart Postgres service: %w", err)
+		}
+	} else if conninfoChanged || demoteConfChanged || replayNeedsReload {
+		// Reload Postgres if it is running. The walreceiver is
+		// checked below on every cycle, so we don't need to force
+		// a reconnect here.
+		if err := p.postgres.Reload(); err != nil {
 			return fmt.Errorf("failed to reload Postgres service: %w", err)
 		}
+	}
 
-		// TODO: Kill walreceiver processes to force a reconnect.
-		// TODO: Make this more robust? What if primary_conninfo was
-		// properly set but we failed before this line. We might
-		// never restart walreceiver.
-		// log.Printf("Killing walreceiver processes to force reconnect to primary %s", primaryHost)
-		// cmd := exec.Command("pkill", "-f", "walreceiver")
-		// cmd.Stdout = os.Stdout
-		// cmd.Stderr = os.Stderr
-		// if err := cmd.Run(); err != nil {
-		// 	// TODO: What if the error is that we couldn't kill the walreciever process?
-		// 	log.Printf("Failed to kill walreceiver processes, might not have been running: %v", err)
-		// }
-	}
-
-	if err := ensurePostgresRunning(); err != nil {
+	if err := p.postgres.EnsureRunning(); err != nil {
 		return fmt.Errorf("Failed to ensure Postgres is running: %w", err)
 	}
+	p.statusMu.Lock()
+	p.shutdownCheckpointLsn = nil
+	p.statusMu.Unlock()
 
 	// Check if pg_is_in_recovery() is false. If so, we need
 	// to point to new primary and become a replica.
@@ -226,36 +643,174 @@ func (p *PostgresNode) ConfigureAsReplica(ctx context.Context, primaryHost strin
 		return fmt.Errorf("failed to check pg_is_in_recovery: %w", err)
 	}
 	if !isInRecovery {
-		log.Printf("Postgres is not in recovery mode. Must be the old primary. Need to stop")
-		if err := stopPostgres(); err != nil {
-			return fmt.Errorf("failed to stop Postgres: %w", err)
+		log.Printf("Postgres is not in recovery mode. Must be the old primary. Need to rejoin %s", primaryHost)
+		return p.rejoinAsReplica(ctx, primaryHost, primaryPort, user, clone, standbyCluster)
+	}
+
+	if err := p.ensureWalReceiverConnected(ctx, upstreamHost, primaryPort); err != nil {
+		return fmt.Errorf("failed to ensure walreceiver is connected: %w", err)
+	}
+
+	if err := p.ensureReplayState(ctx, nodeSpec); err != nil {
+		return fmt.Errorf("failed to ensure WAL replay state: %w", err)
+	}
+
+	return nil
+}
+
+// walReceiverRestartTimeout is how long we wait for the walreceiver to
+// start streaming from the intended upstream after forcing a reconnect
+// before we give up and restart Postgres. It doubles with every restart
+// that didn't help, up to walReceiverMaxRestartTimeout.
+const (
+	walReceiverRestartTimeout    = 30 * time.Second
+	walReceiverMaxRestartTimeout = 15 * time.Minute
+)
+
+// walReceiverRestartBackoff is how long we wait before restarting
+// Postgres again, after that many restarts didn't get the walreceiver
+// streaming.
+func walReceiverRestartBackoff(restarts int) time.Duration {
+	timeout := walReceiverRestartTimeout
+	for range restarts {
+		timeout *= 2
+		if timeout >= walReceiverMaxRestartTimeout {
+			return walReceiverMaxRestartTimeout
 		}
+	}
+	return timeout
+}
 
-		// Run pg_rewind. TODO: We don't necessarily need to do
-		// this every time, but since we must stop the primary
-		// anyway we can be safe.
-		cmd := exec.Command("pg_rewind", "--target-pgdata", pgDataDir, "--source-server=host="+primaryHost+" port="+fmt.Sprintf("%d", primaryPort)+" user="+user)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to run pg_rewind: %w", err)
+type walReceiverAction string
+
+const (
+	walReceiverActionNone      walReceiverAction = "none"
+	walReceiverActionArchive   walReceiverAction = "archive"
+	walReceiverActionReconnect walReceiverAction = "reconnect"
+	walReceiverActionWait      walReceiverAction = "wait"
+	walReceiverActionRestart   walReceiverAction = "restart"
+)
+
+// decideWalReceiverAction decides what to do about the walreceiver
+// given whether it is streaming from the intended upstream, whether
+// Postgres is replaying WAL from the archive instead, and when we
+// first noticed that it wasn't streaming (zero if it was fine last
+// cycle). Postgres only starts the walreceiver once restore_command
+// runs out of WAL, so we leave it alone while it catches up from the
+// archive. now and mismatchSince must come from the local monotonic
+// clock.
+func decideWalReceiverAction(streamingFromUpstream bool, replayingFromArchive bool, mismatchSince time.Time, now time.Time, timeout time.Duration) walReceiverAction {
+	if streamingFromUpstream {
+		return walReceiverActionNone
+	}
+	if replayingFromArchive {
+		return walReceiverActionArchive
+	}
+	if mismatchSince.IsZero() {
+		return walReceiverActionReconnect
+	}
+	if now.Sub(mismatchSince) < timeout {
+		return walReceiverActionWait
+	}
+	return walReceiverActionRestart
+}
+
+// ensureWalReceiverConnected compares the walreceiver's sender with
+// the intended upstream on every cycle. We don't only do this when
+// primary_conninfo changes because we might have written
+// primary_conninfo and reloaded, but failed before the walreceiver
+// reconnected.
+func (p *PostgresNode) ensureWalReceiverConnected(ctx context.Context, upstreamHost string, upstreamPort int) error {
+	var senderHost, status string
+	var senderPort int
+	err := p.pool.QueryRow(ctx, `
+		SELECT coalesce(sender_host, ''), coalesce(sender_port, 0), status
+		FROM pg_stat_wal_receiver`,
+	).Scan(&senderHost, &senderPort, &status)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("query pg_stat_wal_receiver: %w", err)
+	}
+
+	noWalReceiver := errors.Is(err, pgx.ErrNoRows)
+
+	// Without a walreceiver, Postgres may be replaying WAL from the
+	// archive, which we can only tell from the replay LSN moving.
+	replayingFromArchive := false
+	if noWalReceiver {
+		var replayLsnStr string
+		if err := p.pool.QueryRow(ctx, "SELECT coalesce(pg_last_wal_replay_lsn()::text, '0/0')").Scan(&replayLsnStr); err != nil {
+			return fmt.Errorf("query replay LSN: %w", err)
+		}
+		replayLsn, err := ParseLSN(replayLsnStr)
+		if err != nil {
+			return err
 		}
-		log.Printf("pg_rewind completed successfully, Postgres should now be a replica of %s", primaryHost)
+		replayingFromArchive = p.walReceiverReplayLsn != 0 && replayLsn > p.walReceiverReplayLsn
+		p.walReceiverReplayLsn = replayLsn
+	} else {
+		p.walReceiverReplayLsn = 0
+	}
 
-		if err := ensurePostgresRunning(); err != nil {
-			return fmt.Errorf("Failed to ensure Postgres is running after pg_rewind: %w", err)
+	streamingFromUpstream := !noWalReceiver && senderHost == upstreamHost && senderPort == upstreamPort && status == "streaming"
+	now := time.Now()
+	timeout := walReceiverRestartBackoff(p.walReceiverRestarts)
+	action := decideWalReceiverAction(streamingFromUpstream, replayingFromArchive, p.walReceiverMismatchSince, now, timeout)
+
+	switch action {
+	case walReceiverActionNone:
+		p.walReceiverMismatchSince = time.Time{}
+		p.walReceiverRestarts = 0
+	case walReceiverActionArchive:
+		// Start over once Postgres runs out of archived WAL and
+		// tries to stream.
+		log.Printf("Replaying WAL from the archive, at %s", p.walReceiverReplayLsn)
+		p.walReceiverMismatchSince = time.Time{}
+	case walReceiverActionReconnect:
+		log.Printf("walreceiver is connected to %s:%d (status %q), forcing reconnect to %s:%d", senderHost, senderPort, status, upstreamHost, upstreamPort)
+		p.walReceiverMismatchSince = now
+		if _, err := p.pool.Exec(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE backend_type = 'walreceiver'"); err != nil {
+			return fmt.Errorf("failed to terminate walreceiver: %w", err)
+		}
+	case walReceiverActionWait:
+		log.Printf("Waiting for walreceiver to stream from %s:%d (currently %s:%d, status %q)", upstreamHost, upstreamPort, senderHost, senderPort, status)
+	case walReceiverActionRestart:
+		// A restart can't help if the upstream is down or
+		// unreachable, so check again after another timeout.
+		if err := checkUpstreamAcceptsConnections(ctx, upstreamHost, upstreamPort); err != nil {
+			log.Printf("walreceiver did not stream from %s:%d within %s, but not restarting Postgres: %v", upstreamHost, upstreamPort, timeout, err)
+			p.walReceiverMismatchSince = now
+			return nil
+		}
+		log.Printf("walreceiver did not stream from %s:%d within %s, restarting Postgres", upstreamHost, upstreamPort, timeout)
+		p.walReceiverMismatchSince = time.Time{}
+		p.walReceiverRestarts++
+		if err := p.postgres.Restart(); err != nil {
+			return fmt.Errorf("failed to restart Postgres: %w", err)
 		}
-		log.Printf("Postgres restarted successfully after pg_rewind, now a replica of %s", primaryHost)
 	}
 
 	return nil
 }
 
+// upstreamDialTimeout bounds checkUpstreamAcceptsConnections.
+const upstreamDialTimeout = 3 * time.Second
+
+// checkUpstreamAcceptsConnections returns an error if nothing accepts
+// TCP connections at host:port.
+func checkUpstreamAcceptsConnections(ctx context.Context, host string, port int) error {
+	dialer := net.Dialer{Timeout: upstreamDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("upstream is unreachable: %w", err)
+	}
+	return conn.Close()
+}
+
 func (p *PostgresNode) ConfigureAsPrimary(ctx context.Context) error {
-	if _, err := os.Stat(pgVersionFile); errors.Is(err, os.ErrNotExist) {
-		log.Printf("Initializing primary database in %s", pgDataDir)
+	if _, err := os.Stat(p.dataDir + "/PG_VERSION"); errors.Is(err, os.ErrNotExist) {
+		log.Printf("Initializing primary database in %s", p.dataDir)
 
-		cmd := exec.Command("pg_ctl", "initdb", "--pgdata", pgDataDir)
+		cmd := exec.Command(p.pgBin("pg_ctl"), "initdb", "--pgdata", p.dataDir)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 
@@ -263,20 +818,29 @@ func (p *PostgresNode) ConfigureAsPrimary(ctx context.Context) error {
 			return fmt.Errorf("failed to initialize primary database: %w", err)
 		}
 
-		if err := writePostgresConfFiles(); err != nil {
+		if err := p.writePostgresConfFiles(); err != nil {
 			return fmt.Errorf("failed to configure primary database: %w", err)
 		}
 	}
 
-	// Ensure primary_conninfo.conf is nuked
-	conninfoPath := pgDataDir + "/postgresql.conf.d/primary_conninfo.conf"
-	if err := os.Remove(conninfoPath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("failed to remove primary_conninfo.conf: %w", err)
+	// Ensure primary_conninfo.conf, delayed replica settings, and the
+	// switchover write block are nuked
+	for _, name := range []string{"primary_conninfo.conf", "recovery_delay.conf", "recovery_target.conf", "demote.conf"} {
+		if _, err := writeConfFile(p.dataDir+"/postgresql.conf.d/"+name, nil); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+
+	if err := p.ensureArchiveConf(); err != nil {
+		return err
 	}
 
-	if err := ensurePostgresRunning(); err != nil {
+	if err := p.postgres.EnsureRunning(); err != nil {
 		return fmt.Errorf("Failed to ensure Postgres is running: %w", err)
 	}
+	p.statusMu.Lock()
+	p.shutdownCheckpointLsn = nil
+	p.statusMu.Unlock()
 
 	var isInRecovery bool
 	if err := p.pool.QueryRow(ctx, "SELECT pg_is_in_recovery()").Scan(&isInRecovery); err != nil {
@@ -329,20 +893,20 @@ host    all             all             0.0.0.0/0            trust
 host    replication     all             0.0.0.0/0            trust
 `
 
-func writePostgresConfFiles() error {
-	if err := appendToFile(pgDataDir+"/postgresql.conf", "include_dir 'postgresql.conf.d'"); err != nil {
+func (p *PostgresNode) writePostgresConfFiles() error {
+	if err := appendToFile(p.dataDir+"/postgresql.conf", "include_dir 'postgresql.conf.d'"); err != nil {
 		return fmt.Errorf("Failed to append to postgresql.conf: %w", err)
 	}
 
-	if err := os.MkdirAll(pgDataDir+"/postgresql.conf.d", 0755); err != nil {
+	if err := os.MkdirAll(p.dataDir+"/postgresql.conf.d", 0755); err != nil {
 		return fmt.Errorf("Failed to create postgresql.conf.d directory: %w", err)
 	}
 
-	if err := os.WriteFile(pgDataDir+"/postgresql.conf.d/pgdaemon.conf", []byte(pgdaemonConfContent), 0644); err != nil {
+	if err := os.WriteFile(p.dataDir+"/postgresql.conf.d/pgdaemon.conf", []byte(pgdaemonConfContent), 0644); err != nil {
 		return fmt.Errorf("Failed to write pgdaemon.conf: %w", err)
 	}
 
-	if err := appendToFile(pgDataDir+"/pg_hba.conf", hbaConfContent); err != nil {
+	if err := appendToFile(p.dataDir+"/pg_hba.conf", hbaConfContent); err != nil {
 		return fmt.Errorf("Failed to append to pg_hba.conf: %w", err)
 	}
 
@@ -362,52 +926,3 @@ func appendToFile(path string, content string) error {
 
 	return nil
 }
-
-const postgresSystemdUnit = "postgresql.service"
-const pgBouncerSystemdUnit = "pgbouncer.service"
-
-func ensurePostgresRunning() error {
-	return systemctlCommandIfNotRunning("start", postgresSystemdUnit)
-}
-
-func stopPostgres() error {
-	return runSystemctl("stop", postgresSystemdUnit)
-}
-
-func ensurePgBouncerRunning() error {
-	return systemctlCommandIfNotRunning("start", pgBouncerSystemdUnit)
-}
-
-func systemctlCommandIfRunning(command string, name string) error {
-	cmd := exec.Command("systemctl", "is-active", "--quiet", name)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return nil
-	}
-	return runSystemctl(command, name)
-}
-
-func systemctlCommandIfNotRunning(command string, name string) error {
-	cmd := exec.Command("systemctl", "is-active", "--quiet", name)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		return runSystemctl(command, name)
-	}
-
-	return nil
-}
-
-func runSystemctl(command string, name string) error {
-	cmd := exec.Command("sudo", "systemctl", command, name)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to %s %s: %w", command, name, err)
-	}
-	log.Printf("Ran systemctl %s %s successfully", command, name)
-	return nil
-}
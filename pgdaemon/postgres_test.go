@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecideWalReceiverAction(t *testing.T) {
+	now := time.Now()
+	timeout := 30 * time.Second
+
+	assert.Equal(t, walReceiverActionNone, decideWalReceiverAction(true, false, time.Time{}, now, timeout))
+	assert.Equal(t, walReceiverActionNone, decideWalReceiverAction(true, false, now.Add(-time.Hour), now, timeout))
+	assert.Equal(t, walReceiverActionReconnect, decideWalReceiverAction(false, false, time.Time{}, now, timeout))
+	assert.Equal(t, walReceiverActionWait, decideWalReceiverAction(false, false, now.Add(-10*time.Second), now, timeout))
+	assert.Equal(t, walReceiverActionRestart, decideWalReceiverAction(false, false, now.Add(-31*time.Second), now, timeout))
+
+	// Catching up from the archive doesn't need a walreceiver
+	assert.Equal(t, walReceiverActionArchive, decideWalReceiverAction(false, true, time.Time{}, now, timeout))
+	assert.Equal(t, walReceiverActionArchive, decideWalReceiverAction(false, true, now.Add(-time.Hour), now, timeout))
+}
+
+func TestWalReceiverRestartBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, walReceiverRestartBackoff(0))
+	assert.Equal(t, 60*time.Second, walReceiverRestartBackoff(1))
+	assert.Equal(t, 8*time.Minute, walReceiverRestartBackoff(4))
+	assert.Equal(t, walReceiverMaxRestartTimeout, walReceiverRestartBackoff(5))
+	assert.Equal(t, walReceiverMaxRestartTimeout, walReceiverRestartBackoff(100))
+}
+
+func TestCheckUpstreamAcceptsConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	assert.NoError(t, checkUpstreamAcceptsConnections(t.Context(), "127.0.0.1", port))
+
+	require.NoError(t, listener.Close())
+	assert.ErrorContains(t, checkUpstreamAcceptsConnections(t.Context(), "127.0.0.1", port), "upstream is unreachable")
+}
+
+func TestClassifyErrors(t *testing.T) {
+	authErr := fmt.Errorf("connect: %w", &pgconn.PgError{Code: "28P01"})
+	startingErr := &pgconn.PgError{Code: "57P03"}
+	syntaxErr := &pgconn.PgError{Code: "42601"}
+
+	assert.Equal(t, NodeErrorAuthentication, classifyConnectError(authErr, false))
+	assert.Equal(t, NodeErrorStartingUp, classifyConnectError(startingErr, false))
+	refusedErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	assert.Equal(t, NodeErrorConnection, classifyConnectError(fmt.Errorf("connect: %w", refusedErr), false))
+	assert.Equal(t, NodeErrorConnection, classifyConnectError(&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ENOENT)}, false))
+	// A hung or partitioned Postgres times out the dial or handshake
+	timeoutErr := &net.OpError{Op: "dial", Net: "tcp", Err: &timeoutError{}}
+	assert.Equal(t, NodeErrorConnection, classifyConnectError(fmt.Errorf("connect: %w", timeoutErr), false))
+	assert.Equal(t, NodeErrorConnection, classifyConnectError(context.DeadlineExceeded, false))
+	// Waiting for a busy pool to hand out a connection doesn't mean
+	// Postgres is down
+	assert.Equal(t, NodeErrorQuery, classifyConnectError(context.DeadlineExceeded, true))
+	assert.Equal(t, NodeErrorQuery, classifyConnectError(errors.New("tls: handshake failure"), false))
+
+	assert.Equal(t, NodeErrorQuery, classifyQueryError(syntaxErr))
+	assert.Equal(t, NodeErrorQuery, classifyQueryError(context.DeadlineExceeded))
+	assert.Equal(t, NodeErrorStartingUp, classifyQueryError(&pgconn.PgError{Code: "57P01"}))
+
+	var stateErr *NodeStateError
+	assert.True(t, errors.As(fmt.Errorf("wrapped: %w", &NodeStateError{Kind: NodeErrorQuery, Err: syntaxErr}), &stateErr))
+	assert.Equal(t, NodeErrorQuery, stateErr.Kind)
+}
+
+func TestDiskUsageComputesSizeInBackground(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("17\n"), 0644))
+	p := &PostgresNode{dataDir: dir}
+
+	_, diskFree := p.diskUsage()
+	assert.NotNil(t, diskFree)
+
+	assert.Eventually(t, func() bool {
+		size, _ := p.diskUsage()
+		return size != nil && *size == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
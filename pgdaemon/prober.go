@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthProber checks Postgres through PgBouncer in the background,
+// so health check requests read a cached result instead of each
+// running a query. Ages use the local monotonic clock.
+type HealthProber struct {
+	check func() (bool, error)
+
+	mu        sync.Mutex
+	isPrimary bool
+	err       error
+	at        time.Time
+}
+
+func NewHealthProber(check func() (bool, error)) *HealthProber {
+	return &HealthProber{check: check}
+}
+
+// Run probes every interval until ctx is done.
+func (p *HealthProber) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.Probe()
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("returning ctx.Done() error in health prober: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe runs the check once and caches the result.
+func (p *HealthProber) Probe() {
+	isPrimary, err := p.check()
+	if err != nil {
+		log.Printf("Health probe failed: %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.isPrimary = isPrimary
+	p.err = err
+	p.at = time.Now()
+}
+
+// healthProbe is a cached probe result. age is -1 if we haven't
+// probed yet.
+type healthProbe struct {
+	isPrimary bool
+	err       error
+	age       time.Duration
+}
+
+func (p *HealthProber) Result(now time.Time) healthProbe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return healthProbe{
+		isPrimary: p.isPrimary,
+		err:       p.err,
+		age:       cacheAge(p.at, now),
+	}
+}
+
+// healthy returns an error if the probe failed or is older than
+// maxAge, e.g. because queries are hanging.
+func (r healthProbe) healthy(maxAge time.Duration) error {
+	switch {
+	case r.age < 0:
+		return fmt.Errorf("no health probe has finished yet")
+	case r.age > maxAge:
+		return fmt.Errorf("last health probe is %s old, more than %s", r.age.Round(time.Millisecond), maxAge)
+	default:
+		return r.err
+	}
+}
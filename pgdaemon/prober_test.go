@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthProber(t *testing.T) {
+	calls := 0
+	checkErr := errors.New("connection refused")
+	var result error
+	prober := NewHealthProber(func() (bool, error) {
+		calls++
+		return result == nil, result
+	})
+
+	assert.ErrorContains(t, prober.Result(time.Now()).healthy(time.Second), "no health probe has finished yet")
+
+	prober.Probe()
+	probe := prober.Result(time.Now())
+	assert.NoError(t, probe.healthy(time.Second))
+	assert.True(t, probe.isPrimary)
+
+	// Reading the result doesn't run the check again
+	prober.Result(time.Now())
+	assert.Equal(t, 1, calls)
+
+	stale := prober.Result(time.Now().Add(time.Minute))
+	assert.ErrorContains(t, stale.healthy(time.Second), "old, more than 1s")
+
+	result = checkErr
+	prober.Probe()
+	assert.ErrorIs(t, prober.Result(time.Now()).healthy(time.Second), checkErr)
+}
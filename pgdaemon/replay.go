@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+// renderRecoveryDelayConf renders recovery_min_apply_delay for a
+// delayed replica. It returns nil if the file shouldn't exist. While
+// fast-forwarding to a target time we don't delay at all.
+func renderRecoveryDelayConf(spec NodeSpec) []byte {
+	if spec.ApplyDelay == "" || spec.ReplayTargetTime != "" {
+		return nil
+	}
+	return fmt.Appendf(nil, "recovery_min_apply_delay = %s\n", quotePostgresConfString(spec.ApplyDelay))
+}
+
+// renderRecoveryTargetConf renders the recovery target used to
+// fast-forward a delayed replica. We pause when we reach the target
+// so an operator can inspect the data. It returns nil if the file
+// shouldn't exist.
+func renderRecoveryTargetConf(spec NodeSpec) []byte {
+	if spec.ReplayTargetTime == "" {
+		return nil
+	}
+	return fmt.Appendf(nil, "recovery_target_time = %s\nrecovery_target_action = 'pause'\n", quotePostgresConfString(spec.ReplayTargetTime))
+}
+
+// applyDelayPattern matches the values Postgres accepts for a time
+// setting like recovery_min_apply_delay. Without a unit it means
+// milliseconds.
+var applyDelayPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)? ?(us|ms|s|min|h|d)?$`)
+
+// validateReplaySpec checks the replay settings of a node spec, so a
+// bad value is rejected when the spec is set instead of when Postgres
+// reads it.
+func validateReplaySpec(spec NodeSpec) error {
+	if spec.ApplyDelay != "" && !applyDelayPattern.MatchString(spec.ApplyDelay) {
+		return fmt.Errorf("invalid apply_delay %q, must be a duration like \"30min\" or \"1h\"", spec.ApplyDelay)
+	}
+	if spec.ReplayTargetTime != "" {
+		if _, err := time.Parse(time.RFC3339, spec.ReplayTargetTime); err != nil {
+			return fmt.Errorf("invalid replay_target_time %q, must be RFC 3339: %w", spec.ReplayTargetTime, err)
+		}
+	}
+	return nil
+}
+
+// writeConfFile writes content to path if it differs from what is
+// there, or removes path if content is nil. It returns true if it
+// changed anything.
+func writeConfFile(path string, content []byte) (bool, error) {
+	return writeFileIfChanged(path, content, 0644)
+}
+
+// writeSecretFile is writeConfFile for files with passwords, which
+// only we may read.
+func writeSecretFile(path string, content []byte) (bool, error) {
+	return writeFileIfChanged(path, content, 0600)
+}
+
+func writeFileIfChanged(path string, content []byte, perm os.FileMode) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	exists := err == nil
+
+	if content == nil {
+		if !exists {
+			return false, nil
+		}
+		if err := os.Remove(path); err != nil {
+			return false, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		return true, nil
+	}
+
+	if exists && bytes.Equal(current, content) {
+		return false, nil
+	}
+	if err := os.WriteFile(path, content, perm); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// writeReplayConfFiles renders the delayed replica settings. It
+// returns whether Postgres needs a reload (recovery_min_apply_delay)
+// or a restart (recovery_target_*).
+func (p *PostgresNode) writeReplayConfFiles(spec NodeSpec) (needsReload bool, needsRestart bool, err error) {
+	needsReload, err = writeConfFile(p.dataDir+"/postgresql.conf.d/recovery_delay.conf", renderRecoveryDelayConf(spec))
+	if err != nil {
+		return false, false, err
+	}
+	needsRestart, err = writeConfFile(p.dataDir+"/postgresql.conf.d/recovery_target.conf", renderRecoveryTargetConf(spec))
+	if err != nil {
+		return false, false, err
+	}
+	return needsReload, needsRestart, nil
+}
+
+// ensureReplayState pauses or resumes WAL replay to match the spec.
+//
+// N.B. We never resume while a recovery target is configured. Resuming
+// after reaching a recovery target ends recovery and promotes the
+// replica, which is the last thing we want on a delayed replica. To
+// resume after fast-forwarding, the target is cleared and Postgres is
+// restarted first.
+func (p *PostgresNode) ensureReplayState(ctx context.Context, spec NodeSpec) error {
+	if spec.ReplayTargetTime != "" {
+		return nil
+	}
+
+	var paused bool
+	if err := p.pool.QueryRow(ctx, "SELECT pg_is_wal_replay_paused()").Scan(&paused); err != nil {
+		return fmt.Errorf("failed to check pg_is_wal_replay_paused: %w", err)
+	}
+
+	if spec.ReplayPaused && !paused {
+		log.Printf("Pausing WAL replay")
+		if _, err := p.pool.Exec(ctx, "SELECT pg_wal_replay_pause()"); err != nil {
+			return fmt.Errorf("failed to pause WAL replay: %w", err)
+		}
+	} else if !spec.ReplayPaused && paused {
+		log.Printf("Resuming WAL replay")
+		if _, err := p.pool.Exec(ctx, "SELECT pg_wal_replay_resume()"); err != nil {
+			return fmt.Errorf("failed to resume WAL replay: %w", err)
+		}
+	}
+
+	return nil
+}
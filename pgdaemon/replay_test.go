@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderReplayConf(t *testing.T) {
+	assert.Nil(t, renderRecoveryDelayConf(NodeSpec{}))
+	assert.Nil(t, renderRecoveryTargetConf(NodeSpec{}))
+
+	delayed := NodeSpec{ApplyDelay: "1h"}
+	assert.Equal(t, "recovery_min_apply_delay = '1h'\n", string(renderRecoveryDelayConf(delayed)))
+	assert.Nil(t, renderRecoveryTargetConf(delayed))
+
+	// Fast-forwarding replays without delay up to the target
+	fastForward := NodeSpec{ApplyDelay: "1h", ReplayTargetTime: "2025-07-01T12:00:00Z"}
+	assert.Nil(t, renderRecoveryDelayConf(fastForward))
+	assert.Equal(t, "recovery_target_time = '2025-07-01T12:00:00Z'\nrecovery_target_action = 'pause'\n", string(renderRecoveryTargetConf(fastForward)))
+}
+
+func TestValidateReplaySpec(t *testing.T) {
+	assert.NoError(t, validateReplaySpec(NodeSpec{}))
+	assert.NoError(t, validateReplaySpec(NodeSpec{ApplyDelay: "1h", ReplayTargetTime: "2025-07-01T12:00:00Z"}))
+	assert.NoError(t, validateReplaySpec(NodeSpec{ApplyDelay: "90 min"}))
+	assert.NoError(t, validateReplaySpec(NodeSpec{ApplyDelay: "500"}))
+
+	assert.ErrorContains(t, validateReplaySpec(NodeSpec{ApplyDelay: "1h'\nrestore_command = 'sh"}), "apply_delay")
+	assert.ErrorContains(t, validateReplaySpec(NodeSpec{ApplyDelay: "an hour"}), "apply_delay")
+	assert.ErrorContains(t, validateReplaySpec(NodeSpec{ReplayTargetTime: "yesterday"}), "replay_target_time")
+
+	spec := ClusterSpec{Nodes: map[string]NodeSpec{"node2": {ApplyDelay: "soon"}}}
+	assert.ErrorContains(t, spec.validate(), "node node2")
+}
+
+func TestWriteConfFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.conf")
+
+	changed, err := writeConfFile(path, nil)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	changed, err = writeConfFile(path, []byte("a = 1\n"))
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	changed, err = writeConfFile(path, []byte("a = 1\n"))
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	changed, err = writeConfFile(path, nil)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// restoreFromArchive bootstraps a new primary in an empty PGDATA from
+// the newest suitable base backup plus archived WAL. With a target
+// time, recovery stops there and promotes; otherwise we replay all the
+// archived WAL.
+//
+// This is meant for creating a new cluster, so it refuses to touch an
+// existing PGDATA. Start the daemon afterwards with a different
+// -archive-url than the one we restored from, so the new cluster
+// doesn't archive into the old cluster's archive.
+func restoreFromArchive(ctx context.Context, conf config, archive ArchiveTarget, targetTimeStr string) error {
+	var targetTime *time.Time
+	if targetTimeStr != "" {
+		t, err := time.Parse(time.RFC3339, targetTimeStr)
+		if err != nil {
+			return fmt.Errorf("invalid -target-time %q, must be RFC 3339: %w", targetTimeStr, err)
+		}
+		targetTime = &t
+	}
+
+	entries, err := os.ReadDir(conf.pgDataDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", conf.pgDataDir, err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("PGDATA %s is not empty, refusing to restore over it", conf.pgDataDir)
+	}
+
+	backups, err := listBaseBackups(ctx, archive)
+	if err != nil {
+		return err
+	}
+	backup, err := selectBaseBackup(backups, targetTime)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restoring base backup %s from %s into %s", backup.Name, backup.Node, conf.pgDataDir)
+	if err := os.MkdirAll(conf.pgDataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", conf.pgDataDir, err)
+	}
+	if err := os.Chmod(conf.pgDataDir, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", conf.pgDataDir, err)
+	}
+	if err := downloadAndExtract(ctx, archive, baseBackupTarKey(backup.Name), conf.pgDataDir); err != nil {
+		return err
+	}
+
+	if err := prepareRestoredDataDir(conf, targetTimeStr); err != nil {
+		return err
+	}
+
+	postgres, _, err := newServices(conf)
+	if err != nil {
+		return err
+	}
+	if err := postgres.EnsureRunning(); err != nil {
+		return fmt.Errorf("failed to start Postgres: %w", err)
+	}
+
+	security, _, _, err := setUpConnSecurity(conf)
+	if err != nil {
+		return err
+	}
+	if err := waitForRecoveryToFinish(ctx, conf, security); err != nil {
+		return err
+	}
+
+	// The daemon takes over archive settings from here.
+	if _, err := writeConfFile(restoreConfPath(conf.pgDataDir), nil); err != nil {
+		return err
+	}
+	if err := postgres.Reload(); err != nil {
+		return fmt.Errorf("failed to reload Postgres: %w", err)
+	}
+
+	log.Printf("Restore finished, Postgres is out of recovery")
+	return nil
+}
+
+func restoreConfPath(dataDir string) string {
+	return dataDir + "/postgresql.conf.d/recovery_restore.conf"
+}
+
+// renderRestoreConf renders the recovery settings for a restore.
+func renderRestoreConf(restoreCommand string, targetTime string) []byte {
+	content := fmt.Appendf(nil, "restore_command = %s\n", quotePostgresConfString(restoreCommand))
+	if targetTime != "" {
+		content = fmt.Appendf(content, "recovery_target_time = %s\nrecovery_target_action = 'promote'\n", quotePostgresConfString(targetTime))
+	}
+	return content
+}
+
+// prepareRestoredDataDir turns a restored base backup into a data
+// directory that does targeted recovery from the archive. Base backups
+// are taken from replicas, so we strip out the source node's
+// replication settings, and its archive settings so we don't archive
+// into the archive we are restoring from.
+func prepareRestoredDataDir(conf config, targetTime string) error {
+	for _, name := range []string{"standby.signal", "postgresql.conf.d/primary_conninfo.conf", "postgresql.conf.d/recovery_delay.conf", "postgresql.conf.d/recovery_target.conf", "postgresql.conf.d/archive.conf"} {
+		if _, err := writeConfFile(filepath.Join(conf.pgDataDir, name), nil); err != nil {
+			return err
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find pgdaemon executable: %w", err)
+	}
+	restoreCommand := archiveCommandLine(executable, conf, "archive-wal-fetch", "%f", `"%p"`)
+	if _, err := writeConfFile(restoreConfPath(conf.pgDataDir), renderRestoreConf(restoreCommand, targetTime)); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(conf.pgDataDir+"/recovery.signal", []byte{}, 0644); err != nil {
+		return fmt.Errorf("failed to create recovery.signal: %w", err)
+	}
+	return nil
+}
+
+// waitForRecoveryToFinish polls Postgres until it has promoted itself
+// at the end of recovery.
+func waitForRecoveryToFinish(ctx context.Context, conf config, security connSecurity) error {
+	connString := fmt.Sprintf("host=%s port=%d user=%s %s", conninfoValue(conf.postgresHost), conf.postgresPort, conninfoValue(conf.postgresUser), security.localParams())
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		inRecovery, replayLsn, err := checkRecoveryProgress(ctx, connString)
+		if err != nil {
+			log.Printf("Waiting for Postgres to accept connections: %v", err)
+		} else if !inRecovery {
+			return nil
+		} else {
+			log.Printf("Postgres is still recovering, replayed up to %s", replayLsn)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkRecoveryProgress(ctx context.Context, connString string) (bool, string, error) {
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close(ctx)
+
+	var inRecovery bool
+	var replayLsn *string
+	err = conn.QueryRow(ctx, "SELECT pg_is_in_recovery(), pg_last_wal_replay_lsn()::text").Scan(&inRecovery, &replayLsn)
+	if err != nil {
+		return false, "", err
+	}
+	if replayLsn == nil {
+		return inRecovery, "", nil
+	}
+	return inRecovery, *replayLsn, nil
+}
+
+// downloadAndExtract streams a gzipped tarball from the archive into
+// dir.
+func downloadAndExtract(ctx context.Context, archive ArchiveTarget, key string, dir string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.Get(ctx, key, pw))
+	}()
+	defer pr.Close()
+
+	gz, err := gzip.NewReader(pr)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", key, err)
+	}
+	if err := extractTar(gz, dir); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", key, err)
+	}
+	return nil
+}
+
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dir, hdr.Name)
+		if path != filepath.Clean(dir) && !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("tar entry %s is outside of %s", hdr.Name, dir)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping tar entry %s with unsupported type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildTar(t *testing.T, entries map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+	tarBytes := buildTar(t, map[string]string{
+		"PG_VERSION":        "17\n",
+		"global/pg_control": "control",
+	})
+
+	require.NoError(t, extractTar(bytes.NewReader(tarBytes), dir))
+
+	content, err := os.ReadFile(filepath.Join(dir, "global/pg_control"))
+	require.NoError(t, err)
+	assert.Equal(t, "control", string(content))
+}
+
+func TestExtractTar_RejectsPathTraversal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	tarBytes := buildTar(t, map[string]string{"../evil": "x"})
+
+	err := extractTar(bytes.NewReader(tarBytes), dir)
+	assert.ErrorContains(t, err, "is outside of")
+}
+
+func TestRenderRestoreConf(t *testing.T) {
+	assert.Equal(t, "restore_command = 'pgdaemon archive-wal-fetch %f \"%p\"'\n",
+		string(renderRestoreConf(`pgdaemon archive-wal-fetch %f "%p"`, "")))
+
+	assert.Equal(t, "restore_command = 'fetch'\nrecovery_target_time = '2025-07-01T12:00:00Z'\nrecovery_target_action = 'promote'\n",
+		string(renderRestoreConf("fetch", "2025-07-01T12:00:00Z")))
+}
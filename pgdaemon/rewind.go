@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// LSN is a Postgres write-ahead log location.
+type LSN uint64
+
+// ParseLSN parses an LSN in the X/X format Postgres uses.
+func ParseLSN(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	hiVal, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	loVal, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	return LSN(hiVal<<32 | loVal), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint64(l)&0xFFFFFFFF)
+}
+
+// timelineHistoryEntry is a line in a timeline history file. It says
+// that the timeline TLI ended at SwitchPoint, where the next timeline
+// branched off.
+type timelineHistoryEntry struct {
+	TLI         uint32
+	SwitchPoint LSN
+}
+
+// parseTimelineHistory parses the contents of a NNNNNNNN.history file
+// from pg_wal.
+func parseTimelineHistory(content string) ([]timelineHistoryEntry, error) {
+	var entries []timelineHistoryEntry
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid timeline history line %q", line)
+		}
+		tli, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeline in history line %q: %w", line, err)
+		}
+		switchPoint, err := ParseLSN(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid switch point in history line %q: %w", line, err)
+		}
+		entries = append(entries, timelineHistoryEntry{TLI: uint32(tli), SwitchPoint: switchPoint})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read timeline history: %w", err)
+	}
+	return entries, nil
+}
+
+// controlData is the subset of pg_controldata output we need to decide
+// how to rejoin a node as a replica.
+type controlData struct {
+	SystemIdentifier string
+	ClusterState     string
+	CheckpointLSN    LSN
+	TimelineID       uint32
+}
+
+func parseControlData(output string) (controlData, error) {
+	var data controlData
+	var err error
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Database system identifier":
+			data.SystemIdentifier = value
+		case "Database cluster state":
+			data.ClusterState = value
+		case "Latest checkpoint location":
+			if data.CheckpointLSN, err = ParseLSN(value); err != nil {
+				return data, fmt.Errorf("failed to parse checkpoint location: %w", err)
+			}
+		case "Latest checkpoint's TimeLineID":
+			tli, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return data, fmt.Errorf("failed to parse checkpoint timeline: %w", err)
+			}
+			data.TimelineID = uint32(tli)
+		}
+	}
+	if data.SystemIdentifier == "" || data.TimelineID == 0 {
+		return data, fmt.Errorf("pg_controldata output is missing required fields")
+	}
+	return data, nil
+}
+
+func (p *PostgresNode) readControlData() (controlData, error) {
+	out, err := exec.Command(p.pgBin("pg_controldata"), "-D", p.dataDir).Output()
+	if err != nil {
+		return controlData{}, fmt.Errorf("failed to run pg_controldata: %w", err)
+	}
+	return parseControlData(string(out))
+}
+
+// primaryTimelineInfo is what we need to know about the new primary to
+// decide how to rejoin it.
+type primaryTimelineInfo struct {
+	SystemIdentifier string
+	TimelineID       uint32
+	CurrentLSN       LSN
+	History          []timelineHistoryEntry
+}
+
+// fetchPrimaryTimelineInfo fetches the timeline info of the node we
+// rejoin. That node must be a primary, unless inRecoveryOK is set: in a
+// standby cluster, it is the standby leader, which is always in
+// recovery.
+func fetchPrimaryTimelineInfo(ctx context.Context, primaryHost string, connString string, inRecoveryOK bool) (primaryTimelineInfo, error) {
+	var info primaryTimelineInfo
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		return info, fmt.Errorf("failed to connect to primary %s: %w", primaryHost, err)
+	}
+	defer conn.Close(ctx)
+
+	var inRecovery bool
+	if err := conn.QueryRow(ctx, "SELECT pg_is_in_recovery(), system_identifier::text FROM pg_control_system()").Scan(&inRecovery, &info.SystemIdentifier); err != nil {
+		return info, fmt.Errorf("failed to query primary system identifier: %w", err)
+	}
+
+	var currentLSN string
+	switch {
+	case !inRecovery:
+		var walFile string
+		if err := conn.QueryRow(ctx, "SELECT pg_walfile_name(pg_current_wal_lsn()), pg_current_wal_lsn()::text").Scan(&walFile, &currentLSN); err != nil {
+			return info, fmt.Errorf("failed to query primary WAL position: %w", err)
+		}
+		if info.TimelineID, err = timelineFromWalFileName(walFile); err != nil {
+			return info, err
+		}
+	case inRecoveryOK:
+		// pg_current_wal_lsn() errors during recovery, so use how
+		// far the upstream has received WAL, and the timeline it
+		// is receiving or last checkpointed on.
+		if err := conn.QueryRow(ctx, `
+			SELECT coalesce(
+			           (SELECT received_tli FROM pg_stat_wal_receiver),
+			           (SELECT timeline_id FROM pg_control_checkpoint())
+			       ),
+			       coalesce(pg_last_wal_receive_lsn(), pg_last_wal_replay_lsn())::text`,
+		).Scan(&info.TimelineID, &currentLSN); err != nil {
+			return info, fmt.Errorf("failed to query upstream WAL position: %w", err)
+		}
+	default:
+		return info, fmt.Errorf("intended primary %s is still in recovery", primaryHost)
+	}
+	if info.CurrentLSN, err = ParseLSN(currentLSN); err != nil {
+		return info, err
+	}
+
+	if info.TimelineID > 1 {
+		var history string
+		historyFile := fmt.Sprintf("pg_wal/%08X.history", info.TimelineID)
+		if err := conn.QueryRow(ctx, "SELECT pg_read_file($1)", historyFile).Scan(&history); err != nil {
+			return info, fmt.Errorf("failed to read %s on primary: %w", historyFile, err)
+		}
+		if info.History, err = parseTimelineHistory(history); err != nil {
+			return info, err
+		}
+	}
+
+	return info, nil
+}
+
+type RejoinAction string
+
+const (
+	RejoinActionRestart RejoinAction = "restart_as_standby"
+	RejoinActionRewind  RejoinAction = "rewind"
+	RejoinActionReclone RejoinAction = "reclone"
+)
+
+// decideRejoinAction decides how a stopped node that used to be a
+// primary can become a replica of the new primary. lastRecord is where
+// the last valid record in the node's WAL starts. The node can simply
+// restart as a standby if all of its WAL is part of the new primary's
+// history, it needs pg_rewind if it wrote WAL past the point where the
+// new primary's timeline branched off, and it needs to be re-cloned if
+// it isn't even the same database or is ahead of the primary on the
+// same timeline, which pg_rewind can't undo.
+//
+// WAL before the primary's switch point is shared with the primary and
+// switch points are record boundaries, so a record that starts before
+// the switch point also ends by it.
+func decideRejoinAction(local controlData, lastRecord LSN, primary primaryTimelineInfo) (RejoinAction, string) {
+	if local.SystemIdentifier != primary.SystemIdentifier {
+		return RejoinActionReclone, fmt.Sprintf("system identifier %s does not match primary's %s", local.SystemIdentifier, primary.SystemIdentifier)
+	}
+
+	if local.TimelineID == primary.TimelineID {
+		if lastRecord < primary.CurrentLSN {
+			return RejoinActionRestart, fmt.Sprintf("on primary's timeline %d and last WAL record %s is behind primary at %s", local.TimelineID, lastRecord, primary.CurrentLSN)
+		}
+		return RejoinActionReclone, fmt.Sprintf("on primary's timeline %d but last WAL record %s is not behind primary at %s", local.TimelineID, lastRecord, primary.CurrentLSN)
+	}
+
+	for _, entry := range primary.History {
+		if entry.TLI != local.TimelineID {
+			continue
+		}
+		if lastRecord < entry.SwitchPoint {
+			return RejoinActionRestart, fmt.Sprintf("last WAL record %s on timeline %d is before primary's switch point %s", lastRecord, local.TimelineID, entry.SwitchPoint)
+		}
+		return RejoinActionRewind, fmt.Sprintf("last WAL record %s on timeline %d is past primary's switch point %s", lastRecord, local.TimelineID, entry.SwitchPoint)
+	}
+
+	return RejoinActionRewind, fmt.Sprintf("timeline %d is not in primary's timeline %d history", local.TimelineID, primary.TimelineID)
+}
+
+// unknownWalEnd stands in for the last WAL record when we can't find
+// it, so decideRejoinAction assumes the node is ahead of the primary.
+const unknownWalEnd = LSN(math.MaxUint64)
+
+// lastWalRecord finds where the last valid record in the stopped
+// node's WAL starts. After a clean shutdown that is the shutdown
+// checkpoint. After a crash, the node may have written WAL after its
+// last checkpoint, so we scan for it with pg_waldump.
+func (p *PostgresNode) lastWalRecord(local controlData) (LSN, error) {
+	if local.ClusterState == "shut down" {
+		return local.CheckpointLSN, nil
+	}
+
+	walDir := filepath.Join(p.dataDir, "pg_wal")
+	entries, err := os.ReadDir(walDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", walDir, err)
+	}
+	for _, entry := range entries {
+		if !walSegmentFileRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		// A node that crashed soon after being promoted may have
+		// WAL on a timeline its control file doesn't know yet.
+		tli, err := timelineFromWalFileName(entry.Name())
+		if err != nil {
+			return 0, err
+		}
+		if tli > local.TimelineID {
+			return 0, fmt.Errorf("%s has WAL on timeline %d, after checkpoint timeline %d", walDir, tli, local.TimelineID)
+		}
+	}
+
+	// pg_waldump exits with an error when it reaches the end of
+	// valid WAL, which is exactly where we want it to stop, so we
+	// only look at the records it printed.
+	cmd := exec.Command(p.pgBin("pg_waldump"),
+		"--path", walDir,
+		"--timeline", strconv.FormatUint(uint64(local.TimelineID), 10),
+		"--start", local.CheckpointLSN.String(),
+	)
+	out, _ := cmd.Output()
+	return parseLastWalRecord(string(out))
+}
+
+var walDumpRecordLSNRegexp = regexp.MustCompile(`\blsn: ([0-9A-F]+/[0-9A-F]+),`)
+
+// parseLastWalRecord returns the LSN of the last record in pg_waldump
+// output.
+func parseLastWalRecord(output string) (LSN, error) {
+	matches := walDumpRecordLSNRegexp.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("pg_waldump found no WAL records")
+	}
+	return ParseLSN(matches[len(matches)-1][1])
+}
+
+// rejoinAsReplica turns a node that is not in recovery into a replica
+// of the new primary, using the cheapest method that is safe. It
+// leaves Postgres stopped so the next reconciliation cycle can write
+// standby.signal and primary_conninfo before starting it. In a standby
+// cluster, primaryHost is in recovery too.
+func (p *PostgresNode) rejoinAsReplica(ctx context.Context, primaryHost string, primaryPort int, user string, clone cloneSource, standbyCluster bool) error {
+	// Fetch the primary's info before stopping so we don't take
+	// down this node when the new primary isn't ready yet.
+	primary, err := fetchPrimaryTimelineInfo(ctx, primaryHost, p.security.peerConninfo(primaryHost, primaryPort, user), standbyCluster)
+	if err != nil {
+		return fmt.Errorf("failed to fetch primary timeline info: %w", err)
+	}
+
+	if err := p.postgres.Stop(); err != nil {
+		return fmt.Errorf("failed to stop Postgres: %w", err)
+	}
+
+	local, err := p.readControlData()
+	if err != nil {
+		return p.recloneAfter(ctx, RejoinActionReclone, fmt.Sprintf("failed to read local control data: %v", err), clone, user)
+	}
+
+	lastRecord, err := p.lastWalRecord(local)
+	if err != nil {
+		log.Printf("Failed to find the end of local WAL, assuming it is past the primary's: %v", err)
+		lastRecord = unknownWalEnd
+	}
+
+	action, reason := decideRejoinAction(local, lastRecord, primary)
+	log.Printf("Rejoining primary %s: %s (%s)", primaryHost, action, reason)
+
+	switch action {
+	case RejoinActionRestart:
+		p.recordRejoin(action, reason, nil)
+	case RejoinActionRewind:
+		cmd := exec.Command(p.pgBin("pg_rewind"), "--target-pgdata", p.dataDir, "--source-server="+p.security.peerConninfo(primaryHost, primaryPort, user))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("pg_rewind failed, falling back to re-clone: %v", err)
+			return p.recloneAfter(ctx, RejoinActionReclone, fmt.Sprintf("%s; pg_rewind failed: %v", reason, err), clone, user)
+		}
+		log.Printf("pg_rewind completed successfully, Postgres should now be a replica of %s", primaryHost)
+		p.recordRejoin(action, reason, nil)
+	case RejoinActionReclone:
+		return p.recloneAfter(ctx, action, reason, clone, user)
+	}
+
+	return nil
+}
+
+// recloneAfter moves the data directory aside and clones a fresh copy
+// from clone. We keep the previous data directory around in case
+// a human needs something from it.
+func (p *PostgresNode) recloneAfter(ctx context.Context, action RejoinAction, reason string, clone cloneSource, user string) error {
+	oldDataDir := p.dataDir + ".pgdaemon-old"
+	err := func() error {
+		if err := os.RemoveAll(oldDataDir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", oldDataDir, err)
+		}
+		if err := os.Rename(p.dataDir, oldDataDir); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", p.dataDir, err)
+		}
+		return p.cloneDataDir(ctx, clone, user)
+	}()
+	p.recordRejoin(action, reason, err)
+	if err != nil {
+		return fmt.Errorf("failed to re-clone replica: %w", err)
+	}
+	return nil
+}
+
+func (p *PostgresNode) recordRejoin(action RejoinAction, reason string, err error) {
+	rejoin := &NodeRejoinStatus{
+		Action:   action,
+		Reason:   reason,
+		NodeTime: time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		errStr := err.Error()
+		rejoin.Error = &errStr
+	}
+	p.statusMu.Lock()
+	p.lastRejoin = rejoin
+	p.statusMu.Unlock()
+}
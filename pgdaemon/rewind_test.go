@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLSN(t *testing.T) {
+	lsn, err := ParseLSN("1/3000060")
+	require.NoError(t, err)
+	assert.Equal(t, LSN(0x1_03000060), lsn)
+	assert.Equal(t, "1/3000060", lsn.String())
+
+	_, err = ParseLSN("nonsense")
+	assert.Error(t, err)
+}
+
+func TestParseTimelineHistory(t *testing.T) {
+	content := "1\t0/3000060\tno recovery target specified\n\n2\t0/5000028\tno recovery target specified\n"
+
+	entries, err := parseTimelineHistory(content)
+	require.NoError(t, err)
+	assert.Equal(t, []timelineHistoryEntry{
+		{TLI: 1, SwitchPoint: 0x3000060},
+		{TLI: 2, SwitchPoint: 0x5000028},
+	}, entries)
+}
+
+func TestParseControlData(t *testing.T) {
+	output := `pg_control version number:            1700
+Database system identifier:           7523469137813612345
+Database cluster state:               shut down
+Latest checkpoint location:           0/5000028
+Latest checkpoint's REDO location:    0/5000028
+Latest checkpoint's TimeLineID:       2
+`
+
+	data, err := parseControlData(output)
+	require.NoError(t, err)
+	assert.Equal(t, controlData{
+		SystemIdentifier: "7523469137813612345",
+		ClusterState:     "shut down",
+		CheckpointLSN:    0x5000028,
+		TimelineID:       2,
+	}, data)
+}
+
+func TestDecideRejoinAction(t *testing.T) {
+	primary := primaryTimelineInfo{
+		SystemIdentifier: "42",
+		TimelineID:       3,
+		CurrentLSN:       0x9000000,
+		History: []timelineHistoryEntry{
+			{TLI: 1, SwitchPoint: 0x3000060},
+			{TLI: 2, SwitchPoint: 0x5000028},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		local      controlData
+		lastRecord LSN
+		expected   RejoinAction
+	}{
+		{
+			name:       "different database",
+			local:      controlData{SystemIdentifier: "43", TimelineID: 2, CheckpointLSN: 0x4000000},
+			lastRecord: 0x4000000,
+			expected:   RejoinActionReclone,
+		},
+		{
+			name:       "stopped before switch point",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 2, CheckpointLSN: 0x4000000},
+			lastRecord: 0x4000000,
+			expected:   RejoinActionRestart,
+		},
+		{
+			name:       "checkpoint before switch point but WAL after it",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 2, CheckpointLSN: 0x4000000},
+			lastRecord: 0x5000100,
+			expected:   RejoinActionRewind,
+		},
+		{
+			name:       "last record starts at switch point",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 2, CheckpointLSN: 0x4000000},
+			lastRecord: 0x5000028,
+			expected:   RejoinActionRewind,
+		},
+		{
+			name:       "wrote past switch point",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 2, CheckpointLSN: 0x6000000},
+			lastRecord: 0x6000000,
+			expected:   RejoinActionRewind,
+		},
+		{
+			name:       "unknown end of WAL",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 2, CheckpointLSN: 0x4000000},
+			lastRecord: unknownWalEnd,
+			expected:   RejoinActionRewind,
+		},
+		{
+			name:       "same timeline and behind",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 3, CheckpointLSN: 0x8000000},
+			lastRecord: 0x8000100,
+			expected:   RejoinActionRestart,
+		},
+		{
+			name:       "same timeline and ahead",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 3, CheckpointLSN: 0x8000000},
+			lastRecord: 0x9000100,
+			expected:   RejoinActionReclone,
+		},
+		{
+			name:       "timeline unknown to primary",
+			local:      controlData{SystemIdentifier: "42", TimelineID: 4, CheckpointLSN: 0x8000000},
+			lastRecord: 0x8000000,
+			expected:   RejoinActionRewind,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, _ := decideRejoinAction(tt.local, tt.lastRecord, primary)
+			assert.Equal(t, tt.expected, action)
+		})
+	}
+}
+
+func TestParseLastWalRecord(t *testing.T) {
+	output := `rmgr: XLOG        len (rec/tot):    114/   114, tx:          0, lsn: 0/04000028, prev 0/03FFFFB8, desc: CHECKPOINT_ONLINE redo 0/4000028
+rmgr: Heap        len (rec/tot):     54/    54, tx:        735, lsn: 0/040000A0, prev 0/04000028, desc: INSERT off: 2
+rmgr: Transaction len (rec/tot):     34/    34, tx:        735, lsn: 0/040000D8, prev 0/040000A0, desc: COMMIT
+`
+	lsn, err := parseLastWalRecord(output)
+	require.NoError(t, err)
+	assert.Equal(t, LSN(0x40000D8), lsn)
+
+	_, err = parseLastWalRecord("")
+	assert.Error(t, err)
+}
+
+func TestLastWalRecord(t *testing.T) {
+	dataDir := t.TempDir()
+	p := &PostgresNode{dataDir: dataDir}
+
+	lsn, err := p.lastWalRecord(controlData{ClusterState: "shut down", CheckpointLSN: 0x4000028, TimelineID: 2})
+	require.NoError(t, err)
+	assert.Equal(t, LSN(0x4000028), lsn)
+
+	// A crashed node with WAL on a newer timeline than its last
+	// checkpoint needs pg_rewind to sort it out.
+	require.NoError(t, os.MkdirAll(filepath.Join(dataDir, "pg_wal"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "pg_wal", "000000030000000000000004"), nil, 0o600))
+	_, err = p.lastWalRecord(controlData{ClusterState: "in production", CheckpointLSN: 0x4000028, TimelineID: 2})
+	assert.ErrorContains(t, err, "timeline 3")
+}
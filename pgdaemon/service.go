@@ -0,0 +1,445 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Service controls the lifecycle of a process that pgdaemon manages,
+// like Postgres or PgBouncer.
+type Service interface {
+	// EnsureRunning starts the service if it isn't already running.
+	EnsureRunning() error
+	Stop() error
+	Restart() error
+	// Reload makes the service re-read its configuration. It is a
+	// no-op if the service isn't running.
+	Reload() error
+}
+
+// newServices builds the Postgres and PgBouncer services for the
+// configured -service-manager.
+func newServices(conf config) (postgres Service, pgBouncer Service, err error) {
+	switch conf.serviceManager {
+	case "systemd":
+		return NewSystemdService(conf.postgresUnit), NewSystemdService(conf.pgBouncerUnit), nil
+	case "direct":
+		postgres := NewPgCtlService(pgBinPath(conf.pgBinDir, "pg_ctl"), pgBinPath(conf.pgBinDir, "postgres"), conf.pgDataDir, conf.postgresLogFile)
+		pgBouncer := NewProcessService("pgbouncer", conf.pgBouncerBin, conf.pgBouncerConfig)
+		return postgres, pgBouncer, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown -service-manager %s", conf.serviceManager)
+	}
+}
+
+// pgBinPath returns the path to a Postgres binary. If binDir is empty
+// we rely on $PATH.
+func pgBinPath(binDir string, name string) string {
+	if binDir == "" {
+		return name
+	}
+	return binDir + "/" + name
+}
+
+// SystemdService manages a systemd unit with systemctl.
+type SystemdService struct {
+	unit string
+}
+
+func NewSystemdService(unit string) *SystemdService {
+	return &SystemdService{unit: unit}
+}
+
+func (s *SystemdService) EnsureRunning() error {
+	return systemctlCommandIfNotRunning("start", s.unit)
+}
+
+func (s *SystemdService) Stop() error {
+	return runSystemctl("stop", s.unit)
+}
+
+func (s *SystemdService) Restart() error {
+	return runSystemctl("restart", s.unit)
+}
+
+func (s *SystemdService) Reload() error {
+	return systemctlCommandIfRunning("reload", s.unit)
+}
+
+func systemctlCommandIfRunning(command string, name string) error {
+	cmd := exec.Command("systemctl", "is-active", "--quiet", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil
+	}
+	return runSystemctl(command, name)
+}
+
+func systemctlCommandIfNotRunning(command string, name string) error {
+	cmd := exec.Command("systemctl", "is-active", "--quiet", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return runSystemctl(command, name)
+	}
+
+	return nil
+}
+
+func runSystemctl(command string, name string) error {
+	cmd := exec.Command("sudo", "systemctl", command, name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to %s %s: %w", command, name, err)
+	}
+	log.Printf("Ran systemctl %s %s successfully", command, name)
+	return nil
+}
+
+// postgresStartTimeout is how long we wait for Postgres to accept
+// connections after starting it, like pg_ctl start --wait.
+const postgresStartTimeout = 60 * time.Second
+
+// PgCtlService manages Postgres directly, without needing root or
+// systemd. It runs postgres as a child of pgdaemon, like
+// ProcessService, so we notice as soon as it exits and start it again
+// on the next EnsureRunning. Stopping and reloading go through pg_ctl.
+//
+// Postgres keeps running if pgdaemon exits, so a restarted pgdaemon
+// can find it running without being its parent. We leave it alone
+// then, and start our own child once it exits.
+type PgCtlService struct {
+	pgCtlPath    string
+	postgresPath string
+	dataDir      string
+	logFile      string
+
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func NewPgCtlService(pgCtlPath string, postgresPath string, dataDir string, logFile string) *PgCtlService {
+	return &PgCtlService{
+		pgCtlPath:    pgCtlPath,
+		postgresPath: postgresPath,
+		dataDir:      dataDir,
+		logFile:      logFile,
+	}
+}
+
+func (s *PgCtlService) isRunning() (bool, error) {
+	cmd := exec.Command(s.pgCtlPath, "status", "--pgdata", s.dataDir)
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+
+	// pg_ctl status exits with 3 if the server isn't running and 4
+	// if there is no data directory.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == 3 || exitErr.ExitCode() == 4) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to run pg_ctl status: %w", err)
+}
+
+// childRunning must be called with s.mu held.
+func (s *PgCtlService) childRunning() bool {
+	if s.done == nil {
+		return false
+	}
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *PgCtlService) EnsureRunning() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.childRunning() {
+		return nil
+	}
+	running, err := s.isRunning()
+	if err != nil {
+		return err
+	}
+	if running {
+		return nil
+	}
+	return s.start()
+}
+
+// start must be called with s.mu held.
+func (s *PgCtlService) start() error {
+	cmd := exec.Command(s.postgresPath, "-D", s.dataDir)
+	// Keep Postgres out of our process group, so a Ctrl-C meant for
+	// pgdaemon doesn't shut it down.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if s.logFile != "" {
+		logFile, err := os.OpenFile(s.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open Postgres log file: %w", err)
+		}
+		defer logFile.Close()
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start postgres: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		log.Printf("postgres exited: %v", err)
+		close(done)
+	}()
+	s.done = done
+	log.Printf("Started postgres with pid %d", cmd.Process.Pid)
+
+	return waitForPostgresReady(s.dataDir, done, postgresStartTimeout)
+}
+
+// waitForPostgresReady waits like pg_ctl start --wait, until
+// postmaster.pid says that Postgres accepts connections. It gives up if
+// Postgres exits first.
+func waitForPostgresReady(dataDir string, done <-chan struct{}, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if postmasterReady(dataDir) {
+			return nil
+		}
+		select {
+		case <-done:
+			return fmt.Errorf("postgres exited while starting up, see the server log")
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("postgres didn't accept connections within %s", timeout)
+		}
+	}
+}
+
+// postmasterReady returns true if the status line of postmaster.pid is
+// "ready" (a primary) or "standby" (a hot standby).
+func postmasterReady(dataDir string) bool {
+	content, err := os.ReadFile(dataDir + "/postmaster.pid")
+	if err != nil {
+		return false
+	}
+	lines := strings.Split(string(content), "\n")
+	if len(lines) < 8 {
+		return false
+	}
+	status := strings.TrimSpace(lines[7])
+	return status == "ready" || status == "standby"
+}
+
+func (s *PgCtlService) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stop()
+}
+
+// stop must be called with s.mu held.
+func (s *PgCtlService) stop() error {
+	running, err := s.isRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		return nil
+	}
+	if err := s.run("stop", "--wait", "--mode", "fast"); err != nil {
+		return err
+	}
+	// pg_ctl returns once postmaster.pid is gone, just before
+	// Postgres exits. Wait for that too so EnsureRunning doesn't see
+	// our child as still running.
+	if s.done != nil {
+		select {
+		case <-s.done:
+		case <-time.After(processStopTimeout):
+			return fmt.Errorf("postgres did not exit after pg_ctl stop")
+		}
+	}
+	return nil
+}
+
+func (s *PgCtlService) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// pg_ctl restart would start Postgres detached from us, so stop
+	// it and start our own child instead.
+	if err := s.stop(); err != nil {
+		return err
+	}
+	return s.start()
+}
+
+func (s *PgCtlService) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running, err := s.isRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		return nil
+	}
+	return s.run("reload")
+}
+
+func (s *PgCtlService) run(command string, args ...string) error {
+	args = append([]string{command, "--pgdata", s.dataDir}, args...)
+	cmd := exec.Command(s.pgCtlPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to pg_ctl %s: %w", command, err)
+	}
+	log.Printf("Ran pg_ctl %s successfully", command)
+	return nil
+}
+
+// processStopTimeout is how long we wait for a supervised process to
+// exit after SIGTERM before we SIGKILL it.
+const processStopTimeout = 10 * time.Second
+
+// ProcessService runs a long-lived process as a child of pgdaemon and
+// restarts it on the next EnsureRunning if it exits. We use this for
+// PgBouncer when not running under systemd.
+type ProcessService struct {
+	name string
+	path string
+	args []string
+
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+func NewProcessService(name string, path string, args ...string) *ProcessService {
+	return &ProcessService{
+		name: name,
+		path: path,
+		args: args,
+	}
+}
+
+// running must be called with s.mu held.
+func (s *ProcessService) running() bool {
+	if s.done == nil {
+		return false
+	}
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *ProcessService) EnsureRunning() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running() {
+		return nil
+	}
+	return s.start()
+}
+
+// start must be called with s.mu held.
+func (s *ProcessService) start() error {
+	cmd := exec.Command(s.path, s.args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", s.name, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		log.Printf("%s exited: %v", s.name, err)
+		close(done)
+	}()
+
+	s.cmd = cmd
+	s.done = done
+	log.Printf("Started %s with pid %d", s.name, cmd.Process.Pid)
+	return nil
+}
+
+func (s *ProcessService) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stop()
+}
+
+// stop must be called with s.mu held.
+func (s *ProcessService) stop() error {
+	if !s.running() {
+		return nil
+	}
+
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to send SIGTERM to %s: %w", s.name, err)
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(processStopTimeout):
+		log.Printf("%s did not exit after %s, killing it", s.name, processStopTimeout)
+		if err := s.cmd.Process.Kill(); err != nil {
+			return fmt.Errorf("failed to kill %s: %w", s.name, err)
+		}
+		<-s.done
+	}
+	return nil
+}
+
+func (s *ProcessService) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.stop(); err != nil {
+		return err
+	}
+	return s.start()
+}
+
+func (s *ProcessService) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running() {
+		return nil
+	}
+	if err := s.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to send SIGHUP to %s: %w", s.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewServices(t *testing.T) {
+	conf := config{
+		serviceManager:  "direct",
+		pgDataDir:       t.TempDir(),
+		pgBinDir:        "/usr/lib/postgresql/17/bin",
+		pgBouncerBin:    "pgbouncer",
+		pgBouncerConfig: "/etc/pgbouncer/pgbouncer.ini",
+	}
+
+	postgres, pgBouncer, err := newServices(conf)
+	require.NoError(t, err)
+	assert.Equal(t, NewPgCtlService("/usr/lib/postgresql/17/bin/pg_ctl", "/usr/lib/postgresql/17/bin/postgres", conf.pgDataDir, ""), postgres)
+	assert.IsType(t, &ProcessService{}, pgBouncer)
+
+	conf.serviceManager = "systemd"
+	conf.postgresUnit = "postgresql@17-main.service"
+	conf.pgBouncerUnit = "pgbouncer.service"
+	postgres, pgBouncer, err = newServices(conf)
+	require.NoError(t, err)
+	assert.Equal(t, NewSystemdService("postgresql@17-main.service"), postgres)
+	assert.Equal(t, NewSystemdService("pgbouncer.service"), pgBouncer)
+
+	conf.serviceManager = "launchd"
+	_, _, err = newServices(conf)
+	assert.Error(t, err)
+}
+
+func TestProcessServiceLifecycle(t *testing.T) {
+	svc := NewProcessService("sleep", "sleep", "60")
+	t.Cleanup(func() { svc.Stop() })
+
+	require.NoError(t, svc.EnsureRunning())
+	svc.mu.Lock()
+	firstPid := svc.cmd.Process.Pid
+	assert.True(t, svc.running())
+	svc.mu.Unlock()
+
+	// Already running, so this is a no-op
+	require.NoError(t, svc.EnsureRunning())
+	svc.mu.Lock()
+	assert.Equal(t, firstPid, svc.cmd.Process.Pid)
+	svc.mu.Unlock()
+
+	require.NoError(t, svc.Restart())
+	svc.mu.Lock()
+	assert.NotEqual(t, firstPid, svc.cmd.Process.Pid)
+	svc.mu.Unlock()
+
+	require.NoError(t, svc.Stop())
+	svc.mu.Lock()
+	assert.False(t, svc.running())
+	svc.mu.Unlock()
+
+	// A process that exits on its own is restarted by EnsureRunning
+	exiting := NewProcessService("true", "true")
+	require.NoError(t, exiting.EnsureRunning())
+	assert.Eventually(t, func() bool {
+		exiting.mu.Lock()
+		defer exiting.mu.Unlock()
+		return !exiting.running()
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, exiting.EnsureRunning())
+}
+
+func TestWaitForPostgresReady(t *testing.T) {
+	dataDir := t.TempDir()
+	assert.False(t, postmasterReady(dataDir))
+
+	pidFile := filepath.Join(dataDir, "postmaster.pid")
+	starting := "1234\n" + dataDir + "\n1700000000\n5432\n/var/run/postgresql\n*\n  1234567     0\nstarting\n"
+	require.NoError(t, os.WriteFile(pidFile, []byte(starting), 0600))
+	assert.False(t, postmasterReady(dataDir))
+
+	// Postgres exiting while starting up is an error right away
+	done := make(chan struct{})
+	close(done)
+	assert.ErrorContains(t, waitForPostgresReady(dataDir, done, time.Minute), "exited")
+	assert.ErrorContains(t, waitForPostgresReady(dataDir, make(chan struct{}), 200*time.Millisecond), "didn't accept connections")
+
+	for _, status := range []string{"ready", "standby"} {
+		require.NoError(t, os.WriteFile(pidFile, []byte(strings.Replace(starting, "starting", status+"   ", 1)), 0600))
+		assert.True(t, postmasterReady(dataDir))
+		assert.NoError(t, waitForPostgresReady(dataDir, make(chan struct{}), time.Minute))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// version can be set at build time with
+// -ldflags "-X main.version=v1.2.3". Otherwise we use the VCS
+// revision Go embeds in the binary.
+var version string
+
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return info.Main.Version
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// peerLivenessTimeout is how long a peer's status can go unchanged
+// before we consider it dead. Nodes write a new status every cycle,
+// and from nodeStatusLoop while a cycle is busy.
+const peerLivenessTimeout = 10 * time.Second
+
+// daemonStatus is the /status response: what this daemon currently
+// thinks, for operators and dashboards. Ages are in seconds on the
+// local monotonic clock, and null if we haven't seen anything yet.
+type daemonStatus struct {
+	Node    string `json:"node"`
+	Version string `json:"version"`
+
+	NodeStatus           *NodeStatus `json:"node_status"`
+	NodeStatusAgeSeconds *float64    `json:"node_status_age_seconds"`
+
+	ClusterStatus           *ClusterStatus `json:"cluster_status"`
+	ClusterStatusAgeSeconds *float64       `json:"cluster_status_age_seconds"`
+
+	LastCycle *cycleOutcome `json:"last_cycle"`
+
+	Peers []peerLiveness `json:"peers"`
+}
+
+type cycleOutcome struct {
+	AgeSeconds      float64 `json:"age_seconds"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           *string `json:"error"`
+}
+
+type peerLiveness struct {
+	Name       string    `json:"name"`
+	StatusUuid uuid.UUID `json:"status_uuid"`
+	// LastChangeAgeSeconds is how long ago we saw the peer's status
+	// change.
+	LastChangeAgeSeconds float64 `json:"last_change_age_seconds"`
+	Alive                bool    `json:"alive"`
+}
+
+func newDaemonStatus(nodeName string, snapshot statusSnapshot) daemonStatus {
+	status := daemonStatus{
+		Node:    nodeName,
+		Version: buildVersion(),
+		Peers:   []peerLiveness{},
+	}
+
+	if snapshot.nodeAge >= 0 {
+		status.NodeStatus = &snapshot.node
+		status.NodeStatusAgeSeconds = ageSeconds(snapshot.nodeAge)
+	}
+
+	if snapshot.clusterAge >= 0 {
+		status.ClusterStatus = &snapshot.cluster.Status
+		status.ClusterStatusAgeSeconds = ageSeconds(snapshot.clusterAge)
+		for _, node := range snapshot.cluster.Nodes {
+			age := snapshot.peerAges[node.Name]
+			status.Peers = append(status.Peers, peerLiveness{
+				Name:                 node.Name,
+				StatusUuid:           node.StatusUuid,
+				LastChangeAgeSeconds: age.Seconds(),
+				Alive:                age <= peerLivenessTimeout,
+			})
+		}
+		slices.SortFunc(status.Peers, func(a, b peerLiveness) int {
+			return cmp.Compare(a.Name, b.Name)
+		})
+	}
+
+	if snapshot.cycleAge >= 0 {
+		status.LastCycle = &cycleOutcome{
+			AgeSeconds:      snapshot.cycleAge.Seconds(),
+			DurationSeconds: snapshot.cycleDuration.Seconds(),
+		}
+		if snapshot.cycleErr != nil {
+			errStr := snapshot.cycleErr.Error()
+			status.LastCycle.Error = &errStr
+		}
+	}
+
+	return status
+}
+
+func ageSeconds(age time.Duration) *float64 {
+	seconds := age.Seconds()
+	return &seconds
+}
+
+func statusHandler(nodeName string, cache *StatusCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := newDaemonStatus(nodeName, cache.Snapshot(time.Now()))
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(status); err != nil {
+			log.Printf("Failed to write /status response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCache_WatchClusterStatus(t *testing.T) {
+	store := &memStore{state: ClusterState{Status: ClusterStatus{IntendedPrimary: "node1"}}}
+	cache := NewStatusCache()
+	cache.SetCluster(ClusterState{Status: ClusterStatus{IntendedPrimary: "node2"}})
+
+	// The reconciler is busy, but the status /primary checks still
+	// follows the store
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- cache.WatchClusterStatus(ctx, store, 10*time.Millisecond) }()
+	assert.Eventually(t, func() bool {
+		snapshot := cache.Snapshot(time.Now())
+		return snapshot.status.IntendedPrimary == "node1" && snapshot.statusAge < time.Second
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "node2", cache.Snapshot(time.Now()).cluster.Status.IntendedPrimary)
+
+	cancel()
+	assert.Error(t, <-done)
+}
+
+func TestStatusCache_PeerAges(t *testing.T) {
+	cache := NewStatusCache()
+	node1, node2 := uuid.New(), uuid.New()
+
+	cache.SetCluster(ClusterState{Nodes: []NodeStatus{
+		{Name: "node1", StatusUuid: node1},
+		{Name: "node2", StatusUuid: node2},
+	}})
+	time.Sleep(20 * time.Millisecond)
+
+	// node1 wrote a new status, node2 didn't
+	cache.SetCluster(ClusterState{Nodes: []NodeStatus{
+		{Name: "node1", StatusUuid: uuid.New()},
+		{Name: "node2", StatusUuid: node2},
+	}})
+
+	snapshot := cache.Snapshot(time.Now())
+	assert.Less(t, snapshot.peerAges["node1"], snapshot.peerAges["node2"])
+	assert.GreaterOrEqual(t, snapshot.peerAges["node2"], 20*time.Millisecond)
+}
+
+func TestNewDaemonStatus(t *testing.T) {
+	empty := newDaemonStatus("node1", statusSnapshot{nodeAge: -1, clusterAge: -1, cycleAge: -1})
+	assert.Equal(t, "node1", empty.Node)
+	assert.NotEmpty(t, empty.Version)
+	assert.Nil(t, empty.NodeStatus)
+	assert.Nil(t, empty.ClusterStatus)
+	assert.Nil(t, empty.LastCycle)
+	assert.Empty(t, empty.Peers)
+
+	status := newDaemonStatus("node1", statusSnapshot{
+		node:    NodeStatus{Name: "node1", IsPrimary: true},
+		nodeAge: time.Second,
+		cluster: ClusterState{
+			Status: ClusterStatus{IntendedPrimary: "node1"},
+			Nodes:  []NodeStatus{{Name: "node2"}, {Name: "node1"}},
+		},
+		clusterAge:    2 * time.Second,
+		cycleAge:      500 * time.Millisecond,
+		cycleDuration: 100 * time.Millisecond,
+		cycleErr:      errors.New("Failed to fetch node spec"),
+		peerAges:      map[string]time.Duration{"node1": time.Second, "node2": time.Minute},
+	})
+	require.NotNil(t, status.NodeStatus)
+	assert.True(t, status.NodeStatus.IsPrimary)
+	assert.Equal(t, 1.0, *status.NodeStatusAgeSeconds)
+	require.NotNil(t, status.ClusterStatus)
+	assert.Equal(t, "node1", status.ClusterStatus.IntendedPrimary)
+	assert.Equal(t, 2.0, *status.ClusterStatusAgeSeconds)
+	assert.Equal(t, &cycleOutcome{
+		AgeSeconds:      0.5,
+		DurationSeconds: 0.1,
+		Error:           status.LastCycle.Error,
+	}, status.LastCycle)
+	assert.Equal(t, "Failed to fetch node spec", *status.LastCycle.Error)
+
+	require.Len(t, status.Peers, 2)
+	assert.Equal(t, "node1", status.Peers[0].Name)
+	assert.True(t, status.Peers[0].Alive)
+	assert.Equal(t, "node2", status.Peers[1].Name)
+	assert.False(t, status.Peers[1].Alive)
+}
+
+func TestStatusHandler(t *testing.T) {
+	cache := NewStatusCache()
+	cache.SetNode(NodeStatus{Name: "node1"})
+	cache.CycleDone(time.Millisecond, nil)
+
+	rec := httptest.NewRecorder()
+	statusHandler("node1", cache)(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, "node1", body["node"])
+	assert.Nil(t, body["cluster_status"])
+	assert.Nil(t, body["last_cycle"].(map[string]any)["error"])
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StatusCache holds what the reconciler last saw, so the health check
+// server can answer without querying Postgres or the store on every
+// request. Ages use the local monotonic clock.
+type StatusCache struct {
+	mu sync.Mutex
+
+	node      NodeStatus
+	nodeAt    time.Time
+	cluster   ClusterState
+	clusterAt time.Time
+
+	// status is the latest cluster status we fetched, either by the
+	// reconciler or by WatchClusterStatus.
+	status   ClusterStatus
+	statusAt time.Time
+
+	// peers tracks when each node's status last changed, which is
+	// how we tell if a peer is still alive.
+	peers map[string]peerSeen
+
+	// cycleAt is when the reconciler last finished a cycle, whether
+	// or not it succeeded.
+	cycleAt       time.Time
+	cycleDuration time.Duration
+	cycleErr      error
+}
+
+type peerSeen struct {
+	statusUuid uuid.UUID
+	changedAt  time.Time
+}
+
+func NewStatusCache() *StatusCache {
+	return &StatusCache{peers: make(map[string]peerSeen)}
+}
+
+// SetNode records the node status we just published.
+func (c *StatusCache) SetNode(status NodeStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.node = status
+	c.nodeAt = time.Now()
+}
+
+// SetCluster records the cluster state the reconciler acted on, and
+// returns the events since the previous state, for the caller to
+// record in the state store.
+func (c *StatusCache) SetCluster(state ClusterState) []ClusterEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var events []ClusterEvent
+	if !c.clusterAt.IsZero() {
+		events = newClusterEvents(now, diffClusterStates(c.cluster, state))
+	}
+	c.cluster = state
+	c.clusterAt = now
+	c.status = state.Status
+	c.statusAt = now
+	c.observePeers(state.Nodes, now)
+	return events
+}
+
+// clusterStatusWatchInterval is how often WatchClusterStatus fetches
+// the cluster status.
+const clusterStatusWatchInterval = 1 * time.Second
+
+// WatchClusterStatus fetches the cluster status every interval until
+// ctx is done. /primary checks this status rather than the one the
+// reconciler acted on, which can get old while a cycle is busy, e.g.
+// cloning a replica, or skipped because of a CAS conflict.
+func (c *StatusCache) WatchClusterStatus(ctx context.Context, store StateStore, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, interval)
+		state, err := store.FetchClusterState(fetchCtx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to fetch cluster status: %v", err)
+		} else {
+			c.mu.Lock()
+			c.status = state.Status
+			c.statusAt = time.Now()
+			c.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("returning ctx.Done() error in cluster status watcher: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// StaleNodes records the node statuses we just fetched and returns the
+// nodes whose status hasn't changed within peerLivenessTimeout, which
+// means their pgdaemon has stopped.
+func (c *StatusCache) StaleNodes(nodes []NodeStatus) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.observePeers(nodes, now)
+	var stale []string
+	for _, node := range nodes {
+		if now.Sub(c.peers[node.Name].changedAt) > peerLivenessTimeout {
+			stale = append(stale, node.Name)
+		}
+	}
+	return stale
+}
+
+func (c *StatusCache) observePeers(nodes []NodeStatus, now time.Time) {
+	for _, node := range nodes {
+		if seen, ok := c.peers[node.Name]; !ok || seen.statusUuid != node.StatusUuid {
+			c.peers[node.Name] = peerSeen{statusUuid: node.StatusUuid, changedAt: now}
+		}
+	}
+}
+
+// newClusterEvents logs events with a well known prefix, so they are
+// easy to find in the logs, and sets their time. Events noticed
+// together are a nanosecond apart so they keep their order.
+func newClusterEvents(now time.Time, events []ClusterEvent) []ClusterEvent {
+	for i := range events {
+		events[i].Time = now.UTC().Add(time.Duration(i)).Format(time.RFC3339Nano)
+		log.Printf("CLUSTER EVENT %s: %s", events[i].Kind, events[i].Message)
+	}
+	return events
+}
+
+// CycleDone records that the reconciler finished a cycle, and how it
+// went.
+func (c *StatusCache) CycleDone(duration time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cycleAt = time.Now()
+	c.cycleDuration = duration
+	c.cycleErr = err
+}
+
+// statusSnapshot is a consistent copy of the cache. The ages are -1 if
+// we haven't seen anything yet.
+type statusSnapshot struct {
+	node       NodeStatus
+	nodeAge    time.Duration
+	cluster    ClusterState
+	clusterAge time.Duration
+	cycleAge   time.Duration
+
+	// status is the latest cluster status we fetched, which can be
+	// newer than cluster.Status.
+	status    ClusterStatus
+	statusAge time.Duration
+
+	cycleDuration time.Duration
+	cycleErr      error
+
+	// peerAges is how long ago each node's status last changed,
+	// including our own.
+	peerAges map[string]time.Duration
+}
+
+func (c *StatusCache) Snapshot(now time.Time) statusSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peerAges := make(map[string]time.Duration, len(c.peers))
+	for name, seen := range c.peers {
+		peerAges[name] = cacheAge(seen.changedAt, now)
+	}
+	return statusSnapshot{
+		node:          c.node,
+		nodeAge:       cacheAge(c.nodeAt, now),
+		cluster:       c.cluster,
+		clusterAge:    cacheAge(c.clusterAt, now),
+		status:        c.status,
+		statusAge:     cacheAge(c.statusAt, now),
+		cycleAge:      cacheAge(c.cycleAt, now),
+		cycleDuration: c.cycleDuration,
+		cycleErr:      c.cycleErr,
+		peerAges:      peerAges,
+	}
+}
+
+func cacheAge(at time.Time, now time.Time) time.Duration {
+	if at.IsZero() {
+		return -1
+	}
+	return now.Sub(at)
+}
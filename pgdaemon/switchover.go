@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// switchoverCatchupTimeout is how long the new primary waits to
+// receive the old primary's shutdown checkpoint. Promoting without it
+// could lose commits, so after this we abort the switchover and the old
+// primary starts up again instead.
+const switchoverCatchupTimeout = 60 * time.Second
+
+// demoteConfContent blocks new writes while the primary is shutting
+// down for a switchover.
+const demoteConfContent = "default_transaction_read_only = on\n"
+
+// Demote cleanly shuts down this primary for a switchover: checkpoint
+// so the shutdown is quick, block new writes, then shut down in fast
+// mode. Fast shutdown waits for walsenders to send all WAL, including
+// the shutdown checkpoint, to connected replicas. We record the
+// shutdown checkpoint LSN so the new primary knows how much WAL it
+// must receive before it promotes. Demote is idempotent.
+func (p *PostgresNode) Demote(ctx context.Context) error {
+	if p.shutdownCheckpointLsn != nil {
+		return nil
+	}
+
+	log.Printf("Demoting primary: checkpointing and blocking writes")
+	if _, err := p.pool.Exec(ctx, "CHECKPOINT"); err != nil {
+		// The shutdown checkpoint below still makes this safe, it
+		// just takes longer.
+		log.Printf("Failed to checkpoint before demotion: %v", err)
+	}
+
+	changed, err := writeConfFile(p.dataDir+"/postgresql.conf.d/demote.conf", []byte(demoteConfContent))
+	if err != nil {
+		return fmt.Errorf("failed to write demote.conf: %w", err)
+	}
+	if changed {
+		if err := p.postgres.Reload(); err != nil {
+			return fmt.Errorf("failed to reload Postgres service: %w", err)
+		}
+	}
+
+	log.Printf("Demoting primary: shutting down Postgres")
+	if err := p.postgres.Stop(); err != nil {
+		return fmt.Errorf("failed to stop Postgres: %w", err)
+	}
+
+	data, err := p.readControlData()
+	if err != nil {
+		return err
+	}
+	if data.ClusterState != "shut down" {
+		return fmt.Errorf("Postgres was not shut down cleanly, cluster state is %q", data.ClusterState)
+	}
+
+	lsn := data.CheckpointLSN.String()
+	p.statusMu.Lock()
+	p.shutdownCheckpointLsn = &lsn
+	p.statusMu.Unlock()
+	log.Printf("Demoted primary, shutdown checkpoint is at %s", lsn)
+	return nil
+}
+
+type promotionAction string
+
+const (
+	promotionActionWait    promotionAction = "wait"
+	promotionActionPromote promotionAction = "promote"
+	promotionActionAbort   promotionAction = "abort"
+)
+
+// decidePromotion decides whether the new primary of a switchover may
+// promote. It waits until it has received WAL past the old primary's
+// shutdown checkpoint, and aborts the switchover if that takes longer
+// than timeout. receiveLsn is nil if the walreceiver hasn't received
+// anything.
+func decidePromotion(status ClusterStatus, receiveLsn *LSN, waitingFor time.Duration, timeout time.Duration) (action promotionAction, reason string, err error) {
+	switch status.FailoverState {
+	case FailoverStateDemotingOldPrimary:
+		return promotionActionWait, fmt.Sprintf("waiting for %s to shut down", status.PreviousPrimary), nil
+	case FailoverStatePromotingNewPrimary:
+		if status.SwitchoverLsn == "" {
+			return promotionActionPromote, "", nil
+		}
+		switchoverLsn, err := ParseLSN(status.SwitchoverLsn)
+		if err != nil {
+			return promotionActionWait, "", fmt.Errorf("failed to parse switchover LSN: %w", err)
+		}
+		// The received LSN is the end of the last record we got,
+		// and the checkpoint LSN is the start of the shutdown
+		// checkpoint record.
+		if receiveLsn != nil && *receiveLsn > switchoverLsn {
+			return promotionActionPromote, "", nil
+		}
+		received := "nothing"
+		if receiveLsn != nil {
+			received = receiveLsn.String()
+		}
+		if waitingFor >= timeout {
+			return promotionActionAbort, fmt.Sprintf("did not receive shutdown checkpoint %s from %s within %s (received %s), aborting", switchoverLsn, status.PreviousPrimary, timeout, received), nil
+		}
+		return promotionActionWait, fmt.Sprintf("waiting to receive shutdown checkpoint %s from %s (received %s)", switchoverLsn, status.PreviousPrimary, received), nil
+	default:
+		return promotionActionPromote, "", nil
+	}
+}
+
+// readyToPromote decides whether this node, the intended primary, may
+// promote itself yet.
+func (p *PostgresNode) readyToPromote(ctx context.Context, status ClusterStatus) (promotionAction, error) {
+	if status.FailoverState == "" || status.FailoverState == FailoverStateStable {
+		p.promotionWaitSince = time.Time{}
+		return promotionActionPromote, nil
+	}
+
+	var isInRecovery bool
+	var receiveLsnStr *string
+	err := p.pool.QueryRow(ctx, "SELECT pg_is_in_recovery(), pg_last_wal_receive_lsn()::text").Scan(&isInRecovery, &receiveLsnStr)
+	if err != nil {
+		return promotionActionWait, fmt.Errorf("failed to query received WAL: %w", err)
+	}
+	if !isInRecovery {
+		// Already promoted
+		p.promotionWaitSince = time.Time{}
+		return promotionActionPromote, nil
+	}
+
+	var receiveLsn *LSN
+	if receiveLsnStr != nil {
+		lsn, err := ParseLSN(*receiveLsnStr)
+		if err != nil {
+			return promotionActionWait, fmt.Errorf("failed to parse received LSN: %w", err)
+		}
+		receiveLsn = &lsn
+	}
+
+	// Only start the timeout once the old primary is done.
+	now := time.Now()
+	if status.FailoverState != FailoverStatePromotingNewPrimary {
+		p.promotionWaitSince = time.Time{}
+	} else if p.promotionWaitSince.IsZero() {
+		p.promotionWaitSince = now
+	}
+	action, reason, err := decidePromotion(status, receiveLsn, now.Sub(p.promotionWaitSince), switchoverCatchupTimeout)
+	if err != nil {
+		return promotionActionWait, err
+	}
+	if reason != "" {
+		log.Printf("Switchover: %s", reason)
+	}
+	if action != promotionActionWait {
+		p.promotionWaitSince = time.Time{}
+	}
+	return action, nil
+}
+
+// revertSwitchover makes the old primary of a switchover the intended
+// primary again. It restarts as a primary on its next cycle, since it
+// is still a primary that shut down cleanly.
+func revertSwitchover(status ClusterStatus) ClusterStatus {
+	status.IntendedPrimary = status.PreviousPrimary
+	status.FailoverState = FailoverStateStable
+	status.PreviousPrimary = ""
+	status.SwitchoverLsn = ""
+	return status
+}
+
+// abortSwitchover reverts the switchover to nodeName, unless someone
+// else already finished or reverted it.
+func abortSwitchover(store StateStore, nodeName string) error {
+	return updateClusterStatus(store, nodeName, func(status *ClusterStatus) {
+		if status.FailoverState == FailoverStatePromotingNewPrimary && status.IntendedPrimary == nodeName {
+			*status = revertSwitchover(*status)
+		}
+	})
+}
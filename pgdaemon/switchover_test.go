@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecidePromotion(t *testing.T) {
+	timeout := time.Minute
+	lsn := func(s string) *LSN {
+		l, err := ParseLSN(s)
+		require.NoError(t, err)
+		return &l
+	}
+
+	demoting := ClusterStatus{FailoverState: FailoverStateDemotingOldPrimary, PreviousPrimary: "node1"}
+	action, reason, err := decidePromotion(demoting, lsn("0/6000000"), 0, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionWait, action)
+	assert.Equal(t, "waiting for node1 to shut down", reason)
+
+	promoting := ClusterStatus{FailoverState: FailoverStatePromotingNewPrimary, PreviousPrimary: "node1", SwitchoverLsn: "0/5000028"}
+
+	action, reason, err = decidePromotion(promoting, lsn("0/5000028"), time.Second, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionWait, action)
+	assert.Equal(t, "waiting to receive shutdown checkpoint 0/5000028 from node1 (received 0/5000028)", reason)
+
+	action, _, err = decidePromotion(promoting, nil, time.Second, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionWait, action)
+
+	action, reason, err = decidePromotion(promoting, lsn("0/50000A0"), time.Second, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionPromote, action)
+	assert.Empty(t, reason)
+
+	// Don't wait forever, but don't promote without the shutdown
+	// checkpoint either
+	action, reason, err = decidePromotion(promoting, lsn("0/5000000"), timeout, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionAbort, action)
+	assert.Contains(t, reason, "aborting")
+
+	// The old primary went down before it could shut down cleanly
+	action, _, err = decidePromotion(ClusterStatus{FailoverState: FailoverStatePromotingNewPrimary}, nil, 0, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionPromote, action)
+
+	action, _, err = decidePromotion(ClusterStatus{FailoverState: FailoverStateStable}, nil, 0, timeout)
+	require.NoError(t, err)
+	assert.Equal(t, promotionActionPromote, action)
+}
+
+func TestRevertSwitchover(t *testing.T) {
+	status := ClusterStatus{
+		IntendedPrimary: "node2",
+		PreviousPrimary: "node1",
+		FailoverState:   FailoverStatePromotingNewPrimary,
+		SwitchoverLsn:   "0/5000028",
+	}
+	assert.Equal(t, ClusterStatus{IntendedPrimary: "node1", FailoverState: FailoverStateStable}, revertSwitchover(status))
+}
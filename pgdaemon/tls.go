@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// serverCertValidity is how long the server certificates we generate
+// are valid, and serverCertRenewBefore is how long before expiry we
+// replace them.
+const (
+	serverCertValidity    = 365 * 24 * time.Hour
+	serverCertRenewBefore = 30 * 24 * time.Hour
+)
+
+// connSecurity is how we authenticate and encrypt connections between
+// nodes. The zero value is the legacy setup: trust auth and no TLS.
+type connSecurity struct {
+	// replicationUser connects to other nodes using the password in
+	// passfile. passfile is empty if no replication password is
+	// configured, in which case we connect as -pguser. It also has
+	// -pguser's password for our local connections, if there is one.
+	replicationUser string
+	passfile        string
+
+	// rootCert is the CA that signs every node's server certificate.
+	// If it is set we connect with sslmode=verify-full.
+	rootCert string
+}
+
+func (s connSecurity) authEnabled() bool {
+	return s.passfile != ""
+}
+
+func (s connSecurity) tlsEnabled() bool {
+	return s.rootCert != ""
+}
+
+// peerConninfo is the libpq connection string for connecting to
+// another node: primary_conninfo, pg_basebackup, pg_rewind, and our
+// own checks before rejoining.
+func (s connSecurity) peerConninfo(host string, port int, fallbackUser string) string {
+	parts := []string{"host=" + conninfoValue(host), fmt.Sprintf("port=%d", port)}
+	if s.authEnabled() {
+		// pg_rewind and our rejoin checks need a database, and the
+		// default database named after the role doesn't exist.
+		parts = append(parts, "user="+conninfoValue(s.replicationUser), "dbname=postgres", "passfile="+conninfoValue(s.passfile))
+	} else {
+		parts = append(parts, "user="+conninfoValue(fallbackUser))
+	}
+	if s.tlsEnabled() {
+		parts = append(parts, s.sslParams())
+	}
+	return strings.Join(parts, " ")
+}
+
+// sslParams are the TLS connection parameters for pgdaemon's own
+// connections.
+func (s connSecurity) sslParams() string {
+	if !s.tlsEnabled() {
+		return "sslmode=disable"
+	}
+	return "sslmode=verify-full sslrootcert=" + conninfoValue(s.rootCert)
+}
+
+// localParams are the connection parameters for pgdaemon's own
+// connections to the local Postgres and PgBouncer as -pguser.
+func (s connSecurity) localParams() string {
+	if s.passfile == "" {
+		return s.sslParams()
+	}
+	return s.sslParams() + " passfile=" + conninfoValue(s.passfile)
+}
+
+// conninfoValue quotes a libpq connection string value if needed.
+func conninfoValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " '\\\t\n") {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// serverTLSFiles are the files Postgres uses for TLS. They are empty
+// if TLS is disabled.
+type serverTLSFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	// caKeyFile is set if we generate certFile and keyFile ourselves,
+	// signed by this CA.
+	caKeyFile string
+}
+
+// newServerTLSFiles resolves the -tls-* flags. With -tls-cert and
+// -tls-key we use the given certificate. With -tls-ca-key instead, we
+// generate one next to PGDATA.
+func newServerTLSFiles(conf config) (serverTLSFiles, error) {
+	files := serverTLSFiles{certFile: conf.tlsCert, keyFile: conf.tlsKey, caFile: conf.tlsCA}
+	if conf.tlsCA == "" {
+		if conf.tlsCert != "" || conf.tlsKey != "" || conf.tlsCAKey != "" {
+			return files, fmt.Errorf("-tls-ca is required for TLS, since we connect with sslmode=verify-full")
+		}
+		return files, nil
+	}
+	if (conf.tlsCert == "") != (conf.tlsKey == "") {
+		return files, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if conf.tlsCert == "" {
+		if conf.tlsCAKey == "" {
+			return files, fmt.Errorf("TLS needs either -tls-cert and -tls-key, or -tls-ca-key to generate a certificate")
+		}
+		dir := conf.pgDataDir + ".pgdaemon-tls"
+		files.certFile = dir + "/server.crt"
+		files.keyFile = dir + "/server.key"
+		files.caKeyFile = conf.tlsCAKey
+	}
+	return files, nil
+}
+
+func (f serverTLSFiles) enabled() bool {
+	return f.caFile != ""
+}
+
+// renderTLSConf renders the Postgres TLS settings, or nil if TLS is
+// disabled.
+func renderTLSConf(files serverTLSFiles) []byte {
+	if !files.enabled() {
+		return nil
+	}
+	return fmt.Appendf(nil, "ssl = on\nssl_cert_file = %s\nssl_key_file = %s\nssl_ca_file = %s\n",
+		quotePostgresConfString(files.certFile),
+		quotePostgresConfString(files.keyFile),
+		quotePostgresConfString(files.caFile))
+}
+
+// certHostnames are the names other nodes and pgdaemon itself use to
+// connect to this node, which the server certificate must cover for
+// sslmode=verify-full.
+func certHostnames(conf config) []string {
+	hosts := []string{conf.nodeName, "localhost", "127.0.0.1", conf.postgresHost}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	slices.Sort(hosts)
+	return slices.Compact(slices.DeleteFunc(hosts, func(h string) bool { return h == "" }))
+}
+
+// ensureServerCert generates a server certificate signed by the CA if
+// it is missing, doesn't cover hosts, or expires soon. It returns
+// whether it wrote a new certificate.
+func ensureServerCert(files serverTLSFiles, hosts []string, now time.Time) (bool, error) {
+	if files.caKeyFile == "" {
+		return false, nil
+	}
+
+	if certPEM, err := os.ReadFile(files.certFile); err == nil {
+		if cert, err := parseCertPEM(certPEM); err == nil && !certNeedsRenewal(cert, hosts, now) {
+			return false, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("failed to read %s: %w", files.certFile, err)
+	}
+
+	ca, err := tls.LoadX509KeyPair(files.caFile, files.caKeyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load CA: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	certPEM, keyPEM, err := generateServerCert(caCert, ca.PrivateKey, hosts, now)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(files.certFile), 0700); err != nil {
+		return false, fmt.Errorf("failed to create TLS directory: %w", err)
+	}
+	// Postgres refuses keys that others can read
+	if err := os.WriteFile(files.keyFile, keyPEM, 0600); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", files.keyFile, err)
+	}
+	if err := os.WriteFile(files.certFile, certPEM, 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", files.certFile, err)
+	}
+	return true, nil
+}
+
+func parseCertPEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func certNeedsRenewal(cert *x509.Certificate, hosts []string, now time.Time) bool {
+	if now.Add(serverCertRenewBefore).After(cert.NotAfter) {
+		return true
+	}
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func generateServerCert(caCert *x509.Certificate, caKey any, hosts []string, now time.Time) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(serverCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal key: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
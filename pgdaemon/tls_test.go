@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerConninfo(t *testing.T) {
+	var legacy connSecurity
+	assert.Equal(t, "host=node1 port=5432 user=postgres", legacy.peerConninfo("node1", 5432, "postgres"))
+	assert.Equal(t, "sslmode=disable", legacy.sslParams())
+
+	secure := connSecurity{
+		replicationUser: "replicator",
+		passfile:        "/var/lib/postgres/data.pgdaemon-pgpass",
+		rootCert:        "/etc/pgdaemon/my ca.crt",
+	}
+	assert.Equal(t,
+		"host=node1 port=5432 user=replicator dbname=postgres passfile=/var/lib/postgres/data.pgdaemon-pgpass sslmode=verify-full sslrootcert='/etc/pgdaemon/my ca.crt'",
+		secure.peerConninfo("node1", 5432, "postgres"))
+}
+
+func TestConninfoValue(t *testing.T) {
+	assert.Equal(t, "plain", conninfoValue("plain"))
+	assert.Equal(t, "''", conninfoValue(""))
+	assert.Equal(t, `'it\'s a \\path'`, conninfoValue(`it's a \path`))
+}
+
+func TestNewServerTLSFiles(t *testing.T) {
+	files, err := newServerTLSFiles(config{})
+	require.NoError(t, err)
+	assert.False(t, files.enabled())
+	assert.Nil(t, renderTLSConf(files))
+
+	_, err = newServerTLSFiles(config{tlsCert: "server.crt", tlsKey: "server.key"})
+	assert.ErrorContains(t, err, "-tls-ca is required")
+
+	_, err = newServerTLSFiles(config{tlsCA: "ca.crt", tlsCert: "server.crt"})
+	assert.ErrorContains(t, err, "must be given together")
+
+	_, err = newServerTLSFiles(config{tlsCA: "ca.crt"})
+	assert.ErrorContains(t, err, "-tls-ca-key")
+
+	files, err = newServerTLSFiles(config{tlsCA: "ca.crt", tlsCAKey: "ca.key", pgDataDir: "/data"})
+	require.NoError(t, err)
+	assert.Equal(t, serverTLSFiles{
+		certFile:  "/data.pgdaemon-tls/server.crt",
+		keyFile:   "/data.pgdaemon-tls/server.key",
+		caFile:    "ca.crt",
+		caKeyFile: "ca.key",
+	}, files)
+	assert.Equal(t, "ssl = on\nssl_cert_file = '/data.pgdaemon-tls/server.crt'\nssl_key_file = '/data.pgdaemon-tls/server.key'\nssl_ca_file = 'ca.crt'\n", string(renderTLSConf(files)))
+}
+
+// writeTestCA writes a self-signed CA certificate and key to dir.
+func writeTestCA(t *testing.T, dir string) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "ca.crt")
+	keyFile = filepath.Join(dir, "ca.key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestEnsureServerCert(t *testing.T) {
+	dir := t.TempDir()
+	caFile, caKeyFile := writeTestCA(t, dir)
+	files, err := newServerTLSFiles(config{tlsCA: caFile, tlsCAKey: caKeyFile, pgDataDir: filepath.Join(dir, "data")})
+	require.NoError(t, err)
+	hosts := []string{"node1", "localhost", "127.0.0.1"}
+	now := time.Now()
+
+	changed, err := ensureServerCert(files, hosts, now)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	// The certificate verifies against the CA for every host
+	caPEM, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+	certPEM, err := os.ReadFile(files.certFile)
+	require.NoError(t, err)
+	cert, err := parseCertPEM(certPEM)
+	require.NoError(t, err)
+	for _, host := range hosts {
+		_, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		assert.NoError(t, err, host)
+	}
+
+	keyInfo, err := os.Stat(files.keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), keyInfo.Mode().Perm())
+
+	changed, err = ensureServerCert(files, hosts, now)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// New hostnames and upcoming expiry need a new certificate
+	changed, err = ensureServerCert(files, append(hosts, "node1.example.com"), now)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	changed, err = ensureServerCert(files, hosts, now.Add(serverCertValidity-serverCertRenewBefore+time.Hour))
+	require.NoError(t, err)
+	assert.True(t, changed)
+}
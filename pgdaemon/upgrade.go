@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgBinariesFile records which binaries a data directory was upgraded
+// to. It lives in PGDATA so it follows the data into base backups and
+// clones, and so pgdaemon keeps using the new binaries after a restart
+// even though its -pg-bin-dir flag still names the old ones.
+const pgBinariesFile = "pgdaemon_binaries.json"
+
+type pgBinaries struct {
+	BinDir       string `json:"bin_dir"`
+	PostgresUnit string `json:"postgres_unit,omitempty"`
+}
+
+// readPgBinaries reads pgBinariesFile from dataDir. It returns nil if
+// the data directory was never upgraded.
+func readPgBinaries(dataDir string) (*pgBinaries, error) {
+	content, err := os.ReadFile(dataDir + "/" + pgBinariesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", pgBinariesFile, err)
+	}
+	var bins pgBinaries
+	if err := json.Unmarshal(content, &bins); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", pgBinariesFile, err)
+	}
+	if bins.BinDir == "" {
+		return nil, fmt.Errorf("%s has no bin_dir", pgBinariesFile)
+	}
+	return &bins, nil
+}
+
+// applyPgBinaries returns conf with -pg-bin-dir and -postgres-unit
+// replaced by bins.
+func applyPgBinaries(conf config, bins pgBinaries) config {
+	conf.pgBinDir = bins.BinDir
+	if bins.PostgresUnit != "" {
+		conf.postgresUnit = bins.PostgresUnit
+	}
+	return conf
+}
+
+// withPgBinaries applies the binaries PGDATA was upgraded to, if any.
+func withPgBinaries(conf config) (config, error) {
+	bins, err := readPgBinaries(conf.pgDataDir)
+	if err != nil || bins == nil {
+		return conf, err
+	}
+	return applyPgBinaries(conf, *bins), nil
+}
+
+// startUpgrade pauses automatic failover and asks the primary to
+// upgrade itself to the binaries in newBinDir.
+func startUpgrade(spec ClusterSpec, status ClusterStatus, nodes []NodeStatus, newBinDir string, newPostgresUnit string, now time.Time) (ClusterStatus, error) {
+	if newBinDir == "" {
+		return status, fmt.Errorf("The new Postgres binaries must be specified with -new-bin-dir")
+	}
+	if status.Upgrade.inProgress() {
+		return status, fmt.Errorf("A major version upgrade is already in progress (%s)", status.Upgrade.Phase)
+	}
+	if status.FailoverState != "" && status.FailoverState != FailoverStateStable {
+		return status, fmt.Errorf("Can't upgrade during a switchover (%s)", status.FailoverState)
+	}
+	if spec.StandbyCluster != nil {
+		return status, fmt.Errorf("Can't upgrade a standby cluster, it must run the same major version as %s", spec.StandbyCluster.Host)
+	}
+
+	idx := slices.IndexFunc(nodes, func(node NodeStatus) bool { return node.Name == status.IntendedPrimary })
+	if idx < 0 || nodeIsDown(nodes[idx]) || !nodes[idx].IsPrimary {
+		return status, fmt.Errorf("Primary %q must be up to upgrade the cluster", status.IntendedPrimary)
+	}
+
+	status.Paused = true
+	status.Upgrade = &ClusterUpgradeStatus{
+		Phase:           UpgradePhaseChecking,
+		Primary:         status.IntendedPrimary,
+		NewBinDir:       newBinDir,
+		NewPostgresUnit: newPostgresUnit,
+		StartedAt:       now.UTC().Format(time.RFC3339),
+	}
+	return status, nil
+}
+
+// updateUpgrade applies update to the cluster's upgrade status if it
+// is still in phase from, so we don't clobber a newer upgrade.
+func updateUpgrade(store StateStore, nodeName string, from UpgradePhase, update func(status *ClusterStatus, upgrade *ClusterUpgradeStatus)) error {
+	return updateClusterStatus(store, nodeName, func(status *ClusterStatus) {
+		if status.Upgrade == nil || status.Upgrade.Phase != from {
+			return
+		}
+		upgrade := *status.Upgrade
+		update(status, &upgrade)
+		status.Upgrade = &upgrade
+	})
+}
+
+// readDataDirMajorVersion reads the major version from PG_VERSION.
+func readDataDirMajorVersion(dataDir string) (int, error) {
+	content, err := os.ReadFile(dataDir + "/PG_VERSION")
+	if err != nil {
+		return 0, err
+	}
+	major, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse PG_VERSION: %w", err)
+	}
+	return major, nil
+}
+
+// parsePostgresVersion parses the major version from `postgres
+// --version`, e.g. "postgres (PostgreSQL) 17.2 (Debian 17.2-1)".
+func parsePostgresVersion(output string) (int, error) {
+	fields := strings.Fields(output)
+	if len(fields) < 3 {
+		return 0, fmt.Errorf("unexpected postgres --version output %q", output)
+	}
+	// Development versions look like 18beta1
+	version := fields[2]
+	end := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		version = version[:end]
+	}
+	major, err := strconv.Atoi(version)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected postgres --version output %q", output)
+	}
+	return major, nil
+}
+
+func postgresMajorVersion(binDir string) (int, error) {
+	out, err := exec.Command(pgBinPath(binDir, "postgres"), "--version").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run postgres --version: %w", err)
+	}
+	return parsePostgresVersion(string(out))
+}
+
+// resolveBinDir finds the binaries on $PATH if binDir is empty, since
+// pg_upgrade needs both directories.
+func resolveBinDir(binDir string) (string, error) {
+	if binDir != "" {
+		return binDir, nil
+	}
+	path, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		return "", fmt.Errorf("failed to find the Postgres binaries: %w", err)
+	}
+	return filepath.Dir(path), nil
+}
+
+// upgradeLocale is what the new cluster must share with the old one
+// for pg_upgrade to accept it.
+type upgradeLocale struct {
+	encoding      string
+	collate       string
+	ctype         string
+	dataChecksums bool
+}
+
+func (p *PostgresNode) fetchUpgradeLocale(ctx context.Context) (upgradeLocale, error) {
+	var locale upgradeLocale
+	err := p.pool.QueryRow(ctx, `
+		SELECT pg_encoding_to_char(encoding), datcollate, datctype, current_setting('data_checksums')::bool
+		FROM pg_database
+		WHERE datname = 'template1'`,
+	).Scan(&locale.encoding, &locale.collate, &locale.ctype, &locale.dataChecksums)
+	if err != nil {
+		return locale, fmt.Errorf("failed to query cluster locale: %w", err)
+	}
+	return locale, nil
+}
+
+// initdbUpgradeArgs are the initdb arguments for a new cluster that
+// pg_upgrade can upgrade the old one into.
+func initdbUpgradeArgs(dataDir string, user string, locale upgradeLocale, newMajor int) []string {
+	args := []string{
+		"--pgdata", dataDir,
+		"--username", user,
+		"--encoding", locale.encoding,
+		"--lc-collate", locale.collate,
+		"--lc-ctype", locale.ctype,
+	}
+	if locale.dataChecksums {
+		args = append(args, "--data-checksums")
+	} else if newMajor >= 18 {
+		// Postgres 18 enables checksums by default
+		args = append(args, "--no-data-checksums")
+	}
+	return args
+}
+
+// copyUpgradeConf copies our configuration into the new cluster.
+// pg_upgrade leaves configuration files alone.
+func copyUpgradeConf(oldDir string, newDir string) error {
+	for _, name := range []string{"pg_hba.conf", "pg_ident.conf", "postgresql.auto.conf"} {
+		if err := copyFile(oldDir+"/"+name, newDir+"/"+name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(oldDir + "/postgresql.conf.d")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read postgresql.conf.d: %w", err)
+	}
+	if err := os.MkdirAll(newDir+"/postgresql.conf.d", 0755); err != nil {
+		return fmt.Errorf("failed to create postgresql.conf.d directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := copyFile(oldDir+"/postgresql.conf.d/"+entry.Name(), newDir+"/postgresql.conf.d/"+entry.Name()); err != nil {
+			return err
+		}
+	}
+
+	return appendToFile(newDir+"/postgresql.conf", "\ninclude_dir 'postgresql.conf.d'\n")
+}
+
+func copyFile(src string, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, content, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	return nil
+}
+
+// upgradeDataDir is where we initialize the new cluster. It is next to
+// PGDATA because pg_upgrade --link needs both on the same filesystem.
+func (p *PostgresNode) upgradeDataDir() string {
+	return p.dataDir + ".pgdaemon-upgrade"
+}
+
+// recloning returns true while this replica re-clones for an upgrade.
+// It is safe to call on a nil status.
+func (u *NodeUpgradeStatus) recloning() bool {
+	return u != nil && u.Phase == NodeUpgradePhaseRecloning
+}
+
+func (p *PostgresNode) recordUpgrade(phase NodeUpgradePhase, err error) {
+	progress := &NodeUpgradeStatus{
+		Phase:    phase,
+		NodeTime: time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		errStr := err.Error()
+		progress.Error = &errStr
+	}
+	p.statusMu.Lock()
+	p.upgradeProgress = progress
+	p.statusMu.Unlock()
+}
+
+// switchBinaries makes this node use bins from now on.
+func (p *PostgresNode) switchBinaries(bins pgBinaries) error {
+	if p.binDir == bins.BinDir {
+		return nil
+	}
+	postgres, err := p.postgresServiceFor(bins)
+	if err != nil {
+		return err
+	}
+	p.postgres = postgres
+	p.binDir = bins.BinDir
+	log.Printf("Switched to the Postgres binaries in %s", bins.BinDir)
+	return nil
+}
+
+// upgradeAsPrimary runs the primary's part of an upgrade: check that
+// pg_upgrade will work, then upgrade in place with --link, which only
+// takes as long as hard-linking the data files. The check runs against
+// the live cluster, so Postgres is only down from the start of the
+// upgrade until the new version starts, and PgBouncer holds queries in
+// the meantime. If either step fails we roll back to the old version.
+func (p *PostgresNode) upgradeAsPrimary(ctx context.Context, store StateStore, conf config, upgrade ClusterUpgradeStatus) error {
+	if upgrade.Phase == UpgradePhaseChecking {
+		target, err := p.checkUpgrade(ctx, conf, upgrade)
+		if err != nil {
+			return p.rollBackUpgrade(store, conf, upgrade.Phase, fmt.Errorf("upgrade check failed: %w", err))
+		}
+		if err := updateUpgrade(store, conf.nodeName, upgrade.Phase, func(_ *ClusterStatus, u *ClusterUpgradeStatus) {
+			u.Phase = UpgradePhaseUpgradingPrimary
+			u.TargetMajorVersion = target
+		}); err != nil {
+			return fmt.Errorf("failed to record upgrade check: %w", err)
+		}
+		upgrade.Phase = UpgradePhaseUpgradingPrimary
+		upgrade.TargetMajorVersion = target
+	}
+	if upgrade.Phase != UpgradePhaseUpgradingPrimary {
+		return nil
+	}
+
+	p.recordUpgrade(NodeUpgradePhaseUpgrading, nil)
+	major, err := readDataDirMajorVersion(p.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory version: %w", err)
+	}
+	// If pgdaemon restarted after moving the new cluster into place,
+	// we just need to start it.
+	if major != upgrade.TargetMajorVersion {
+		log.Printf("Upgrading to Postgres %d, stopping Postgres", upgrade.TargetMajorVersion)
+		if err := p.FreezeWrites(ctx); err != nil {
+			log.Printf("Failed to freeze writes, stopping Postgres anyway: %v", err)
+		}
+		if err := p.postgres.Stop(); err != nil {
+			return p.rollBackUpgrade(store, conf, upgrade.Phase, fmt.Errorf("failed to stop Postgres: %w", err))
+		}
+		if err := p.runPgUpgrade(ctx, conf, upgrade, false); err != nil {
+			return p.rollBackUpgrade(store, conf, upgrade.Phase, err)
+		}
+		if err := p.moveUpgradedDataDir(); err != nil {
+			return p.rollBackUpgrade(store, conf, upgrade.Phase, err)
+		}
+	}
+
+	// From here on the old cluster can't be used, so there is no
+	// rolling back.
+	bins := pgBinaries{BinDir: upgrade.NewBinDir, PostgresUnit: upgrade.NewPostgresUnit}
+	content, err := json.Marshal(bins)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", pgBinariesFile, err)
+	}
+	if _, err := writeConfFile(p.dataDir+"/"+pgBinariesFile, content); err != nil {
+		return fmt.Errorf("failed to write %s: %w", pgBinariesFile, err)
+	}
+	if err := p.switchBinaries(bins); err != nil {
+		return err
+	}
+	if err := p.postgres.EnsureRunning(); err != nil {
+		return fmt.Errorf("Failed to start upgraded Postgres: %w", err)
+	}
+	log.Printf("Upgraded primary to Postgres %d", upgrade.TargetMajorVersion)
+
+	// pg_upgrade doesn't carry over planner statistics
+	go p.analyzeAfterUpgrade(conf)
+
+	p.recordUpgrade(NodeUpgradePhaseDone, nil)
+	return updateUpgrade(store, conf.nodeName, upgrade.Phase, func(_ *ClusterStatus, u *ClusterUpgradeStatus) {
+		u.Phase = UpgradePhaseUpgradingReplicas
+	})
+}
+
+// checkUpgrade initializes the new cluster and runs pg_upgrade --check
+// against the running old cluster, so a failed check doesn't take the
+// primary down. It returns the new major version.
+func (p *PostgresNode) checkUpgrade(ctx context.Context, conf config, upgrade ClusterUpgradeStatus) (int, error) {
+	p.recordUpgrade(NodeUpgradePhaseChecking, nil)
+
+	oldMajor, err := readDataDirMajorVersion(p.dataDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data directory version: %w", err)
+	}
+	newMajor, err := postgresMajorVersion(upgrade.NewBinDir)
+	if err != nil {
+		return 0, err
+	}
+	if newMajor <= oldMajor {
+		return 0, fmt.Errorf("the binaries in %s are Postgres %d, which isn't newer than %d", upgrade.NewBinDir, newMajor, oldMajor)
+	}
+	locale, err := p.fetchUpgradeLocale(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Checking upgrade from Postgres %d to %d", oldMajor, newMajor)
+	newDataDir := p.upgradeDataDir()
+	if err := os.RemoveAll(newDataDir); err != nil {
+		return 0, fmt.Errorf("failed to remove %s: %w", newDataDir, err)
+	}
+	cmd := exec.CommandContext(ctx, pgBinPath(upgrade.NewBinDir, "initdb"), initdbUpgradeArgs(newDataDir, conf.postgresUser, locale, newMajor)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("failed to initialize new cluster: %w", err)
+	}
+	if err := copyUpgradeConf(p.dataDir, newDataDir); err != nil {
+		return 0, fmt.Errorf("failed to configure new cluster: %w", err)
+	}
+
+	if err := p.runPgUpgrade(ctx, conf, upgrade, true); err != nil {
+		return 0, err
+	}
+	return newMajor, nil
+}
+
+func (p *PostgresNode) runPgUpgrade(ctx context.Context, conf config, upgrade ClusterUpgradeStatus, check bool) error {
+	oldBinDir, err := resolveBinDir(p.binDir)
+	if err != nil {
+		return err
+	}
+
+	// pg_upgrade writes logs and sockets into its working directory
+	workDir, err := os.MkdirTemp("", "pgdaemon-upgrade-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	args := []string{
+		"--link",
+		"--old-bindir", oldBinDir,
+		"--new-bindir", upgrade.NewBinDir,
+		"--old-datadir", p.dataDir,
+		"--new-datadir", p.upgradeDataDir(),
+		"--username", conf.postgresUser,
+	}
+	if check {
+		// The old cluster is still running. pg_upgrade finds its
+		// socket directory in postmaster.pid.
+		args = append(args, "--check", "--old-port", strconv.Itoa(conf.postgresPort))
+	}
+	cmd := exec.CommandContext(ctx, pgBinPath(upgrade.NewBinDir, "pg_upgrade"), args...)
+	cmd.Dir = workDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_upgrade failed: %w", err)
+	}
+	return nil
+}
+
+// moveUpgradedDataDir moves the new cluster into PGDATA. The old data
+// directory is kept next to it, but it shares its data files with the
+// new cluster, so it can't be started again.
+func (p *PostgresNode) moveUpgradedDataDir() error {
+	oldDataDir := p.dataDir + ".pgdaemon-pre-upgrade"
+	if err := os.RemoveAll(oldDataDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", oldDataDir, err)
+	}
+	if err := os.Rename(p.dataDir, oldDataDir); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", p.dataDir, err)
+	}
+	if err := os.Rename(p.upgradeDataDir(), p.dataDir); err != nil {
+		// Put the old cluster back so we can roll back
+		if restoreErr := os.Rename(oldDataDir, p.dataDir); restoreErr != nil {
+			return fmt.Errorf("failed to move new cluster into place: %w, and failed to restore %s: %v", err, p.dataDir, restoreErr)
+		}
+		return fmt.Errorf("failed to move new cluster into place: %w", err)
+	}
+	log.Printf("Moved the old data directory to %s, delete it once the upgrade is done", oldDataDir)
+	return nil
+}
+
+// rollBackUpgrade starts the old cluster again after a failed upgrade.
+// pg_upgrade --link renames the old cluster's pg_control once it starts
+// linking files, and the old cluster is usable again once we rename it
+// back, as long as the new cluster never started.
+func (p *PostgresNode) rollBackUpgrade(store StateStore, conf config, phase UpgradePhase, cause error) error {
+	log.Printf("Rolling back upgrade: %v", cause)
+
+	rollbackErr := func() error {
+		controlFile := p.dataDir + "/global/pg_control"
+		if err := os.Rename(controlFile+".old", controlFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to restore pg_control: %w", err)
+		}
+		if err := os.RemoveAll(p.upgradeDataDir()); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", p.upgradeDataDir(), err)
+		}
+		if err := p.postgres.EnsureRunning(); err != nil {
+			return fmt.Errorf("failed to start Postgres: %w", err)
+		}
+		return nil
+	}()
+
+	newPhase, nodePhase, upgradeErr := UpgradePhaseRolledBack, NodeUpgradePhaseRolledBack, cause
+	if rollbackErr != nil {
+		newPhase, nodePhase = UpgradePhaseFailed, NodeUpgradePhaseFailed
+		upgradeErr = fmt.Errorf("%w; rollback failed: %v", cause, rollbackErr)
+	}
+	p.recordUpgrade(nodePhase, upgradeErr)
+	if err := updateUpgrade(store, conf.nodeName, phase, func(status *ClusterStatus, u *ClusterUpgradeStatus) {
+		u.Phase = newPhase
+		u.Error = upgradeErr.Error()
+		// A failed upgrade stays paused for a human to look at
+		status.Paused = newPhase == UpgradePhaseFailed
+	}); err != nil {
+		return fmt.Errorf("failed to record upgrade rollback: %w", err)
+	}
+
+	if rollbackErr != nil {
+		return upgradeErr
+	}
+	log.Printf("Rolled back upgrade, running the old version again")
+	return nil
+}
+
+func (p *PostgresNode) analyzeAfterUpgrade(conf config) {
+	cmd := exec.Command(p.pgBin("vacuumdb"),
+		"--all",
+		"--analyze-in-stages",
+		"--host", conf.postgresHost,
+		"--port", strconv.Itoa(conf.postgresPort),
+		"--username", conf.postgresUser,
+	)
+	cmd.Env = pgpassEnv(conf)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Failed to analyze databases after upgrade: %v", err)
+		return
+	}
+	log.Printf("Analyzed databases after upgrade")
+}
+
+// prepareReplicaUpgrade gets a replica ready for the new major version.
+// Streaming replication doesn't work across major versions, so a
+// replica that is still on the old version moves its data directory
+// aside and re-clones from the upgraded primary with the new binaries.
+func (p *PostgresNode) prepareReplicaUpgrade(upgrade ClusterUpgradeStatus) error {
+	bins := pgBinaries{BinDir: upgrade.NewBinDir, PostgresUnit: upgrade.NewPostgresUnit}
+	major, err := readDataDirMajorVersion(p.dataDir)
+	if errors.Is(err, os.ErrNotExist) {
+		// We are in the middle of re-cloning
+		return p.switchBinaries(bins)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read data directory version: %w", err)
+	}
+
+	if major == upgrade.TargetMajorVersion {
+		if err := p.switchBinaries(bins); err != nil {
+			return err
+		}
+		if p.upgradeProgress == nil || p.upgradeProgress.Phase != NodeUpgradePhaseDone {
+			p.recordUpgrade(NodeUpgradePhaseDone, nil)
+		}
+		return nil
+	}
+
+	log.Printf("Re-cloning replica to upgrade from Postgres %d to %d", major, upgrade.TargetMajorVersion)
+	p.recordUpgrade(NodeUpgradePhaseRecloning, nil)
+	if err := p.postgres.Stop(); err != nil {
+		return fmt.Errorf("failed to stop Postgres: %w", err)
+	}
+	if err := p.switchBinaries(bins); err != nil {
+		return err
+	}
+	oldDataDir := p.dataDir + ".pgdaemon-old"
+	if err := os.RemoveAll(oldDataDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", oldDataDir, err)
+	}
+	if err := os.Rename(p.dataDir, oldDataDir); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", p.dataDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartUpgrade(t *testing.T) {
+	nodes := []NodeStatus{
+		{Name: "node1", IsPrimary: true},
+		{Name: "node2"},
+	}
+	status := ClusterStatus{IntendedPrimary: "node1", FailoverState: FailoverStateStable}
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	result, err := startUpgrade(ClusterSpec{}, status, nodes, "/usr/lib/postgresql/17/bin", "", now)
+	require.NoError(t, err)
+	assert.True(t, result.Paused)
+	require.NotNil(t, result.Upgrade)
+	assert.Equal(t, UpgradePhaseChecking, result.Upgrade.Phase)
+	assert.Equal(t, "node1", result.Upgrade.Primary)
+	assert.Equal(t, "2025-07-01T12:00:00Z", result.Upgrade.StartedAt)
+
+	_, err = startUpgrade(ClusterSpec{}, result, nodes, "/usr/lib/postgresql/17/bin", "", now)
+	assert.ErrorContains(t, err, "already in progress")
+
+	_, err = startUpgrade(ClusterSpec{}, status, nodes, "", "", now)
+	assert.ErrorContains(t, err, "-new-bin-dir")
+
+	switching := status
+	switching.FailoverState = FailoverStateDemotingOldPrimary
+	_, err = startUpgrade(ClusterSpec{}, switching, nodes, "/usr/lib/postgresql/17/bin", "", now)
+	assert.ErrorContains(t, err, "switchover")
+
+	_, err = startUpgrade(ClusterSpec{StandbyCluster: &StandbyClusterSpec{Host: "other"}}, status, nodes, "/usr/lib/postgresql/17/bin", "", now)
+	assert.ErrorContains(t, err, "standby cluster")
+
+	connErr := "connection refused"
+	nodes[0].Error = &connErr
+	nodes[0].ErrorKind = NodeErrorConnection
+	_, err = startUpgrade(ClusterSpec{}, status, nodes, "/usr/lib/postgresql/17/bin", "", now)
+	assert.ErrorContains(t, err, "must be up")
+
+	// A rolled back upgrade can be retried
+	status.Upgrade = &ClusterUpgradeStatus{Phase: UpgradePhaseRolledBack}
+	nodes[0].Error = nil
+	_, err = startUpgrade(ClusterSpec{}, status, nodes, "/usr/lib/postgresql/17/bin", "", now)
+	assert.NoError(t, err)
+}
+
+func TestParsePostgresVersion(t *testing.T) {
+	for output, expected := range map[string]int{
+		"postgres (PostgreSQL) 17.2\n":                   17,
+		"postgres (PostgreSQL) 16.4 (Debian 16.4-1)\n":   16,
+		"postgres (PostgreSQL) 18beta1\n":                18,
+		"postgres (PostgreSQL) 9.6.24 (Ubuntu 9.6.24)\n": 9,
+	} {
+		major, err := parsePostgresVersion(output)
+		require.NoError(t, err, output)
+		assert.Equal(t, expected, major, output)
+	}
+
+	_, err := parsePostgresVersion("command not found")
+	assert.Error(t, err)
+}
+
+func TestInitdbUpgradeArgs(t *testing.T) {
+	locale := upgradeLocale{encoding: "UTF8", collate: "C.UTF-8", ctype: "C.UTF-8"}
+	assert.Equal(t, []string{
+		"--pgdata", "/data.pgdaemon-upgrade",
+		"--username", "postgres",
+		"--encoding", "UTF8",
+		"--lc-collate", "C.UTF-8",
+		"--lc-ctype", "C.UTF-8",
+	}, initdbUpgradeArgs("/data.pgdaemon-upgrade", "postgres", locale, 17))
+
+	// Postgres 18 turns checksums on unless we say otherwise
+	args := initdbUpgradeArgs("/data.pgdaemon-upgrade", "postgres", locale, 18)
+	assert.Contains(t, args, "--no-data-checksums")
+
+	locale.dataChecksums = true
+	args = initdbUpgradeArgs("/data.pgdaemon-upgrade", "postgres", locale, 18)
+	assert.Contains(t, args, "--data-checksums")
+	assert.NotContains(t, args, "--no-data-checksums")
+}
+
+func TestWithPgBinaries(t *testing.T) {
+	dataDir := t.TempDir()
+	conf := config{pgDataDir: dataDir, pgBinDir: "/usr/lib/postgresql/16/bin", postgresUnit: "postgresql@16-main.service"}
+
+	unchanged, err := withPgBinaries(conf)
+	require.NoError(t, err)
+	assert.Equal(t, conf, unchanged)
+
+	require.NoError(t, os.WriteFile(dataDir+"/"+pgBinariesFile, []byte(`{"bin_dir": "/usr/lib/postgresql/17/bin"}`), 0644))
+	upgraded, err := withPgBinaries(conf)
+	require.NoError(t, err)
+	assert.Equal(t, "/usr/lib/postgresql/17/bin", upgraded.pgBinDir)
+	assert.Equal(t, "postgresql@16-main.service", upgraded.postgresUnit)
+
+	require.NoError(t, os.WriteFile(dataDir+"/"+pgBinariesFile, []byte(`{"bin_dir": "/usr/lib/postgresql/17/bin", "postgres_unit": "postgresql@17-main.service"}`), 0644))
+	upgraded, err = withPgBinaries(conf)
+	require.NoError(t, err)
+	assert.Equal(t, "postgresql@17-main.service", upgraded.postgresUnit)
+
+	require.NoError(t, os.WriteFile(dataDir+"/"+pgBinariesFile, []byte(`{}`), 0644))
+	_, err = withPgBinaries(conf)
+	assert.Error(t, err)
+}
+
+func TestCopyUpgradeConf(t *testing.T) {
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	require.NoError(t, os.Mkdir(oldDir+"/postgresql.conf.d", 0755))
+	require.NoError(t, os.WriteFile(oldDir+"/postgresql.conf.d/pgdaemon.conf", []byte("wal_level = logical\n"), 0644))
+	require.NoError(t, os.WriteFile(oldDir+"/pg_hba.conf", []byte("local all all trust\n"), 0600))
+	require.NoError(t, os.WriteFile(newDir+"/postgresql.conf", []byte("# initdb\n"), 0600))
+
+	require.NoError(t, copyUpgradeConf(oldDir, newDir))
+
+	content, err := os.ReadFile(newDir + "/postgresql.conf.d/pgdaemon.conf")
+	require.NoError(t, err)
+	assert.Equal(t, "wal_level = logical\n", string(content))
+	content, err = os.ReadFile(newDir + "/pg_hba.conf")
+	require.NoError(t, err)
+	assert.Equal(t, "local all all trust\n", string(content))
+	content, err = os.ReadFile(newDir + "/postgresql.conf")
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "include_dir 'postgresql.conf.d'")
+}
+
+func TestUpdateUpgrade_IgnoresOtherPhases(t *testing.T) {
+	store := &memStore{state: ClusterState{
+		Status: ClusterStatus{
+			StatusUuid: uuid.New(),
+			Paused:     true,
+			Upgrade:    &ClusterUpgradeStatus{Phase: UpgradePhaseChecking},
+		},
+	}}
+
+	require.NoError(t, updateUpgrade(store, "node1", UpgradePhaseUpgradingPrimary, func(_ *ClusterStatus, u *ClusterUpgradeStatus) {
+		u.Phase = UpgradePhaseUpgradingReplicas
+	}))
+	assert.Equal(t, UpgradePhaseChecking, store.state.Status.Upgrade.Phase)
+
+	require.NoError(t, updateUpgrade(store, "node1", UpgradePhaseChecking, func(status *ClusterStatus, u *ClusterUpgradeStatus) {
+		u.Phase = UpgradePhaseRolledBack
+		status.Paused = false
+	}))
+	assert.Equal(t, UpgradePhaseRolledBack, store.state.Status.Upgrade.Phase)
+	assert.False(t, store.state.Status.Paused)
+}
@@ -22,14 +22,16 @@ type WakeupManager struct {
 	clusterName string
 	nodeName    string
 	wakeupChan  chan struct{}
+	metrics     *Metrics
 }
 
-func NewWakeupManager(port int, clusterName, nodeName string) *WakeupManager {
+func NewWakeupManager(port int, clusterName, nodeName string, metrics *Metrics) *WakeupManager {
 	return &WakeupManager{
 		port:        port,
 		clusterName: clusterName,
 		nodeName:    nodeName,
 		wakeupChan:  make(chan struct{}, 1), // Buffered to avoid blocking
+		metrics:     metrics,
 	}
 }
 
@@ -79,6 +81,8 @@ func (w *WakeupManager) StartListener(ctx context.Context) error {
 					continue // Ignore packets from self
 				}
 
+				w.metrics.WakeupReceived()
+
 				// Send wakeup signal (non-blocking)
 				select {
 				case w.wakeupChan <- struct{}{}:
@@ -134,6 +138,7 @@ func (w *WakeupManager) SendWakeupToNodes(peerHostnames []string) {
 				return
 			}
 
+			w.metrics.WakeupSent()
 			log.Printf("Sent wakeup to node %s", host)
 		}(hostname)
 	}
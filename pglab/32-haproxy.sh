@@ -40,10 +40,11 @@ listen primary
     server pg1 ${HOST_IPS[pg1]}:$pgbouncer_port check port $pgdaemon_port
     server pg2 ${HOST_IPS[pg2]}:$pgbouncer_port check port $pgdaemon_port
 
-# Route to all healthy nodes (including primary)
+# Route to all healthy nodes (including primary), skipping replicas
+# more than 16MB behind
 listen all
     bind *:5433
-    option httpchk OPTIONS /health
+    option httpchk OPTIONS /health?lag=16MB
     http-check expect status 200
     default-server inter 3s fall 2 rise 1
     server pg0 ${HOST_IPS[pg0]}:$pgbouncer_port check port $pgdaemon_port